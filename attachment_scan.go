@@ -0,0 +1,92 @@
+package courier
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AttachmentScanner is something which can scan an incoming attachment for malware before it's stored
+type AttachmentScanner interface {
+	// Scan scans the given attachment content, returning the name of any threat found or empty string if it's clean
+	Scan(ctx context.Context, content io.Reader) (string, error)
+}
+
+const (
+	clamdDefaultTimeout = time.Second * 30
+	clamdChunkSize      = 64 * 1024
+)
+
+type clamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+// NewClamdScanner returns a new scanner which streams attachments to the clamd server at the given TCP address
+func NewClamdScanner(address string) AttachmentScanner {
+	return &clamdScanner{address: address, timeout: clamdDefaultTimeout}
+}
+
+// Scan scans the given content using clamd's INSTREAM command
+func (s *clamdScanner) Scan(ctx context.Context, content io.Reader) (string, error) {
+	dialer := &net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return "", errors.Wrap(err, "error connecting to clamd")
+	}
+	defer conn.Close()
+
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(s.timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", errors.Wrap(err, "error writing to clamd")
+	}
+
+	// content is streamed as chunks prefixed with their length, with a zero length chunk to end the stream
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(content, buf[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", errors.Wrap(err, "error reading content to scan")
+		}
+
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		if _, err := conn.Write(buf[:4+n]); err != nil {
+			return "", errors.Wrap(err, "error writing to clamd")
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", errors.Wrap(err, "error reading from clamd")
+	}
+
+	return parseClamdReply(reply)
+}
+
+// parses a reply like "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+
+	if result == "OK" {
+		return "", nil
+	}
+	if threat, found := strings.CutSuffix(result, " FOUND"); found {
+		return threat, nil
+	}
+	return "", errors.Errorf("unexpected reply from clamd: %s", reply)
+}
@@ -0,0 +1,95 @@
+package courier_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/courier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// starts a stub clamd server which reads INSTREAM requests and replies using the given func
+func startClamdStub(t *testing.T, reply func([]byte) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				data := &bytes.Buffer{}
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(r, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					if _, err := io.CopyN(data, r, int64(n)); err != nil {
+						return
+					}
+				}
+
+				conn.Write([]byte(reply(data.Bytes()) + "\x00"))
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	ctx := context.Background()
+
+	address := startClamdStub(t, func(data []byte) string {
+		if bytes.Contains(data, []byte("EICAR")) {
+			return "stream: Eicar-Test-Signature FOUND"
+		}
+		if len(data) > 100*1024 {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		return "stream: OK"
+	})
+
+	scanner := courier.NewClamdScanner(address)
+
+	threat, err := scanner.Scan(ctx, strings.NewReader("hello world"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", threat)
+
+	// data which is streamed over multiple chunks
+	threat, err = scanner.Scan(ctx, strings.NewReader(strings.Repeat("x", 70*1024)+"EICAR"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", threat)
+
+	_, err = scanner.Scan(ctx, strings.NewReader(strings.Repeat("x", 150*1024)))
+	assert.EqualError(t, err, "unexpected reply from clamd: INSTREAM size limit exceeded. ERROR")
+
+	// clamd not running
+	scanner = courier.NewClamdScanner("127.0.0.1:1")
+
+	_, err = scanner.Scan(ctx, strings.NewReader("hello world"))
+	assert.ErrorContains(t, err, "error connecting to clamd")
+}
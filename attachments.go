@@ -1,29 +1,125 @@
 package courier
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"hash"
 	"io"
 	"log/slog"
 	"mime"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/nyaruka/courier/utils"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/pkg/errors"
 	"gopkg.in/h2non/filetype.v1"
 )
 
 const (
-	maxAttBodyReadBytes = 100 * 1024 * 1024
+	maxAttBodyReadBytes  = 100 * 1024 * 1024
+	maxAttTraceBodyBytes = 4096
 )
 
 type Attachment struct {
 	ContentType string `json:"content_type"`
 	URL         string `json:"url"`
 	Size        int    `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// the path under which privately stored attachments are referred to, and which redirects to presigned URLs to read them
+const attachmentRefPath = "/c/_attachments/"
+
+// AttachmentRef returns a reference to the privately stored attachment at the given storage path
+func AttachmentRef(domain, path string) string {
+	return "https://" + domain + attachmentRefPath + path
+}
+
+// ParseAttachmentRef returns the storage path from the given URL if it's a reference to a privately stored attachment
+func ParseAttachmentRef(domain, attURL string) (string, bool) {
+	path, found := strings.CutPrefix(attURL, "https://"+domain+attachmentRefPath)
+	return path, found && path != ""
+}
+
+// AttachmentPolicy describes which incoming attachments can be stored
+type AttachmentPolicy struct {
+	MaxBytes        int                 // the maximum size of attachments
+	ChannelMaxBytes map[ChannelType]int // overrides of the maximum size for specific channel types
+	AllowedTypes    []string            // MIME types which attachments must match if non-empty, e.g. image/*
+	DeniedTypes     []string            // MIME types which attachments can't match
+	Scanner         AttachmentScanner   // optional scanner for malware
+}
+
+// NewAttachmentPolicy creates a new attachment policy from the given config
+func NewAttachmentPolicy(cfg *Config) *AttachmentPolicy {
+	channelMaxBytes, _ := cfg.ParseAttachmentMaxSizes()
+
+	p := &AttachmentPolicy{
+		MaxBytes:        cfg.AttachmentMaxSize * 1024 * 1024,
+		ChannelMaxBytes: channelMaxBytes,
+		AllowedTypes:    splitConfigList(cfg.AttachmentAllowedTypes),
+		DeniedTypes:     splitConfigList(cfg.AttachmentDeniedTypes),
+	}
+	if cfg.ClamdAddress != "" {
+		p.Scanner = NewClamdScanner(cfg.ClamdAddress)
+	}
+	return p
+}
+
+func (p *AttachmentPolicy) maxBytes(channelType ChannelType) int {
+	if p == nil {
+		return maxAttBodyReadBytes
+	}
+	if max, ok := p.ChannelMaxBytes[channelType]; ok {
+		return max
+	}
+	if p.MaxBytes > 0 {
+		return p.MaxBytes
+	}
+	return maxAttBodyReadBytes
+}
+
+func (p *AttachmentPolicy) allows(contentType string) bool {
+	if p == nil {
+		return true
+	}
+	for _, t := range p.DeniedTypes {
+		if matchesMIMEType(contentType, t) {
+			return false
+		}
+	}
+	if len(p.AllowedTypes) == 0 {
+		return true
+	}
+	for _, t := range p.AllowedTypes {
+		if matchesMIMEType(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks whether the given content type matches a MIME type pattern like image/png, image/* or *
+func matchesMIMEType(contentType, pattern string) bool {
+	contentType, pattern = strings.ToLower(contentType), strings.ToLower(pattern)
+
+	if pattern == "*" || pattern == "*/*" || contentType == pattern {
+		return true
+	}
+	if prefix, found := strings.CutSuffix(pattern, "/*"); found {
+		return strings.HasPrefix(contentType, prefix+"/")
+	}
+	return false
 }
 
 type fetchAttachmentRequest struct {
@@ -38,7 +134,7 @@ type fetchAttachmentResponse struct {
 	LogUUID    ChannelLogUUID `json:"log_uuid"`
 }
 
-func fetchAttachment(ctx context.Context, b Backend, r *http.Request) (*fetchAttachmentResponse, error) {
+func fetchAttachment(ctx context.Context, b Backend, policy *AttachmentPolicy, r *http.Request) (*fetchAttachmentResponse, error) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		return nil, errors.Wrap(err, "error reading request body")
@@ -59,7 +155,7 @@ func fetchAttachment(ctx context.Context, b Backend, r *http.Request) (*fetchAtt
 
 	clog := NewChannelLogForAttachmentFetch(ch, GetHandler(ch.ChannelType()).RedactValues(ch))
 
-	attachment, err := FetchAndStoreAttachment(ctx, b, ch, fa.URL, clog)
+	attachment, err := FetchAndStoreAttachment(ctx, b, ch, fa.URL, policy, clog)
 
 	// try to write channel log even if we have an error
 	clog.End()
@@ -74,7 +170,9 @@ func fetchAttachment(ctx context.Context, b Backend, r *http.Request) (*fetchAtt
 	return &fetchAttachmentResponse{Attachment: attachment, LogUUID: clog.UUID()}, nil
 }
 
-func FetchAndStoreAttachment(ctx context.Context, b Backend, channel Channel, attURL string, clog *ChannelLog) (*Attachment, error) {
+// FetchAndStoreAttachment fetches the given attachment URL and saves it to backend storage. If the attachment can't be
+// fetched or is rejected by the given policy, an attachment with the unavailable pseudo content type is returned.
+func FetchAndStoreAttachment(ctx context.Context, b Backend, channel Channel, attURL string, policy *AttachmentPolicy, clog *ChannelLog) (*Attachment, error) {
 	parsedURL, err := url.Parse(attURL)
 	if err != nil {
 		return nil, err
@@ -93,18 +191,44 @@ func FetchAndStoreAttachment(ctx context.Context, b Backend, channel Channel, at
 		return nil, errors.Wrap(err, "unable to create attachment request")
 	}
 
-	trace, err := httpx.DoTrace(b.HttpClient(true), attRequest, nil, b.HttpAccess(), maxAttBodyReadBytes)
-	if trace != nil {
-		clog.HTTP(trace)
+	maxBytes := policy.maxBytes(channel.ChannelType())
+	unavailable := &Attachment{ContentType: "unavailable", URL: attURL}
 
-		// if we got a non-200 response, return the attachment with a pseudo content type which tells the caller
-		// to continue without the attachment
-		if trace.Response == nil || trace.Response.StatusCode/100 != 2 || err == httpx.ErrResponseSize || err == httpx.ErrAccessConfig {
-			return &Attachment{ContentType: "unavailable", URL: attURL}, nil
-		}
+	// we don't use httpx.DoTrace as that reads the entire body into memory, but we build a similar trace for our log
+	// which only includes the start of the body
+	requestTrace, err := httputil.DumpRequestOut(attRequest, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to dump attachment request")
 	}
+	trace := &httpx.Trace{Request: attRequest, RequestTrace: requestTrace, StartTime: dates.Now()}
+	defer func() {
+		trace.EndTime = dates.Now()
+		clog.HTTP(trace)
+	}()
+
+	// if the request fails or we got a non-200 response, return the attachment with a pseudo content type which tells
+	// the caller to continue without the attachment
+	resp, err := httpx.Do(b.HttpClient(true), attRequest, nil, b.HttpAccess())
 	if err != nil {
-		return nil, err
+		return unavailable, nil
+	}
+	defer resp.Body.Close()
+
+	trace.Response = resp
+	trace.ResponseTrace, _ = httputil.DumpResponse(resp, false)
+
+	body := bufio.NewReaderSize(resp.Body, maxAttTraceBodyBytes)
+	prefix, _ := body.Peek(maxAttTraceBodyBytes)
+	trace.ResponseBody = bytes.Clone(prefix)
+
+	if resp.StatusCode/100 != 2 {
+		return unavailable, nil
+	}
+
+	// no point reading the body if it has told us it's too big
+	if resp.ContentLength > int64(maxBytes) {
+		clog.Error(ErrorAttachmentTooLarge(maxBytes))
+		return unavailable, nil
 	}
 
 	mimeType := ""
@@ -114,7 +238,7 @@ func FetchAndStoreAttachment(ctx context.Context, b Backend, channel Channel, at
 	}
 
 	// first try getting our mime type from the first 300 bytes of our body
-	fileType, _ := filetype.Match(trace.ResponseBody[:300])
+	fileType, _ := filetype.Match(trace.ResponseBody[:min(len(trace.ResponseBody), 300)])
 	if fileType != filetype.Unknown {
 		mimeType = fileType.MIME.Value
 		extension = fileType.Extension
@@ -129,7 +253,7 @@ func FetchAndStoreAttachment(ctx context.Context, b Backend, channel Channel, at
 
 	// we still don't know our mime type, use our content header instead
 	if mimeType == "" {
-		mimeType, _, _ = mime.ParseMediaType(trace.Response.Header.Get("Content-Type"))
+		mimeType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
 		if extension == "" {
 			extensions, err := mime.ExtensionsByType(mimeType)
 			if extensions == nil || err != nil {
@@ -140,10 +264,97 @@ func FetchAndStoreAttachment(ctx context.Context, b Backend, channel Channel, at
 		}
 	}
 
-	storageURL, err := b.SaveAttachment(ctx, channel, mimeType, trace.ResponseBody, extension)
+	if !policy.allows(mimeType) {
+		clog.Error(ErrorAttachmentTypeNotAllowed(mimeType))
+		return unavailable, nil
+	}
+
+	att := newAttachmentReader(body, maxBytes)
+	var content io.Reader = att
+
+	// scanning has to happen before the attachment is stored, so we spool it to a temporary file rather than memory,
+	// and if it can't be scanned we error so that fetching can be retried
+	if policy != nil && policy.Scanner != nil {
+		spooled, err := spoolAttachment(att)
+		if spooled != nil {
+			defer spooled.Close()
+			defer os.Remove(spooled.Name())
+		}
+		if att.exceeded {
+			clog.Error(ErrorAttachmentTooLarge(maxBytes))
+			return unavailable, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		threat, err := policy.Scanner.Scan(ctx, spooled)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning attachment")
+		}
+		if threat != "" {
+			clog.Error(ErrorAttachmentMalware(threat))
+			return unavailable, nil
+		}
+
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.Wrap(err, "error rewinding scanned attachment")
+		}
+		content = spooled
+	}
+
+	storageURL, err := b.SaveAttachment(ctx, channel, mimeType, content, extension)
+	if att.exceeded {
+		clog.Error(ErrorAttachmentTooLarge(maxBytes))
+		return unavailable, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &Attachment{ContentType: mimeType, URL: storageURL, Size: len(trace.ResponseBody)}, nil
+	return &Attachment{ContentType: mimeType, URL: storageURL, Size: att.size, SHA256: att.sha256()}, nil
+}
+
+// reader for an incoming attachment which counts and hashes what is read, and errors if it exceeds a maximum size
+type attachmentReader struct {
+	r        io.Reader
+	maxBytes int
+	size     int
+	hash     hash.Hash
+	exceeded bool
+}
+
+func newAttachmentReader(r io.Reader, maxBytes int) *attachmentReader {
+	return &attachmentReader{r: r, maxBytes: maxBytes, hash: sha256.New()}
+}
+
+func (r *attachmentReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.size += n
+	r.hash.Write(p[:n])
+
+	if r.size > r.maxBytes {
+		r.exceeded = true
+		return n, httpx.ErrResponseSize
+	}
+	return n, err
+}
+
+func (r *attachmentReader) sha256() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// copies the given attachment to a temporary file, returning it ready to be read from the start
+func spoolAttachment(r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "courier-attachment-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating temporary attachment file")
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		return f, errors.Wrap(err, "error spooling attachment")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return f, errors.Wrap(err, "error rewinding spooled attachment")
+	}
+	return f, nil
 }
@@ -1,8 +1,11 @@
 package courier_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/nyaruka/courier"
@@ -29,6 +32,9 @@ func TestFetchAndStoreAttachment(t *testing.T) {
 		"http://mock.com/media/hello.txt": {
 			httpx.NewMockResponse(200, nil, []byte(`hi`)),
 		},
+		"http://mock.com/media/big.txt": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "text/plain"}, bytes.Repeat([]byte(`z`), 10000)),
+		},
 	}))
 
 	defer uuids.SetGenerator(uuids.DefaultGenerator)
@@ -42,11 +48,12 @@ func TestFetchAndStoreAttachment(t *testing.T) {
 
 	clog := courier.NewChannelLogForAttachmentFetch(mockChannel, []string{"sesame"})
 
-	att, err := courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.jpg", clog)
+	att, err := courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.jpg", nil, clog)
 	assert.NoError(t, err)
 	assert.Equal(t, "image/jpeg", att.ContentType)
 	assert.Equal(t, "https://backend.com/attachments/cdf7ed27-5ad5-4028-b664-880fc7581c77.jpg", att.URL)
 	assert.Equal(t, 17301, att.Size)
+	assert.Equal(t, "c0dd06c42c906a2a06488f601079289bed14ea0766c4209ec500beda03e7921a", att.SHA256)
 
 	assert.Len(t, mb.SavedAttachments(), 1)
 	assert.Equal(t, &test.SavedAttachment{Channel: mockChannel, ContentType: "image/jpeg", Data: testJPG, Extension: "jpg"}, mb.SavedAttachments()[0])
@@ -54,7 +61,7 @@ func TestFetchAndStoreAttachment(t *testing.T) {
 	assert.Equal(t, "http://mock.com/media/hello.jpg", clog.HTTPLogs()[0].URL)
 
 	// a non-200 response should return an unavailable attachment
-	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.mp3", clog)
+	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.mp3", nil, clog)
 	assert.NoError(t, err)
 	assert.Equal(t, &courier.Attachment{ContentType: "unavailable", URL: "http://mock.com/media/hello.mp3"}, att)
 
@@ -64,14 +71,140 @@ func TestFetchAndStoreAttachment(t *testing.T) {
 	assert.Len(t, mb.SavedAttachments(), 1)
 
 	// same for a connection error
-	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.pdf", clog)
+	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.pdf", nil, clog)
 	assert.NoError(t, err)
 	assert.Equal(t, &courier.Attachment{ContentType: "unavailable", URL: "http://mock.com/media/hello.pdf"}, att)
 
+	// attachments are streamed to storage and only the start of the body is included in the log
+	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/big.txt", nil, clog)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", att.ContentType)
+	assert.Equal(t, 10000, att.Size)
+	assert.Equal(t, "0b722b8a96bfe84a3bd16d9d41cd2a1a4335e6b974d6ea0412bdeff4462e479f", att.SHA256)
+
+	assert.Len(t, mb.SavedAttachments(), 2)
+	assert.Equal(t, bytes.Repeat([]byte(`z`), 10000), mb.SavedAttachments()[1].Data)
+	assert.Len(t, clog.HTTPLogs(), 4)
+	assert.Equal(t, 4096, strings.Count(clog.HTTPLogs()[3].Response, "z"))
+
 	// an actual error on our part should be returned as an error
 	mb.SetStorageError(errors.New("boom"))
 
-	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.txt", clog)
+	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.txt", nil, clog)
 	assert.EqualError(t, err, "boom")
 	assert.Nil(t, att)
 }
+
+type testScanner struct {
+	threats map[int]string
+	err     error
+}
+
+func (s *testScanner) Scan(ctx context.Context, content io.Reader) (string, error) {
+	data, _ := io.ReadAll(content)
+	return s.threats[len(data)], s.err
+}
+
+func TestFetchAndStoreAttachmentWithPolicy(t *testing.T) {
+	testJPG := test.ReadFile("test/testdata/test.jpg")
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"http://mock.com/media/hello.jpg": {
+			httpx.NewMockResponse(200, nil, testJPG),
+			httpx.NewMockResponse(200, nil, testJPG),
+			httpx.NewMockResponse(200, nil, testJPG),
+			httpx.NewMockResponse(200, nil, testJPG),
+			httpx.NewMockResponse(200, nil, testJPG),
+		},
+		"http://mock.com/media/hello.txt": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "text/plain"}, []byte(`hi there`)),
+		},
+	}))
+
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+
+	mockChannel := test.NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "MCK", "2020", "US", map[string]any{})
+	mb.AddChannel(mockChannel)
+
+	assertUnavailable := func(policy *courier.AttachmentPolicy, url string, expectedError *courier.ChannelError) {
+		clog := courier.NewChannelLogForAttachmentFetch(mockChannel, nil)
+
+		att, err := courier.FetchAndStoreAttachment(ctx, mb, mockChannel, url, policy, clog)
+		assert.NoError(t, err)
+		assert.Equal(t, &courier.Attachment{ContentType: "unavailable", URL: url}, att)
+		assert.Equal(t, []*courier.ChannelError{expectedError}, clog.Errors())
+	}
+
+	// attachment too big for the channel type
+	policy := &courier.AttachmentPolicy{MaxBytes: 100 * 1024 * 1024, ChannelMaxBytes: map[courier.ChannelType]int{"MCK": 10000}}
+	assertUnavailable(policy, "http://mock.com/media/hello.jpg", courier.ErrorAttachmentTooLarge(10000))
+
+	// attachment type not in allowed types
+	policy = &courier.AttachmentPolicy{AllowedTypes: []string{"image/*", "audio/mpeg"}}
+	assertUnavailable(policy, "http://mock.com/media/hello.txt", courier.ErrorAttachmentTypeNotAllowed("text/plain"))
+
+	// attachment type in denied types
+	policy = &courier.AttachmentPolicy{DeniedTypes: []string{"image/jpeg"}}
+	assertUnavailable(policy, "http://mock.com/media/hello.jpg", courier.ErrorAttachmentTypeNotAllowed("image/jpeg"))
+
+	// attachment flagged by scanner
+	policy = &courier.AttachmentPolicy{Scanner: &testScanner{threats: map[int]string{17301: "Eicar-Test-Signature"}}}
+	assertUnavailable(policy, "http://mock.com/media/hello.jpg", courier.ErrorAttachmentMalware("Eicar-Test-Signature"))
+
+	assert.Len(t, mb.SavedAttachments(), 0)
+
+	// scanner not working is an actual error
+	clog := courier.NewChannelLogForAttachmentFetch(mockChannel, nil)
+	policy = &courier.AttachmentPolicy{Scanner: &testScanner{err: errors.New("connection refused")}}
+	att, err := courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.jpg", policy, clog)
+	assert.EqualError(t, err, "error scanning attachment: connection refused")
+	assert.Nil(t, att)
+
+	// attachment allowed and clean
+	clog = courier.NewChannelLogForAttachmentFetch(mockChannel, nil)
+	policy = &courier.AttachmentPolicy{ChannelMaxBytes: map[courier.ChannelType]int{"MCK": 20000}, AllowedTypes: []string{"image/*"}, DeniedTypes: []string{"image/gif"}, Scanner: &testScanner{}}
+	att, err = courier.FetchAndStoreAttachment(ctx, mb, mockChannel, "http://mock.com/media/hello.jpg", policy, clog)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", att.ContentType)
+	assert.Len(t, clog.Errors(), 0)
+	assert.Len(t, mb.SavedAttachments(), 1)
+}
+
+func TestNewAttachmentPolicy(t *testing.T) {
+	cfg := courier.NewConfig()
+	cfg.AttachmentMaxSize = 50
+	cfg.AttachmentMaxSizes = "WA:16, TG:20"
+	cfg.AttachmentAllowedTypes = "image/*,audio/*, video/mp4"
+	cfg.AttachmentDeniedTypes = "image/svg+xml"
+	cfg.ClamdAddress = "localhost:3310"
+
+	policy := courier.NewAttachmentPolicy(cfg)
+	assert.Equal(t, 50*1024*1024, policy.MaxBytes)
+	assert.Equal(t, map[courier.ChannelType]int{"WA": 16 * 1024 * 1024, "TG": 20 * 1024 * 1024}, policy.ChannelMaxBytes)
+	assert.Equal(t, []string{"image/*", "audio/*", "video/mp4"}, policy.AllowedTypes)
+	assert.Equal(t, []string{"image/svg+xml"}, policy.DeniedTypes)
+	assert.NotNil(t, policy.Scanner)
+
+	assert.NoError(t, cfg.Validate())
+
+	cfg.AttachmentMaxSizes = "WA:16,TG"
+	assert.EqualError(t, cfg.Validate(), "unable to parse 'AttachmentMaxSizes': invalid channel type size 'TG'")
+}
+
+func TestAttachmentRefs(t *testing.T) {
+	ref := courier.AttachmentRef("courier.example.com", "media/1/c00e/5d67/c00e5d67-c275-4389-aded-7d8b151cbd5b.jpg")
+	assert.Equal(t, "https://courier.example.com/c/_attachments/media/1/c00e/5d67/c00e5d67-c275-4389-aded-7d8b151cbd5b.jpg", ref)
+
+	path, isRef := courier.ParseAttachmentRef("courier.example.com", ref)
+	assert.True(t, isRef)
+	assert.Equal(t, "media/1/c00e/5d67/c00e5d67-c275-4389-aded-7d8b151cbd5b.jpg", path)
+
+	_, isRef = courier.ParseAttachmentRef("courier.example.com", "https://courier.example.com/c/_attachments/")
+	assert.False(t, isRef)
+	_, isRef = courier.ParseAttachmentRef("other.example.com", ref)
+	assert.False(t, isRef)
+	_, isRef = courier.ParseAttachmentRef("courier.example.com", "https://backend.com/attachments/1234.jpg")
+	assert.False(t, isRef)
+}
@@ -3,8 +3,10 @@ package courier
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/gocommon/httpx"
@@ -25,6 +27,9 @@ type Backend interface {
 	// Cleanup closes any active connections to databases
 	Cleanup() error
 
+	// Flush waits until any batched writes of status updates and channel logs have been written, or the context is done
+	Flush(context.Context) error
+
 	// GetChannel returns the channel with the passed in type and UUID
 	GetChannel(context.Context, ChannelType, ChannelUUID) (Channel, error)
 
@@ -67,6 +72,12 @@ type Backend interface {
 	// WriteChannelLog writes the passed in channel log to our backend
 	WriteChannelLog(context.Context, *ChannelLog) error
 
+	// ChannelLogs returns the most recent logs for the passed in channel that match the passed in query, newest first
+	ChannelLogs(context.Context, Channel, *ChannelLogQuery) ([]*ChannelLogRecord, error)
+
+	// GetChannelLog returns the log with the passed in UUID for the passed in channel, or ErrChannelLogNotFound
+	GetChannelLog(context.Context, Channel, ChannelLogUUID) (*ChannelLogRecord, error)
+
 	// PopNextOutgoingMsg returns the next message that needs to be sent, callers should call MarkOutgoingMsgComplete with the
 	// returned message when they have dealt with the message (regardless of whether it was sent or not)
 	PopNextOutgoingMsg(context.Context) (MsgOut, error)
@@ -84,8 +95,20 @@ type Backend interface {
 	// used to determine any sort of deduping of msg sends
 	MarkOutgoingMsgComplete(context.Context, MsgOut, StatusUpdate)
 
-	// SaveAttachment saves an attachment to backend storage
-	SaveAttachment(context.Context, Channel, string, []byte, string) (string, error)
+	// RequeueOutgoingMsg puts the passed in message back on its queue to be retried after the given delay, incrementing
+	// its retry count. Callers should still call MarkOutgoingMsgComplete for the original message.
+	RequeueOutgoingMsg(context.Context, MsgOut, time.Duration) error
+
+	// ThrottleOutgoingMsg pauses the queue of the passed in message's channel for the given duration and puts the message
+	// back on that queue, without incrementing its retry count
+	ThrottleOutgoingMsg(context.Context, MsgOut, time.Duration) error
+
+	// SaveAttachment streams an attachment with the given content type and extension to backend storage
+	SaveAttachment(context.Context, Channel, string, io.Reader, string) (string, error)
+
+	// AttachmentURL returns a URL which can be used to read the attachment with the passed in URL, which for references
+	// to privately stored attachments will be a short lived presigned URL
+	AttachmentURL(context.Context, string) (string, error)
 
 	// ResolveMedia resolves an outgoing attachment URL to a media object
 	ResolveMedia(context.Context, string) (Media, error)
@@ -100,6 +123,12 @@ type Backend interface {
 	// Status returns a string describing the current status, this can detail queue sizes or other attributes
 	Status() string
 
+	// HealthReport returns the result of checking each of the services the backend depends on
+	HealthReport(context.Context) *HealthReport
+
+	// StatusReport returns the current status of the backend's queues
+	StatusReport(context.Context) (*StatusReport, error)
+
 	// Heartbeat is called every minute, it can be used by backends to log status to a dashboard such as librato
 	Heartbeat() error
 
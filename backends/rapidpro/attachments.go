@@ -0,0 +1,229 @@
+package rapidpro
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/pkg/errors"
+)
+
+const (
+	s3AttachmentPartSize    = 5 * 1024 * 1024 // the minimum allowed by S3
+	s3AttachmentConcurrency = 2
+)
+
+// attachmentStore streams attachments to storage, so that we never need an entire attachment in memory, and provides
+// URLs to read them back
+type attachmentStore interface {
+	// Upload uploads the given body to the given path, returning its storage URL
+	Upload(ctx context.Context, path, contentType string, body io.Reader) (string, error)
+
+	// ReadURL returns a URL which can be used to read the attachment at the given path
+	ReadURL(path string) (string, error)
+}
+
+type s3AttachmentStore struct {
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+	bucket   string
+	region   string
+	acl      string
+	expiry   time.Duration
+}
+
+// creates a new store which uses multipart uploads to S3, so at most a few parts are buffered at once. If acl is
+// private then read URLs are presigned and valid for the given expiry.
+func newS3AttachmentStore(client s3iface.S3API, bucket, region, acl string, expiry time.Duration) attachmentStore {
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		u.PartSize = s3AttachmentPartSize
+		u.Concurrency = s3AttachmentConcurrency
+	})
+
+	return &s3AttachmentStore{client: client, uploader: uploader, bucket: bucket, region: region, acl: acl, expiry: expiry}
+}
+
+func (s *s3AttachmentStore) Upload(ctx context.Context, path, contentType string, body io.Reader) (string, error) {
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(path),
+		Body:        body,
+		ContentType: aws.String(contentType),
+		ACL:         aws.String(s.acl),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error uploading S3 object")
+	}
+
+	return s.url(path), nil
+}
+
+func (s *s3AttachmentStore) ReadURL(path string) (string, error) {
+	if s.acl != s3.BucketCannedACLPrivate {
+		return s.url(path), nil
+	}
+
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(path)})
+	url, err := req.Presign(s.expiry)
+	if err != nil {
+		return "", errors.Wrap(err, "error presigning S3 object URL")
+	}
+	return url, nil
+}
+
+// same URL format as our storage package uses
+func (s *s3AttachmentStore) url(path string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, path)
+}
+
+type fsAttachmentStore struct {
+	directory string
+	perms     os.FileMode
+}
+
+// creates a new store which writes to the local file system
+func newFSAttachmentStore(directory string, perms os.FileMode) attachmentStore {
+	return &fsAttachmentStore{directory: directory, perms: perms}
+}
+
+func (s *fsAttachmentStore) Upload(ctx context.Context, path, contentType string, body io.Reader) (string, error) {
+	fullPath := filepath.Join(s.directory, path)
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), s.perms); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.perms)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fullPath)
+		return "", err
+	}
+
+	return fullPath, nil
+}
+
+func (s *fsAttachmentStore) ReadURL(path string) (string, error) {
+	return filepath.Join(s.directory, path), nil
+}
+
+// returns the URL that a saved attachment should be referred to by, which for private storage is a reference that can
+// only be read via AttachmentURL
+func (b *backend) attachmentRef(path, storageURL string) string {
+	if b.config.S3AttachmentsPrivate {
+		return courier.AttachmentRef(b.config.Domain, path)
+	}
+	return storageURL
+}
+
+// AttachmentURL returns a URL which can be used to read the attachment with the given URL. For references to privately
+// stored attachments that's a short lived presigned URL, otherwise it's the URL unchanged.
+func (b *backend) AttachmentURL(ctx context.Context, attURL string) (string, error) {
+	path, isRef := courier.ParseAttachmentRef(b.config.Domain, attURL)
+	if !isRef {
+		return attURL, nil
+	}
+
+	return b.attachmentStore.ReadURL(path)
+}
+
+// replaces any references to privately stored attachments on an outgoing message with URLs that handlers can give to
+// channels. The message's own attachments are left unchanged so that it can be requeued.
+func (b *backend) resolveAttachmentURLs(ctx context.Context, m *Msg) {
+	for i, att := range m.Attachments_ {
+		contentType, attURL, found := strings.Cut(att, ":")
+		if !found {
+			continue
+		}
+
+		readURL, err := b.AttachmentURL(ctx, attURL)
+		if err != nil {
+			slog.Error("error resolving attachment URL", "error", err, "msg", m.UUID(), "url", attURL)
+			continue
+		}
+
+		if readURL != attURL {
+			if m.attachmentURLs == nil {
+				m.attachmentURLs = slices.Clone(m.Attachments_)
+			}
+			m.attachmentURLs[i] = contentType + ":" + readURL
+		}
+	}
+}
+
+// saves an attachment unless an identical one has already been saved for the same org, in which case the URL of that
+// one is returned. We need the hash of the content before we can decide whether to upload it, so it's first written
+// to a temporary file rather than held in memory.
+func (b *backend) saveDedupedAttachment(ctx context.Context, orgID OrgID, path, contentType string, content io.Reader, extension string) (string, error) {
+	f, err := os.CreateTemp("", "courier-attachment-*")
+	if err != nil {
+		return "", errors.Wrap(err, "error creating temporary attachment file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), content); err != nil {
+		return "", errors.Wrap(err, "error reading attachment")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Wrap(err, "error rewinding attachment file")
+	}
+
+	// the extension is included in case the same content is saved with different types
+	key := fmt.Sprintf("attachment_hash:%d:%s.%s", orgID, hex.EncodeToString(hash.Sum(nil)), extension)
+	ttl := b.config.AttachmentDedupeDays * 24 * 60 * 60
+
+	// errors with the index are logged but don't stop us saving the attachment
+	rc := b.redisPool.Get()
+	existingURL, err := redis.String(rc.Do("GET", key))
+	if err == nil {
+		_, err = rc.Do("EXPIRE", key, ttl)
+	}
+	rc.Close()
+
+	if existingURL != "" {
+		if err != nil {
+			slog.Error("error refreshing attachment hash", "error", err, "key", key)
+		}
+		return existingURL, nil
+	} else if err != redis.ErrNil {
+		slog.Error("error looking up attachment hash", "error", err, "key", key)
+	}
+
+	storageURL, err := b.attachmentStore.Upload(ctx, path, contentType, f)
+	if err != nil {
+		return "", errors.Wrap(err, "error saving attachment to storage")
+	}
+	storageURL = b.attachmentRef(path, storageURL)
+
+	rc = b.redisPool.Get()
+	defer rc.Close()
+
+	if _, err := rc.Do("SET", key, storageURL, "EX", ttl); err != nil {
+		slog.Error("error recording attachment hash", "error", err, "key", key)
+	}
+
+	return storageURL, nil
+}
@@ -7,9 +7,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -19,6 +21,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/courier"
@@ -49,6 +52,9 @@ var storageDir = "_storage"
 
 var uuidRegex = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
 
+// how often we check our storages and spool for health reports
+const slowHealthCheckInterval = time.Second * 30
+
 func init() {
 	courier.RegisterBackend("rapidpro", newBackend)
 }
@@ -63,7 +69,9 @@ type backend struct {
 
 	db                *sqlx.DB
 	redisPool         *redis.Pool
+	msgQueue          queue.MsgQueue
 	attachmentStorage storage.Storage
+	attachmentStore   attachmentStore
 	logStorage        storage.Storage
 
 	stopChan  chan bool
@@ -76,13 +84,27 @@ type backend struct {
 	mediaCache   *redisx.IntervalHash
 	mediaMutexes syncx.HashMutex
 
-	// tracking of recent messages received to avoid creating duplicates
-	receivedExternalIDs *redisx.IntervalHash // using external id
-	receivedMsgs        *redisx.IntervalHash // using content hash
+	// how recent messages received are tracked to avoid creating duplicates
+	dedupePolicy *courier.DedupePolicy
 
 	// tracking of external ids of messages we've sent in case we need one before its status update has been written
 	sentExternalIDs *redisx.IntervalHash
 
+	// limits on how many msgs and channel events we'll accept from channels and URNs
+	inboundLimits *courier.InboundLimits
+
+	// the channels whose concurrency limits we last wrote to our msg queue, so we only write them again when a channel
+	// has been reloaded and its config may have changed
+	maxConcurrencyMutex  sync.Mutex
+	maxConcurrencySynced map[courier.ChannelUUID]*Channel
+
+	// results of checking our storages and spool, which are too slow to check on every health or status request so are
+	// refreshed in the background
+	slowHealthMutex sync.RWMutex
+	storageErr      error
+	spoolErr        error
+	spoolBacklog    []*courier.SpoolBacklog
+
 	// both sqlx and redis provide wait stats which are cummulative that we need to convert into increments
 	dbWaitDuration    time.Duration
 	dbWaitCount       int64
@@ -120,9 +142,12 @@ func newBackend(cfg *courier.Config) courier.Backend {
 		mediaCache:   redisx.NewIntervalHash("media-lookups", time.Hour*24, 2),
 		mediaMutexes: *syncx.NewHashMutex(8),
 
-		receivedMsgs:        redisx.NewIntervalHash("seen-msgs", time.Second*2, 2),        // 2 - 4 seconds
-		receivedExternalIDs: redisx.NewIntervalHash("seen-external-ids", time.Hour*24, 2), // 24 - 48 hours
-		sentExternalIDs:     redisx.NewIntervalHash("sent-external-ids", time.Hour, 2),    // 1 - 2 hours
+		dedupePolicy:    courier.NewDedupePolicy(cfg),
+		sentExternalIDs: redisx.NewIntervalHash("sent-external-ids", time.Hour, 2), // 1 - 2 hours
+
+		inboundLimits: courier.NewInboundLimits(cfg),
+
+		maxConcurrencySynced: make(map[courier.ChannelUUID]*Channel),
 	}
 }
 
@@ -212,9 +237,26 @@ func (b *backend) Start() error {
 		log.Info("redis ok")
 	}
 
-	// start our dethrottler if we are going to be doing some sending
+	// create our outgoing message queue
+	visibility := time.Duration(b.config.MsgQueueVisibilityTimeout) * time.Second
+
+	switch b.config.MsgQueue {
+	case "streams":
+		if visibility <= 0 {
+			return errors.New("streams msg queue requires a visibility timeout")
+		}
+		hostname, _ := os.Hostname()
+		consumer := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+		b.msgQueue = queue.NewStreamsQueue(msgQueueName, consumer, visibility)
+	case "sorted_sets", "":
+		b.msgQueue = queue.NewSortedSetQueue(msgQueueName, visibility)
+	default:
+		return errors.Errorf("unknown msg queue type: %s", b.config.MsgQueue)
+	}
+
+	// start our queue's background processes (e.g. dethrottler, reaper) if we are going to be doing some sending
 	if b.config.MaxWorkers > 0 {
-		queue.StartDethrottler(redisPool, b.stopChan, b.waitGroup, msgQueueName)
+		b.msgQueue.Start(redisPool, b.stopChan, b.waitGroup)
 	}
 
 	// create our storage (S3 or file system)
@@ -236,10 +278,18 @@ func (b *backend) Start() error {
 		if err != nil {
 			return err
 		}
-		b.attachmentStorage = storage.NewS3(s3Client, b.config.S3AttachmentsBucket, b.config.S3Region, s3.BucketCannedACLPublicRead, 32)
+		attachmentsACL := s3.BucketCannedACLPublicRead
+		if b.config.S3AttachmentsPrivate {
+			attachmentsACL = s3.BucketCannedACLPrivate
+		}
+		attachmentsURLExpiry := time.Duration(b.config.S3AttachmentsURLExpiry) * time.Second
+
+		b.attachmentStorage = storage.NewS3(s3Client, b.config.S3AttachmentsBucket, b.config.S3Region, attachmentsACL, 32)
+		b.attachmentStore = newS3AttachmentStore(s3Client.(s3iface.S3API), b.config.S3AttachmentsBucket, b.config.S3Region, attachmentsACL, attachmentsURLExpiry)
 		b.logStorage = storage.NewS3(s3Client, b.config.S3LogsBucket, b.config.S3Region, s3.BucketCannedACLPrivate, 32)
 	} else {
 		b.attachmentStorage = storage.NewFS(storageDir+"/attachments", 0766)
+		b.attachmentStore = newFSAttachmentStore(storageDir+"/attachments", 0766)
 		b.logStorage = storage.NewFS(storageDir+"/logs", 0766)
 	}
 
@@ -276,14 +326,22 @@ func (b *backend) Start() error {
 	b.dbLogWriter = NewDBLogWriter(b.db, b.writerWG)
 	b.dbLogWriter.Start()
 
-	b.stLogWriter = NewStorageLogWriter(b.logStorage, b.writerWG)
+	b.stLogWriter = NewStorageLogWriter(b.logStorage, b.redisPool, b.writerWG)
 	b.stLogWriter.Start()
 
 	// register and start our spool flushers
-	courier.RegisterFlusher(path.Join(b.config.SpoolDir, "msgs"), b.flushMsgFile)
+	courier.RegisterOrderedFlusher(path.Join(b.config.SpoolDir, "msgs"), b.flushMsgFile, spooledMsgOrder)
 	courier.RegisterFlusher(path.Join(b.config.SpoolDir, "statuses"), b.flushStatusFile)
 	courier.RegisterFlusher(path.Join(b.config.SpoolDir, "events"), b.flushChannelEventFile)
 
+	// start checking our storages and spool in the background
+	b.startSlowHealthChecks()
+
+	// start our inbound workers if incoming msgs and events are being queued
+	if b.config.InboundQueue {
+		b.startInboundWorkers()
+	}
+
 	slog.Info("backend started", "comp", "backend", "state", "started")
 	return nil
 }
@@ -320,6 +378,20 @@ func (b *backend) Cleanup() error {
 	return b.redisPool.Close()
 }
 
+// Flush waits until our batched writers have written everything queued on them
+func (b *backend) Flush(ctx context.Context) error {
+	if err := b.statusWriter.Flush(ctx); err != nil {
+		return errors.Wrap(err, "error flushing status writer")
+	}
+	if err := b.dbLogWriter.Flush(ctx); err != nil {
+		return errors.Wrap(err, "error flushing db log writer")
+	}
+	if err := b.stLogWriter.Flush(ctx); err != nil {
+		return errors.Wrap(err, "error flushing storage log writer")
+	}
+	return nil
+}
+
 // GetChannel returns the channel for the passed in type and UUID
 func (b *backend) GetChannel(ctx context.Context, ct courier.ChannelType, uuid courier.ChannelUUID) (courier.Channel, error) {
 	timeout, cancel := context.WithTimeout(ctx, backendTimeout)
@@ -413,10 +485,10 @@ func (b *backend) NewIncomingMsg(channel courier.Channel, urn urns.URN, text str
 	msg := newMsg(MsgIncoming, channel, urn, text, extID, clog)
 	msg.WithReceivedOn(time.Now().UTC())
 
-	// check if this message could be a duplicate and if so use the original's UUID
-	if prevUUID := b.checkMsgAlreadyReceived(msg); prevUUID != courier.NilMsgUUID {
-		msg.UUID_ = prevUUID
-		msg.alreadyWritten = true
+	// check if this message could be a duplicate and if so use the original's UUID, unless it's on a channel deduped by
+	// fingerprint in which case we check when it's written so that the handler can set one
+	if b.dedupePolicy.ForChannel(channel).Mode != courier.MsgDedupeFingerprint {
+		b.dedupeMsg(msg)
 	}
 
 	return msg
@@ -428,30 +500,34 @@ func (b *backend) PopNextOutgoingMsg(ctx context.Context) (courier.MsgOut, error
 	rc := b.redisPool.Get()
 	defer rc.Close()
 
-	token, msgJSON, err := queue.PopFromQueue(rc, msgQueueName)
-	if err != nil {
-		return nil, err
-	}
-
-	for token == queue.Retry {
-		token, msgJSON, err = queue.PopFromQueue(rc, msgQueueName)
+	for {
+		token, msgJSON, err := b.msgQueue.Pop(rc)
 		if err != nil {
 			return nil, err
 		}
-	}
 
-	if msgJSON != "" {
+		for token == queue.Retry {
+			token, msgJSON, err = b.msgQueue.Pop(rc)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if msgJSON == "" {
+			return nil, nil
+		}
+
 		dbMsg := &Msg{}
 		err = json.Unmarshal([]byte(msgJSON), dbMsg)
 		if err != nil {
-			queue.MarkComplete(rc, msgQueueName, token)
+			b.msgQueue.Complete(rc, token)
 			return nil, errors.Wrapf(err, "unable to unmarshal message: %s", string(msgJSON))
 		}
 
 		// populate the channel on our db msg
 		channel, err := b.GetChannel(ctx, courier.AnyChannelType, dbMsg.ChannelUUID_)
 		if err != nil {
-			queue.MarkComplete(rc, msgQueueName, token)
+			b.msgQueue.Complete(rc, token)
 			return nil, err
 		}
 
@@ -459,13 +535,51 @@ func (b *backend) PopNextOutgoingMsg(ctx context.Context) (courier.MsgOut, error
 		dbMsg.channel = channel.(*Channel)
 		dbMsg.workerToken = token
 
+		// make sure the queue's concurrency limit is in sync with the channel's config so the pop script can enforce it
+		b.syncMaxConcurrency(rc, dbMsg.channel)
+
+		// if this message is scheduled to be sent later, put it back on its queue until then and try the next one
+		if sendAt := scheduledSendTime(dbMsg, time.Now()); !sendAt.IsZero() {
+			err := b.requeueMsg(rc, dbMsg, sendAt)
+			b.msgQueue.Complete(rc, token)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		// clear out our seen incoming messages
 		b.clearMsgSeen(rc, dbMsg)
 
+		b.resolveAttachmentURLs(ctx, dbMsg)
+
 		return dbMsg, nil
 	}
+}
 
-	return nil, nil
+// returns when the passed in message should be sent if that's later than now, i.e. it has a send after time that
+// hasn't passed yet, or that time falls within its channel's quiet hours. Otherwise returns a zero time.
+func scheduledSendTime(m *Msg, now time.Time) time.Time {
+	if m.SendAfter_ == nil {
+		return time.Time{}
+	}
+
+	sendAt := *m.SendAfter_
+	if sendAt.Before(now) {
+		sendAt = now
+	}
+
+	quietHours, err := courier.ChannelQuietHours(m.channel)
+	if err != nil {
+		slog.Error("error reading channel quiet hours", "error", err, "channel_uuid", m.ChannelUUID_)
+	} else if quietHours != nil {
+		sendAt = quietHours.Until(sendAt)
+	}
+
+	if sendAt.After(now) {
+		return sendAt
+	}
+	return time.Time{}
 }
 
 var luaSent = redis.NewScript(3,
@@ -511,7 +625,21 @@ func (b *backend) MarkOutgoingMsgComplete(ctx context.Context, msg courier.MsgOu
 
 	dbMsg := msg.(*Msg)
 
-	queue.MarkComplete(rc, msgQueueName, dbMsg.workerToken)
+	b.msgQueue.Complete(rc, dbMsg.workerToken)
+
+	// track consecutive errored sends for this channel so that we can pause its queue if its provider is down
+	if status != nil && b.config.CircuitBreakerThreshold > 0 {
+		switch status.Status() {
+		case courier.MsgStatusErrored, courier.MsgStatusWired, courier.MsgStatusSent, courier.MsgStatusDelivered:
+			errored := status.Status() == courier.MsgStatusErrored
+			state, err := recordSendOutcome(rc, msg.Channel().UUID(), errored, b.config.CircuitBreakerThreshold, b.config.CircuitBreakerCooldown)
+			if err != nil {
+				slog.Error("error recording send outcome", "error", err, "channel_uuid", msg.Channel().UUID())
+			} else if errored && state == circuitOpen {
+				slog.Warn("circuit open, pausing channel queue", "channel_uuid", msg.Channel().UUID(), "cooldown", b.config.CircuitBreakerCooldown)
+			}
+		}
+	}
 
 	// mark as sent in redis as well if this was actually wired or sent
 	if status != nil && (status.Status() == courier.MsgStatusSent || status.Status() == courier.MsgStatusWired) {
@@ -533,6 +661,60 @@ func (b *backend) MarkOutgoingMsgComplete(ctx context.Context, msg courier.MsgOu
 	}
 }
 
+// RequeueOutgoingMsg puts the passed in message back on the queue it was popped from, scheduled to be popped again after
+// the given delay
+func (b *backend) RequeueOutgoingMsg(ctx context.Context, msg courier.MsgOut, delay time.Duration) error {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	retry := *msg.(*Msg)
+	retry.RetryCount_++
+
+	return b.requeueMsg(rc, &retry, time.Now().Add(delay))
+}
+
+// ThrottleOutgoingMsg engages the rate limit on the passed in message's channel for the given duration, and puts the
+// message back on its queue to be sent once that has passed
+func (b *backend) ThrottleOutgoingMsg(ctx context.Context, msg courier.MsgOut, retryAfter time.Duration) error {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	if err := b.msgQueue.Throttle(rc, string(msg.Channel().UUID()), retryAfter); err != nil {
+		return err
+	}
+
+	return b.requeueMsg(rc, msg.(*Msg), time.Now())
+}
+
+// pushes the given message back onto the queue it was popped from
+func (b *backend) requeueMsg(rc redis.Conn, m *Msg, at time.Time) error {
+	queueName, tps, err := b.msgQueue.Queue(m.workerToken)
+	if err != nil {
+		return err
+	}
+
+	var priority queue.Priority = queue.LowPriority
+	if m.HighPriority_ {
+		priority = queue.HighPriority
+	}
+
+	msgJSON, err := json.Marshal([]any{m})
+	if err != nil {
+		return errors.Wrap(err, "error marshalling message to requeue")
+	}
+
+	err = b.msgQueue.Push(rc, queueName, tps, string(msgJSON), priority, at)
+	return errors.Wrap(err, "error requeueing message")
+}
+
+// checks that accepting an incoming msg or channel event from the given URN won't exceed any inbound rate limits
+func (b *backend) checkInboundLimits(ctx context.Context, channel courier.Channel, urn urns.URN) error {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	return b.inboundLimits.Check(ctx, rc, channel, urn, time.Now())
+}
+
 // WriteMsg writes the passed in message to our store
 func (b *backend) WriteMsg(ctx context.Context, m courier.MsgIn, clog *courier.ChannelLog) error {
 	timeout, cancel := context.WithTimeout(ctx, backendTimeout)
@@ -673,13 +855,14 @@ func (b *backend) WriteChannelLog(ctx context.Context, clog *courier.ChannelLog)
 	timeout, cancel := context.WithTimeout(ctx, backendTimeout)
 	defer cancel()
 
+	courier.PublishChannelLog(clog)
 	queueChannelLog(timeout, b, clog)
 
 	return nil
 }
 
-// SaveAttachment saves an attachment to backend storage
-func (b *backend) SaveAttachment(ctx context.Context, ch courier.Channel, contentType string, data []byte, extension string) (string, error) {
+// SaveAttachment streams an attachment to backend storage
+func (b *backend) SaveAttachment(ctx context.Context, ch courier.Channel, contentType string, content io.Reader, extension string) (string, error) {
 	// create our filename
 	filename := string(uuids.New())
 	if extension != "" {
@@ -690,12 +873,16 @@ func (b *backend) SaveAttachment(ctx context.Context, ch courier.Channel, conten
 
 	path := filepath.Join(b.config.S3AttachmentsPrefix, strconv.FormatInt(int64(orgID), 10), filename[:4], filename[4:8], filename)
 
-	storageURL, err := b.attachmentStorage.Put(ctx, path, contentType, data)
+	if b.config.AttachmentDedupeDays > 0 {
+		return b.saveDedupedAttachment(ctx, orgID, path, contentType, content, extension)
+	}
+
+	storageURL, err := b.attachmentStore.Upload(ctx, path, contentType, content)
 	if err != nil {
-		return "", errors.Wrapf(err, "error saving attachment to storage (bytes=%d)", len(data))
+		return "", errors.Wrap(err, "error saving attachment to storage")
 	}
 
-	return storageURL, nil
+	return b.attachmentRef(path, storageURL), nil
 }
 
 // ResolveMedia resolves the passed in attachment URL to a media object
@@ -757,25 +944,110 @@ func (b *backend) HttpAccess() *httpx.AccessConfig {
 
 // Health returns the health of this backend as a string, returning "" if all is well
 func (b *backend) Health() string {
-	// test redis
-	rc := b.redisPool.Get()
-	defer rc.Close()
-	_, redisErr := rc.Do("PING")
+	health := bytes.Buffer{}
+	for _, c := range b.HealthReport(context.Background()).Checks {
+		if c.Required && !c.OK {
+			health.WriteString(fmt.Sprintf("\n% 16s: %s", c.Name+" err", c.Error))
+		}
+	}
+	return health.String()
+}
 
+// HealthReport checks our DB and redis, and includes the last background checks of our storage and spool, only DB and
+// redis being required
+func (b *backend) HealthReport(ctx context.Context) *courier.HealthReport {
 	// test our db
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	dbErr := b.db.PingContext(ctx)
 	cancel()
 
-	health := bytes.Buffer{}
-	if redisErr != nil {
-		health.WriteString(fmt.Sprintf("\n% 16s: %v", "redis err", redisErr))
+	// test redis
+	rc := b.redisPool.Get()
+	_, redisErr := rc.Do("PING")
+	rc.Close()
+
+	// storage and spool results are from their last background check
+	b.slowHealthMutex.RLock()
+	storageErr, spoolErr := b.storageErr, b.spoolErr
+	b.slowHealthMutex.RUnlock()
+
+	return &courier.HealthReport{
+		Checks: []*courier.HealthCheck{
+			courier.NewHealthCheck("db", true, dbErr),
+			courier.NewHealthCheck("redis", true, redisErr),
+			courier.NewHealthCheck("storage", false, storageErr),
+			courier.NewHealthCheck("spool", false, spoolErr),
+		},
 	}
-	if dbErr != nil {
-		health.WriteString(fmt.Sprintf("\n% 16s: %v", "db err", dbErr))
+}
+
+// checks our storages and spool directories, recording the results for health reports
+func (b *backend) checkSlowHealth() {
+	storageErr := checkStorage(b.attachmentStorage)
+	if storageErr == nil {
+		storageErr = checkStorage(b.logStorage)
 	}
 
-	return health.String()
+	var spoolErr error
+	for _, subdir := range []string{"msgs", "statuses", "events"} {
+		if spoolErr = courier.CheckSpoolDirWritable(b.config.SpoolDir, subdir); spoolErr != nil {
+			break
+		}
+	}
+
+	// summarizing our spool means reading every file in it, so it's done here rather than on every status request
+	var spoolBacklog []*courier.SpoolBacklog
+	if spool, err := courier.ReadSpool(b.config.SpoolDir); err != nil {
+		slog.Error("error reading spool", "error", err, "spool_dir", b.config.SpoolDir)
+	} else {
+		spoolBacklog = courier.SummarizeSpool(spool)
+	}
+
+	b.slowHealthMutex.Lock()
+	b.storageErr, b.spoolErr, b.spoolBacklog = storageErr, spoolErr, spoolBacklog
+	b.slowHealthMutex.Unlock()
+}
+
+// checks our storages and spool now and then periodically in the background until we're stopped
+func (b *backend) startSlowHealthChecks() {
+	b.checkSlowHealth()
+
+	b.waitGroup.Add(1)
+
+	go func() {
+		defer b.waitGroup.Done()
+
+		for {
+			select {
+			case <-b.stopChan:
+				return
+			case <-time.After(slowHealthCheckInterval):
+				b.checkSlowHealth()
+			}
+		}
+	}()
+}
+
+// writes the given channel's concurrency limit to our msg queue so the pop script can enforce it, unless we've already
+// written it since the channel was last loaded
+func (b *backend) syncMaxConcurrency(rc redis.Conn, channel *Channel) {
+	b.maxConcurrencyMutex.Lock()
+	synced := b.maxConcurrencySynced[channel.UUID()] == channel
+	b.maxConcurrencySynced[channel.UUID()] = channel
+	b.maxConcurrencyMutex.Unlock()
+
+	if synced {
+		return
+	}
+
+	maxConcurrency := channel.IntConfigForKey(courier.ConfigMaxConcurrency, 0)
+	if err := b.msgQueue.SetMaxConcurrency(rc, string(channel.UUID()), maxConcurrency); err != nil {
+		slog.Error("error setting max concurrency", "error", err, "channel_uuid", channel.UUID())
+
+		b.maxConcurrencyMutex.Lock()
+		delete(b.maxConcurrencySynced, channel.UUID())
+		b.maxConcurrencyMutex.Unlock()
+	}
 }
 
 // Heartbeat is called every minute, we log our queue depth to librato
@@ -783,32 +1055,29 @@ func (b *backend) Heartbeat() error {
 	rc := b.redisPool.Get()
 	defer rc.Close()
 
-	active, err := redis.Strings(rc.Do("ZRANGE", fmt.Sprintf("%s:active", msgQueueName), "0", "-1"))
-	if err != nil {
-		return errors.Wrapf(err, "error getting active queues")
-	}
-	throttled, err := redis.Strings(rc.Do("ZRANGE", fmt.Sprintf("%s:throttled", msgQueueName), "0", "-1"))
+	sizes, err := b.msgQueue.Sizes(rc)
 	if err != nil {
-		return errors.Wrapf(err, "error getting throttled queues")
+		return errors.Wrapf(err, "error getting queue sizes")
 	}
-	queues := append(active, throttled...)
+
+	courier.ResetQueueMetrics()
 
 	prioritySize := 0
 	bulkSize := 0
-	for _, queue := range queues {
-		q := fmt.Sprintf("%s/1", queue)
-		count, err := redis.Int(rc.Do("ZCARD", q))
-		if err != nil {
-			return errors.Wrapf(err, "error getting size of priority queue: %s", q)
-		}
-		prioritySize += count
-
-		q = fmt.Sprintf("%s/0", queue)
-		count, err = redis.Int(rc.Do("ZCARD", q))
-		if err != nil {
-			return errors.Wrapf(err, "error getting size of bulk queue: %s", q)
+	for _, size := range sizes {
+		prioritySize += size.Size
+		bulkSize += size.BulkSize
+
+		// our queues are named by channel UUID, so we can report sizes per channel
+		channelUUID := courier.ChannelUUID(size.Queue)
+		channelType := courier.ChannelType("")
+		if channel, err := getChannel(context.Background(), b.db, courier.AnyChannelType, channelUUID); err == nil {
+			channelType = channel.ChannelType()
+
+			// refresh the concurrency limits of all queued channels so they don't expire whilst they have msgs
+			b.syncMaxConcurrency(rc, channel)
 		}
-		bulkSize += count
+		courier.SetQueueMetrics(channelType, channelUUID, size.Size, size.BulkSize)
 	}
 
 	// get our DB and redis stats
@@ -825,6 +1094,9 @@ func (b *backend) Heartbeat() error {
 	b.redisWaitDuration = redisStats.WaitDuration
 	b.redisWaitCount = redisStats.WaitCount
 
+	courier.SetPoolMetrics("db", dbStats.InUse, dbStats.Idle, dbWaitDurationInPeriod, dbWaitCountInPeriod)
+	courier.SetPoolMetrics("redis", redisStats.ActiveCount-redisStats.IdleCount, redisStats.IdleCount, redisWaitDurationInPeriod, redisWaitCountInPeriod)
+
 	analytics.Gauge("courier.db_busy", float64(dbStats.InUse))
 	analytics.Gauge("courier.db_idle", float64(dbStats.Idle))
 	analytics.Gauge("courier.db_wait_ms", float64(dbWaitDurationInPeriod/time.Millisecond))
@@ -848,71 +1120,95 @@ func (b *backend) Heartbeat() error {
 
 // Status returns information on our queue sizes, number of workers etc..
 func (b *backend) Status() string {
-	rc := b.redisPool.Get()
-	defer rc.Close()
+	report, err := b.StatusReport(context.Background())
+	if err != nil {
+		return err.Error()
+	}
 
 	status := bytes.Buffer{}
-	status.WriteString("------------------------------------------------------------------------------------\n")
-	status.WriteString("     Size | Bulk Size | Workers | TPS | Type | Channel              \n")
-	status.WriteString("------------------------------------------------------------------------------------\n")
-
-	var queue string
-	var workers float64
+	status.WriteString("----------------------------------------------------------------------------------------------------------------\n")
+	status.WriteString("     Size | Bulk Size | Workers | TPS | Type | Channel                              | Circuit | Max | Saturated | Pending\n")
+	status.WriteString("----------------------------------------------------------------------------------------------------------------\n")
+
+	for _, q := range report.Queues {
+		channelType := string(q.ChannelType)
+		if channelType == "" {
+			channelType = "!!"
+		}
+		maxConcurrency := "-"
+		if q.MaxConcurrency > 0 {
+			maxConcurrency = strconv.Itoa(q.MaxConcurrency)
+		}
+		saturated := ""
+		if q.Saturated {
+			saturated = "yes"
+		}
+		status.WriteString(fmt.Sprintf("% 9d   % 9d   % 7d   % 3d   % 4s   %s   % 7s   % 3s   %-9s   % 7d\n", q.Size, q.BulkSize, q.Workers, q.TPS, channelType, q.ChannelUUID, q.Circuit, maxConcurrency, saturated, q.Pending))
+	}
 
-	// get all our queues
-	rc.Send("zrevrangebyscore", fmt.Sprintf("%s:active", msgQueueName), "+inf", "-inf", "withscores")
-	rc.Send("zrevrangebyscore", fmt.Sprintf("%s:throttled", msgQueueName), "+inf", "-inf", "withscores")
-	rc.Flush()
+	status.WriteString("\n")
+	status.WriteString("-----------------------------------------------------------\n")
+	status.WriteString("    Spool | Pending | Invalid | Quarantined | Oldest\n")
+	status.WriteString("-----------------------------------------------------------\n")
 
-	active, err := redis.Values(rc.Receive())
-	if err != nil {
-		return fmt.Sprintf("unable to read active queues: %v", err)
+	for _, s := range report.Spool {
+		oldest := "-"
+		if s.OldestOn != nil {
+			oldest = time.Since(*s.OldestOn).Round(time.Second).String()
+		}
+		status.WriteString(fmt.Sprintf("% 9s   % 7d   % 7d   % 11d   %s\n", s.Subdir, s.Pending, s.Invalid, s.Quarantined, oldest))
 	}
-	throttled, err := redis.Values(rc.Receive())
+
+	return status.String()
+}
+
+// StatusReport returns information on our queue sizes, number of workers etc..
+func (b *backend) StatusReport(ctx context.Context) (*courier.StatusReport, error) {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	sizes, err := b.msgQueue.Sizes(rc)
 	if err != nil {
-		return fmt.Sprintf("unable to read throttled queues: %v", err)
+		return nil, errors.Wrap(err, "error reading queue sizes")
 	}
-	values := append(active, throttled...)
 
-	for len(values) > 0 {
-		values, err = redis.Scan(values, &queue, &workers)
-		if err != nil {
-			return fmt.Sprintf("error reading active queues: %v", err)
-		}
+	report := &courier.StatusReport{Queues: make([]*courier.QueueStatus, 0, len(sizes))}
 
-		// our queue name is in the format msgs:uuid|tps, break it apart
-		queue = strings.TrimPrefix(queue, "msgs:")
-		parts := strings.Split(queue, "|")
-		if len(parts) != 2 {
-			return fmt.Sprintf("error parsing queue name '%s'", queue)
-		}
-		uuid := parts[0]
-		tps := parts[1]
-
-		// try to look up our channel
-		channelUUID := courier.ChannelUUID(uuid)
-		channel, err := getChannel(context.Background(), b.db, courier.AnyChannelType, channelUUID)
-		channelType := "!!"
+	for _, size := range sizes {
+		// our queues are named by channel UUID, try to look up the channel
+		channelUUID := courier.ChannelUUID(size.Queue)
+		var channelType courier.ChannelType
+		channel, err := getChannel(ctx, b.db, courier.AnyChannelType, channelUUID)
 		if err == nil {
-			channelType = string(channel.ChannelType())
+			channelType = channel.ChannelType()
 		}
 
-		// get # of items in our normal queue
-		size, err := redis.Int64(rc.Do("ZCARD", fmt.Sprintf("%s:%s/1", msgQueueName, queue)))
+		circuit, failures, err := getCircuitState(rc, channelUUID)
 		if err != nil {
-			return fmt.Sprintf("error reading queue size: %v", err)
+			return nil, errors.Wrap(err, "error reading circuit state")
 		}
 
-		// get # of items in the bulk queue
-		bulkSize, err := redis.Int64(rc.Do("ZCARD", fmt.Sprintf("%s:%s/0", msgQueueName, queue)))
-		if err != nil {
-			return fmt.Sprintf("error reading bulk queue size: %v", err)
-		}
-
-		status.WriteString(fmt.Sprintf("% 9d   % 9d   % 7d   % 3s   % 4s   %s\n", size, bulkSize, int(workers), tps, channelType, uuid))
+		report.Queues = append(report.Queues, &courier.QueueStatus{
+			ChannelUUID:     channelUUID,
+			ChannelType:     channelType,
+			Size:            size.Size,
+			BulkSize:        size.BulkSize,
+			Pending:         size.Pending,
+			Workers:         size.Workers,
+			TPS:             size.TPS,
+			MaxConcurrency:  size.MaxConcurrency,
+			Saturated:       size.MaxConcurrency > 0 && size.Workers >= size.MaxConcurrency,
+			Circuit:         circuit,
+			CircuitFailures: failures,
+		})
 	}
 
-	return status.String()
+	// our spool backlog comes from the last background check, and is nil if we couldn't read our spool
+	b.slowHealthMutex.RLock()
+	report.Spool = b.spoolBacklog
+	b.slowHealthMutex.RUnlock()
+
+	return report, nil
 }
 
 // RedisPool returns the redisPool for this backend
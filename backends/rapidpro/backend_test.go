@@ -1,15 +1,19 @@
 package rapidpro
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strings"
 	"sync"
 	"testing"
@@ -26,6 +30,7 @@ import (
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/null/v3"
 	"github.com/nyaruka/redisx/assertredis"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -722,6 +727,31 @@ func (ts *BackendTestSuite) TestSentExternalIDCaching() {
 func (ts *BackendTestSuite) TestHealth() {
 	// all should be well in test land
 	ts.Equal(ts.b.Health(), "")
+
+	report := ts.b.HealthReport(context.Background())
+	ts.True(report.Ready())
+	ts.Len(report.Checks, 4)
+	ts.Equal("db", report.Checks[0].Name)
+	ts.True(report.Checks[0].OK)
+	ts.Equal("redis", report.Checks[1].Name)
+	ts.True(report.Checks[1].OK)
+	ts.Equal("storage", report.Checks[2].Name)
+	ts.True(report.Checks[2].OK)
+	ts.Equal("spool", report.Checks[3].Name)
+	ts.False(report.Checks[3].Required)
+
+	// storage and spool results come from their last background check rather than being checked on every request
+	ts.b.slowHealthMutex.Lock()
+	ts.b.storageErr = errors.New("storage unreachable")
+	ts.b.slowHealthMutex.Unlock()
+
+	report = ts.b.HealthReport(context.Background())
+	ts.True(report.Ready())
+	ts.False(report.Checks[2].OK)
+	ts.Equal("storage unreachable", report.Checks[2].Error)
+
+	ts.b.checkSlowHealth()
+	ts.True(ts.b.HealthReport(context.Background()).Checks[2].OK)
 }
 
 func (ts *BackendTestSuite) TestHeartbeat() {
@@ -761,6 +791,7 @@ func (ts *BackendTestSuite) TestCheckForDuplicate() {
 	msg2 := createAndWriteMsg(knChannel, urn, "ping", "")
 	ts.Equal(msg1.UUID(), msg2.UUID())
 	ts.True(msg2.alreadyWritten)
+	ts.Equal(courier.MsgDedupeContent, msg2.DedupedBy())
 
 	// different text should change that
 	msg3 := createAndWriteMsg(knChannel, urn, "test", "")
@@ -803,6 +834,79 @@ func (ts *BackendTestSuite) TestCheckForDuplicate() {
 	ts.False(msg7.alreadyWritten)
 	ts.True(msg8.alreadyWritten)
 	ts.False(msg9.alreadyWritten)
+	ts.Equal(courier.MsgDedupeExternalID, msg8.DedupedBy())
+}
+
+func (ts *BackendTestSuite) TestDedupeModes() {
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ctx := context.Background()
+	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	urn, _ := urns.NewTelURNForCountry("12065551219", knChannel.Country())
+
+	ts.clearRedis()
+
+	defer func() {
+		ts.b.dedupePolicy.ChannelModes = nil
+		ts.b.dedupePolicy.ChannelContentWindows = nil
+	}()
+
+	createAndWriteMsg := func(text, extID, fingerprint string) *Msg {
+		clog := courier.NewChannelLog(courier.ChannelLogTypeUnknown, knChannel, nil)
+		m := ts.b.NewIncomingMsg(knChannel, urn, text, extID, clog)
+		if fingerprint != "" {
+			m.WithFingerprint(fingerprint)
+		}
+		err := ts.b.WriteMsg(ctx, m, clog)
+		ts.NoError(err)
+		return m.(*Msg)
+	}
+
+	// deduping by external ID only means repeated keywords without IDs aren't merged
+	ts.b.dedupePolicy.ChannelModes = map[courier.ChannelType]courier.MsgDedupeMode{"KN": courier.MsgDedupeExternalID}
+
+	msg1 := createAndWriteMsg("yes", "", "")
+	msg2 := createAndWriteMsg("yes", "", "")
+	ts.NotEqual(msg1.UUID(), msg2.UUID())
+	ts.False(msg2.alreadyWritten)
+
+	msg3 := createAndWriteMsg("yes", "EX345", "")
+	msg4 := createAndWriteMsg("yes", "EX345", "")
+	ts.Equal(msg3.UUID(), msg4.UUID())
+	ts.Equal(courier.MsgDedupeExternalID, msg4.DedupedBy())
+
+	// deduping by content ignores external IDs and can be over a longer window
+	ts.b.dedupePolicy.ChannelModes = map[courier.ChannelType]courier.MsgDedupeMode{"KN": courier.MsgDedupeContent}
+	ts.b.dedupePolicy.ChannelContentWindows = map[courier.ChannelType]time.Duration{"KN": time.Minute * 5}
+
+	msg5 := createAndWriteMsg("hello", "EX456", "")
+	msg6 := createAndWriteMsg("hello", "EX567", "")
+	ts.Equal(msg5.UUID(), msg6.UUID())
+	ts.Equal(courier.MsgDedupeContent, msg6.DedupedBy())
+
+	keys, err := redis.Strings(r.Do("KEYS", "seen-msgs-300:*"))
+	ts.NoError(err)
+	ts.Len(keys, 1)
+
+	// deduping by fingerprint uses the fingerprint set by the handler
+	ts.b.dedupePolicy.ChannelModes = map[courier.ChannelType]courier.MsgDedupeMode{"KN": courier.MsgDedupeFingerprint}
+
+	msg7 := createAndWriteMsg("bonjour", "", "2024-01-01T12:00:00.123456")
+	msg8 := createAndWriteMsg("bonjour", "", "2024-01-01T12:00:00.123456")
+	msg9 := createAndWriteMsg("bonjour", "", "2024-01-01T12:05:00.654321")
+	ts.Equal(msg7.UUID(), msg8.UUID())
+	ts.Equal(courier.MsgDedupeFingerprint, msg8.DedupedBy())
+	ts.NotEqual(msg7.UUID(), msg9.UUID())
+	ts.False(msg9.alreadyWritten)
+
+	// and not deduping at all means even identical msgs are written
+	ts.b.dedupePolicy.ChannelModes = map[courier.ChannelType]courier.MsgDedupeMode{"KN": courier.MsgDedupeNone}
+
+	msg10 := createAndWriteMsg("ciao", "EX678", "")
+	msg11 := createAndWriteMsg("ciao", "EX678", "")
+	ts.NotEqual(msg10.UUID(), msg11.UUID())
+	ts.False(msg11.alreadyWritten)
 }
 
 func (ts *BackendTestSuite) TestStatus() {
@@ -826,6 +930,40 @@ func (ts *BackendTestSuite) TestStatus() {
 
 	// status should now contain that channel
 	ts.True(strings.Contains(ts.b.Status(), "1           0         0    10     KN   dbc126ed-66bc-4e28-b67b-81dc3327c95d"), ts.b.Status())
+
+	report, err := ts.b.StatusReport(context.Background())
+	ts.NoError(err)
+	ts.Contains(report.Queues, &courier.QueueStatus{ChannelUUID: "dbc126ed-66bc-4e28-b67b-81dc3327c95d", ChannelType: "KN", Size: 1, BulkSize: 0, Workers: 0, TPS: 10, Circuit: "closed"})
+
+	// give the channel a concurrency limit of one and pop our message so that it is saturated
+	ts.NoError(ts.b.msgQueue.SetMaxConcurrency(r, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 1))
+	defer ts.b.msgQueue.SetMaxConcurrency(r, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 0)
+
+	token, _, err := ts.b.msgQueue.Pop(r)
+	ts.NoError(err)
+	defer ts.b.msgQueue.Complete(r, token)
+
+	ts.True(strings.Contains(ts.b.Status(), "dbc126ed-66bc-4e28-b67b-81dc3327c95d    closed     1   yes"), ts.b.Status())
+
+	report, err = ts.b.StatusReport(context.Background())
+	ts.NoError(err)
+	ts.Contains(report.Queues, &courier.QueueStatus{ChannelUUID: "dbc126ed-66bc-4e28-b67b-81dc3327c95d", ChannelType: "KN", Size: 0, BulkSize: 0, Workers: 1, TPS: 10, MaxConcurrency: 1, Saturated: true, Circuit: "closed"})
+
+	// our spool backlog isn't read on every request but comes from the last background check
+	spoolDir := ts.b.config.SpoolDir
+	ts.b.config.SpoolDir = ts.T().TempDir()
+	defer func() { ts.b.config.SpoolDir = spoolDir }()
+	ts.NoError(courier.EnsureSpoolDirPresent(ts.b.config.SpoolDir, "msgs"))
+	ts.NoError(courier.WriteToSpool(ts.b.config.SpoolDir, "msgs", map[string]string{"text": "hi"}))
+
+	ts.b.checkSlowHealth()
+
+	report, err = ts.b.StatusReport(context.Background())
+	ts.NoError(err)
+	if ts.Len(report.Spool, 1) {
+		ts.Equal("msgs", report.Spool[0].Subdir)
+		ts.Equal(1, report.Spool[0].Pending)
+	}
 }
 
 func (ts *BackendTestSuite) TestOutgoingQueue() {
@@ -887,6 +1025,281 @@ func (ts *BackendTestSuite) TestOutgoingQueue() {
 	ts.False(sent)
 }
 
+func (ts *BackendTestSuite) TestRequeueOutgoingMsg() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ts.clearRedis()
+
+	dbMsg := readMsgFromDB(ts.b, 10000)
+	dbMsg.ChannelUUID_ = courier.ChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	msgJSON, err := json.Marshal([]any{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority)
+	ts.NoError(err)
+
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Equal(0, msg.RetryCount())
+
+	// requeue it to be retried in 2 seconds
+	err = ts.b.RequeueOutgoingMsg(ctx, msg, time.Second*2)
+	ts.NoError(err)
+	ts.b.MarkOutgoingMsgComplete(ctx, msg, nil)
+
+	// the original message is unchanged
+	ts.Equal(0, msg.RetryCount())
+
+	// but isn't available to be popped yet
+	msg2, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg2)
+
+	// wait for it to become available (and our dethrottler to move its queue back to active)
+	time.Sleep(time.Second * 3)
+
+	msg2, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.NotNil(msg2)
+	ts.Equal(msg.ID(), msg2.ID())
+	ts.Equal(1, msg2.RetryCount())
+	ts.Equal("test message", msg2.Text())
+}
+
+func (ts *BackendTestSuite) TestThrottleOutgoingMsg() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ts.clearRedis()
+
+	dbMsg := readMsgFromDB(ts.b, 10000)
+	dbMsg.ChannelUUID_ = courier.ChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	msgJSON, err := json.Marshal([]any{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority)
+	ts.NoError(err)
+
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+
+	// throttle the channel for 2 seconds
+	err = ts.b.ThrottleOutgoingMsg(ctx, msg, time.Second*2)
+	ts.NoError(err)
+	ts.b.MarkOutgoingMsgComplete(ctx, msg, nil)
+
+	assertredis.Get(ts.T(), ts.b.redisPool, "rate_limit:dbc126ed-66bc-4e28-b67b-81dc3327c95d", "engaged")
+
+	// message isn't available to be popped until the rate limit expires
+	msg2, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg2)
+
+	time.Sleep(time.Second * 3)
+
+	msg2, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.NotNil(msg2)
+	ts.Equal(msg.ID(), msg2.ID())
+	ts.Equal(0, msg2.RetryCount())
+}
+
+func (ts *BackendTestSuite) TestScheduledOutgoingMsg() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ts.clearRedis()
+
+	dbMsg := readMsgFromDB(ts.b, 10000)
+	dbMsg.ChannelUUID_ = courier.ChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	sendAfter := time.Now().Add(time.Second * 2)
+	dbMsg.SendAfter_ = &sendAfter
+
+	msgJSON, err := json.Marshal([]any{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority)
+	ts.NoError(err)
+
+	// message is put back on the queue until its send after time
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg)
+
+	report, err := ts.b.StatusReport(ctx)
+	ts.NoError(err)
+	ts.Contains(report.Queues, &courier.QueueStatus{ChannelUUID: "dbc126ed-66bc-4e28-b67b-81dc3327c95d", ChannelType: "KN", Size: 1, Pending: 1, TPS: 10, Circuit: "closed"})
+
+	time.Sleep(time.Second * 3)
+
+	msg, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.NotNil(msg)
+	ts.Equal(dbMsg.ID(), msg.ID())
+	ts.Equal(0, msg.RetryCount())
+
+	ts.b.MarkOutgoingMsgComplete(ctx, msg, nil)
+}
+
+func (ts *BackendTestSuite) TestStreamsMsgQueue() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ts.clearRedis()
+
+	sortedSets := ts.b.msgQueue
+	ts.b.msgQueue = queue.NewStreamsQueue(msgQueueName, "courier1", time.Minute)
+	defer func() { ts.b.msgQueue = sortedSets }()
+
+	dbMsg := readMsgFromDB(ts.b, 10000)
+	dbMsg.ChannelUUID_ = courier.ChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	msgJSON, err := json.Marshal([]any{dbMsg})
+	ts.NoError(err)
+
+	err = ts.b.msgQueue.Push(r, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority, time.Now())
+	ts.NoError(err)
+
+	status, err := ts.b.StatusReport(ctx)
+	ts.NoError(err)
+	ts.Len(status.Queues, 1)
+	ts.Equal(1, status.Queues[0].Size)
+	ts.Equal(10, status.Queues[0].TPS)
+
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Equal(dbMsg.ID(), msg.ID())
+
+	// requeue it to be retried in a second
+	err = ts.b.RequeueOutgoingMsg(ctx, msg, time.Second)
+	ts.NoError(err)
+	ts.b.MarkOutgoingMsgComplete(ctx, msg, nil)
+
+	status, err = ts.b.StatusReport(ctx)
+	ts.NoError(err)
+	ts.Equal(0, status.Queues[0].Workers)
+
+	msg2, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg2)
+
+	time.Sleep(time.Millisecond * 1500)
+
+	msg2, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Equal(msg.ID(), msg2.ID())
+	ts.Equal(1, msg2.RetryCount())
+	ts.b.MarkOutgoingMsgComplete(ctx, msg2, nil)
+}
+
+func (ts *BackendTestSuite) TestSyncMaxConcurrency() {
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ts.clearRedis()
+
+	channel := &Channel{UUID_: "dbc126ed-66bc-4e28-b67b-81dc3327c95d", ChannelType_: "KN", Config_: null.Map[any]{"max_concurrency": float64(3)}}
+
+	ts.b.syncMaxConcurrency(r, channel)
+	assertredis.Get(ts.T(), ts.b.redisPool, "max_concurrency:dbc126ed-66bc-4e28-b67b-81dc3327c95d", "3")
+
+	// limit isn't written again until the channel is reloaded
+	r.Do("DEL", "max_concurrency:dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	ts.b.syncMaxConcurrency(r, channel)
+	assertredis.NotExists(ts.T(), ts.b.redisPool, "max_concurrency:dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	reloaded := &Channel{UUID_: "dbc126ed-66bc-4e28-b67b-81dc3327c95d", ChannelType_: "KN", Config_: null.Map[any]{"max_concurrency": float64(2)}}
+	ts.b.syncMaxConcurrency(r, reloaded)
+	assertredis.Get(ts.T(), ts.b.redisPool, "max_concurrency:dbc126ed-66bc-4e28-b67b-81dc3327c95d", "2")
+
+	// removing the limit from the channel's config removes it from the queue
+	reloaded = &Channel{UUID_: "dbc126ed-66bc-4e28-b67b-81dc3327c95d", ChannelType_: "KN", Config_: null.Map[any]{}}
+	ts.b.syncMaxConcurrency(r, reloaded)
+	assertredis.NotExists(ts.T(), ts.b.redisPool, "max_concurrency:dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+}
+
+func (ts *BackendTestSuite) TestCircuitBreaker() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ts.clearRedis()
+
+	ts.b.config.CircuitBreakerThreshold = 2
+	ts.b.config.CircuitBreakerCooldown = 2
+	defer func() {
+		ts.b.config.CircuitBreakerThreshold = 0
+		ts.b.config.CircuitBreakerCooldown = 60
+	}()
+
+	channelUUID := courier.ChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	// queue up 4 messages
+	for i := 0; i < 4; i++ {
+		dbMsg := readMsgFromDB(ts.b, 10000)
+		dbMsg.ChannelUUID_ = channelUUID
+		msgJSON, err := json.Marshal([]any{dbMsg})
+		ts.NoError(err)
+		ts.NoError(queue.PushOntoQueue(r, msgQueueName, string(channelUUID), 0, string(msgJSON), queue.HighPriority))
+	}
+
+	popAndComplete := func(status courier.MsgStatus) courier.MsgOut {
+		msg, err := ts.b.PopNextOutgoingMsg(ctx)
+		ts.NoError(err)
+		if msg != nil {
+			clog := courier.NewChannelLogForSend(msg, nil)
+			ts.b.MarkOutgoingMsgComplete(ctx, msg, ts.b.NewStatusUpdate(msg.Channel(), msg.ID(), status, clog))
+		}
+		return msg
+	}
+
+	// a single errored send doesn't open the circuit
+	ts.NotNil(popAndComplete(courier.MsgStatusErrored))
+	assertredis.HGetAll(ts.T(), ts.b.redisPool, "circuit:"+string(channelUUID), map[string]string{"failures": "1"})
+	assertredis.NotExists(ts.T(), ts.b.redisPool, "rate_limit:"+string(channelUUID))
+
+	// but a second consecutive one does
+	ts.NotNil(popAndComplete(courier.MsgStatusErrored))
+	assertredis.HGetAll(ts.T(), ts.b.redisPool, "circuit:"+string(channelUUID), map[string]string{"state": "open", "failures": "2", "cooldown": "2"})
+	assertredis.Get(ts.T(), ts.b.redisPool, "rate_limit:"+string(channelUUID), "circuit")
+
+	// which shows up in our status
+	report, err := ts.b.StatusReport(ctx)
+	ts.NoError(err)
+	ts.Equal("open", report.Queues[0].Circuit)
+	ts.Equal(2, report.Queues[0].CircuitFailures)
+
+	// and means we can't pop any more messages from that channel
+	ts.Nil(popAndComplete(courier.MsgStatusSent))
+
+	// after our cooldown, a single message is popped as a probe
+	time.Sleep(time.Second * 3)
+
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.NotNil(msg)
+	assertredis.HGet(ts.T(), ts.b.redisPool, "circuit:"+string(channelUUID), "state", "probing")
+	assertredis.Get(ts.T(), ts.b.redisPool, "rate_limit:"+string(channelUUID), "circuit")
+
+	msg2, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg2)
+
+	// probe succeeds so circuit is closed and queue resumed
+	ts.b.MarkOutgoingMsgComplete(ctx, msg, ts.b.NewStatusUpdate(msg.Channel(), msg.ID(), courier.MsgStatusWired, courier.NewChannelLogForSend(msg, nil)))
+	assertredis.NotExists(ts.T(), ts.b.redisPool, "circuit:"+string(channelUUID))
+	assertredis.NotExists(ts.T(), ts.b.redisPool, "rate_limit:"+string(channelUUID))
+
+	ts.NotNil(popAndComplete(courier.MsgStatusSent))
+}
+
 func (ts *BackendTestSuite) TestChannel() {
 	noAddress := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c99a")
 	ts.Equal("US", noAddress.Country())
@@ -1064,6 +1477,83 @@ func (ts *BackendTestSuite) TestWriteChanneLog() {
 	assertdb.Query(ts.T(), ts.b.db, `SELECT count(*) FROM channels_channellog`).Returns(1)
 }
 
+func (ts *BackendTestSuite) TestChannelLogs() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	rc := ts.b.redisPool.Get()
+	defer rc.Close()
+
+	defer func() {
+		ts.b.db.MustExecContext(ctx, "DELETE FROM channels_channellog")
+		rc.Do("DEL", "channel_logs:dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	}()
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://api.messages.com/send.json": {
+			httpx.NewMockResponse(200, nil, []byte(`{"status":"success"}`)),
+		},
+	}))
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	req, _ := http.NewRequest("POST", "https://api.messages.com/send.json", nil)
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+	ts.NoError(err)
+
+	// one log written to the database and two to storage
+	clog1 := courier.NewChannelLog(courier.ChannelLogTypeTokenRefresh, channel, nil)
+	clog1.HTTP(trace)
+	clog1.Error(courier.ErrorResponseStatusCode())
+	ts.NoError(ts.b.WriteChannelLog(ctx, clog1))
+
+	clog2 := courier.NewChannelLog(courier.ChannelLogTypeMsgSend, channel, nil)
+	clog2.HTTP(trace)
+	clog2.SetAttached(true)
+	ts.NoError(ts.b.WriteChannelLog(ctx, clog2))
+
+	clog3 := courier.NewChannelLog(courier.ChannelLogTypeMsgSend, channel, nil)
+	clog3.HTTP(trace)
+	clog3.Error(courier.ErrorResponseStatusCode())
+	clog3.SetAttached(true)
+	ts.NoError(ts.b.WriteChannelLog(ctx, clog3))
+
+	time.Sleep(time.Second) // give writers time to write these
+
+	logUUIDs := func(q *courier.ChannelLogQuery) []courier.ChannelLogUUID {
+		logs, err := ts.b.ChannelLogs(ctx, channel, q)
+		ts.NoError(err)
+		us := make([]courier.ChannelLogUUID, len(logs))
+		for i, l := range logs {
+			us[i] = l.UUID
+		}
+		return us
+	}
+	isError := true
+
+	ts.Equal([]courier.ChannelLogUUID{clog3.UUID(), clog2.UUID(), clog1.UUID()}, logUUIDs(&courier.ChannelLogQuery{Limit: 10}))
+	ts.Equal([]courier.ChannelLogUUID{clog3.UUID(), clog2.UUID()}, logUUIDs(&courier.ChannelLogQuery{Limit: 2}))
+	ts.Equal([]courier.ChannelLogUUID{clog3.UUID(), clog2.UUID()}, logUUIDs(&courier.ChannelLogQuery{Type: courier.ChannelLogTypeMsgSend, Limit: 10}))
+	ts.Equal([]courier.ChannelLogUUID{clog3.UUID(), clog1.UUID()}, logUUIDs(&courier.ChannelLogQuery{IsError: &isError, Limit: 10}))
+	ts.Equal([]courier.ChannelLogUUID{clog1.UUID()}, logUUIDs(&courier.ChannelLogQuery{Before: clog2.CreatedOn(), Limit: 10}))
+
+	// fetch single logs from either store
+	l, err := ts.b.GetChannelLog(ctx, channel, clog1.UUID())
+	ts.NoError(err)
+	ts.Equal(courier.ChannelLogTypeTokenRefresh, l.Type)
+	ts.True(l.IsError)
+	ts.Equal("https://api.messages.com/send.json", l.HTTPLogs[0].URL)
+	ts.Equal("Unexpected response status code.", l.Errors[0].Message)
+
+	l, err = ts.b.GetChannelLog(ctx, channel, clog2.UUID())
+	ts.NoError(err)
+	ts.Equal(courier.ChannelLogTypeMsgSend, l.Type)
+	ts.False(l.IsError)
+	ts.Equal("https://api.messages.com/send.json", l.HTTPLogs[0].URL)
+
+	_, err = ts.b.GetChannelLog(ctx, channel, courier.ChannelLogUUID(uuids.New()))
+	ts.Equal(courier.ErrChannelLogNotFound, err)
+}
+
 func (ts *BackendTestSuite) TestSaveAttachment() {
 	testJPG := test.ReadFile("../../test/testdata/test.jpg")
 	ctx := context.Background()
@@ -1073,9 +1563,58 @@ func (ts *BackendTestSuite) TestSaveAttachment() {
 	defer uuids.SetGenerator(uuids.DefaultGenerator)
 	uuids.SetGenerator(uuids.NewSeededGenerator(1234))
 
-	newURL, err := ts.b.SaveAttachment(ctx, knChannel, "image/jpeg", testJPG, "jpg")
+	newURL, err := ts.b.SaveAttachment(ctx, knChannel, "image/jpeg", bytes.NewReader(testJPG), "jpg")
 	ts.NoError(err)
 	ts.Equal("_test_storage/attachments/media/1/c00e/5d67/c00e5d67-c275-4389-aded-7d8b151cbd5b.jpg", newURL)
+
+	// with deduplication enabled, identical attachments for the same org are only stored once
+	ts.b.config.AttachmentDedupeDays = 7
+	defer func() { ts.b.config.AttachmentDedupeDays = 0 }()
+
+	url1, err := ts.b.SaveAttachment(ctx, knChannel, "image/jpeg", bytes.NewReader(testJPG), "jpg")
+	ts.NoError(err)
+	ts.NotEqual(newURL, url1)
+
+	url2, err := ts.b.SaveAttachment(ctx, knChannel, "image/jpeg", bytes.NewReader(testJPG), "jpg")
+	ts.NoError(err)
+	ts.Equal(url1, url2)
+
+	url3, err := ts.b.SaveAttachment(ctx, knChannel, "image/jpeg", bytes.NewReader(testJPG[:1000]), "jpg")
+	ts.NoError(err)
+	ts.NotEqual(url1, url3)
+
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	ttl, err := redis.Int(r.Do("TTL", fmt.Sprintf("attachment_hash:1:%x.jpg", sha256.Sum256(testJPG))))
+	ts.NoError(err)
+	ts.Equal(7*24*60*60, ttl)
+
+	ts.b.config.AttachmentDedupeDays = 0
+
+	// with private storage, attachments are referred to by references which are resolved to readable URLs
+	ts.b.config.S3AttachmentsPrivate = true
+	defer func() { ts.b.config.S3AttachmentsPrivate = false }()
+
+	ref, err := ts.b.SaveAttachment(ctx, knChannel, "image/jpeg", bytes.NewReader(testJPG), "jpg")
+	ts.NoError(err)
+	ts.Regexp(`^https://localhost/c/_attachments/media/1/\w{4}/\w{4}/[\w-]{36}\.jpg$`, ref)
+
+	path, _ := courier.ParseAttachmentRef("localhost", ref)
+	readURL, err := ts.b.AttachmentURL(ctx, ref)
+	ts.NoError(err)
+	ts.Equal("_test_storage/attachments/"+path, readURL)
+
+	// other URLs are returned as is
+	readURL, err = ts.b.AttachmentURL(ctx, "https://example.com/test.jpg")
+	ts.NoError(err)
+	ts.Equal("https://example.com/test.jpg", readURL)
+
+	// outgoing messages are given readable URLs without changing the attachments they'll be requeued with
+	msg := &Msg{Attachments_: []string{"image/jpeg:" + ref, "image/png:https://example.com/test.png", "geo:1.23,4.56"}}
+	ts.b.resolveAttachmentURLs(ctx, msg)
+	ts.Equal([]string{"image/jpeg:_test_storage/attachments/" + path, "image/png:https://example.com/test.png", "geo:1.23,4.56"}, msg.Attachments())
+	ts.Equal("image/jpeg:"+ref, msg.Attachments_[0])
 }
 
 func (ts *BackendTestSuite) TestWriteMsg() {
@@ -1214,7 +1753,14 @@ func (ts *BackendTestSuite) TestWriteMsgWithAttachments() {
 	msg.WithAttachment("data:34564363576573573")
 
 	err = ts.b.WriteMsg(ctx, msg, clog)
-	ts.EqualError(err, "unable to decode attachment data: illegal base64 data at input byte 16")
+	ts.EqualError(err, "unable to decode attachment data: unexpected EOF")
+
+	// try an embedded attachment which is only invalid after the part we sniff the content type from
+	msg = ts.b.NewIncomingMsg(knChannel, urn, "invalid embedded attachment data", "", clog).(*Msg)
+	msg.WithAttachment(fmt.Sprintf("data:%s!!!!", base64.StdEncoding.EncodeToString(test.ReadFile("../../test/testdata/test.jpg"))))
+
+	err = ts.b.WriteMsg(ctx, msg, clog)
+	ts.ErrorContains(err, "unable to decode attachment data: illegal base64 data")
 
 	// try a geo attachment
 	msg = ts.b.NewIncomingMsg(knChannel, urn, "geo attachment", "", clog).(*Msg)
@@ -1290,6 +1836,126 @@ func (ts *BackendTestSuite) TestChannelEvent() {
 	ts.Equal(null.Int(1), dbE.OptInID_)
 }
 
+func (ts *BackendTestSuite) TestInboundQueue() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	clog := courier.NewChannelLog(courier.ChannelLogTypeUnknown, channel, nil)
+	urn, _ := urns.NewTelURNForCountry("12065551717", channel.Country())
+	shard := inboundShard(urn)
+
+	ts.clearRedis()
+
+	ts.b.config.InboundQueue = true
+	defer func() { ts.b.config.InboundQueue = false }()
+
+	msg := ts.b.NewIncomingMsg(channel, urn, "queued", "ext456", clog).(*Msg)
+	err := ts.b.WriteMsg(ctx, msg, clog)
+	ts.NoError(err)
+
+	event := ts.b.NewChannelEvent(channel, courier.EventTypeNewConversation, urn, clog).(*ChannelEvent)
+	err = ts.b.WriteChannelEvent(ctx, event, clog)
+	ts.NoError(err)
+
+	// both should be queued and nothing written to the db yet
+	rc := ts.b.redisPool.Get()
+	defer rc.Close()
+
+	count, _ := redis.Int(rc.Do("LLEN", inboundQueueKey(shard)))
+	ts.Equal(2, count)
+	assertdb.Query(ts.T(), ts.b.db, `SELECT count(*) FROM msgs_msg WHERE uuid = $1`, msg.UUID()).Returns(0)
+
+	// msg should still be marked as received so a retry from the channel isn't queued again
+	msg2 := ts.b.NewIncomingMsg(channel, urn, "queued", "ext456", clog).(*Msg)
+	ts.True(msg2.alreadyWritten)
+
+	// an error processing leaves the item to be retried first next time
+	n, err := ts.b.processInboundShard(shard, func([]byte) error { return errors.New("boom") })
+	ts.EqualError(err, "boom")
+	ts.Equal(0, n)
+
+	count, _ = redis.Int(rc.Do("LLEN", inboundProcessingKey(shard)))
+	ts.Equal(1, count)
+
+	n, err = ts.b.processInboundShard(shard, ts.b.writeInboundItem)
+	ts.NoError(err)
+	ts.Equal(2, n)
+
+	assertdb.Query(ts.T(), ts.b.db, `SELECT text FROM msgs_msg WHERE uuid = $1`, msg.UUID()).Returns("queued")
+	assertdb.Query(ts.T(), ts.b.db, `SELECT count(*) FROM channels_channelevent WHERE event_type = 'new_conversation' AND contact_urn_id = (SELECT id FROM contacts_contacturn WHERE identity = $1)`, urn.Identity()).Returns(1)
+
+	count, _ = redis.Int(rc.Do("LLEN", inboundQueueKey(shard)))
+	ts.Equal(0, count)
+	count, _ = redis.Int(rc.Do("LLEN", inboundProcessingKey(shard)))
+	ts.Equal(0, count)
+
+	// an item which keeps failing is eventually moved to the spool so that it stops holding up the rest of its shard
+	spoolDir := ts.b.config.SpoolDir
+	ts.b.config.SpoolDir = ts.T().TempDir()
+	defer func() { ts.b.config.SpoolDir = spoolDir }()
+	ts.NoError(courier.EnsureSpoolDirPresent(ts.b.config.SpoolDir, "msgs"))
+
+	msg3 := ts.b.NewIncomingMsg(channel, urn, "poison", "ext789", clog).(*Msg)
+	ts.NoError(ts.b.WriteMsg(ctx, msg3, clog))
+
+	for i := 1; i < inboundMaxAttempts; i++ {
+		n, err = ts.b.processInboundShard(shard, func([]byte) error { return errors.New("boom") })
+		ts.EqualError(err, "boom")
+		ts.Equal(0, n)
+	}
+
+	n, err = ts.b.processInboundShard(shard, func([]byte) error { return errors.New("boom") })
+	ts.NoError(err)
+	ts.Equal(1, n)
+
+	count, _ = redis.Int(rc.Do("LLEN", inboundProcessingKey(shard)))
+	ts.Equal(0, count)
+	assertredis.NotExists(ts.T(), ts.b.redisPool, inboundAttemptsKey(shard))
+
+	spooled, err := os.ReadDir(path.Join(ts.b.config.SpoolDir, "msgs"))
+	ts.NoError(err)
+	if ts.Len(spooled, 1) {
+		contents, err := os.ReadFile(path.Join(ts.b.config.SpoolDir, "msgs", spooled[0].Name()))
+		ts.NoError(err)
+		spooledMsg := &Msg{}
+		ts.NoError(json.Unmarshal(contents, spooledMsg))
+		ts.Equal(msg3.UUID(), spooledMsg.UUID())
+	}
+
+	// items which can never be written are dropped rather than blocking the queue
+	ts.NoError(ts.b.writeInboundItem([]byte(`{"type":"msg","data":{"channel_uuid":"8e2bd1a4-7ab7-4b41-a6c9-2f2b8a1a3bd6"}}`)))
+	ts.NoError(ts.b.writeInboundItem([]byte(`{"type":"foo","data":{}}`)))
+	ts.NoError(ts.b.writeInboundItem([]byte(`xyz`)))
+}
+
+func (ts *BackendTestSuite) TestInboundLimits() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	clog := courier.NewChannelLog(courier.ChannelLogTypeUnknown, channel, nil)
+	urn1, _ := urns.NewTelURNForCountry("12065551818", channel.Country())
+	urn2, _ := urns.NewTelURNForCountry("12065551819", channel.Country())
+
+	ts.clearRedis()
+
+	ts.b.inboundLimits.URNLimit = 2
+	defer func() { ts.b.inboundLimits.URNLimit = 0 }()
+
+	ts.NoError(ts.b.WriteMsg(ctx, ts.b.NewIncomingMsg(channel, urn1, "one", "", clog), clog))
+	ts.NoError(ts.b.WriteChannelEvent(ctx, ts.b.NewChannelEvent(channel, courier.EventTypeNewConversation, urn1, clog), clog))
+
+	// third msg or event from the same URN is over the limit and isn't written
+	msg := ts.b.NewIncomingMsg(channel, urn1, "three", "", clog).(*Msg)
+	err := ts.b.WriteMsg(ctx, msg, clog)
+	ts.ErrorIs(err, courier.ErrInboundLimitExceeded)
+	ts.Equal(courier.InboundLimitScopeURN, err.(*courier.InboundLimitError).Scope)
+	assertdb.Query(ts.T(), ts.b.db, `SELECT count(*) FROM msgs_msg WHERE uuid = $1`, msg.UUID()).Returns(0)
+
+	err = ts.b.WriteChannelEvent(ctx, ts.b.NewChannelEvent(channel, courier.EventTypeNewConversation, urn1, clog), clog)
+	ts.ErrorIs(err, courier.ErrInboundLimitExceeded)
+
+	// but other URNs are fine
+	ts.NoError(ts.b.WriteMsg(ctx, ts.b.NewIncomingMsg(channel, urn2, "one", "", clog), clog))
+}
+
 func (ts *BackendTestSuite) TestSessionTimeout() {
 	ctx := context.Background()
 
@@ -1456,6 +2122,35 @@ func (ts *BackendTestSuite) assertQueuedContactTask(contactID ContactID, expecte
 	ts.Equal(expectedBody, body["task"])
 }
 
+func TestScheduledSendTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)
+	past, soon, later := now.Add(-time.Minute), now.Add(time.Minute*30), now.Add(time.Hour*2)
+	channel := &Channel{Config_: map[string]any{}}
+	quietChannel := &Channel{Config_: map[string]any{
+		courier.ConfigQuietHours: map[string]any{"start": "21:00", "end": "08:00"},
+	}}
+
+	tcs := []struct {
+		channel   *Channel
+		sendAfter *time.Time
+		sendAt    time.Time
+	}{
+		{channel, nil, time.Time{}},
+		{channel, &past, time.Time{}},
+		{channel, &soon, soon},
+		{channel, &later, later},
+		{quietChannel, nil, time.Time{}},
+		{quietChannel, &past, time.Time{}},
+		{quietChannel, &soon, soon},
+		{quietChannel, &later, time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)},
+	}
+
+	for i, tc := range tcs {
+		m := &Msg{SendAfter_: tc.sendAfter, channel: tc.channel}
+		assert.Equal(t, tc.sendAt, scheduledSendTime(m, now), "send time mismatch in test case %d", i)
+	}
+}
+
 func TestMsgSuite(t *testing.T) {
 	suite.Run(t, new(BackendTestSuite))
 }
@@ -1571,3 +2266,18 @@ func readChannelEventFromDB(b *backend, id ChannelEventID) *ChannelEvent {
 	}
 	return e
 }
+
+func TestSpooledMsgOrder(t *testing.T) {
+	key, receivedOn, err := spooledMsgOrder([]byte(`{"urn": "tel:+250788383383", "created_on": "2024-03-01T12:00:00Z", "SentOn_": "2024-03-01T11:59:30Z"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "tel:+250788383383", key)
+	assert.Equal(t, time.Date(2024, 3, 1, 11, 59, 30, 0, time.UTC), receivedOn)
+
+	key, receivedOn, err = spooledMsgOrder([]byte(`{"urn": "tel:+250788383383", "created_on": "2024-03-01T12:00:00Z"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "tel:+250788383383", key)
+	assert.Equal(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), receivedOn)
+
+	_, _, err = spooledMsgOrder([]byte(`{"urn": `))
+	assert.Error(t, err)
+}
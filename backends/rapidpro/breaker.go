@@ -0,0 +1,70 @@
+package rapidpro
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/queue"
+)
+
+// circuit states
+const (
+	circuitClosed  = "closed"
+	circuitOpen    = "open"
+	circuitProbing = "probing"
+)
+
+var luaRecordSendOutcome = redis.NewScript(5, `-- KEYS: [CircuitKey, RateLimitKey, Errored, Threshold, Cooldown]
+	local circuitKey, rateLimitKey = KEYS[1], KEYS[2]
+	local threshold, cooldown = tonumber(KEYS[4]), tonumber(KEYS[5])
+	local state = redis.call("hget", circuitKey, "state")
+
+	-- a successful send closes the circuit and, if we were probing, resumes the queue
+	if KEYS[3] == "0" then
+		if state == "probing" and redis.call("get", rateLimitKey) == "circuit" then
+			redis.call("del", rateLimitKey)
+		end
+		redis.call("del", circuitKey)
+		return "closed"
+	end
+
+	local failures = redis.call("hincrby", circuitKey, "failures", 1)
+	redis.call("expire", circuitKey, 86400)
+
+	-- open the circuit if the probe failed or we've reached our threshold, pausing the queue for the cooldown
+	if state == "probing" or (state ~= "open" and failures >= threshold) then
+		redis.call("hset", circuitKey, "state", "open", "cooldown", cooldown)
+		redis.call("set", rateLimitKey, "circuit", "EX", cooldown)
+		return "open"
+	end
+
+	return state or "closed"
+`)
+
+// records the outcome of a send on the given channel, opening its circuit if it has reached the threshold for
+// consecutive errored sends, and returns the new circuit state
+func recordSendOutcome(rc redis.Conn, channelUUID courier.ChannelUUID, errored bool, threshold, cooldown int) (string, error) {
+	erroredArg := "0"
+	if errored {
+		erroredArg = "1"
+	}
+
+	return redis.String(luaRecordSendOutcome.Do(rc, queue.CircuitKeyPrefix+string(channelUUID), queue.RateLimitKeyPrefix+string(channelUUID), erroredArg, threshold, cooldown))
+}
+
+// gets the circuit state and number of consecutive errored sends for the given channel
+func getCircuitState(rc redis.Conn, channelUUID courier.ChannelUUID) (string, int, error) {
+	values, err := redis.Values(rc.Do("HMGET", queue.CircuitKeyPrefix+string(channelUUID), "state", "failures"))
+	if err != nil {
+		return "", 0, err
+	}
+
+	var state string
+	var failures int
+	if _, err := redis.Scan(values, &state, &failures); err != nil {
+		return "", 0, err
+	}
+	if state == "" {
+		state = circuitClosed
+	}
+	return state, failures, nil
+}
@@ -5,9 +5,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
-	"log"
 	"log/slog"
-	"os"
 	"strconv"
 	"time"
 
@@ -120,11 +118,25 @@ func (e *ChannelEvent) WithOccurredOn(time time.Time) courier.ChannelEvent {
 func writeChannelEvent(ctx context.Context, b *backend, event courier.ChannelEvent, clog *courier.ChannelLog) error {
 	dbEvent := event.(*ChannelEvent)
 
-	err := writeChannelEventToDB(ctx, b, dbEvent, clog)
+	if err := b.checkInboundLimits(ctx, dbEvent.channel, dbEvent.URN_); err != nil {
+		return err
+	}
 
-	// failed writing, write to our spool instead
-	if err != nil {
-		slog.Error("error writing channel event to db", "error", err, "channel_id", dbEvent.ChannelID, "event_type", dbEvent.EventType_)
+	var err error
+
+	if b.config.InboundQueue {
+		// queue it for an inbound worker to write to our db
+		err = b.queueInbound(inboundTypeEvent, dbEvent.URN_, dbEvent, clog)
+		if err != nil {
+			slog.Error("error queueing channel event", "error", err, "channel_id", dbEvent.ChannelID, "event_type", dbEvent.EventType_)
+		}
+	} else {
+		err = writeChannelEventToDB(ctx, b, dbEvent, clog)
+
+		// failed writing, write to our spool instead
+		if err != nil {
+			slog.Error("error writing channel event to db", "error", err, "channel_id", dbEvent.ChannelID, "event_type", dbEvent.EventType_)
+		}
 	}
 
 	if err != nil {
@@ -184,9 +196,7 @@ func (b *backend) flushChannelEventFile(filename string, contents []byte) error
 	event := &ChannelEvent{}
 	err := json.Unmarshal(contents, event)
 	if err != nil {
-		log.Printf("ERROR unmarshalling spool file '%s', renaming: %s\n", filename, err)
-		os.Rename(filename, fmt.Sprintf("%s.error", filename))
-		return nil
+		return fmt.Errorf("%w: %w", courier.ErrInvalidSpoolFile, err)
 	}
 
 	// look up our channel
@@ -2,20 +2,29 @@ package rapidpro
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"math"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/gocommon/dbutil"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/storage"
-	"github.com/nyaruka/gocommon/syncx"
+	"github.com/pkg/errors"
 )
 
 const sqlInsertChannelLog = `
@@ -36,13 +45,17 @@ type dbChannelLog struct {
 
 // channel log to be written to logs storage
 type stChannelLog struct {
-	UUID        courier.ChannelLogUUID `json:"uuid"`
-	Type        courier.ChannelLogType `json:"type"`
-	HTTPLogs    []*httpx.Log           `json:"http_logs"`
-	Errors      []channelError         `json:"errors"`
-	ElapsedMS   int                    `json:"elapsed_ms"`
-	CreatedOn   time.Time              `json:"created_on"`
-	ChannelUUID courier.ChannelUUID    `json:"-"`
+	UUID        courier.ChannelLogUUID       `json:"uuid"`
+	Type        courier.ChannelLogType       `json:"type"`
+	HTTPLogs    []*httpx.Log                 `json:"http_logs"`
+	Errors      []channelError               `json:"errors"`
+	ElapsedMS   int                          `json:"elapsed_ms"`
+	Attempt     int                          `json:"attempt,omitempty"`
+	CreatedOn   time.Time                    `json:"created_on"`
+	Retention   *courier.ChannelLogRetention `json:"retention,omitempty"`
+	ChannelUUID courier.ChannelUUID          `json:"-"`
+
+	isError bool
 }
 
 func (l *stChannelLog) path() string {
@@ -77,6 +90,11 @@ func queueChannelLog(ctx context.Context, b *backend, clog *courier.ChannelLog)
 		return
 	}
 
+	// and depending on the channel's retention settings, we might sample it out or trim it
+	if !clog.Retain() {
+		return
+	}
+
 	// if log is attached to a call or message, only write to storage
 	if clog.Attached() {
 		log = log.With("storage", "s3")
@@ -86,8 +104,11 @@ func queueChannelLog(ctx context.Context, b *backend, clog *courier.ChannelLog)
 			HTTPLogs:    logs,
 			Errors:      errors,
 			ElapsedMS:   int(clog.Elapsed() / time.Millisecond),
+			Attempt:     clog.Attempt(),
 			CreatedOn:   clog.CreatedOn(),
+			Retention:   clog.Retention(),
 			ChannelUUID: clog.Channel().UUID(),
+			isError:     isError,
 		}
 		if b.stLogWriter.Queue(v) <= 0 {
 			log.Error("channel log writer buffer full")
@@ -114,12 +135,12 @@ func queueChannelLog(ctx context.Context, b *backend, clog *courier.ChannelLog)
 }
 
 type DBLogWriter struct {
-	*syncx.Batcher[*dbChannelLog]
+	*batchWriter[*dbChannelLog]
 }
 
 func NewDBLogWriter(db *sqlx.DB, wg *sync.WaitGroup) *DBLogWriter {
 	return &DBLogWriter{
-		Batcher: syncx.NewBatcher[*dbChannelLog](func(batch []*dbChannelLog) {
+		batchWriter: newBatchWriter[*dbChannelLog](func(batch []*dbChannelLog) {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 			defer cancel()
 
@@ -150,21 +171,23 @@ func writeDBChannelLogs(ctx context.Context, db *sqlx.DB, batch []*dbChannelLog)
 }
 
 type StorageLogWriter struct {
-	*syncx.Batcher[*stChannelLog]
+	*batchWriter[*stChannelLog]
 }
 
-func NewStorageLogWriter(st storage.Storage, wg *sync.WaitGroup) *StorageLogWriter {
+func NewStorageLogWriter(st storage.Storage, rp *redis.Pool, wg *sync.WaitGroup) *StorageLogWriter {
 	return &StorageLogWriter{
-		Batcher: syncx.NewBatcher[*stChannelLog](func(batch []*stChannelLog) {
+		batchWriter: newBatchWriter[*stChannelLog](func(batch []*stChannelLog) {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 			defer cancel()
 
-			writeStorageChannelLogs(ctx, st, batch)
+			if writeStorageChannelLogs(ctx, st, batch) {
+				indexStorageChannelLogs(rp, batch)
+			}
 		}, 1000, time.Millisecond*500, 1000, wg),
 	}
 }
 
-func writeStorageChannelLogs(ctx context.Context, st storage.Storage, batch []*stChannelLog) {
+func writeStorageChannelLogs(ctx context.Context, st storage.Storage, batch []*stChannelLog) bool {
 	uploads := make([]*storage.Upload, len(batch))
 	for i, l := range batch {
 		uploads[i] = &storage.Upload{
@@ -174,6 +197,234 @@ func writeStorageChannelLogs(ctx context.Context, st storage.Storage, batch []*s
 		}
 	}
 	if err := st.BatchPut(ctx, uploads); err != nil {
-		slog.Error("error writing channel logs", "comp", "storage log writer")
+		slog.Error("error writing channel logs", "comp", "storage log writer", "error", err)
+		return false
+	}
+	return true
+}
+
+const (
+	channelLogsIndexSize   = 1000               // max number of storage logs we index per channel
+	channelLogsIndexExpiry = time.Hour * 24 * 7 // how long a channel's index lives after its last log is added
+)
+
+// storage has no way to list logs, so we keep a capped index of the most recent logs written there for each channel as
+// a sorted set of <uuid>|<type>|<is_error> scored by created on
+func channelLogsIndexKey(channelUUID courier.ChannelUUID) string {
+	return fmt.Sprintf("channel_logs:%s", channelUUID)
+}
+
+func indexStorageChannelLogs(rp *redis.Pool, batch []*stChannelLog) {
+	rc := rp.Get()
+	defer rc.Close()
+
+	keys := make(map[string]bool)
+	for _, l := range batch {
+		key := channelLogsIndexKey(l.ChannelUUID)
+		keys[key] = true
+
+		rc.Send("ZADD", key, float64(l.CreatedOn.UnixMilli())/1000, fmt.Sprintf("%s|%s|%t", l.UUID, l.Type, l.isError))
+	}
+	for key := range keys {
+		rc.Send("ZREMRANGEBYRANK", key, 0, -(channelLogsIndexSize + 1))
+		rc.Send("EXPIRE", key, int(channelLogsIndexExpiry/time.Second))
+	}
+
+	if _, err := rc.Do(""); err != nil {
+		slog.Error("error indexing channel logs", "comp", "storage log writer", "error", err)
+	}
+}
+
+// an entry in a channel's index of storage logs
+type stChannelLogRef struct {
+	uuid      courier.ChannelLogUUID
+	type_     courier.ChannelLogType
+	isError   bool
+	createdOn time.Time
+}
+
+func readChannelLogsIndex(rc redis.Conn, channelUUID courier.ChannelUUID) ([]*stChannelLogRef, error) {
+	values, err := redis.Strings(rc.Do("ZREVRANGE", channelLogsIndexKey(channelUUID), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]*stChannelLogRef, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		parts := strings.Split(values[i], "|")
+		score, _ := strconv.ParseFloat(values[i+1], 64)
+		if len(parts) != 3 {
+			continue
+		}
+
+		refs = append(refs, &stChannelLogRef{
+			uuid:      courier.ChannelLogUUID(parts[0]),
+			type_:     courier.ChannelLogType(parts[1]),
+			isError:   parts[2] == "true",
+			createdOn: time.UnixMilli(int64(math.Round(score * 1000))).In(time.UTC),
+		})
+	}
+	return refs, nil
+}
+
+const sqlSelectChannelLogs = `
+  SELECT uuid, log_type, channel_id, http_logs, errors, is_error, created_on, elapsed_ms
+    FROM channels_channellog
+   WHERE channel_id = $1 AND ($2::varchar = '' OR log_type = $2) AND ($3::boolean IS NULL OR is_error = $3) AND 
+         ($4::timestamptz IS NULL OR created_on >= $4) AND ($5::timestamptz IS NULL OR created_on < $5)
+ORDER BY created_on DESC
+   LIMIT $6`
+
+const sqlSelectChannelLog = `
+SELECT uuid, log_type, channel_id, http_logs, errors, is_error, created_on, elapsed_ms
+  FROM channels_channellog
+ WHERE channel_id = $1 AND uuid = $2`
+
+// ChannelLogs returns the most recent logs for the passed in channel matching the passed in query, from both the
+// database and the index of logs written to storage
+func (b *backend) ChannelLogs(ctx context.Context, ch courier.Channel, q *courier.ChannelLogQuery) ([]*courier.ChannelLogRecord, error) {
+	dbChan := ch.(*Channel)
+
+	dbLogs := make([]*dbChannelLog, 0, q.Limit)
+	if err := b.db.SelectContext(ctx, &dbLogs, sqlSelectChannelLogs, dbChan.ID(), q.Type, q.IsError, nullTime(q.After), nullTime(q.Before), q.Limit); err != nil {
+		return nil, errors.Wrap(err, "error querying channel logs")
+	}
+
+	rc := b.redisPool.Get()
+	refs, err := readChannelLogsIndex(rc, dbChan.UUID())
+	rc.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading channel logs index")
+	}
+
+	// merge logs from both stores, newest first
+	type entry struct {
+		createdOn time.Time
+		db        *dbChannelLog
+		st        *stChannelLogRef
+	}
+	entries := make([]entry, 0, len(dbLogs)+len(refs))
+	for _, l := range dbLogs {
+		entries = append(entries, entry{createdOn: l.CreatedOn, db: l})
+	}
+	for _, r := range refs {
+		if q.Matches(r.type_, r.isError, r.createdOn) {
+			entries = append(entries, entry{createdOn: r.createdOn, st: r})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].createdOn.After(entries[j].createdOn) })
+	if len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+
+	records := make([]*courier.ChannelLogRecord, 0, len(entries))
+	for _, e := range entries {
+		if e.db != nil {
+			r, err := e.db.record(dbChan.UUID())
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		} else {
+			r, err := b.getStorageChannelLog(ctx, dbChan.UUID(), e.st.uuid)
+			if err == courier.ErrChannelLogNotFound {
+				continue // index can outlive logs in storage
+			} else if err != nil {
+				return nil, err
+			}
+			r.IsError = e.st.isError
+			records = append(records, r)
+		}
+	}
+
+	return records, nil
+}
+
+// GetChannelLog returns the log with the passed in UUID for the passed in channel, looking first in the database and
+// then in storage
+func (b *backend) GetChannelLog(ctx context.Context, ch courier.Channel, uuid courier.ChannelLogUUID) (*courier.ChannelLogRecord, error) {
+	dbChan := ch.(*Channel)
+
+	dbLog := &dbChannelLog{}
+	err := b.db.GetContext(ctx, dbLog, sqlSelectChannelLog, dbChan.ID(), uuid)
+	if err == nil {
+		return dbLog.record(dbChan.UUID())
+	} else if err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "error querying channel log")
+	}
+
+	return b.getStorageChannelLog(ctx, dbChan.UUID(), uuid)
+}
+
+func (b *backend) getStorageChannelLog(ctx context.Context, channelUUID courier.ChannelUUID, uuid courier.ChannelLogUUID) (*courier.ChannelLogRecord, error) {
+	if len(uuid) < 4 {
+		return nil, courier.ErrChannelLogNotFound
+	}
+
+	l := &stChannelLog{UUID: uuid, ChannelUUID: channelUUID}
+	_, body, err := b.logStorage.Get(ctx, l.path())
+	if err != nil {
+		if isStorageNotFound(err) {
+			return nil, courier.ErrChannelLogNotFound
+		}
+		return nil, errors.Wrap(err, "error reading channel log from storage")
+	}
+
+	if err := json.Unmarshal(body, l); err != nil {
+		return nil, errors.Wrap(err, "error unmarshalling channel log from storage")
+	}
+
+	r := &courier.ChannelLogRecord{
+		UUID:        l.UUID,
+		Type:        l.Type,
+		ChannelUUID: channelUUID,
+		HTTPLogs:    l.HTTPLogs,
+		Errors:      make([]*courier.ChannelLogError, len(l.Errors)),
+		IsError:     len(l.Errors) > 0,
+		ElapsedMS:   l.ElapsedMS,
+		CreatedOn:   l.CreatedOn,
+		Retention:   l.Retention,
+	}
+	for i, e := range l.Errors {
+		r.Errors[i] = &courier.ChannelLogError{Code: e.Code, ExtCode: e.ExtCode, Message: e.Message}
+	}
+	for _, h := range l.HTTPLogs {
+		if h.StatusCode < 200 || h.StatusCode >= 400 {
+			r.IsError = true
+		}
+	}
+	return r, nil
+}
+
+func (l *dbChannelLog) record(channelUUID courier.ChannelUUID) (*courier.ChannelLogRecord, error) {
+	r := &courier.ChannelLogRecord{
+		UUID:        l.UUID,
+		Type:        l.Type,
+		ChannelUUID: channelUUID,
+		IsError:     l.IsError,
+		ElapsedMS:   l.ElapsedMS,
+		CreatedOn:   l.CreatedOn,
+	}
+	if err := json.Unmarshal(l.HTTPLogs, &r.HTTPLogs); err != nil {
+		return nil, errors.Wrap(err, "error unmarshalling channel log HTTP logs")
+	}
+	if err := json.Unmarshal(l.Errors, &r.Errors); err != nil {
+		return nil, errors.Wrap(err, "error unmarshalling channel log errors")
+	}
+	return r, nil
+}
+
+func isStorageNotFound(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
+	return &t
 }
@@ -0,0 +1,288 @@
+package rapidpro
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/redisx"
+	"github.com/pkg/errors"
+)
+
+// incoming msgs and channel events are sharded by URN across this many queues, so that each URN's items are processed
+// in order by whichever worker holds the lock on its shard. This can't change without draining the queues first.
+const inboundQueueShards = 32
+
+const (
+	inboundLockExpiry   = time.Minute
+	inboundBatchSize    = 100
+	inboundPollInterval = time.Millisecond * 500
+	inboundRetryBackoff = time.Second * 10
+	inboundWriteTimeout = time.Second * 30
+
+	// how many times an item can fail to be written before it's moved to the spool so it stops holding up its shard
+	inboundMaxAttempts = 5
+)
+
+const (
+	inboundTypeMsg   = "msg"
+	inboundTypeEvent = "event"
+)
+
+var errInvalidInboundItem = errors.New("invalid inbound item")
+
+// an incoming msg or channel event waiting to be written to the database, along with the type of the channel log of
+// the request it came from so that anything logged whilst writing it is logged the same way
+type inboundItem struct {
+	Type    string                 `json:"type"`
+	Data    json.RawMessage        `json:"data"`
+	LogType courier.ChannelLogType `json:"log_type,omitempty"`
+}
+
+func inboundQueueKey(shard int) string      { return fmt.Sprintf("inbound:%d", shard) }
+func inboundProcessingKey(shard int) string { return fmt.Sprintf("inbound:%d:processing", shard) }
+func inboundAttemptsKey(shard int) string   { return fmt.Sprintf("inbound:%d:attempts", shard) }
+func inboundLockKey(shard int) string       { return fmt.Sprintf("inbound:%d:lock", shard) }
+
+func inboundShard(urn urns.URN) int {
+	h := fnv.New32a()
+	h.Write([]byte(urn))
+	return int(h.Sum32() % inboundQueueShards)
+}
+
+// adds the given msg or channel event to the inbound queue for its URN
+func (b *backend) queueInbound(type_ string, urn urns.URN, v any, clog *courier.ChannelLog) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling inbound item")
+	}
+	item, _ := json.Marshal(&inboundItem{Type: type_, Data: data, LogType: clog.Type()})
+
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	_, err = rc.Do("LPUSH", inboundQueueKey(inboundShard(urn)), item)
+	return errors.Wrap(err, "error queueing inbound item")
+}
+
+// starts the workers which write queued msgs and channel events to the database
+func (b *backend) startInboundWorkers() {
+	workers := min(max(b.config.InboundWorkers, 1), inboundQueueShards)
+
+	for w := 0; w < workers; w++ {
+		// each worker looks after every nth shard
+		shards := make([]int, 0, inboundQueueShards/workers+1)
+		for s := w; s < inboundQueueShards; s += workers {
+			shards = append(shards, s)
+		}
+
+		b.waitGroup.Add(1)
+
+		go func(shards []int) {
+			defer b.waitGroup.Done()
+
+			retryAfter := make(map[int]time.Time, len(shards))
+
+			for {
+				processed := 0
+				for _, shard := range shards {
+					if time.Now().Before(retryAfter[shard]) {
+						continue
+					}
+
+					n, err := b.processInboundShard(shard, b.writeInboundItem)
+					if err != nil {
+						slog.Error("error processing inbound queue, will retry", "comp", "inbound", "shard", shard, "error", err)
+						retryAfter[shard] = time.Now().Add(inboundRetryBackoff)
+					}
+					processed += n
+				}
+
+				// if there was nothing to do, wait a bit before checking again
+				wait := time.Duration(0)
+				if processed == 0 {
+					wait = inboundPollInterval
+				}
+
+				select {
+				case <-b.stopChan:
+					return
+				case <-time.After(wait):
+				}
+			}
+		}(shards)
+	}
+
+	slog.Info("inbound workers started", "comp", "inbound", "state", "started", "workers", workers)
+}
+
+// processes up to a batch of items from the given shard if we can get its lock, returning how many were processed. An
+// item which errors is left in place to be retried, so that later items for the same URN aren't written before it,
+// unless it has reached our max attempts, in which case it's moved to the spool so the rest of the shard can proceed.
+func (b *backend) processInboundShard(shard int, process func([]byte) error) (int, error) {
+	locker := redisx.NewLocker(inboundLockKey(shard), inboundLockExpiry)
+
+	lock, err := locker.Grab(b.redisPool, 0)
+	if err != nil || lock == "" {
+		return 0, err // another worker has this shard
+	}
+	defer locker.Release(b.redisPool, lock)
+
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	processed := 0
+	for processed < inboundBatchSize {
+		// an item already in processing was being processed by a worker which died or errored, so is retried first
+		item, err := redis.Bytes(rc.Do("LINDEX", inboundProcessingKey(shard), 0))
+		if err == redis.ErrNil {
+			item, err = redis.Bytes(rc.Do("RPOPLPUSH", inboundQueueKey(shard), inboundProcessingKey(shard)))
+			if err == redis.ErrNil {
+				break
+			}
+		}
+		if err != nil {
+			return processed, errors.Wrap(err, "error reading inbound queue")
+		}
+
+		if err := process(item); err != nil {
+			attempts, aErr := redis.Int(rc.Do("INCR", inboundAttemptsKey(shard)))
+			if aErr != nil || attempts < inboundMaxAttempts {
+				return processed, err
+			}
+
+			if sErr := b.spoolInboundItem(item); sErr != nil {
+				return processed, errors.Wrapf(sErr, "error spooling inbound item which failed with: %s", err)
+			}
+			slog.Error("spooled inbound item which repeatedly failed to be written", "comp", "inbound", "shard", shard, "attempts", attempts, "error", err, "item", string(item))
+		}
+
+		if _, err := rc.Do("LPOP", inboundProcessingKey(shard)); err != nil {
+			return processed, errors.Wrap(err, "error removing processed inbound item")
+		}
+		if _, err := rc.Do("DEL", inboundAttemptsKey(shard)); err != nil {
+			return processed, errors.Wrap(err, "error clearing inbound item attempts")
+		}
+		processed++
+
+		if err := locker.Extend(b.redisPool, lock, inboundLockExpiry); err != nil {
+			return processed, errors.Wrap(err, "error extending inbound lock")
+		}
+	}
+
+	return processed, nil
+}
+
+// writes the given item to the spool, where it will be retried by the spool flushers for its type
+func (b *backend) spoolInboundItem(data []byte) error {
+	item := &inboundItem{}
+	if err := json.Unmarshal(data, item); err != nil {
+		return err
+	}
+
+	subdir := "msgs"
+	if item.Type == inboundTypeEvent {
+		subdir = "events"
+	}
+
+	if err := courier.WriteToSpool(b.config.SpoolDir, subdir, item.Data); err != nil {
+		return err
+	}
+
+	courier.RecordInboundSpooled(item.Type)
+	return nil
+}
+
+// writes a queued msg or channel event to the database. Items that can never be written are logged and dropped.
+func (b *backend) writeInboundItem(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), inboundWriteTimeout)
+	defer cancel()
+
+	var err error
+
+	item := &inboundItem{}
+	if err = json.Unmarshal(data, item); err == nil {
+		switch item.Type {
+		case inboundTypeMsg:
+			msg := &Msg{}
+			if err = json.Unmarshal(item.Data, msg); err == nil {
+				err = b.writeInboundMsg(ctx, msg, item.logType(courier.ChannelLogTypeMsgReceive))
+			} else {
+				err = fmt.Errorf("%w: %w", errInvalidInboundItem, err)
+			}
+		case inboundTypeEvent:
+			event := &ChannelEvent{}
+			if err = json.Unmarshal(item.Data, event); err == nil {
+				err = b.writeInboundChannelEvent(ctx, event, item.logType(courier.ChannelLogTypeEventReceive))
+			} else {
+				err = fmt.Errorf("%w: %w", errInvalidInboundItem, err)
+			}
+		default:
+			err = fmt.Errorf("%w: unknown type %s", errInvalidInboundItem, item.Type)
+		}
+	} else {
+		err = fmt.Errorf("%w: %w", errInvalidInboundItem, err)
+	}
+
+	if errors.Is(err, errInvalidInboundItem) || errors.Is(err, courier.ErrChannelNotFound) {
+		slog.Error("dropping inbound item which can't be written", "comp", "inbound", "error", err, "item", string(data))
+		return nil
+	}
+	return err
+}
+
+func (b *backend) writeInboundMsg(ctx context.Context, msg *Msg, logType courier.ChannelLogType) error {
+	channel, err := b.GetChannel(ctx, courier.AnyChannelType, msg.ChannelUUID_)
+	if err != nil {
+		return err
+	}
+	msg.channel = channel.(*Channel)
+
+	// contact and URN lookups are logged to a log of our own which is added to those of the msg
+	clog := courier.NewChannelLog(logType, channel, nil)
+	msg.LogUUIDs = append(msg.LogUUIDs, string(clog.UUID()))
+
+	err = writeMsgToDB(ctx, b, msg, clog)
+	b.writeInboundLog(ctx, clog)
+	return err
+}
+
+func (b *backend) writeInboundChannelEvent(ctx context.Context, event *ChannelEvent, logType courier.ChannelLogType) error {
+	channel, err := b.GetChannel(ctx, courier.AnyChannelType, event.ChannelUUID_)
+	if err != nil {
+		return err
+	}
+	event.channel = channel.(*Channel)
+
+	// contact and URN lookups are logged to a log of our own which is added to those of the event
+	clog := courier.NewChannelLog(logType, channel, nil)
+	event.LogUUIDs = append(event.LogUUIDs, string(clog.UUID()))
+
+	err = writeChannelEventToDB(ctx, b, event, clog)
+	b.writeInboundLog(ctx, clog)
+	return err
+}
+
+// writes the given log of writing a queued item if anything was logged to it
+func (b *backend) writeInboundLog(ctx context.Context, clog *courier.ChannelLog) {
+	if len(clog.HTTPLogs()) == 0 && len(clog.Errors()) == 0 {
+		return
+	}
+
+	clog.End()
+	b.WriteChannelLog(ctx, clog)
+}
+
+// returns the type of the log of the request this item came from, or the given default if it wasn't recorded
+func (i *inboundItem) logType(def courier.ChannelLogType) courier.ChannelLogType {
+	if i.LogType != "" && i.LogType != courier.ChannelLogTypeUnknown {
+		return i.LogType
+	}
+	return def
+}
@@ -1,15 +1,15 @@
 package rapidpro
 
 import (
+	"bufio"
 	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"log/slog"
-	"os"
 	"strings"
 	"time"
 
@@ -22,6 +22,7 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/null/v3"
+	"github.com/nyaruka/redisx"
 	"github.com/pkg/errors"
 	filetype "gopkg.in/h2non/filetype.v1"
 )
@@ -86,6 +87,7 @@ type Msg struct {
 	OptIn_                *courier.OptInReference `json:"optin"`
 	Origin_               courier.MsgOrigin       `json:"origin"`
 	ContactLastSeenOn_    *time.Time              `json:"contact_last_seen_on"`
+	SendAfter_            *time.Time              `json:"send_after,omitempty"`
 
 	// extra fields used to allow courier to update a session's timeout to *after* the message has been sent
 	SessionID_            SessionID  `json:"session_id"`
@@ -93,11 +95,17 @@ type Msg struct {
 	SessionWaitStartedOn_ *time.Time `json:"session_wait_started_on"`
 	SessionStatus_        string     `json:"session_status"`
 
+	// extra field used by courier itself when it requeues a message that errored to be retried
+	RetryCount_ int `json:"retry_count,omitempty"`
+
 	ContactName_   string            `json:"contact_name"`
 	URNAuthTokens_ map[string]string `json:"auth_tokens"`
 	channel        *Channel
 	workerToken    queue.WorkerToken
 	alreadyWritten bool
+	fingerprint    string                // provider specific fingerprint set by the handler for deduping
+	dedupedBy      courier.MsgDedupeMode // how this msg was found to be a duplicate, if it was
+	attachmentURLs []string              // attachments with references to private storage resolved, set when popped to be sent
 }
 
 // newMsg creates a new DBMsg object with the passed in parameters
@@ -138,10 +146,18 @@ func (m *Msg) ID() courier.MsgID        { return m.ID_ }
 func (m *Msg) UUID() courier.MsgUUID    { return m.UUID_ }
 func (m *Msg) ExternalID() string       { return string(m.ExternalID_) }
 func (m *Msg) Text() string             { return m.Text_ }
-func (m *Msg) Attachments() []string    { return m.Attachments_ }
 func (m *Msg) URN() urns.URN            { return m.URN_ }
 func (m *Msg) Channel() courier.Channel { return m.channel }
 
+// Attachments returns the attachments of this message, with any references to private storage resolved if this is an
+// outgoing message being sent
+func (m *Msg) Attachments() []string {
+	if m.attachmentURLs != nil {
+		return m.attachmentURLs
+	}
+	return m.Attachments_
+}
+
 // outgoing specific
 func (m *Msg) QuickReplies() []string        { return m.QuickReplies_ }
 func (m *Msg) Locale() i18n.Locale           { return i18n.Locale(string(m.Locale_)) }
@@ -165,6 +181,8 @@ func (m *Msg) Flow() *courier.FlowReference   { return m.Flow_ }
 func (m *Msg) OptIn() *courier.OptInReference { return m.OptIn_ }
 func (m *Msg) SessionStatus() string          { return m.SessionStatus_ }
 func (m *Msg) HighPriority() bool             { return m.HighPriority_ }
+func (m *Msg) SendAfter() *time.Time          { return m.SendAfter_ }
+func (m *Msg) RetryCount() int                { return m.RetryCount_ }
 
 // incoming specific
 func (m *Msg) ReceivedOn() *time.Time { return m.SentOn_ }
@@ -178,6 +196,11 @@ func (m *Msg) WithURNAuthTokens(tokens map[string]string) courier.MsgIn {
 	return m
 }
 func (m *Msg) WithReceivedOn(date time.Time) courier.MsgIn { m.SentOn_ = &date; return m }
+func (m *Msg) WithFingerprint(fingerprint string) courier.MsgIn {
+	m.fingerprint = fingerprint
+	return m
+}
+func (m *Msg) DedupedBy() courier.MsgDedupeMode { return m.dedupedBy }
 
 func (m *Msg) hash() string {
 	hash := sha1.Sum([]byte(m.Text_ + "|" + strings.Join(m.Attachments_, "|")))
@@ -187,26 +210,39 @@ func (m *Msg) hash() string {
 // WriteMsg creates a message given the passed in arguments
 func writeMsg(ctx context.Context, b *backend, msg courier.MsgIn, clog *courier.ChannelLog) error {
 	m := msg.(*Msg)
+	channel := m.Channel()
+
+	// msgs on channels deduped by fingerprint can only be checked now that the handler has had a chance to set one
+	if b.dedupePolicy.ForChannel(channel).Mode == courier.MsgDedupeFingerprint {
+		b.dedupeMsg(m)
+	}
 
 	// this msg has already been written (we received it twice), we are a no op
 	if m.alreadyWritten {
 		return nil
 	}
 
-	channel := m.Channel()
+	if err := b.checkInboundLimits(ctx, channel, m.URN_); err != nil {
+		return err
+	}
 
 	// check for data: attachment URLs which need to be fetched now - fetching of other URLs can be deferred until
 	// message handling and performed by calling the /c/_fetch-attachment endpoint
 	for i, attURL := range m.Attachments_ {
 		if strings.HasPrefix(attURL, "data:") {
-			attData, err := base64.StdEncoding.DecodeString(attURL[5:])
-			if err != nil {
+			// decode as we stream to storage rather than holding a decoded copy in memory
+			attData := &decodeReader{r: base64.NewDecoder(base64.StdEncoding, strings.NewReader(attURL[5:]))}
+			attBody := bufio.NewReader(attData)
+
+			// sniff our content type from the start of the decoded data
+			prefix, _ := attBody.Peek(300)
+			if attData.err != nil {
 				clog.Error(courier.ErrorAttachmentNotDecodable())
-				return errors.Wrap(err, "unable to decode attachment data")
+				return errors.Wrap(attData.err, "unable to decode attachment data")
 			}
 
 			var contentType, extension string
-			fileType, _ := filetype.Match(attData[:300])
+			fileType, _ := filetype.Match(prefix)
 			if fileType != filetype.Unknown {
 				contentType = fileType.MIME.Value
 				extension = fileType.Extension
@@ -215,7 +251,11 @@ func writeMsg(ctx context.Context, b *backend, msg courier.MsgIn, clog *courier.
 				extension = "bin"
 			}
 
-			newURL, err := b.SaveAttachment(ctx, channel, contentType, attData, extension)
+			newURL, err := b.SaveAttachment(ctx, channel, contentType, attBody, extension)
+			if attData.err != nil {
+				clog.Error(courier.ErrorAttachmentNotDecodable())
+				return errors.Wrap(attData.err, "unable to decode attachment data")
+			}
 			if err != nil {
 				return err
 			}
@@ -223,12 +263,22 @@ func writeMsg(ctx context.Context, b *backend, msg courier.MsgIn, clog *courier.
 		}
 	}
 
-	// try to write it our db
-	err := writeMsgToDB(ctx, b, m, clog)
+	var err error
 
-	// fail? log
-	if err != nil {
-		slog.Error("error writing to db", "error", err, "msg", m.UUID())
+	if b.config.InboundQueue {
+		// queue it for an inbound worker to write to our db
+		err = b.queueInbound(inboundTypeMsg, m.URN_, m, clog)
+		if err != nil {
+			slog.Error("error queueing incoming msg", "error", err, "msg", m.UUID())
+		}
+	} else {
+		// try to write it our db
+		err = writeMsgToDB(ctx, b, m, clog)
+
+		// fail? log
+		if err != nil {
+			slog.Error("error writing to db", "error", err, "msg", m.UUID())
+		}
 	}
 
 	// if we failed write to spool
@@ -236,8 +286,10 @@ func writeMsg(ctx context.Context, b *backend, msg courier.MsgIn, clog *courier.
 		err = courier.WriteToSpool(b.config.SpoolDir, "msgs", m)
 	}
 
-	// mark this msg as having been seen
-	b.recordMsgReceived(m)
+	// mark this msg as having been seen, unless we couldn't spool it either and so the sender will need to retry
+	if err == nil {
+		b.recordMsgReceived(m)
+	}
 
 	return err
 }
@@ -292,6 +344,20 @@ func writeMsgToDB(ctx context.Context, b *backend, m *Msg, clog *courier.Channel
 // Msg flusher for flushing failed writes
 //-----------------------------------------------------------------------------
 
+// spooled msgs are flushed in the order they were received for each URN so that conversations aren't reordered
+func spooledMsgOrder(contents []byte) (string, time.Time, error) {
+	msg := &Msg{}
+	if err := json.Unmarshal(contents, msg); err != nil {
+		return "", time.Time{}, err
+	}
+
+	receivedOn := msg.CreatedOn_
+	if msg.SentOn_ != nil {
+		receivedOn = *msg.SentOn_
+	}
+	return string(msg.URN_), receivedOn, nil
+}
+
 func (b *backend) flushMsgFile(filename string, contents []byte) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
@@ -299,9 +365,7 @@ func (b *backend) flushMsgFile(filename string, contents []byte) error {
 	msg := &Msg{}
 	err := json.Unmarshal(contents, msg)
 	if err != nil {
-		log.Printf("ERROR unmarshalling spool file '%s', renaming: %s\n", filename, err)
-		os.Rename(filename, fmt.Sprintf("%s.error", filename))
-		return nil
+		return fmt.Errorf("%w: %w", courier.ErrInvalidSpoolFile, err)
 	}
 
 	// look up our channel
@@ -325,55 +389,124 @@ func (b *backend) flushMsgFile(filename string, contents []byte) error {
 // Deduping utility methods
 //-----------------------------------------------------------------------------
 
-// checks to see if this message has already been received and if so returns its UUID
-func (b *backend) checkMsgAlreadyReceived(msg *Msg) courier.MsgUUID {
-	rc := b.redisPool.Get()
-	defer rc.Close()
+// the windows msgs were deduped over before they were configurable, whose interval hashes keep their original keys
+const (
+	defaultDedupeContentWindow = time.Second * 2
+	defaultDedupeIDWindow      = time.Hour * 24
+)
 
-	// if we have an external id use that
-	if msg.ExternalID_ != "" {
-		fingerprint := fmt.Sprintf("%s|%s|%s", msg.Channel().UUID(), msg.URN().Identity(), msg.ExternalID())
+// gets the interval hash which tracks msgs received over the given window, e.g. a window of 2 seconds tracks msgs for
+// 2 - 4 seconds
+func receivedMsgsHash(keyBase string, window, defaultWindow time.Duration) *redisx.IntervalHash {
+	if window != defaultWindow {
+		keyBase = fmt.Sprintf("%s-%d", keyBase, int(window/time.Second))
+	}
+	return redisx.NewIntervalHash(keyBase, window, 2)
+}
+
+// msgTracker is how a received msg is tracked so that it can be deduped
+type msgTracker struct {
+	mode  courier.MsgDedupeMode // external_id, content or fingerprint
+	hash  *redisx.IntervalHash
+	field string
+	value string
+}
 
-		if uuid, _ := b.receivedExternalIDs.Get(rc, fingerprint); uuid != "" {
-			return courier.MsgUUID(uuid)
+// gets how the given msg is tracked for deduping, or nil if it isn't deduped
+func (b *backend) msgTracker(msg *Msg) *msgTracker {
+	dedupe := b.dedupePolicy.ForChannel(msg.Channel())
+	channelAndURN := fmt.Sprintf("%s|%s", msg.Channel().UUID(), msg.URN().Identity())
+	mode := dedupe.Mode
+
+	// msgs without a fingerprint or on channels which dedupe automatically use their external ID if they have one
+	if mode == courier.MsgDedupeFingerprint && msg.fingerprint != "" {
+		return &msgTracker{mode, receivedMsgsHash("seen-fingerprints", dedupe.IDWindow, defaultDedupeIDWindow), channelAndURN + "|" + msg.fingerprint, string(msg.UUID())}
+	} else if mode == courier.MsgDedupeFingerprint || mode == courier.MsgDedupeAuto {
+		if msg.ExternalID_ != "" {
+			mode = courier.MsgDedupeExternalID
+		} else {
+			mode = courier.MsgDedupeContent
 		}
-	} else {
-		// otherwise de-dup based on text received from that channel+urn since last send
-		fingerprint := fmt.Sprintf("%s|%s", msg.Channel().UUID(), msg.URN().Identity())
+	}
 
-		if uuidAndHash, _ := b.receivedMsgs.Get(rc, fingerprint); uuidAndHash != "" {
-			prevUUID := uuidAndHash[:36]
-			prevHash := uuidAndHash[37:]
+	switch mode {
+	case courier.MsgDedupeExternalID:
+		if msg.ExternalID_ != "" {
+			return &msgTracker{mode, receivedMsgsHash("seen-external-ids", dedupe.IDWindow, defaultDedupeIDWindow), channelAndURN + "|" + msg.ExternalID(), string(msg.UUID())}
+		}
+	case courier.MsgDedupeContent:
+		// content is tracked since the last msg sent to the URN, so only one field per channel and URN
+		return &msgTracker{mode, receivedMsgsHash("seen-msgs", dedupe.ContentWindow, defaultDedupeContentWindow), channelAndURN, fmt.Sprintf("%s|%s", msg.UUID(), msg.hash())}
+	}
+	return nil
+}
 
-			// if it is the same hash, return the UUID
-			if prevHash == msg.hash() {
-				return courier.MsgUUID(prevUUID)
-			}
+// checks to see if this message has already been received and if so returns its UUID and how it was deduped
+func (b *backend) checkMsgAlreadyReceived(msg *Msg) (courier.MsgUUID, courier.MsgDedupeMode) {
+	tracker := b.msgTracker(msg)
+	if tracker == nil {
+		return courier.NilMsgUUID, ""
+	}
+
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	value, _ := tracker.hash.Get(rc, tracker.field)
+	if value == "" {
+		return courier.NilMsgUUID, ""
+	}
+
+	// msgs tracked by content are only duplicates if they have the same hash
+	if tracker.mode == courier.MsgDedupeContent {
+		if len(value) < 37 || value[37:] != msg.hash() {
+			return courier.NilMsgUUID, ""
 		}
+		value = value[:36]
 	}
 
-	return courier.NilMsgUUID
+	return courier.MsgUUID(value), tracker.mode
+}
+
+// checks if this message could be a duplicate and if so uses the original's UUID and marks it as already written
+func (b *backend) dedupeMsg(msg *Msg) {
+	if prevUUID, mode := b.checkMsgAlreadyReceived(msg); prevUUID != courier.NilMsgUUID {
+		msg.UUID_ = prevUUID
+		msg.alreadyWritten = true
+		msg.dedupedBy = mode
+	}
 }
 
 // records that the given message has been received and written to the database
 func (b *backend) recordMsgReceived(msg *Msg) {
+	tracker := b.msgTracker(msg)
+	if tracker == nil {
+		return
+	}
+
 	rc := b.redisPool.Get()
 	defer rc.Close()
 
-	if msg.ExternalID_ != "" {
-		fingerprint := fmt.Sprintf("%s|%s|%s", msg.Channel().UUID(), msg.URN().Identity(), msg.ExternalID())
-
-		b.receivedExternalIDs.Set(rc, fingerprint, string(msg.UUID()))
-	} else {
-		fingerprint := fmt.Sprintf("%s|%s", msg.Channel().UUID(), msg.URN().Identity())
-
-		b.receivedMsgs.Set(rc, fingerprint, fmt.Sprintf("%s|%s", msg.UUID(), msg.hash()))
-	}
+	tracker.hash.Set(rc, tracker.field, tracker.value)
 }
 
 // clearMsgSeen clears our seen incoming messages for the passed in channel and URN
 func (b *backend) clearMsgSeen(rc redis.Conn, msg *Msg) {
 	fingerprint := fmt.Sprintf("%s|%s", msg.Channel().UUID(), msg.URN().Identity())
+	window := b.dedupePolicy.ForChannel(msg.Channel()).ContentWindow
+
+	receivedMsgsHash("seen-msgs", window, defaultDedupeContentWindow).Del(rc, fingerprint)
+}
+
+// reader which records any error from the reader it wraps, other than EOF
+type decodeReader struct {
+	r   io.Reader
+	err error
+}
 
-	b.receivedMsgs.Del(rc, fingerprint)
+func (r *decodeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
 }
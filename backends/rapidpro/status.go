@@ -5,14 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/gocommon/dbutil"
-	"github.com/nyaruka/gocommon/syncx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/pkg/errors"
 )
@@ -121,9 +119,7 @@ func (b *backend) flushStatusFile(filename string, contents []byte) error {
 	status := &StatusUpdate{}
 	err := json.Unmarshal(contents, status)
 	if err != nil {
-		slog.Info(fmt.Sprintf("ERROR unmarshalling spool file '%s', renaming: %s\n", filename, err))
-		os.Rename(filename, fmt.Sprintf("%s.error", filename))
-		return nil
+		return fmt.Errorf("%w: %w", courier.ErrInvalidSpoolFile, err)
 	}
 
 	// try to flush to our db
@@ -164,13 +160,13 @@ func (s *StatusUpdate) SetStatus(status courier.MsgStatus) { s.Status_ = status
 
 // StatusWriter handles batched writes of status updates to the database
 type StatusWriter struct {
-	*syncx.Batcher[*StatusUpdate]
+	*batchWriter[*StatusUpdate]
 }
 
 // NewStatusWriter creates a new status update writer
 func NewStatusWriter(b *backend, spoolDir string, wg *sync.WaitGroup) *StatusWriter {
 	return &StatusWriter{
-		Batcher: syncx.NewBatcher[*StatusUpdate](func(batch []*StatusUpdate) {
+		batchWriter: newBatchWriter[*StatusUpdate](func(batch []*StatusUpdate) {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 			defer cancel()
 
@@ -0,0 +1,45 @@
+package rapidpro
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyaruka/gocommon/syncx"
+)
+
+// batchWriter is a batcher which tracks how many of the values queued on it are still to be processed, so that
+// callers can wait for it to be flushed without stopping it
+type batchWriter[T any] struct {
+	*syncx.Batcher[T]
+	pending atomic.Int64
+}
+
+func newBatchWriter[T any](process func(batch []T), maxItems int, maxAge time.Duration, bufferSize int, wg *sync.WaitGroup) *batchWriter[T] {
+	w := &batchWriter[T]{}
+	w.Batcher = syncx.NewBatcher[T](func(batch []T) {
+		defer w.pending.Add(-int64(len(batch)))
+
+		process(batch)
+	}, maxItems, maxAge, bufferSize, wg)
+	return w
+}
+
+// Queue queues the given value, potentially blocking. Returns the new free capacity (batch + buffer).
+func (w *batchWriter[T]) Queue(value T) int {
+	w.pending.Add(1)
+	return w.Batcher.Queue(value)
+}
+
+// Flush waits until all queued values have been processed or the passed in context is done
+func (w *batchWriter[T]) Flush(ctx context.Context) error {
+	for w.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package rapidpro
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchWriter(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	processed := make([]int, 0)
+
+	w := newBatchWriter[int](func(batch []int) {
+		time.Sleep(100 * time.Millisecond)
+		processed = append(processed, batch...)
+	}, 10, time.Millisecond*500, 10, wg)
+	w.Start()
+	defer func() { w.Stop(); wg.Wait() }()
+
+	// flushing an empty writer returns immediately
+	assert.NoError(t, w.Flush(context.Background()))
+
+	w.Queue(1)
+	w.Queue(2)
+	w.Queue(3)
+
+	// flushing waits for our batch to be processed
+	assert.NoError(t, w.Flush(context.Background()))
+	assert.Equal(t, []int{1, 2, 3}, processed)
+
+	// unless our context is done first
+	w.Queue(4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, w.Flush(ctx))
+}
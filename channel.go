@@ -9,6 +9,9 @@ import (
 )
 
 const (
+	// ConfigAllowedNetworks is the list of IP addresses and networks which incoming requests for a channel must come from
+	ConfigAllowedNetworks = "allowed_networks"
+
 	// ConfigAPIKey is a constant key for channel configs
 	ConfigAPIKey = "api_key"
 
@@ -24,12 +27,45 @@ const (
 	// ConfigContentType is a constant key for channel configs
 	ConfigContentType = "content_type"
 
+	// ConfigDedupeContentWindow is the minimum number of seconds incoming msgs on a channel are deduped by content
+	ConfigDedupeContentWindow = "dedupe_content_window"
+
+	// ConfigDedupeIDWindow is the minimum number of seconds incoming msgs on a channel are deduped by external ID or fingerprint
+	ConfigDedupeIDWindow = "dedupe_id_window"
+
+	// ConfigDedupeMode is how incoming msgs on a channel are deduped
+	ConfigDedupeMode = "dedupe_mode"
+
+	// ConfigInboundChannelLimit is the maximum number of incoming msgs and channel events per minute for a channel
+	ConfigInboundChannelLimit = "inbound_channel_limit"
+
+	// ConfigInboundURNLimit is the maximum number of incoming msgs and channel events per minute from a single URN on a channel
+	ConfigInboundURNLimit = "inbound_urn_limit"
+
+	// ConfigLogBodyLimit is the maximum length of request and response traces in logs of successful interactions
+	ConfigLogBodyLimit = "log_body_limit"
+
+	// ConfigLogDropHeaders is whether request and response headers should be dropped from logs
+	ConfigLogDropHeaders = "log_drop_headers"
+
+	// ConfigLogErrorBodyLimit is the maximum length of request and response traces in logs of failed interactions
+	ConfigLogErrorBodyLimit = "log_error_body_limit"
+
+	// ConfigLogSampleRate is the fraction of logs of successful interactions with a channel that are kept
+	ConfigLogSampleRate = "log_sample_rate"
+
+	// ConfigMaxConcurrency is the maximum number of messages that will be sent on a channel at the same time
+	ConfigMaxConcurrency = "max_concurrency"
+
 	// ConfigMaxLength is the maximum size of a message in characters
 	ConfigMaxLength = "max_length"
 
 	// ConfigPassword is a constant key for channel configs
 	ConfigPassword = "password"
 
+	// ConfigQuietHours is the daily period during which scheduled messages shouldn't be sent on a channel
+	ConfigQuietHours = "quiet_hours"
+
 	// ConfigSecret is the secret used for signing commands by the channel
 	ConfigSecret = "secret"
 
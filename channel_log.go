@@ -2,8 +2,12 @@ package courier
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
@@ -14,6 +18,14 @@ import (
 // ChannelLogUUID is our type for a channel log UUID
 type ChannelLogUUID uuids.UUID
 
+// the mask which redacted values are replaced with
+const redactMask = "**********"
+
+const (
+	logURLLimit         = 2048
+	defaultLogBodyLimit = 50000
+)
+
 // ChannelLogType is the type of channel interaction we are logging
 type ChannelLogType string
 
@@ -72,6 +84,26 @@ func ErrorAttachmentNotDecodable() *ChannelError {
 	return NewChannelError("attachment_not_decodable", "", "Unable to decode embedded attachment data.")
 }
 
+func ErrorSourceNotAllowed(ip string) *ChannelError {
+	return NewChannelError("source_not_allowed", "", "Request from %s is not from an allowed network.", ip)
+}
+
+func ErrorInboundLimitExceeded(scope InboundLimitScope) *ChannelError {
+	return NewChannelError("inbound_limit_exceeded", "", "Inbound rate limit for %s exceeded.", scope)
+}
+
+func ErrorAttachmentTooLarge(maxBytes int) *ChannelError {
+	return NewChannelError("attachment_too_large", "", "Attachment exceeds the maximum size of %d bytes.", maxBytes)
+}
+
+func ErrorAttachmentTypeNotAllowed(contentType string) *ChannelError {
+	return NewChannelError("attachment_type_not_allowed", "", "Attachment type %s is not allowed.", contentType)
+}
+
+func ErrorAttachmentMalware(threat string) *ChannelError {
+	return NewChannelError("attachment_malware", "", "Attachment was rejected by malware scan: %s.", threat)
+}
+
 func ErrorExternal(code, message string) *ChannelError {
 	if message == "" {
 		message = fmt.Sprintf("Service specific error: %s.", code)
@@ -79,6 +111,14 @@ func ErrorExternal(code, message string) *ChannelError {
 	return NewChannelError("external", code, message)
 }
 
+func ErrorSendRetrying(attempt, maxAttempts int, delay time.Duration) *ChannelError {
+	return NewChannelError("send_retrying", "", "Send attempt %d of %d errored, will retry in %s.", attempt, maxAttempts, delay)
+}
+
+func ErrorSendAttemptsExhausted(attempts int) *ChannelError {
+	return NewChannelError("send_attempts_exhausted", "", "Send failed after %d attempts.", attempts)
+}
+
 func (e *ChannelError) Redact(r stringsx.Redactor) *ChannelError {
 	return &ChannelError{code: e.code, extCode: e.extCode, message: r(e.message)}
 }
@@ -104,10 +144,27 @@ type ChannelLog struct {
 	errors    []*ChannelError
 	createdOn time.Time
 	elapsed   time.Duration
+	attempt   int
+
+	retryAfter time.Duration
 
 	attached bool
 	recorder *httpx.Recorder
 	redactor stringsx.Redactor
+
+	sampleRate     float64
+	bodyLimit      int
+	errorBodyLimit int
+	dropHeaders    bool
+	retention      ChannelLogRetention
+}
+
+// ChannelLogRetention records how a log was sampled and trimmed before being written
+type ChannelLogRetention struct {
+	SampleRate     float64 `json:"sample_rate,omitempty"`     // fraction of success logs kept if this log was sampled
+	BodyLimit      int     `json:"body_limit,omitempty"`      // length that traces were truncated to if any were
+	Truncated      bool    `json:"truncated,omitempty"`       // whether any request or response trace was truncated
+	HeadersDropped bool    `json:"headers_dropped,omitempty"` // whether headers were dropped from traces
 }
 
 // NewChannelLogForIncoming creates a new channel log for an incoming request, the type of which won't be known
@@ -132,15 +189,29 @@ func NewChannelLog(t ChannelLogType, ch Channel, redactVals []string) *ChannelLo
 }
 
 func newChannelLog(t ChannelLogType, ch Channel, r *httpx.Recorder, attached bool, redactVals []string) *ChannelLog {
-	return &ChannelLog{
+	l := &ChannelLog{
 		uuid:      ChannelLogUUID(uuids.New()),
 		type_:     t,
 		channel:   ch,
 		recorder:  r,
 		createdOn: dates.Now(),
+		attached:  attached,
+
+		redactor: stringsx.NewRedactor(redactMask, redactVals...),
+
+		sampleRate:     1,
+		bodyLimit:      defaultLogBodyLimit,
+		errorBodyLimit: defaultLogBodyLimit,
+	}
 
-		redactor: stringsx.NewRedactor("**********", redactVals...),
+	if ch != nil {
+		l.sampleRate = min(max(floatConfigForKey(ch, ConfigLogSampleRate, 1), 0), 1)
+		l.bodyLimit = max(ch.IntConfigForKey(ConfigLogBodyLimit, defaultLogBodyLimit), 3)
+		l.errorBodyLimit = max(ch.IntConfigForKey(ConfigLogErrorBodyLimit, max(l.bodyLimit, defaultLogBodyLimit)), 3)
+		l.dropHeaders = ch.BoolConfigForKey(ConfigLogDropHeaders, false)
 	}
+
+	return l
 }
 
 // HTTP logs an outgoing HTTP request and response
@@ -190,6 +261,26 @@ func (l *ChannelLog) SetAttached(a bool) {
 	l.attached = a
 }
 
+// Attempt returns which attempt at sending a message this log is for, zero if it isn't a send log
+func (l *ChannelLog) Attempt() int {
+	return l.attempt
+}
+
+func (l *ChannelLog) SetAttempt(a int) {
+	l.attempt = a
+}
+
+// RetryAfter returns how long the channel's provider asked us to wait before sending again, zero if it didn't
+func (l *ChannelLog) RetryAfter() time.Duration {
+	return l.retryAfter
+}
+
+// SetRetryAfter records that the channel's provider rate limited us, this is done automatically for HTTP requests made
+// by handlers which get a 429 response
+func (l *ChannelLog) SetRetryAfter(d time.Duration) {
+	l.retryAfter = d
+}
+
 func (l *ChannelLog) HTTPLogs() []*httpx.Log {
 	return l.httpLogs
 }
@@ -221,6 +312,121 @@ func (l *ChannelLog) IsError() bool {
 	return false
 }
 
+// Record returns a copy of this log as a record, as if it had been written and read back
+func (l *ChannelLog) Record() *ChannelLogRecord {
+	httpLogs := make([]*httpx.Log, len(l.httpLogs))
+	for i, h := range l.httpLogs {
+		lwt := *h.LogWithoutTime
+		httpLogs[i] = &httpx.Log{LogWithoutTime: &lwt, CreatedOn: h.CreatedOn}
+	}
+	errs := make([]*ChannelLogError, len(l.errors))
+	for i, e := range l.errors {
+		errs[i] = &ChannelLogError{Code: e.Code(), ExtCode: e.ExtCode(), Message: e.Message()}
+	}
+
+	return &ChannelLogRecord{
+		UUID:        l.uuid,
+		Type:        l.type_,
+		ChannelUUID: l.channel.UUID(),
+		HTTPLogs:    httpLogs,
+		Errors:      errs,
+		IsError:     l.IsError(),
+		ElapsedMS:   int(l.elapsed / time.Millisecond),
+		CreatedOn:   l.createdOn,
+		Retention:   l.Retention(),
+	}
+}
+
+// Retain applies the channel's retention settings to this log before it's written, returning false if it has been
+// sampled out. Only logs of successful interactions are sampled or trimmed to the channel's success body limit, and
+// only if they're attached to a message, as otherwise they are the only record of that interaction.
+func (l *ChannelLog) Retain() bool {
+	if l.IsError() {
+		return true
+	}
+
+	if l.attached && l.sampleRate < 1 {
+		if !sampleChannelLog(l.uuid, l.sampleRate) {
+			return false
+		}
+		l.retention.SampleRate = l.sampleRate
+	}
+
+	if l.bodyLimit < l.errorBodyLimit {
+		for _, h := range l.httpLogs {
+			h.Request = l.truncateTrace(h.Request, l.bodyLimit)
+			h.Response = l.truncateTrace(h.Response, l.bodyLimit)
+		}
+	}
+
+	return true
+}
+
+// Retention returns how this log was sampled and trimmed, or nil if it was kept as is
+func (l *ChannelLog) Retention() *ChannelLogRetention {
+	if l.retention == (ChannelLogRetention{}) {
+		return nil
+	}
+	r := l.retention
+	return &r
+}
+
 func (l *ChannelLog) traceToLog(t *httpx.Trace) *httpx.Log {
-	return httpx.NewLog(t, 2048, 50000, l.redactor)
+	// truncate traces ourselves so that we can record if we did
+	log := httpx.NewLog(t, logURLLimit, math.MaxInt32, l.redactor)
+
+	if l.dropHeaders {
+		log.Request = dropTraceHeaders(log.Request)
+		log.Response = dropTraceHeaders(log.Response)
+		l.retention.HeadersDropped = true
+	}
+
+	// we don't yet know if this log will be an error so use the larger limit for now
+	log.Request = l.truncateTrace(log.Request, l.errorBodyLimit)
+	log.Response = l.truncateTrace(log.Response, l.errorBodyLimit)
+	return log
+}
+
+func (l *ChannelLog) truncateTrace(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	l.retention.Truncated = true
+	l.retention.BodyLimit = limit
+	return stringsx.TruncateEllipsis(s, limit)
+}
+
+// drops the headers from an HTTP request or response trace leaving the request or status line and the body
+func dropTraceHeaders(trace string) string {
+	firstLine, rest, found := strings.Cut(trace, "\r\n")
+	if !found {
+		return trace
+	}
+	_, body, found := strings.Cut(rest, "\r\n\r\n")
+	if !found {
+		return firstLine + "\r\n\r\n"
+	}
+	return firstLine + "\r\n\r\n" + body
+}
+
+// samples logs by their UUID so that the decision is stable for a given log
+func sampleChannelLog(uuid ChannelLogUUID, rate float64) bool {
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	return float64(h.Sum32()%10000) < rate*10000
+}
+
+// gets a float config value for a channel, which may have been set as a number or a string
+func floatConfigForKey(ch Channel, key string, defaultValue float64) float64 {
+	switch v := ch.ConfigForKey(key, defaultValue).(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
 }
@@ -0,0 +1,82 @@
+package courier
+
+import (
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/stringsx"
+	"github.com/pkg/errors"
+)
+
+// ErrChannelLogNotFound is returned when a channel log can't be found in any of the backend's log stores
+var ErrChannelLogNotFound = errors.New("channel log not found")
+
+const (
+	defaultChannelLogQueryLimit = 50
+	maxChannelLogQueryLimit     = 500
+)
+
+// ChannelLogQuery describes which of a channel's recent logs to fetch
+type ChannelLogQuery struct {
+	Type    ChannelLogType // only logs of this type if non-empty
+	IsError *bool          // only error or non-error logs if non-nil
+	After   time.Time      // only logs created on or after this time if non-zero
+	Before  time.Time      // only logs created before this time if non-zero
+	Limit   int
+}
+
+// Matches returns whether a log with the given attributes matches this query
+func (q *ChannelLogQuery) Matches(type_ ChannelLogType, isError bool, createdOn time.Time) bool {
+	if q.Type != "" && type_ != q.Type {
+		return false
+	}
+	if q.IsError != nil && isError != *q.IsError {
+		return false
+	}
+	if !q.After.IsZero() && createdOn.Before(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !createdOn.Before(q.Before) {
+		return false
+	}
+	return true
+}
+
+// ChannelLogError is an error in a channel log which has been read back from a backend
+type ChannelLogError struct {
+	Code    string `json:"code"`
+	ExtCode string `json:"ext_code,omitempty"`
+	Message string `json:"message"`
+}
+
+// ChannelLogRecord is a channel log which has been read back from a backend
+type ChannelLogRecord struct {
+	UUID        ChannelLogUUID       `json:"uuid"`
+	Type        ChannelLogType       `json:"type"`
+	ChannelUUID ChannelUUID          `json:"channel_uuid"`
+	HTTPLogs    []*httpx.Log         `json:"http_logs"`
+	Errors      []*ChannelLogError   `json:"errors"`
+	IsError     bool                 `json:"is_error"`
+	ElapsedMS   int                  `json:"elapsed_ms"`
+	CreatedOn   time.Time            `json:"created_on"`
+	Retention   *ChannelLogRetention `json:"retention,omitempty"`
+}
+
+// Redact redacts the passed in values from the HTTP logs and errors of this log. Logs are redacted when they're
+// written but we redact again when reading them back in case a channel's secrets have changed since.
+func (r *ChannelLogRecord) Redact(vals []string) {
+	if len(vals) == 0 {
+		return
+	}
+
+	redact := stringsx.NewRedactor(redactMask, vals...)
+
+	for _, l := range r.HTTPLogs {
+		l.URL = redact(l.URL)
+		l.Request = redact(l.Request)
+		l.Response = redact(l.Response)
+	}
+	for _, e := range r.Errors {
+		e.Message = redact(e.Message)
+	}
+}
@@ -0,0 +1,107 @@
+package courier
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ChannelLogSubscription is a live subscription to the logs of a channel as they are written
+type ChannelLogSubscription struct {
+	channelUUID ChannelUUID
+	logs        chan *ChannelLogRecord
+	dropped     atomic.Int64
+	closeOnce   sync.Once
+}
+
+var channelLogSubs = struct {
+	sync.RWMutex
+	byChannel map[ChannelUUID]map[*ChannelLogSubscription]bool
+}{byChannel: make(map[ChannelUUID]map[*ChannelLogSubscription]bool)}
+
+// number of open subscriptions so that publishing can return without locking when there are none
+var channelLogSubsCount atomic.Int64
+
+// SubscribeChannelLogs subscribes to the logs of the given channel. Logs are dropped rather than blocking writers if
+// the subscriber falls more than buffer logs behind. Callers must call Close when done.
+func SubscribeChannelLogs(channelUUID ChannelUUID, buffer int) *ChannelLogSubscription {
+	s := &ChannelLogSubscription{channelUUID: channelUUID, logs: make(chan *ChannelLogRecord, buffer)}
+
+	channelLogSubs.Lock()
+	defer channelLogSubs.Unlock()
+
+	if channelLogSubs.byChannel[channelUUID] == nil {
+		channelLogSubs.byChannel[channelUUID] = make(map[*ChannelLogSubscription]bool)
+	}
+	channelLogSubs.byChannel[channelUUID][s] = true
+	channelLogSubsCount.Add(1)
+
+	return s
+}
+
+// Logs returns the channel logs are delivered on, which is closed when the subscription is closed
+func (s *ChannelLogSubscription) Logs() <-chan *ChannelLogRecord { return s.logs }
+
+// Dropped returns the number of logs dropped because this subscriber wasn't keeping up
+func (s *ChannelLogSubscription) Dropped() int64 { return s.dropped.Load() }
+
+// Close ends this subscription
+func (s *ChannelLogSubscription) Close() {
+	s.closeOnce.Do(func() {
+		channelLogSubs.Lock()
+		defer channelLogSubs.Unlock()
+
+		subs := channelLogSubs.byChannel[s.channelUUID]
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(channelLogSubs.byChannel, s.channelUUID)
+		}
+		channelLogSubsCount.Add(-1)
+
+		close(s.logs)
+	})
+}
+
+// PublishChannelLog publishes the passed in log to any subscribers to its channel. Backends should call this from
+// WriteChannelLog for every log regardless of whether they then store it.
+func PublishChannelLog(clog *ChannelLog) {
+	// nobody is tailing logs so nothing to do
+	if channelLogSubsCount.Load() == 0 {
+		return
+	}
+
+	channelLogSubs.RLock()
+	defer channelLogSubs.RUnlock()
+
+	subs := channelLogSubs.byChannel[clog.Channel().UUID()]
+	if len(subs) == 0 {
+		return
+	}
+
+	// subscribers share a single redacted copy of the log
+	record := clog.Record()
+	record.Redact(redactValuesForChannel(clog.Channel()))
+
+	for s := range subs {
+		select {
+		case s.logs <- record:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// closes all subscriptions, e.g. when we're shutting down
+func closeChannelLogSubscriptions() {
+	channelLogSubs.RLock()
+	all := make([]*ChannelLogSubscription, 0, channelLogSubsCount.Load())
+	for _, subs := range channelLogSubs.byChannel {
+		for s := range subs {
+			all = append(all, s)
+		}
+	}
+	channelLogSubs.RUnlock()
+
+	for _, s := range all {
+		s.Close()
+	}
+}
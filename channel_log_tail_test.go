@@ -0,0 +1,55 @@
+package courier_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelLogSubscriptions(t *testing.T) {
+	channel1 := test.NewMockChannel("fef91e9b-a6ed-44fb-b6ce-feed8af585a8", "MCK", "1234", "US", nil)
+	channel2 := test.NewMockChannel("a2a1e8ba-1cf3-4a5c-b8cc-b7c1b5b5e3d4", "MCK", "5678", "US", nil)
+
+	// publishing with no subscribers is a noop
+	courier.PublishChannelLog(courier.NewChannelLog(courier.ChannelLogTypeMsgSend, channel1, nil))
+
+	sub1 := courier.SubscribeChannelLogs(channel1.UUID(), 2)
+	sub2 := courier.SubscribeChannelLogs(channel1.UUID(), 2)
+	sub3 := courier.SubscribeChannelLogs(channel2.UUID(), 2)
+	defer sub3.Close()
+
+	clog1 := courier.NewChannelLog(courier.ChannelLogTypeMsgSend, channel1, nil)
+	clog1.Error(courier.NewChannelError("oops", "", "Oops password=sesame"))
+	courier.PublishChannelLog(clog1)
+
+	// both subscribers to channel1 get the log, redacted by the channel's handler
+	for _, sub := range []*courier.ChannelLogSubscription{sub1, sub2} {
+		l := <-sub.Logs()
+		assert.Equal(t, clog1.UUID(), l.UUID)
+		assert.Equal(t, channel1.UUID(), l.ChannelUUID)
+		assert.Equal(t, "Oops password=**********", l.Errors[0].Message)
+	}
+	assert.Len(t, sub3.Logs(), 0)
+
+	// once a subscriber's buffer is full, logs are dropped rather than blocking
+	for i := 0; i < 3; i++ {
+		courier.PublishChannelLog(courier.NewChannelLog(courier.ChannelLogTypeMsgSend, channel1, nil))
+	}
+	assert.Len(t, sub1.Logs(), 2)
+	assert.Equal(t, int64(1), sub1.Dropped())
+
+	// closing a subscription closes its channel
+	sub1.Close()
+	sub1.Close()
+	assert.Len(t, sub1.Logs(), 2)
+	<-sub1.Logs()
+	<-sub1.Logs()
+	_, ok := <-sub1.Logs()
+	assert.False(t, ok)
+
+	sub2.Close()
+	courier.PublishChannelLog(clog1)
+	assert.Len(t, sub3.Logs(), 0)
+}
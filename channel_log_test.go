@@ -11,6 +11,7 @@ import (
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestChannelLog(t *testing.T) {
@@ -81,6 +82,89 @@ func TestChannelLog(t *testing.T) {
 	assert.Equal(t, courier.ChannelLogTypeEventReceive, clog.Type())
 }
 
+func TestChannelLogRetention(t *testing.T) {
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://api.messages.com/send.json": {
+			httpx.NewMockResponse(200, nil, []byte(`{"status":"success","id":"1234567890"}`)),
+			httpx.NewMockResponse(200, nil, []byte(`{"status":"success","id":"1234567890"}`)),
+			httpx.NewMockResponse(500, nil, []byte(`{"status":"error","message":"something went wrong"}`)),
+		},
+	}))
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	uuids.SetGenerator(uuids.NewSeededGenerator(1234))
+	defer uuids.SetGenerator(uuids.DefaultGenerator)
+
+	trace := func() *httpx.Trace {
+		req, _ := http.NewRequest("POST", "https://api.messages.com/send.json", nil)
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+		require.NoError(t, err)
+		return trace
+	}
+
+	newSendLog := func(ch courier.Channel) *courier.ChannelLog {
+		return courier.NewChannelLogForSend(test.NewMockMsg(1, "0191e180-7d60-7000-aded-7d8b151cbd5b", ch, "tel:+1234567890", "Hi", nil), nil)
+	}
+
+	// by default logs are kept as is
+	channel := test.NewMockChannel("fef91e9b-a6ed-44fb-b6ce-feed8af585a8", "NX", "1234", "US", nil)
+	clog := newSendLog(channel)
+	clog.HTTP(trace())
+	assert.True(t, clog.Retain())
+	assert.Nil(t, clog.Retention())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length: 38\r\n\r\n{\"status\":\"success\",\"id\":\"1234567890\"}", clog.HTTPLogs()[0].Response)
+
+	channel = test.NewMockChannel("fef91e9b-a6ed-44fb-b6ce-feed8af585a8", "NX", "1234", "US", map[string]any{
+		courier.ConfigLogBodyLimit:      20,
+		courier.ConfigLogErrorBodyLimit: 100,
+		courier.ConfigLogDropHeaders:    true,
+	})
+
+	// success logs are trimmed to the success limit when retained
+	clog = newSendLog(channel)
+	clog.HTTP(trace())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n\r\n{\"status\":\"success\",\"id\":\"1234567890\"}", clog.HTTPLogs()[0].Response)
+	assert.Equal(t, &courier.ChannelLogRetention{HeadersDropped: true}, clog.Retention())
+
+	assert.True(t, clog.Retain())
+	assert.Equal(t, "POST /send.json H...", clog.HTTPLogs()[0].Request)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n...", clog.HTTPLogs()[0].Response)
+	assert.Equal(t, &courier.ChannelLogRetention{BodyLimit: 20, Truncated: true, HeadersDropped: true}, clog.Retention())
+	assert.Equal(t, clog.Retention(), clog.Record().Retention)
+
+	// error logs keep the larger error limit
+	clog = newSendLog(channel)
+	clog.HTTP(trace())
+	assert.True(t, clog.Retain())
+	assert.Equal(t, "POST /send.json HTTP/1.1\r\n\r\n", clog.HTTPLogs()[0].Request)
+	assert.Equal(t, "HTTP/1.0 500 Internal Server Error\r\n\r\n{\"status\":\"error\",\"message\":\"something went wrong\"}", clog.HTTPLogs()[0].Response)
+	assert.Equal(t, &courier.ChannelLogRetention{HeadersDropped: true}, clog.Retention())
+
+	// success logs attached to messages are sampled by their UUID
+	channel = test.NewMockChannel("fef91e9b-a6ed-44fb-b6ce-feed8af585a8", "NX", "1234", "US", map[string]any{courier.ConfigLogSampleRate: 0.25})
+
+	kept := 0
+	for i := 0; i < 100; i++ {
+		clog = newSendLog(channel)
+		if clog.Retain() {
+			assert.Equal(t, &courier.ChannelLogRetention{SampleRate: 0.25}, clog.Retention())
+			kept++
+		}
+	}
+	assert.Equal(t, 29, kept)
+
+	// but not logs which aren't attached or are errors
+	clog = courier.NewChannelLog(courier.ChannelLogTypeTokenRefresh, channel, nil)
+	assert.True(t, clog.Retain())
+	assert.Nil(t, clog.Retention())
+
+	for i := 0; i < 10; i++ {
+		clog = newSendLog(channel)
+		clog.Error(courier.ErrorResponseStatusCode())
+		assert.True(t, clog.Retain())
+	}
+}
+
 func TestChannelErrors(t *testing.T) {
 	tcs := []struct {
 		err             *courier.ChannelError
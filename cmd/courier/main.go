@@ -1,16 +1,23 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	_ "github.com/lib/pq"
 	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/ezconf"
 	slogmulti "github.com/samber/slog-multi"
 	slogsentry "github.com/samber/slog-sentry"
 
@@ -99,6 +106,20 @@ func main() {
 	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level})
 	slog.SetDefault(slog.New(logHandler))
 
+	// if we've been run as courier [flags] spool ..., call the spool API of a running instance rather than starting one,
+	// and refuse to start if we were given any other arguments which we'd otherwise ignore
+	if args := commandArgs(os.Args[1:]); len(args) > 0 {
+		if args[0] != "spool" {
+			fmt.Fprintf(os.Stderr, "unknown command '%s'\n", args[0])
+			os.Exit(1)
+		}
+		if err := runSpoolCommand(config, args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger := slog.With("comp", "main")
 	logger.Info("starting courier", "version", version)
 
@@ -125,6 +146,13 @@ func main() {
 		slog.SetDefault(logger)
 	}
 
+	// convert outgoing images that channels don't support, and if we have ffmpeg, use it to convert audio and video too
+	handlers.RegisterMediaConverter(handlers.NewImageConverter(config.MaxImagePixels))
+
+	if config.FFmpegPath != "" {
+		handlers.RegisterMediaConverter(handlers.NewFFmpegConverter(config.FFmpegPath))
+	}
+
 	// load our backend
 	backend, err := courier.NewBackend(config)
 	if err != nil {
@@ -146,3 +174,27 @@ func main() {
 	server.Stop()
 
 }
+
+// gets the arguments which follow any config flags in the given command line, by parsing them with flags which mirror
+// those that ezconf builds from our config, i.e. a bool flag for each bool field and a flag taking a value for the rest
+func commandArgs(args []string) []string {
+	flags := flag.NewFlagSet("courier", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Bool("help", false, "")
+	flags.Bool("debug-conf", false, "")
+
+	config := reflect.TypeOf(courier.Config{})
+	for i := 0; i < config.NumField(); i++ {
+		name := strings.ReplaceAll(ezconf.CamelToSnake(config.Field(i).Name), "_", "-")
+		if config.Field(i).Type.Kind() == reflect.Bool {
+			flags.Bool(name, false, "")
+		} else {
+			flags.String(name, "", "")
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil // config loading will already have rejected these
+	}
+	return flags.Args()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/pkg/errors"
+)
+
+const spoolUsage = `Usage of courier spool:
+  courier spool list                                 summarizes the spool of a running courier
+  courier spool list <subdir> [<limit> [<offset>]]   lists the entries in a spool subdirectory, 100 at a time by default
+  courier spool flush                                starts flushing the spool immediately
+  courier spool quarantine <subdir> <name>           moves an entry to the quarantine directory so it's no longer retried
+  courier spool reinject <subdir> <name>             moves an invalid or quarantined entry back so that it's retried
+`
+
+type spoolResponse struct {
+	Backlog []*courier.SpoolBacklog `json:"backlog"`
+	Entries []*courier.SpoolEntry   `json:"entries"`
+	Total   int                     `json:"total"`
+}
+
+// runs the spool subcommand, which calls the spool admin API of the courier instance described by our config
+func runSpoolCommand(config *courier.Config, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(spoolUsage)
+		return errors.New("missing spool command")
+	}
+
+	var resp *spoolResponse
+	var err error
+
+	switch args[0] {
+	case "list":
+		if len(args) > 4 {
+			fmt.Print(spoolUsage)
+			return errors.New("list takes at most a subdir, a limit and an offset")
+		}
+		query := url.Values{}
+		for i, param := range []string{"subdir", "limit", "offset"} {
+			if len(args) > i+1 {
+				query.Set(param, args[i+1])
+			}
+		}
+		action := ""
+		if len(query) > 0 {
+			action = "?" + query.Encode()
+		}
+		resp, err = callSpoolAPI(config, http.MethodGet, action, nil)
+	case "flush":
+		resp, err = callSpoolAPI(config, http.MethodPost, "/flush", nil)
+	case "quarantine", "reinject":
+		if len(args) != 3 {
+			fmt.Print(spoolUsage)
+			return errors.Errorf("%s requires a subdir and a name", args[0])
+		}
+		resp, err = callSpoolAPI(config, http.MethodPost, "/"+args[0], map[string]string{"subdir": args[1], "name": args[2]})
+	default:
+		fmt.Print(spoolUsage)
+		return errors.Errorf("unknown spool command '%s'", args[0])
+	}
+
+	if err != nil {
+		return err
+	}
+
+	printSpool(os.Stdout, resp)
+	return nil
+}
+
+func callSpoolAPI(config *courier.Config, method, action string, body any) (*spoolResponse, error) {
+	host := config.Address
+	if host == "" || host == "0.0.0.0" {
+		host = "localhost"
+	}
+	apiURL := fmt.Sprintf("http://%s:%d/c/_spool%s", host, config.Port, action)
+
+	var reqBody io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, _ := http.NewRequest(method, apiURL, reqBody)
+	req.Header.Set("Authorization", "Bearer "+config.AuthToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling spool API")
+	}
+	defer r.Body.Close()
+
+	respBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading spool API response")
+	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusAccepted {
+		return nil, errors.Errorf("spool API returned %d: %s", r.StatusCode, string(respBody))
+	}
+
+	resp := &spoolResponse{}
+	if err := json.Unmarshal(respBody, resp); err != nil {
+		return nil, errors.Wrap(err, "error unmarshalling spool API response")
+	}
+	return resp, nil
+}
+
+func printSpool(out io.Writer, resp *spoolResponse) {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+
+	fmt.Fprintln(w, "SUBDIR\tPENDING\tINVALID\tQUARANTINED\tOLDEST")
+	for _, b := range resp.Backlog {
+		oldest := "-"
+		if b.OldestOn != nil {
+			oldest = time.Since(*b.OldestOn).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", b.Subdir, b.Pending, b.Invalid, b.Quarantined, oldest)
+	}
+
+	if len(resp.Entries) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "SUBDIR\tNAME\tSTATUS\tSIZE\tAGE\tLAST ERROR")
+		for _, e := range resp.Entries {
+			age := time.Since(e.ModifiedOn).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", e.Subdir, e.Name, e.Status, e.Size, age, e.LastError)
+		}
+		fmt.Fprintf(w, "\n%d of %d entries\n", len(resp.Entries), resp.Total)
+	}
+
+	w.Flush()
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/csv"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/ezconf"
@@ -34,12 +36,19 @@ type Config struct {
 	S3DisableSSL        bool   `help:"whether we disable SSL when accessing S3. Should always be set to False unless you're hosting an S3 compatible service within a secure internal network"`
 	S3ForcePathStyle    bool   `help:"whether we force S3 path style. Should generally need to default to False unless you're hosting an S3 compatible service"`
 
+	S3AttachmentsPrivate   bool `help:"whether attachments are written privately, in which case they're referred to by courier URLs and read using short lived presigned URLs"`
+	S3AttachmentsURLExpiry int  `help:"the number of seconds that presigned URLs of private attachments are valid for"`
+
 	FacebookApplicationSecret    string `help:"the Facebook app secret"`
 	FacebookWebhookSecret        string `help:"the secret for Facebook webhook URL verification"`
 	WhatsappAdminSystemUserToken string `help:"the token of the admin system user for WhatsApp"`
 
+	AllowedNetworks    string `help:"semicolon separated list of channel type:networks pairs, where networks is a comma separated list of IP addresses and networks which incoming requests for channels of that type must come from unless overridden by channel config, e.g. KN:10.0.0.0/8,192.168.1.5;AT:52.48.80.0/22"`
+	TrustedProxies     string `help:"comma separated list of IP addresses and networks of proxies which we trust to set the X-Forwarded-For and X-Real-IP headers of incoming requests, which are ignored when checking allowed networks for requests from anywhere else"`
 	DisallowedNetworks string `help:"comma separated list of IP addresses and networks which we disallow fetching attachments from"`
 	MediaDomain        string `help:"the domain on which we'll try to resolve outgoing media URLs"`
+	FFmpegPath         string `help:"the path of an ffmpeg binary used to convert outgoing audio and video that channels don't support (leave empty to only convert images)"`
+	MaxImagePixels     int    `help:"the maximum number of pixels (width x height) of outgoing images that we'll decode to convert them"`
 	MaxWorkers         int    `help:"the maximum number of go routines that will be used for sending (set to 0 to disable sending)"`
 	LibratoUsername    string `help:"the username that will be used to authenticate to Librato"`
 	LibratoToken       string `help:"the token that will be used to authenticate to Librato"`
@@ -49,6 +58,45 @@ type Config struct {
 	LogLevel           string `help:"the logging level courier should use"`
 	Version            string `help:"the version that will be used in request and response headers"`
 
+	SendMaxAttempts     int `help:"the number of attempts courier will make to send a message that errors before failing it (set to 0 to leave retrying to RapidPro)"`
+	SendRetryBackoff    int `help:"the number of seconds courier will wait before retrying an errored send, doubled after each attempt"`
+	SendRetryMaxBackoff int `help:"the maximum number of seconds courier will wait before retrying an errored send"`
+
+	CircuitBreakerThreshold int `help:"the number of consecutive errored sends after which a channel's queue is paused (set to 0 to disable)"`
+	CircuitBreakerCooldown  int `help:"the number of seconds a channel's queue is paused for before a single message is sent to probe it"`
+
+	MsgQueue                  string `validate:"oneof=sorted_sets streams" help:"the queue used for outgoing messages, either sorted_sets (the format RapidPro writes) or streams"`
+	MsgQueueStreamsProducer   bool   `help:"whether something other than RapidPro writes outgoing messages as streams, which is required to use the streams queue"`
+	MsgQueueVisibilityTimeout int    `help:"the number of seconds a popped message can go uncompleted, e.g. because courier died whilst sending it, before it is requeued (set to 0 to disable for sorted_sets)"`
+
+	DrainTimeout     int `help:"the maximum number of seconds to wait for active sends to complete when draining"`
+	DrainGracePeriod int `help:"the number of seconds to keep accepting incoming requests after draining has started when shutting down"`
+
+	SpoolMaxSize      int `help:"the maximum size in MB of files waiting in the spool, after which requests which need to be spooled fail with a 503 (set to 0 for no limit)"`
+	SpoolFlushWorkers int `help:"the number of workers that flush files from the spool in parallel"`
+	SpoolFlushRate    int `help:"the maximum number of files flushed from the spool per second (set to 0 for no limit)"`
+
+	AttachmentMaxSize      int    `help:"the maximum size in MB of incoming attachments, larger attachments are dropped"`
+	AttachmentMaxSizes     string `help:"comma separated list of channel type:MB pairs which override the maximum size of incoming attachments for those channel types, e.g. WA:16,TG:20"`
+	AttachmentAllowedTypes string `help:"comma separated list of MIME types (which can be wildcards like image/*) that incoming attachments must match to be stored (leave empty to allow all)"`
+	AttachmentDeniedTypes  string `help:"comma separated list of MIME types (which can be wildcards like application/*) that incoming attachments can't match to be stored"`
+	ClamdAddress           string `help:"the host:port of a clamd server which incoming attachments are scanned with before being stored (leave empty to disable scanning)"`
+	AttachmentDedupeDays   int    `help:"the number of days stored attachments are remembered by their content hash so that identical attachments for the same org are only stored once (set to 0 to disable)"`
+
+	InboundQueue   bool `help:"whether incoming msgs and channel events are acknowledged as soon as they're written to a Redis queue, with inbound workers then writing them to the database"`
+	InboundWorkers int  `help:"the number of inbound workers writing queued msgs and channel events to the database"`
+
+	InboundChannelLimit int    `help:"the maximum number of incoming msgs and channel events per minute for a channel unless overridden by channel config (set to 0 for no limit)"`
+	InboundURNLimit     int    `help:"the maximum number of incoming msgs and channel events per minute from a single URN on a channel unless overridden by channel config (set to 0 for no limit)"`
+	InboundLimitAction  string `validate:"oneof=reject ignore" help:"what to do with incoming requests which exceed a limit, either reject (respond with a 429) or ignore (respond as the channel would to an ignored request), though requests which exceed a limit part way through are always ignored as part of them has already been written"`
+
+	MsgDedupeMode           string `validate:"oneof=auto external_id content fingerprint none" help:"how incoming msgs are deduped, either auto (by external ID if they have one, otherwise by content), external_id, content, fingerprint (by a provider specific fingerprint set by the handler, otherwise as auto) or none"`
+	MsgDedupeModes          string `help:"comma separated list of channel type:mode pairs which override how incoming msgs are deduped for those channel types, e.g. TG:external_id,DK:fingerprint"`
+	MsgDedupeContentWindow  int    `validate:"min=1" help:"the minimum number of seconds incoming msgs are deduped by content, or until a msg is sent to the URN"`
+	MsgDedupeContentWindows string `help:"comma separated list of channel type:seconds pairs which override how long incoming msgs are deduped by content for those channel types, e.g. EX:300"`
+	MsgDedupeIDWindow       int    `validate:"min=1" help:"the minimum number of seconds incoming msgs are deduped by external ID or fingerprint"`
+	MsgDedupeIDWindows      string `help:"comma separated list of channel type:seconds pairs which override how long incoming msgs are deduped by external ID or fingerprint for those channel types, e.g. TG:3600"`
+
 	// IncludeChannels is the list of channels to enable, empty means include all
 	IncludeChannels []string
 
@@ -78,14 +126,58 @@ func NewConfig() *Config {
 		S3DisableSSL:        false,
 		S3ForcePathStyle:    false,
 
+		S3AttachmentsPrivate:   false,
+		S3AttachmentsURLExpiry: 900,
+
 		FacebookApplicationSecret:    "missing_facebook_app_secret",
 		FacebookWebhookSecret:        "missing_facebook_webhook_secret",
 		WhatsappAdminSystemUserToken: "missing_whatsapp_admin_system_user_token",
 
+		AllowedNetworks:    "",
+		TrustedProxies:     "",
 		DisallowedNetworks: `127.0.0.1,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16,fe80::/10`,
+		MaxImagePixels:     25_000_000,
 		MaxWorkers:         32,
 		LogLevel:           "error",
 		Version:            "Dev",
+
+		SendMaxAttempts:     0,
+		SendRetryBackoff:    30,
+		SendRetryMaxBackoff: 900,
+
+		CircuitBreakerThreshold: 0,
+		CircuitBreakerCooldown:  60,
+
+		MsgQueue:                  "sorted_sets",
+		MsgQueueVisibilityTimeout: 300,
+
+		DrainTimeout:     30,
+		DrainGracePeriod: 0,
+
+		SpoolMaxSize:      0,
+		SpoolFlushWorkers: 4,
+		SpoolFlushRate:    100,
+
+		AttachmentMaxSize:      100,
+		AttachmentMaxSizes:     "",
+		AttachmentAllowedTypes: "",
+		AttachmentDeniedTypes:  "",
+		ClamdAddress:           "",
+		AttachmentDedupeDays:   0,
+
+		InboundQueue:   false,
+		InboundWorkers: 8,
+
+		InboundChannelLimit: 0,
+		InboundURNLimit:     0,
+		InboundLimitAction:  "reject",
+
+		MsgDedupeMode:           "auto",
+		MsgDedupeModes:          "",
+		MsgDedupeContentWindow:  2,
+		MsgDedupeContentWindows: "",
+		MsgDedupeIDWindow:       86400,
+		MsgDedupeIDWindows:      "",
 	}
 }
 
@@ -108,9 +200,32 @@ func (c *Config) Validate() error {
 		return err
 	}
 
+	// RapidPro only writes outgoing messages as sorted sets so reading streams would mean never sending anything
+	if c.MsgQueue == "streams" && !c.MsgQueueStreamsProducer {
+		return errors.New("'MsgQueue' can only be streams if 'MsgQueueStreamsProducer' is set as RapidPro only writes sorted sets")
+	}
+
+	if _, _, err := c.ParseTrustedProxies(); err != nil {
+		return errors.Wrap(err, "unable to parse 'TrustedProxies'")
+	}
 	if _, _, err := c.ParseDisallowedNetworks(); err != nil {
 		return errors.Wrap(err, "unable to parse 'DisallowedNetworks'")
 	}
+	if _, err := c.ParseAttachmentMaxSizes(); err != nil {
+		return errors.Wrap(err, "unable to parse 'AttachmentMaxSizes'")
+	}
+	if _, err := c.ParseAllowedNetworks(); err != nil {
+		return errors.Wrap(err, "unable to parse 'AllowedNetworks'")
+	}
+	if _, err := c.ParseMsgDedupeModes(); err != nil {
+		return errors.Wrap(err, "unable to parse 'MsgDedupeModes'")
+	}
+	if _, err := c.ParseMsgDedupeContentWindows(); err != nil {
+		return errors.Wrap(err, "unable to parse 'MsgDedupeContentWindows'")
+	}
+	if _, err := c.ParseMsgDedupeIDWindows(); err != nil {
+		return errors.Wrap(err, "unable to parse 'MsgDedupeIDWindows'")
+	}
 	return nil
 }
 
@@ -123,3 +238,98 @@ func (c *Config) ParseDisallowedNetworks() ([]net.IP, []*net.IPNet, error) {
 
 	return httpx.ParseNetworks(addrs...)
 }
+
+// ParseTrustedProxies parses the list of IPs and IP networks of trusted proxies
+func (c *Config) ParseTrustedProxies() ([]net.IP, []*net.IPNet, error) {
+	return httpx.ParseNetworks(splitConfigList(c.TrustedProxies)...)
+}
+
+// ParseAttachmentMaxSizes parses the list of channel type:MB pairs into a map of channel type to max size in bytes
+func (c *Config) ParseAttachmentMaxSizes() (map[ChannelType]int, error) {
+	sizes := make(map[ChannelType]int)
+
+	for _, pair := range splitConfigList(c.AttachmentMaxSizes) {
+		channelType, size, found := strings.Cut(pair, ":")
+		mb, err := strconv.Atoi(strings.TrimSpace(size))
+		if !found || err != nil || mb <= 0 {
+			return nil, errors.Errorf("invalid channel type size '%s'", pair)
+		}
+		sizes[ChannelType(strings.TrimSpace(channelType))] = mb * 1024 * 1024
+	}
+
+	return sizes, nil
+}
+
+// ParseAllowedNetworks parses the list of channel type:networks pairs into a map of channel type to IP addresses and networks
+func (c *Config) ParseAllowedNetworks() (map[ChannelType][]string, error) {
+	networks := make(map[ChannelType][]string)
+
+	for _, pair := range strings.Split(c.AllowedNetworks, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		channelType, addrs, found := strings.Cut(pair, ":")
+		list := splitConfigList(addrs)
+		if !found || len(list) == 0 {
+			return nil, errors.Errorf("invalid channel type networks '%s'", pair)
+		}
+		if _, _, err := httpx.ParseNetworks(list...); err != nil {
+			return nil, err
+		}
+		networks[ChannelType(strings.TrimSpace(channelType))] = list
+	}
+
+	return networks, nil
+}
+
+// ParseMsgDedupeModes parses the list of channel type:mode pairs into a map of channel type to dedupe mode
+func (c *Config) ParseMsgDedupeModes() (map[ChannelType]MsgDedupeMode, error) {
+	modes := make(map[ChannelType]MsgDedupeMode)
+
+	for _, pair := range splitConfigList(c.MsgDedupeModes) {
+		channelType, mode, found := strings.Cut(pair, ":")
+		if !found || !MsgDedupeMode(strings.TrimSpace(mode)).IsValid() {
+			return nil, errors.Errorf("invalid channel type dedupe mode '%s'", pair)
+		}
+		modes[ChannelType(strings.TrimSpace(channelType))] = MsgDedupeMode(strings.TrimSpace(mode))
+	}
+
+	return modes, nil
+}
+
+// ParseMsgDedupeContentWindows parses the list of channel type:seconds pairs into a map of channel type to content dedupe window
+func (c *Config) ParseMsgDedupeContentWindows() (map[ChannelType]time.Duration, error) {
+	return parseDedupeWindows(c.MsgDedupeContentWindows)
+}
+
+// ParseMsgDedupeIDWindows parses the list of channel type:seconds pairs into a map of channel type to ID dedupe window
+func (c *Config) ParseMsgDedupeIDWindows() (map[ChannelType]time.Duration, error) {
+	return parseDedupeWindows(c.MsgDedupeIDWindows)
+}
+
+func parseDedupeWindows(s string) (map[ChannelType]time.Duration, error) {
+	windows := make(map[ChannelType]time.Duration)
+
+	for _, pair := range splitConfigList(s) {
+		channelType, seconds, found := strings.Cut(pair, ":")
+		secs, err := strconv.Atoi(strings.TrimSpace(seconds))
+		if !found || err != nil || secs <= 0 {
+			return nil, errors.Errorf("invalid channel type dedupe window '%s'", pair)
+		}
+		windows[ChannelType(strings.TrimSpace(channelType))] = time.Duration(secs) * time.Second
+	}
+
+	return windows, nil
+}
+
+// splits a comma separated config value, ignoring empty items
+func splitConfigList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,22 @@
+package courier_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/courier"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMsgQueue(t *testing.T) {
+	cfg := courier.NewConfig()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MsgQueue = "streams"
+	assert.EqualError(t, cfg.Validate(), "'MsgQueue' can only be streams if 'MsgQueueStreamsProducer' is set as RapidPro only writes sorted sets")
+
+	cfg.MsgQueueStreamsProducer = true
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MsgQueue = "lists"
+	assert.EqualError(t, cfg.Validate(), "Key: 'Config.MsgQueue' Error:Field validation for 'MsgQueue' failed on the 'oneof' tag")
+}
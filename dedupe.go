@@ -0,0 +1,92 @@
+package courier
+
+import (
+	"log/slog"
+	"time"
+)
+
+// MsgDedupeMode is how incoming msgs are deduped, i.e. how we decide that a msg is one we've already received
+type MsgDedupeMode string
+
+// Possible values for MsgDedupeMode
+const (
+	MsgDedupeAuto        MsgDedupeMode = "auto"        // by external ID if the msg has one, otherwise by content
+	MsgDedupeExternalID  MsgDedupeMode = "external_id" // by external ID only
+	MsgDedupeContent     MsgDedupeMode = "content"     // by content only, even if the msg has an external ID
+	MsgDedupeFingerprint MsgDedupeMode = "fingerprint" // by fingerprint set by the handler, otherwise as auto
+	MsgDedupeNone        MsgDedupeMode = "none"        // not deduped at all
+)
+
+// IsValid returns whether this is a known dedupe mode
+func (m MsgDedupeMode) IsValid() bool {
+	switch m {
+	case MsgDedupeAuto, MsgDedupeExternalID, MsgDedupeContent, MsgDedupeFingerprint, MsgDedupeNone:
+		return true
+	}
+	return false
+}
+
+// MsgDedupe is how incoming msgs on a particular channel are deduped
+type MsgDedupe struct {
+	Mode          MsgDedupeMode
+	ContentWindow time.Duration // minimum time msgs are deduped by content, or until a msg is sent to the URN
+	IDWindow      time.Duration // minimum time msgs are deduped by external ID or fingerprint
+}
+
+// DedupePolicy describes how incoming msgs are deduped. A channel's own config takes precedence over the overrides for
+// its channel type, which take precedence over the defaults.
+type DedupePolicy struct {
+	Mode                  MsgDedupeMode
+	ContentWindow         time.Duration
+	IDWindow              time.Duration
+	ChannelModes          map[ChannelType]MsgDedupeMode // overrides of the mode for specific channel types
+	ChannelContentWindows map[ChannelType]time.Duration // overrides of the content window for specific channel types
+	ChannelIDWindows      map[ChannelType]time.Duration // overrides of the ID window for specific channel types
+}
+
+// NewDedupePolicy creates a new dedupe policy from the given config
+func NewDedupePolicy(cfg *Config) *DedupePolicy {
+	channelModes, _ := cfg.ParseMsgDedupeModes() // already validated
+	channelContentWindows, _ := cfg.ParseMsgDedupeContentWindows()
+	channelIDWindows, _ := cfg.ParseMsgDedupeIDWindows()
+
+	return &DedupePolicy{
+		Mode:                  MsgDedupeMode(cfg.MsgDedupeMode),
+		ContentWindow:         time.Duration(cfg.MsgDedupeContentWindow) * time.Second,
+		IDWindow:              time.Duration(cfg.MsgDedupeIDWindow) * time.Second,
+		ChannelModes:          channelModes,
+		ChannelContentWindows: channelContentWindows,
+		ChannelIDWindows:      channelIDWindows,
+	}
+}
+
+// ForChannel returns how incoming msgs on the given channel are deduped
+func (p *DedupePolicy) ForChannel(ch Channel) MsgDedupe {
+	d := MsgDedupe{Mode: p.Mode, ContentWindow: p.ContentWindow, IDWindow: p.IDWindow}
+
+	if mode, ok := p.ChannelModes[ch.ChannelType()]; ok {
+		d.Mode = mode
+	}
+	if window, ok := p.ChannelContentWindows[ch.ChannelType()]; ok {
+		d.ContentWindow = window
+	}
+	if window, ok := p.ChannelIDWindows[ch.ChannelType()]; ok {
+		d.IDWindow = window
+	}
+
+	if mode := MsgDedupeMode(ch.StringConfigForKey(ConfigDedupeMode, "")); mode != "" {
+		if mode.IsValid() {
+			d.Mode = mode
+		} else {
+			slog.Error("invalid dedupe mode in channel config", "mode", mode, "channel_uuid", ch.UUID())
+		}
+	}
+	if secs := ch.IntConfigForKey(ConfigDedupeContentWindow, 0); secs > 0 {
+		d.ContentWindow = time.Duration(secs) * time.Second
+	}
+	if secs := ch.IntConfigForKey(ConfigDedupeIDWindow, 0); secs > 0 {
+		d.IDWindow = time.Duration(secs) * time.Second
+	}
+
+	return d
+}
@@ -0,0 +1,66 @@
+package courier_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupePolicy(t *testing.T) {
+	cfg := courier.NewConfig()
+
+	policy := courier.NewDedupePolicy(cfg)
+	assert.Equal(t, courier.MsgDedupeAuto, policy.Mode)
+	assert.Equal(t, 2*time.Second, policy.ContentWindow)
+	assert.Equal(t, 24*time.Hour, policy.IDWindow)
+
+	cfg.MsgDedupeModes = "TG:external_id, DK:fingerprint"
+	cfg.MsgDedupeContentWindows = "EX:300"
+	cfg.MsgDedupeIDWindows = "TG:3600, DK:604800"
+
+	policy = courier.NewDedupePolicy(cfg)
+	assert.Equal(t, map[courier.ChannelType]courier.MsgDedupeMode{"TG": courier.MsgDedupeExternalID, "DK": courier.MsgDedupeFingerprint}, policy.ChannelModes)
+	assert.Equal(t, map[courier.ChannelType]time.Duration{"EX": 300 * time.Second}, policy.ChannelContentWindows)
+	assert.Equal(t, map[courier.ChannelType]time.Duration{"TG": time.Hour, "DK": 7 * 24 * time.Hour}, policy.ChannelIDWindows)
+
+	newChannel := func(channelType courier.ChannelType, config map[string]any) courier.Channel {
+		return test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", string(channelType), "2020", "US", config)
+	}
+
+	tcs := []struct {
+		channel  courier.Channel
+		expected courier.MsgDedupe
+	}{
+		{newChannel("KN", nil), courier.MsgDedupe{Mode: courier.MsgDedupeAuto, ContentWindow: 2 * time.Second, IDWindow: 24 * time.Hour}},
+		{newChannel("TG", nil), courier.MsgDedupe{Mode: courier.MsgDedupeExternalID, ContentWindow: 2 * time.Second, IDWindow: time.Hour}},
+		{newChannel("DK", nil), courier.MsgDedupe{Mode: courier.MsgDedupeFingerprint, ContentWindow: 2 * time.Second, IDWindow: 7 * 24 * time.Hour}},
+		{newChannel("EX", nil), courier.MsgDedupe{Mode: courier.MsgDedupeAuto, ContentWindow: 300 * time.Second, IDWindow: 24 * time.Hour}},
+		{
+			newChannel("EX", map[string]any{courier.ConfigDedupeMode: "content", courier.ConfigDedupeContentWindow: 60, courier.ConfigDedupeIDWindow: 3600}),
+			courier.MsgDedupe{Mode: courier.MsgDedupeContent, ContentWindow: 60 * time.Second, IDWindow: time.Hour},
+		},
+		{newChannel("TG", map[string]any{courier.ConfigDedupeMode: "none"}), courier.MsgDedupe{Mode: courier.MsgDedupeNone, ContentWindow: 2 * time.Second, IDWindow: time.Hour}},
+		{newChannel("TG", map[string]any{courier.ConfigDedupeMode: "xxx"}), courier.MsgDedupe{Mode: courier.MsgDedupeExternalID, ContentWindow: 2 * time.Second, IDWindow: time.Hour}},
+		{newChannel("TG", map[string]any{courier.ConfigDedupeIDWindow: 60}), courier.MsgDedupe{Mode: courier.MsgDedupeExternalID, ContentWindow: 2 * time.Second, IDWindow: time.Minute}},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, policy.ForChannel(tc.channel), "dedupe mismatch for channel type %s", tc.channel.ChannelType())
+	}
+
+	assert.NoError(t, cfg.Validate())
+
+	cfg.MsgDedupeModes = "TG:external_id,DK:xxx"
+	assert.EqualError(t, cfg.Validate(), "unable to parse 'MsgDedupeModes': invalid channel type dedupe mode 'DK:xxx'")
+
+	cfg.MsgDedupeModes = ""
+	cfg.MsgDedupeContentWindows = "EX:0"
+	assert.EqualError(t, cfg.Validate(), "unable to parse 'MsgDedupeContentWindows': invalid channel type dedupe window 'EX:0'")
+
+	cfg.MsgDedupeContentWindows = ""
+	cfg.MsgDedupeIDWindows = "TG:3600,DK"
+	assert.EqualError(t, cfg.Validate(), "unable to parse 'MsgDedupeIDWindows': invalid channel type dedupe window 'DK'")
+}
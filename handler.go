@@ -2,7 +2,9 @@ package courier
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/nyaruka/gocommon/urns"
 )
@@ -35,6 +37,21 @@ type ChannelHandler interface {
 	WriteRequestIgnored(context.Context, http.ResponseWriter, string) error
 }
 
+// RateLimitedError can be returned by handlers from Send when the channel's provider has told us to slow down. The message
+// will be requeued and the channel's queue paused for RetryAfter, without the message being marked as errored.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+// NewRateLimitedError creates a new rate limited error with the given retry after duration
+func NewRateLimitedError(retryAfter time.Duration) *RateLimitedError {
+	return &RateLimitedError{RetryAfter: retryAfter}
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited by channel, retry after %s", e.RetryAfter)
+}
+
 // URNDescriber is the interface handlers which can look up URN metadata for new contacts should satisfy.
 type URNDescriber interface {
 	DescribeURN(context.Context, Channel, urns.URN, *ChannelLog) (map[string]string, error)
@@ -45,6 +62,13 @@ type AttachmentRequestBuilder interface {
 	BuildAttachmentRequest(context.Context, Backend, Channel, string, *ChannelLog) (*http.Request, error)
 }
 
+// RequestVerifier is the interface handlers which verify that incoming requests were really sent by their channel should
+// satisfy. Requests which can't be verified are rejected before they're handled.
+type RequestVerifier interface {
+	VerifyRequest(context.Context, Channel, *http.Request) error
+	RequestHandled(context.Context, Channel, *http.Request, error)
+}
+
 // RegisterHandler adds a new handler for a channel type, this is called by individual handlers when they are initialized
 func RegisterHandler(handler ChannelHandler) {
 	registeredHandlers[handler.ChannelType()] = handler
@@ -57,3 +81,11 @@ func GetHandler(ct ChannelType) ChannelHandler {
 
 var registeredHandlers = make(map[ChannelType]ChannelHandler)
 var activeHandlers = make(map[ChannelType]ChannelHandler)
+
+// gets the values which should be redacted from the logs of the given channel
+func redactValuesForChannel(ch Channel) []string {
+	if h := GetHandler(ch.ChannelType()); h != nil {
+		return h.RedactValues(ch)
+	}
+	return nil
+}
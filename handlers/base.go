@@ -4,12 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/gocommon/httpx"
 )
 
+// how long we wait before sending again when a channel rate limits us without telling us how long to wait
+const defaultRetryAfter = time.Second * 2
+
 var defaultRedactConfigKeys = []string{courier.ConfigAuthToken, courier.ConfigAPIKey, courier.ConfigSecret, courier.ConfigPassword, courier.ConfigSendAuthorization}
 
 // BaseHandler is the base class for most handlers, it just stored the server, name and channel type for the handler
@@ -20,6 +24,7 @@ type BaseHandler struct {
 	backend            courier.Backend
 	uuidChannelRouting bool
 	redactConfigKeys   []string
+	verifier           Verifier
 }
 
 // NewBaseHandler returns a newly constructed BaseHandler with the passed in parameters
@@ -48,6 +53,12 @@ func WithRedactConfigKeys(keys ...string) func(*BaseHandler) {
 	}
 }
 
+func WithVerifier(v Verifier) func(*BaseHandler) {
+	return func(s *BaseHandler) {
+		s.verifier = v
+	}
+}
+
 // SetServer can be used to change the server on a BaseHandler
 func (h *BaseHandler) SetServer(server courier.Server) {
 	h.server = server
@@ -94,6 +105,21 @@ func (h *BaseHandler) RedactValues(ch courier.Channel) []string {
 	return vals
 }
 
+// VerifyRequest verifies the given request using the handler's verifier, if it has one
+func (h *BaseHandler) VerifyRequest(ctx context.Context, ch courier.Channel, r *http.Request) error {
+	if h.verifier == nil {
+		return nil
+	}
+	return h.verifier.Verify(ctx, h.backend, ch, r)
+}
+
+// RequestHandled lets the handler's verifier know that the given verified request was handled, and whether that failed
+func (h *BaseHandler) RequestHandled(ctx context.Context, ch courier.Channel, r *http.Request, err error) {
+	if h.verifier != nil {
+		h.verifier.Handled(ctx, h.backend, ch, r, err)
+	}
+}
+
 // GetChannel returns the channel
 func (h *BaseHandler) GetChannel(ctx context.Context, r *http.Request) (courier.Channel, error) {
 	uuid := courier.ChannelUUID(chi.URLParam(r, "uuid"))
@@ -127,9 +153,27 @@ func (h *BaseHandler) RequestHTTPWithClient(client *http.Client, req *http.Reque
 		return nil, nil, err
 	}
 
+	// if we've been rate limited, record that on the log so that the sender can pause this channel's queue
+	if retryAfter := rateLimitRetryAfter(resp); retryAfter > 0 {
+		clog.SetRetryAfter(retryAfter)
+	}
+
 	return resp, body, nil
 }
 
+// returns how long the given response asked us to wait before trying again, if it was a 429 or a 503 with a Retry-After
+func rateLimitRetryAfter(resp *http.Response) time.Duration {
+	retryAfter := httpx.ParseRetryAfter(resp.Header.Get("Retry-After"))
+
+	if resp.StatusCode == http.StatusTooManyRequests && retryAfter <= 0 {
+		return defaultRetryAfter
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		return retryAfter
+	}
+	return 0
+}
+
 // WriteStatusSuccessResponse writes a success response for the statuses
 func (h *BaseHandler) WriteStatusSuccessResponse(ctx context.Context, w http.ResponseWriter, statuses []courier.StatusUpdate) error {
 	return courier.WriteStatusSuccess(w, statuses)
@@ -3,6 +3,7 @@ package handlers_test
 import (
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
@@ -17,6 +18,9 @@ func TestRequestHTTP(t *testing.T) {
 		"https://api.messages.com/send.json": {
 			httpx.NewMockResponse(200, nil, []byte(`{"status":"success"}`)),
 			httpx.NewMockResponse(400, nil, []byte(`{"status":"error"}`)),
+			httpx.NewMockResponse(503, nil, []byte(`{"status":"error"}`)),
+			httpx.NewMockResponse(429, map[string]string{"Retry-After": "30"}, []byte(`{"status":"error"}`)),
+			httpx.NewMockResponse(429, nil, []byte(`{"status":"error"}`)),
 		},
 	}))
 	defer httpx.SetRequestor(httpx.DefaultRequestor)
@@ -52,4 +56,27 @@ func TestRequestHTTP(t *testing.T) {
 	hlog2 := clog.HTTPLogs()[1]
 	assert.Equal(t, 400, hlog2.StatusCode)
 	assert.Equal(t, "https://api.messages.com/send.json", hlog2.URL)
+	assert.Equal(t, time.Duration(0), clog.RetryAfter())
+
+	// a 503 without a Retry-After header isn't considered a rate limit
+	req, _ = http.NewRequest("POST", "https://api.messages.com/send.json", nil)
+	resp, _, err = h.RequestHTTP(req, clog)
+	assert.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, time.Duration(0), clog.RetryAfter())
+
+	// but a 429 is, and we use its Retry-After header
+	req, _ = http.NewRequest("POST", "https://api.messages.com/send.json", nil)
+	resp, _, err = h.RequestHTTP(req, clog)
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, 30*time.Second, clog.RetryAfter())
+
+	// or a default if it doesn't have one
+	clog = courier.NewChannelLogForSend(mm, nil)
+	req, _ = http.NewRequest("POST", "https://api.messages.com/send.json", nil)
+	resp, _, err = h.RequestHTTP(req, clog)
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, 2*time.Second, clog.RetryAfter())
 }
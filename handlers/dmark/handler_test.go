@@ -29,6 +29,7 @@ var testCases = []IncomingTestCase{
 		ExpectedMsgText:      Sp("Msg"),
 		ExpectedURN:          "tel:+254791541111",
 		ExpectedDate:         time.Date(2017, 10, 26, 15, 51, 32, 906335000, time.UTC),
+		ExpectedFingerprint:  "2017-10-26T15:51:32.906335+00:00",
 	},
 	{
 		Label:                "Invalid URN",
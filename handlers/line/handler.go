@@ -3,12 +3,9 @@ package line
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -46,8 +43,16 @@ type handler struct {
 	handlers.BaseHandler
 }
 
+// see https://developers.line.biz/en/reference/messaging-api/#signature-validation
+var verifier = &handlers.HMACVerifier{
+	Signature: handlers.HeaderValue(signatureHeader),
+	ConfigKey: courier.ConfigSecret,
+	Hash:      sha256.New,
+	Encoding:  handlers.SignatureBase64,
+}
+
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("LN"), "Line")}
+	return &handler{handlers.NewBaseHandler(courier.ChannelType("LN"), "Line", handlers.WithVerifier(verifier))}
 }
 
 // Initialize is called by the engine once everything is loaded
@@ -111,11 +116,6 @@ type moPayload struct {
 
 // receiveMessage is our HTTP handler function for incoming messages
 func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moPayload, clog *courier.ChannelLog) ([]courier.Event, error) {
-	err := h.validateSignature(channel, r)
-	if err != nil {
-		return nil, err
-	}
-
 	msgs := []courier.MsgIn{}
 
 	for _, lineEvent := range payload.Events {
@@ -190,51 +190,6 @@ func (h *handler) BuildAttachmentRequest(ctx context.Context, b courier.Backend,
 
 var _ courier.AttachmentRequestBuilder = (*handler)(nil)
 
-func (h *handler) validateSignature(channel courier.Channel, r *http.Request) error {
-	actual := r.Header.Get(signatureHeader)
-	if actual == "" {
-		return fmt.Errorf("missing request signature")
-	}
-
-	confSecret := channel.ConfigForKey(courier.ConfigSecret, "")
-	secret, isStr := confSecret.(string)
-	if !isStr || secret == "" {
-		return fmt.Errorf("invalid or missing auth token in config")
-	}
-
-	expected, err := calculateSignature(secret, r)
-	if err != nil {
-		return err
-	}
-
-	// compare signatures in way that isn't sensitive to a timing attack
-	if !hmac.Equal(expected, []byte(actual)) {
-		return fmt.Errorf("invalid request signature")
-	}
-
-	return nil
-}
-
-// see https://developers.line.me/en/docs/messaging-api/reference/#signature-validation
-func calculateSignature(secret string, r *http.Request) ([]byte, error) {
-	defer r.Body.Close()
-	body, err := io.ReadAll(r.Body)
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
-
-	// hash with SHA256
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write(body)
-	hash := mac.Sum(nil)
-
-	// encode with Base64
-	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(hash)))
-	base64.StdEncoding.Encode(encoded, hash)
-	return encoded, nil
-}
-
 type mtTextMsg struct {
 	Type       string        `json:"type"`
 	Text       string        `json:"text"`
@@ -295,7 +250,7 @@ func (h *handler) Send(ctx context.Context, msg courier.MsgOut, clog *courier.Ch
 	parts := handlers.SplitMsgByChannel(msg.Channel(), msg.Text(), maxMsgLength)
 	qrs := msg.QuickReplies()
 
-	attachments, err := handlers.ResolveAttachments(ctx, h.Backend(), msg.Attachments(), mediaSupport, false)
+	attachments, err := handlers.ResolveAttachments(ctx, h.Backend(), msg.Channel(), msg.Attachments(), mediaSupport, false)
 	if err != nil {
 		return nil, errors.Wrap(err, "error resolving attachments")
 	}
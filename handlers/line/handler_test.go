@@ -1,9 +1,15 @@
 package line
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -379,6 +385,25 @@ func addValidSignature(r *http.Request) {
 	r.Header.Set(signatureHeader, string(sig))
 }
 
+func calculateSignature(secret string, r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// hash with SHA256
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	hash := mac.Sum(nil)
+
+	// encode with Base64
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(hash)))
+	base64.StdEncoding.Encode(encoded, hash)
+	return encoded, nil
+}
+
 func addInvalidSignature(r *http.Request) {
 	r.Header.Set(signatureHeader, "invalidsig")
 }
@@ -387,6 +412,27 @@ func TestIncoming(t *testing.T) {
 	RunIncomingTestCases(t, testChannels, newHandler(), handleTestCases)
 }
 
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+
+	newRequest := func(body, sig string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(body))
+		r.Header.Set(signatureHeader, sig)
+		return r
+	}
+
+	// signature as computed by LINE for this body
+	r := newRequest(`{"events":[]}`, "hhLAzqf066RkMt3a68MjulCHJ2y7v5/DSOoA7ie0SIA=")
+	sig, err := verifier.Sign("Secret", r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hhLAzqf066RkMt3a68MjulCHJ2y7v5/DSOoA7ie0SIA=", sig)
+	assert.NoError(t, verifier.Verify(ctx, mb, testChannels[0], r))
+
+	r = newRequest(`{"events":[{}]}`, "hhLAzqf066RkMt3a68MjulCHJ2y7v5/DSOoA7ie0SIA=")
+	assert.Equal(t, ErrInvalidSignature, verifier.Verify(ctx, mb, testChannels[0], r))
+}
+
 func BenchmarkHandler(b *testing.B) {
 	RunChannelBenchmarks(b, testChannels, newHandler(), handleTestCases)
 }
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"log/slog"
 	"net/url"
 	"path"
 	"strings"
@@ -34,12 +35,13 @@ type Attachment struct {
 	Thumbnail   courier.Media
 }
 
-// ResolveAttachments resolves the given attachment strings (content-type:url) into attachment objects
-func ResolveAttachments(ctx context.Context, b courier.Backend, attachments []string, support map[MediaType]MediaTypeSupport, allowURLOnly bool) ([]*Attachment, error) {
+// ResolveAttachments resolves the given attachment strings (content-type:url) into attachment objects. If an uploaded
+// attachment has no alternate which is supported, we try to convert it into one which is saved for the given channel.
+func ResolveAttachments(ctx context.Context, b courier.Backend, ch courier.Channel, attachments []string, support map[MediaType]MediaTypeSupport, allowURLOnly bool) ([]*Attachment, error) {
 	resolved := make([]*Attachment, 0, len(attachments))
 
 	for _, as := range attachments {
-		att, err := resolveAttachment(ctx, b, as, support, allowURLOnly)
+		att, err := resolveAttachment(ctx, b, ch, as, support, allowURLOnly)
 		if err != nil {
 			return nil, err
 		}
@@ -51,7 +53,7 @@ func ResolveAttachments(ctx context.Context, b courier.Backend, attachments []st
 	return resolved, nil
 }
 
-func resolveAttachment(ctx context.Context, b courier.Backend, attachment string, support map[MediaType]MediaTypeSupport, allowURLOnly bool) (*Attachment, error) {
+func resolveAttachment(ctx context.Context, b courier.Backend, ch courier.Channel, attachment string, support map[MediaType]MediaTypeSupport, allowURLOnly bool) (*Attachment, error) {
 	// split into content-type and URL
 	parts := strings.SplitN(attachment, ":", 2)
 	if len(parts) <= 1 || strings.HasPrefix(parts[1], "//") {
@@ -97,9 +99,18 @@ func resolveAttachment(ctx context.Context, b courier.Backend, attachment string
 		candidates = filterMediaBySize(candidates, mediaSupport.MaxBytes)
 	}
 
-	// if we have no candidates, we can't use this media
+	// if we have no candidates, try to convert the media into something we can use
 	if len(candidates) == 0 {
-		return nil, nil
+		converted, err := convertMedia(ctx, b, ch, media, support)
+		if err != nil {
+			slog.Error("error converting media", "error", err, "url", media.URL(), "content_type", media.ContentType())
+		}
+		if converted == nil {
+			return nil, nil
+		}
+
+		candidates = []courier.Media{converted}
+		mediaType, _ = parseContentType(converted.ContentType())
 	}
 	media = candidates[0]
 
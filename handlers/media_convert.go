@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxConvertSourceBytes   = 100 * 1024 * 1024
+	mediaConversionTimeout  = time.Minute * 2
+	mediaConversionCacheTTL = time.Hour * 24 * 7
+)
+
+// MediaConverter is something which can convert media that a channel doesn't support into media that it does
+type MediaConverter interface {
+	// Target returns the content type that media of the given content type should be converted to for it to be
+	// supported, or empty string if this converter can't produce a supported alternate
+	Target(contentType string, support map[MediaType]MediaTypeSupport) string
+
+	// Convert converts the media in the given file to the target content type, keeping it within maxBytes if that is
+	// non-zero
+	Convert(ctx context.Context, src string, contentType, target string, maxBytes int) ([]byte, error)
+}
+
+var mediaConverters []MediaConverter
+var mediaConvertersMutex sync.RWMutex
+
+// RegisterMediaConverter adds a converter which will be tried when an outgoing attachment has no alternate that the
+// channel supports. Converters registered later are tried first so they can take precedence over our builtin ones.
+func RegisterMediaConverter(c MediaConverter) {
+	mediaConvertersMutex.Lock()
+	defer mediaConvertersMutex.Unlock()
+
+	mediaConverters = append([]MediaConverter{c}, mediaConverters...)
+}
+
+// a media alternate that we've converted and saved ourselves
+type convertedMedia struct {
+	Name_        string `json:"name"`
+	ContentType_ string `json:"content_type"`
+	URL_         string `json:"url"`
+	Size_        int    `json:"size"`
+}
+
+func (m *convertedMedia) Name() string                { return m.Name_ }
+func (m *convertedMedia) ContentType() string         { return m.ContentType_ }
+func (m *convertedMedia) URL() string                 { return m.URL_ }
+func (m *convertedMedia) Size() int                   { return m.Size_ }
+func (m *convertedMedia) Width() int                  { return 0 }
+func (m *convertedMedia) Height() int                 { return 0 }
+func (m *convertedMedia) Duration() int               { return 0 }
+func (m *convertedMedia) Alternates() []courier.Media { return nil }
+
+// tries to convert the given media into an alternate which is supported, returning nil if no converter can
+func convertMedia(ctx context.Context, b courier.Backend, ch courier.Channel, media courier.Media, support map[MediaType]MediaTypeSupport) (courier.Media, error) {
+	mediaConvertersMutex.RLock()
+	converters := mediaConverters
+	mediaConvertersMutex.RUnlock()
+
+	var converter MediaConverter
+	var target string
+	for _, c := range converters {
+		if target = c.Target(media.ContentType(), support); target != "" {
+			converter = c
+			break
+		}
+	}
+	if converter == nil {
+		return nil, nil
+	}
+
+	targetType, _ := parseContentType(target)
+	maxBytes := support[targetType].MaxBytes
+
+	// check if we've already converted this media for this target
+	cacheKey := fmt.Sprintf("media_conversion:%s|%s|%d", media.URL(), target, maxBytes)
+	if cached := getCachedConversion(b, cacheKey); cached != nil {
+		return readableMedia(ctx, b, cached)
+	}
+
+	// conversions get their own time limit rather than eating into that of the send which needs them
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mediaConversionTimeout)
+	defer cancel()
+
+	src, size, err := fetchMedia(ctx, b, media.URL())
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(src)
+
+	converted, err := converter.Convert(ctx, src, media.ContentType(), target, maxBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error converting %s to %s", media.ContentType(), target)
+	}
+
+	ext := mediaExtensions[target]
+	url, err := b.SaveAttachment(ctx, ch, target, bytes.NewReader(converted), ext)
+	if err != nil {
+		return nil, errors.Wrap(err, "error saving converted media")
+	}
+
+	name := strings.TrimSuffix(media.Name(), path.Ext(media.Name()))
+	if ext != "" {
+		name += "." + ext
+	}
+
+	result := &convertedMedia{Name_: name, ContentType_: target, URL_: url, Size_: len(converted)}
+	setCachedConversion(b, cacheKey, result)
+
+	slog.Debug("converted media", "url", media.URL(), "content_type", media.ContentType(), "target", target, "size", size, "converted_size", len(converted))
+
+	return readableMedia(ctx, b, result)
+}
+
+// converted media is cached with the URL it was saved with, which for private storage needs resolving to one that
+// channels can read
+func readableMedia(ctx context.Context, b courier.Backend, m *convertedMedia) (courier.Media, error) {
+	readURL, err := b.AttachmentURL(ctx, m.URL_)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting converted media URL")
+	}
+
+	readable := *m
+	readable.URL_ = readURL
+	return &readable, nil
+}
+
+// fetches the media at the given URL into a temp file, returning its path and size, so that we don't have to hold
+// large media in memory to convert it. Callers must remove the file when done with it.
+func fetchMedia(ctx context.Context, b courier.Backend, url string) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "error creating media request")
+	}
+
+	resp, err := httpx.Do(b.HttpClient(true), req, nil, nil)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "error fetching media")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", 0, errors.Errorf("error fetching media, got status %d", resp.StatusCode)
+	}
+
+	f, err := os.CreateTemp("", "courier-media")
+	if err != nil {
+		return "", 0, errors.Wrap(err, "error creating temp file for media")
+	}
+	defer f.Close()
+
+	size, err := io.Copy(f, io.LimitReader(resp.Body, maxConvertSourceBytes+1))
+	if err != nil || size > maxConvertSourceBytes {
+		os.Remove(f.Name())
+		if err != nil {
+			return "", 0, errors.Wrap(err, "error reading media")
+		}
+		return "", 0, errors.Errorf("media exceeds limit of %d bytes", maxConvertSourceBytes)
+	}
+
+	return f.Name(), size, nil
+}
+
+func getCachedConversion(b courier.Backend, key string) *convertedMedia {
+	rp := b.RedisPool()
+	if rp == nil {
+		return nil
+	}
+	rc := rp.Get()
+	defer rc.Close()
+
+	value, err := redis.Bytes(rc.Do("GET", key))
+	if err != nil {
+		if err != redis.ErrNil {
+			slog.Error("error reading cached media conversion", "error", err)
+		}
+		return nil
+	}
+
+	m := &convertedMedia{}
+	if err := json.Unmarshal(value, m); err != nil {
+		return nil
+	}
+	return m
+}
+
+func setCachedConversion(b courier.Backend, key string, m *convertedMedia) {
+	rp := b.RedisPool()
+	if rp == nil {
+		return
+	}
+	rc := rp.Get()
+	defer rc.Close()
+
+	value, _ := json.Marshal(m)
+	if _, err := rc.Do("SET", key, value, "EX", int(mediaConversionCacheTTL/time.Second)); err != nil {
+		slog.Error("error caching media conversion", "error", err)
+	}
+}
+
+// returns the first of the given content types which the given support allows
+func firstSupported(support MediaTypeSupport, types ...string) string {
+	for _, t := range types {
+		if len(support.Types) == 0 {
+			return t
+		}
+		for _, s := range support.Types {
+			if s == t {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// extensions of the content types which converters produce
+var mediaExtensions = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"audio/mpeg": "mp3",
+	"audio/mp3":  "mp3",
+	"audio/mp4":  "m4a",
+	"audio/aac":  "aac",
+	"video/mp4":  "mp4",
+}
@@ -0,0 +1,175 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/test"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveAttachmentsWithConversion(t *testing.T) {
+	handlers.RegisterMediaConverter(handlers.NewImageConverter(1000 * 1000))
+
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+	channel := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "MCK", "2020", "US", nil)
+
+	testJPG := test.ReadFile("../test/testdata/test.jpg")
+
+	// make a GIF with a transparent background
+	gifImg := image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{color.Transparent, color.Black})
+	gifImg.SetColorIndex(10, 10, 1)
+	testGIF := &bytes.Buffer{}
+	require.NoError(t, gif.Encode(testGIF, gifImg, nil))
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"http://mock.com/1234/test.jpg": {
+			httpx.NewMockResponse(200, nil, testJPG),
+			httpx.NewMockResponse(200, nil, testJPG),
+		},
+		"http://mock.com/2345/test.gif": {
+			httpx.NewMockResponse(200, nil, testGIF.Bytes()),
+			httpx.NewMockResponse(200, nil, testGIF.Bytes()),
+		},
+		"http://mock.com/3456/gone.jpg": {
+			httpx.NewMockResponse(404, nil, []byte(`not found`)),
+		},
+	}))
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	mb.MockMedia(test.NewMockMedia("test.jpg", "image/jpeg", "http://mock.com/1234/test.jpg", len(testJPG), 640, 480, 0, nil))
+	mb.MockMedia(test.NewMockMedia("test.gif", "image/gif", "http://mock.com/2345/test.gif", testGIF.Len(), 64, 64, 0, nil))
+	mb.MockMedia(test.NewMockMedia("gone.jpg", "image/jpeg", "http://mock.com/3456/gone.jpg", 1024, 64, 64, 0, nil))
+
+	// JPEG converted to PNG for a channel which only supports PNG
+	resolved, err := handlers.ResolveAttachments(ctx, mb, channel, []string{"image/jpeg:http://mock.com/1234/test.jpg"}, map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/png"}}}, false)
+	assert.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.Equal(t, handlers.MediaTypeImage, resolved[0].Type)
+	assert.Equal(t, "test.png", resolved[0].Name)
+	assert.Equal(t, "image/png", resolved[0].ContentType)
+	assert.Regexp(t, `^https://backend.com/attachments/[\w-]{36}\.png$`, resolved[0].URL)
+
+	require.Len(t, mb.SavedAttachments(), 1)
+	saved := mb.SavedAttachments()[0]
+	assert.Equal(t, channel, saved.Channel)
+	assert.Equal(t, "image/png", saved.ContentType)
+	assert.Equal(t, "png", saved.Extension)
+	assert.Equal(t, len(saved.Data), resolved[0].Media.Size())
+
+	_, err = png.Decode(bytes.NewReader(saved.Data))
+	assert.NoError(t, err)
+
+	// resolving again uses the cached conversion
+	resolved2, err := handlers.ResolveAttachments(ctx, mb, channel, []string{"image/jpeg:http://mock.com/1234/test.jpg"}, map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/png"}}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, resolved[0].URL, resolved2[0].URL)
+	assert.Len(t, mb.SavedAttachments(), 1)
+
+	// JPEG recompressed and resized for a channel with a small max size
+	resolved, err = handlers.ResolveAttachments(ctx, mb, channel, []string{"image/jpeg:http://mock.com/1234/test.jpg"}, map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/jpeg"}, MaxBytes: 5000}}, false)
+	assert.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.Equal(t, "test.jpg", resolved[0].Name)
+	assert.Equal(t, "image/jpeg", resolved[0].ContentType)
+	assert.LessOrEqual(t, resolved[0].Media.Size(), 5000)
+	assert.Len(t, mb.SavedAttachments(), 2)
+
+	// GIF converted to JPEG
+	resolved, err = handlers.ResolveAttachments(ctx, mb, channel, []string{"image/gif:http://mock.com/2345/test.gif"}, map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/jpeg"}}}, false)
+	assert.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.Equal(t, "image/jpeg", resolved[0].ContentType)
+	assert.Len(t, mb.SavedAttachments(), 3)
+
+	// with private storage, channels are given a readable URL for the converted media
+	mb.SetPrivateAttachments("courier.example.com")
+
+	resolved, err = handlers.ResolveAttachments(ctx, mb, channel, []string{"image/gif:http://mock.com/2345/test.gif"}, map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/png"}}}, false)
+	assert.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.Equal(t, "image/png", resolved[0].ContentType)
+	assert.Regexp(t, `^https://backend.com/attachments/[\w-]{36}\.png\?signature=sesame$`, resolved[0].URL)
+	assert.Len(t, mb.SavedAttachments(), 4)
+
+	mb.SetPrivateAttachments("")
+
+	// if we can't fetch the media we can't convert it, so it's dropped
+	resolved, err = handlers.ResolveAttachments(ctx, mb, channel, []string{"image/jpeg:http://mock.com/3456/gone.jpg"}, map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/png"}}}, false)
+	assert.NoError(t, err)
+	assert.Len(t, resolved, 0)
+	assert.Len(t, mb.SavedAttachments(), 4)
+}
+
+func TestImageConverter(t *testing.T) {
+	gifImg := image.NewPaletted(image.Rect(0, 0, 64, 48), color.Palette{color.White, color.Black})
+	gifData := &bytes.Buffer{}
+	require.NoError(t, gif.Encode(gifData, gifImg, nil))
+
+	src := filepath.Join(t.TempDir(), "test.gif")
+	require.NoError(t, os.WriteFile(src, gifData.Bytes(), 0600))
+
+	converted, err := handlers.NewImageConverter(64*48).Convert(context.Background(), src, "image/gif", "image/png", 0)
+	assert.NoError(t, err)
+
+	config, err := png.DecodeConfig(bytes.NewReader(converted))
+	assert.NoError(t, err)
+	assert.Equal(t, 64, config.Width)
+	assert.Equal(t, 48, config.Height)
+
+	// images with more pixels than our limit aren't decoded
+	_, err = handlers.NewImageConverter(64*48-1).Convert(context.Background(), src, "image/gif", "image/png", 0)
+	assert.EqualError(t, err, "image is 64x48 which exceeds limit of 3071 pixels")
+}
+
+func TestFFmpegConverter(t *testing.T) {
+	// use a fake ffmpeg which just copies the input to the output
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	require.NoError(t, os.WriteFile(ffmpeg, []byte("#!/bin/sh\nfor last; do true; done\ncp \"$5\" \"$last\"\n"), 0700))
+
+	c := handlers.NewFFmpegConverter(ffmpeg)
+
+	audioMP3 := map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeAudio: {Types: []string{"audio/mpeg", "audio/mp4"}}}
+	videoMP4 := map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeVideo: {Types: []string{"video/mp4"}}}
+	anyAudio := map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeAudio: {MaxBytes: 1024}}
+
+	assert.Equal(t, "audio/mpeg", c.Target("audio/ogg", audioMP3))
+	assert.Equal(t, "audio/mp4", c.Target("audio/mpeg", audioMP3))
+	assert.Equal(t, "", c.Target("audio/ogg", anyAudio))
+	assert.Equal(t, "", c.Target("audio/ogg", videoMP4))
+	assert.Equal(t, "video/mp4", c.Target("video/quicktime", videoMP4))
+	assert.Equal(t, "", c.Target("video/mp4", videoMP4))
+	assert.Equal(t, "video/mp4", c.Target("image/gif", videoMP4))
+	assert.Equal(t, "", c.Target("image/gif", audioMP3))
+	assert.Equal(t, "", c.Target("image/jpeg", videoMP4))
+
+	src := filepath.Join(t.TempDir(), "in.ogg")
+	require.NoError(t, os.WriteFile(src, []byte("OGG data"), 0600))
+
+	converted, err := c.Convert(context.Background(), src, "audio/ogg", "audio/mpeg", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("OGG data"), converted)
+
+	_, err = c.Convert(context.Background(), src, "audio/ogg", "audio/mpeg", 4)
+	assert.EqualError(t, err, "converted media is 8 bytes which exceeds limit of 4")
+
+	_, err = c.Convert(context.Background(), src, "audio/ogg", "audio/flac", 0)
+	assert.EqualError(t, err, "ffmpeg can't convert to audio/flac")
+
+	// errors from ffmpeg are included in the error
+	require.NoError(t, os.WriteFile(ffmpeg, []byte("#!/bin/sh\necho 'Invalid data found when processing input' >&2\nexit 1\n"), 0700))
+
+	_, err = c.Convert(context.Background(), src, "audio/ogg", "audio/mpeg", 0)
+	assert.EqualError(t, err, "error running ffmpeg: Invalid data found when processing input: exit status 1")
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ffmpeg output options for each content type we can convert to
+var ffmpegOutputArgs = map[string][]string{
+	"audio/mpeg": {"-vn", "-c:a", "libmp3lame", "-q:a", "4"},
+	"audio/mp3":  {"-vn", "-c:a", "libmp3lame", "-q:a", "4"},
+	"audio/mp4":  {"-vn", "-c:a", "aac", "-b:a", "128k"},
+	"audio/aac":  {"-vn", "-c:a", "aac", "-b:a", "128k", "-f", "adts"},
+	"video/mp4":  {"-c:v", "libx264", "-pix_fmt", "yuv420p", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-c:a", "aac", "-movflags", "+faststart"},
+}
+
+// audio types in the order we prefer to convert to them
+var ffmpegAudioTargets = []string{"audio/mpeg", "audio/mp3", "audio/mp4", "audio/aac"}
+
+type ffmpegConverter struct {
+	path string
+}
+
+// NewFFmpegConverter creates a new converter for audio, video and animated images which runs the ffmpeg binary at the
+// given path
+func NewFFmpegConverter(path string) MediaConverter {
+	return &ffmpegConverter{path: path}
+}
+
+func (c *ffmpegConverter) Target(contentType string, support map[MediaType]MediaTypeSupport) string {
+	mediaType, _ := parseContentType(contentType)
+
+	switch {
+	case mediaType == MediaTypeAudio:
+		// only convert audio if the channel is explicit about which types it supports
+		if audioSupport := support[MediaTypeAudio]; len(audioSupport.Types) > 0 {
+			return firstSupported(audioSupport, without(ffmpegAudioTargets, contentType)...)
+		}
+	case mediaType == MediaTypeVideo:
+		if videoSupport := support[MediaTypeVideo]; len(videoSupport.Types) > 0 && contentType != "video/mp4" {
+			return firstSupported(videoSupport, "video/mp4")
+		}
+	case contentType == "image/gif":
+		// GIFs can be sent as videos to channels which support those, preserving the animation
+		if videoSupport, ok := support[MediaTypeVideo]; ok {
+			return firstSupported(videoSupport, "video/mp4")
+		}
+	}
+	return ""
+}
+
+func (c *ffmpegConverter) Convert(ctx context.Context, src string, contentType, target string, maxBytes int) ([]byte, error) {
+	outArgs, ok := ffmpegOutputArgs[target]
+	if !ok {
+		return nil, errors.Errorf("ffmpeg can't convert to %s", target)
+	}
+
+	dir, err := os.MkdirTemp("", "courier-ffmpeg")
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating temp directory")
+	}
+	defer os.RemoveAll(dir)
+
+	outPath := filepath.Join(dir, "out."+mediaExtensions[target])
+
+	args := append([]string{"-y", "-loglevel", "error", "-i", src}, outArgs...)
+	args = append(args, outPath)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, c.path, args...)
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "error running ffmpeg: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	converted, err := os.ReadFile(outPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading ffmpeg output")
+	}
+	if maxBytes > 0 && len(converted) > maxBytes {
+		return nil, errors.Errorf("converted media is %d bytes which exceeds limit of %d", len(converted), maxBytes)
+	}
+
+	return converted, nil
+}
+
+func without(types []string, t string) []string {
+	out := make([]string, 0, len(types))
+	for _, v := range types {
+		if v != t {
+			out = append(out, v)
+		}
+	}
+	return out
+}
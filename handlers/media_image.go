@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// images are scaled down by this factor until they fit within the max size
+const imageScaleFactor = 0.75
+
+// the smallest we'll scale an image down to before giving up
+const minImageDimension = 32
+
+var imageDecodableTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true}
+
+// converts images to JPEG or PNG, recompressing and resizing them if they're too big, using only the standard library
+type imageConverter struct {
+	maxPixels int
+}
+
+// NewImageConverter creates a new converter for images, which refuses to decode images with more than maxPixels
+// (width x height) as decoding those could use too much memory
+func NewImageConverter(maxPixels int) MediaConverter {
+	return &imageConverter{maxPixels: maxPixels}
+}
+
+func (c *imageConverter) Target(contentType string, support map[MediaType]MediaTypeSupport) string {
+	if !imageDecodableTypes[contentType] {
+		return ""
+	}
+
+	imgSupport := support[MediaTypeImage]
+
+	// prefer to keep the same type if that's supported and we can encode it
+	if contentType == "image/jpeg" || contentType == "image/png" {
+		if t := firstSupported(imgSupport, contentType); t != "" {
+			return t
+		}
+	}
+	return firstSupported(imgSupport, "image/jpeg", "image/png")
+}
+
+func (c *imageConverter) Convert(ctx context.Context, src string, contentType, target string, maxBytes int) ([]byte, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening image")
+	}
+	defer f.Close()
+
+	// check the dimensions of the image before decoding it, as a small file can decode to a huge image
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding image")
+	}
+	if config.Width*config.Height > c.maxPixels {
+		return nil, errors.Errorf("image is %dx%d which exceeds limit of %d pixels", config.Width, config.Height, c.maxPixels)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "error reading image")
+	}
+
+	var img image.Image
+	if contentType == "image/gif" {
+		img, err = gif.Decode(f) // only the first frame
+	} else {
+		img, _, err = image.Decode(f)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding image")
+	}
+
+	qualities := []int{0}
+	if target == "image/jpeg" {
+		img = flattenImage(img)
+		qualities = []int{85, 70, 55, 40}
+	}
+
+	for {
+		for _, q := range qualities {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			encoded, err := encodeImage(img, target, q)
+			if err != nil {
+				return nil, err
+			}
+			if maxBytes <= 0 || len(encoded) <= maxBytes {
+				return encoded, nil
+			}
+		}
+
+		// still too big, so scale down and try again
+		bounds := img.Bounds()
+		w, h := int(float64(bounds.Dx())*imageScaleFactor), int(float64(bounds.Dy())*imageScaleFactor)
+		if w < minImageDimension || h < minImageDimension {
+			return nil, errors.Errorf("unable to reduce image to %d bytes", maxBytes)
+		}
+
+		scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+}
+
+func encodeImage(img image.Image, contentType string, quality int) ([]byte, error) {
+	b := &bytes.Buffer{}
+	var err error
+
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(b, img, &jpeg.Options{Quality: quality})
+	case "image/png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(b, img)
+	default:
+		err = errors.Errorf("unsupported image type %s", contentType)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding image")
+	}
+	return b.Bytes(), nil
+}
+
+// draws the given image onto a white background, as JPEG doesn't support transparency
+func flattenImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+	return flat
+}
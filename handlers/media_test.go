@@ -13,6 +13,7 @@ import (
 func TestResolveAttachments(t *testing.T) {
 	ctx := context.Background()
 	mb := test.NewMockBackend()
+	channel := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "MCK", "2020", "US", nil)
 
 	imageJPG := test.NewMockMedia("test.jpg", "image/jpeg", "http://mock.com/1234/test.jpg", 1024*1024, 640, 480, 0, nil)
 
@@ -80,9 +81,9 @@ func TestResolveAttachments(t *testing.T) {
 			allowURLOnly: false,
 			resolved:     []*handlers.Attachment{},
 		},
-		{ // 6: resolveable uploaded image URL, type not in supported types
+		{ // 6: resolveable uploaded image URL, type not in supported types and can't be converted to one that is
 			attachments:  []string{"image/jpeg:http://mock.com/1234/test.jpg"},
-			mediaSupport: map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/png"}}},
+			mediaSupport: map[handlers.MediaType]handlers.MediaTypeSupport{handlers.MediaTypeImage: {Types: []string{"image/bmp"}}},
 			allowURLOnly: true,
 			resolved:     []*handlers.Attachment{},
 		},
@@ -137,7 +138,7 @@ func TestResolveAttachments(t *testing.T) {
 	}
 
 	for i, tc := range tcs {
-		resolved, err := handlers.ResolveAttachments(ctx, mb, tc.attachments, tc.mediaSupport, tc.allowURLOnly)
+		resolved, err := handlers.ResolveAttachments(ctx, mb, channel, tc.attachments, tc.mediaSupport, tc.allowURLOnly)
 		if tc.err != "" {
 			assert.EqualError(t, err, tc.err, "expected error for test %d", i)
 		} else {
@@ -89,6 +89,7 @@ var testCases = []IncomingTestCase{
 		ExpectedMsgText:      Sp("Hello there"),
 		ExpectedURN:          "tel:+242064661201",
 		ExpectedDate:         time.Date(2023, time.March, 14, 11, 46, 4, 855000000, time.UTC),
+		ExpectedFingerprint:  "1678794364855",
 	},
 	{
 		Label:                "Receive invalid URN Message",
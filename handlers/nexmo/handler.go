@@ -2,10 +2,12 @@ package nexmo
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,12 +20,16 @@ import (
 )
 
 const (
-	configNexmoAPIKey        = "nexmo_api_key"
-	configNexmoAPISecret     = "nexmo_api_secret"
-	configNexmoAppID         = "nexmo_app_id"
-	configNexmoAppPrivateKey = "nexmo_app_private_key"
+	configNexmoAPIKey          = "nexmo_api_key"
+	configNexmoAPISecret       = "nexmo_api_secret"
+	configNexmoAppID           = "nexmo_app_id"
+	configNexmoAppPrivateKey   = "nexmo_app_private_key"
+	configNexmoSignatureSecret = "nexmo_signature_secret"
 )
 
+// how old a signed request can be before it's rejected
+const signatureTolerance = 5 * time.Minute
+
 var (
 	maxMsgLength = 1600
 	sendURL      = "https://rest.nexmo.com/sms/json"
@@ -87,10 +93,54 @@ type handler struct {
 	handlers.BaseHandler
 }
 
+// see https://developer.vonage.com/en/getting-started/concepts/signing-messages, we only support the hmac-sha256 method
+var signatureVerifier = &handlers.HMACVerifier{
+	Signature: handlers.FormValue("sig"),
+	ConfigKey: configNexmoSignatureSecret,
+	Hash:      sha256.New,
+	Encoding:  handlers.SignatureHex,
+	Payload:   signedPayload,
+}
+
+// requests are only verified for channels which have a signature secret
+var verifier = handlers.VerifyIfConfigured(configNexmoSignatureSecret, handlers.VerifyAll(
+	signatureVerifier,
+	&handlers.TimestampVerifier{Timestamp: handlers.FormValue("timestamp"), Tolerance: signatureTolerance},
+	&handlers.ReplayVerifier{Key: handlers.FormValue("sig"), Window: signatureTolerance},
+))
+
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("NX"), "Nexmo", handlers.WithRedactConfigKeys(configNexmoAPISecret, configNexmoAppPrivateKey))}
+	return &handler{handlers.NewBaseHandler(courier.ChannelType("NX"), "Nexmo", handlers.WithRedactConfigKeys(configNexmoAPISecret, configNexmoAppPrivateKey, configNexmoSignatureSecret), handlers.WithVerifier(verifier))}
 }
 
+// builds what Vonage signs, which is all parameters except the signature sorted by key, as &key=value pairs with any &
+// or = characters in values replaced by underscores
+func signedPayload(r *http.Request) ([]byte, error) {
+	form, err := handlers.RequestForm(r)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		if k != "sig" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var payload strings.Builder
+	for _, k := range keys {
+		// Vonage never repeats parameters, but if they are we include every value so none can be added
+		for _, v := range form[k] {
+			payload.WriteString("&" + k + "=" + signedValueReplacer.Replace(v))
+		}
+	}
+	return []byte(payload.String()), nil
+}
+
+var signedValueReplacer = strings.NewReplacer("&", "_", "=", "_")
+
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
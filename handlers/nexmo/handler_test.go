@@ -1,8 +1,11 @@
 package nexmo
 
 import (
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
@@ -11,6 +14,7 @@ import (
 
 var testChannels = []courier.Channel{
 	test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "NX", "2020", "US", nil),
+	test.NewMockChannel("b1c2d3e4-5f60-4a7b-8c9d-0e1f2a3b4c5d", "NX", "2021", "US", map[string]any{configNexmoSignatureSecret: "sssh"}),
 }
 
 const (
@@ -114,6 +118,54 @@ func TestIncoming(t *testing.T) {
 	RunIncomingTestCases(t, testChannels, newHandler(), testCases)
 }
 
+func TestSignedRequests(t *testing.T) {
+	signedURL := func(params string, timestamp time.Time) string {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/c/nx/b1c2d3e4-5f60-4a7b-8c9d-0e1f2a3b4c5d/receive?%s&timestamp=%d", params, timestamp.Unix()), nil)
+		sig, _ := signatureVerifier.Sign("sssh", r)
+		return r.URL.String() + "&sig=" + sig
+	}
+
+	now := time.Now()
+	validURL := signedURL("to=2021&msisdn=2349067554729&text=Join%3D%26Go&messageId=external1", now)
+
+	RunIncomingTestCases(t, testChannels, newHandler(), []IncomingTestCase{
+		{
+			Label:                "Valid Signed Receive",
+			URL:                  validURL,
+			ExpectedRespStatus:   200,
+			ExpectedBodyContains: "Accepted",
+			ExpectedMsgText:      Sp("Join=&Go"),
+			ExpectedURN:          "tel:+2349067554729",
+			ExpectedExternalID:   "external1",
+			NoQueueErrorCheck:    true,
+		},
+		{
+			Label:                "Replayed Signed Receive",
+			URL:                  validURL,
+			ExpectedRespStatus:   400,
+			ExpectedBodyContains: "request has already been received",
+		},
+		{
+			Label:                "Expired Signed Receive",
+			URL:                  signedURL("to=2021&msisdn=2349067554729&text=Join&messageId=external2", now.Add(-time.Hour)),
+			ExpectedRespStatus:   400,
+			ExpectedBodyContains: "request timestamp is outside of allowed tolerance",
+		},
+		{
+			Label:                "Invalid Signature",
+			URL:                  signedURL("to=2021&msisdn=2349067554729&text=Join&messageId=external3", now) + "&text=Leave",
+			ExpectedRespStatus:   400,
+			ExpectedBodyContains: "invalid request signature",
+		},
+		{
+			Label:                "Missing Signature",
+			URL:                  "/c/nx/b1c2d3e4-5f60-4a7b-8c9d-0e1f2a3b4c5d/receive?to=2021&msisdn=2349067554729&text=Join&messageId=external4",
+			ExpectedRespStatus:   400,
+			ExpectedBodyContains: "missing request signature",
+		},
+	})
+}
+
 func BenchmarkHandler(b *testing.B) {
 	RunChannelBenchmarks(b, testChannels, newHandler(), testCases)
 }
@@ -3,6 +3,7 @@ package slack
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,8 +26,15 @@ const (
 	configBotToken        = "bot_token"
 	configUserToken       = "user_token"
 	configValidationToken = "verification_token"
+	configSigningSecret   = "signing_secret"
+
+	signatureHeader = "X-Slack-Signature"
+	timestampHeader = "X-Slack-Request-Timestamp"
 )
 
+// how old a signed request can be before it's rejected
+const signatureTolerance = 5 * time.Minute
+
 var (
 	ErrAlreadyPublic         = "already_public"
 	ErrPublicVideoNotAllowed = "public_video_not_allowed"
@@ -40,8 +48,34 @@ type handler struct {
 	handlers.BaseHandler
 }
 
+// see https://api.slack.com/authentication/verifying-requests-from-slack
+var signatureVerifier = &handlers.HMACVerifier{
+	Signature: handlers.HeaderValue(signatureHeader),
+	Prefix:    "v0=",
+	ConfigKey: configSigningSecret,
+	Hash:      sha256.New,
+	Encoding:  handlers.SignatureHex,
+	Payload:   signedPayload,
+}
+
+// requests are only verified for channels which have a signing secret
+var verifier = handlers.VerifyIfConfigured(configSigningSecret, handlers.VerifyAll(
+	signatureVerifier,
+	&handlers.TimestampVerifier{Timestamp: handlers.HeaderValue(timestampHeader), Tolerance: signatureTolerance},
+	&handlers.ReplayVerifier{Key: handlers.HeaderValue(signatureHeader), Window: signatureTolerance},
+))
+
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("SL"), "Slack", handlers.WithRedactConfigKeys(configBotToken, configUserToken, configValidationToken))}
+	return &handler{handlers.NewBaseHandler(courier.ChannelType("SL"), "Slack", handlers.WithRedactConfigKeys(configBotToken, configUserToken, configValidationToken, configSigningSecret), handlers.WithVerifier(verifier))}
+}
+
+// builds what Slack signs, which is the version, the request timestamp and the body
+func signedPayload(r *http.Request) ([]byte, error) {
+	body, err := handlers.BodyPayload(r)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("v0:%s:%s", r.Header.Get(timestampHeader), body)), nil
 }
 
 func (h *handler) Initialize(s courier.Server) error {
@@ -9,23 +9,28 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
 	"github.com/nyaruka/courier/test"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/stretchr/testify/assert"
 )
 
 const (
-	channelUUID = "8eb23e93-5ecb-45ba-b726-3b064e0c568c"
-	receiveURL  = "/c/sl/" + channelUUID + "/receive/"
+	channelUUID       = "8eb23e93-5ecb-45ba-b726-3b064e0c568c"
+	receiveURL        = "/c/sl/" + channelUUID + "/receive/"
+	signedChannelUUID = "4a8f4e8b-57b6-4b1d-8a34-8e2b5b3a1c6d"
+	signedReceiveURL  = "/c/sl/" + signedChannelUUID + "/receive/"
 )
 
 var testChannels = []courier.Channel{
 	test.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]any{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token"}),
+	test.NewMockChannel(signedChannelUUID, "SL", "2023", "US", map[string]any{"bot_token": "xoxb-def456", "signing_secret": "sssh"}),
 }
 
 const helloMsg = `{
@@ -277,6 +282,35 @@ func TestVerification(t *testing.T) {
 	})
 }
 
+func TestSigningSecret(t *testing.T) {
+	// signatures are computed independently as hex(hmac_sha256("sssh", "v0:<timestamp>:<body>"))
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)))
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	RunIncomingTestCases(t, testChannels, newHandler(), []IncomingTestCase{
+		{Label: "Signed Message", URL: signedReceiveURL, Data: helloMsg,
+			Headers:            map[string]string{timestampHeader: "1700000000", signatureHeader: "v0=85ba3acb8c6ff82025facfca3ee02741955df6e71cae473a9fec29fc46d7c4b1"},
+			ExpectedRespStatus: 200, ExpectedBodyContains: "Accepted", ExpectedMsgText: Sp("Hello World!"), ExpectedURN: "slack:U0123ABCDEF",
+			NoQueueErrorCheck: true,
+		},
+		{Label: "Replayed Message", URL: signedReceiveURL, Data: helloMsg,
+			Headers:            map[string]string{timestampHeader: "1700000000", signatureHeader: "v0=85ba3acb8c6ff82025facfca3ee02741955df6e71cae473a9fec29fc46d7c4b1"},
+			ExpectedRespStatus: 400, ExpectedBodyContains: "request has already been received",
+		},
+		{Label: "Expired Signature", URL: signedReceiveURL, Data: helloMsg,
+			Headers:            map[string]string{timestampHeader: "1699999400", signatureHeader: "v0=8ec43328d1bbfd817c2c27f58bb556014a0fe32fa4d8cda8f2b4ffa36d42e9d3"},
+			ExpectedRespStatus: 400, ExpectedBodyContains: "request timestamp is outside of allowed tolerance",
+		},
+		{Label: "Invalid Signature", URL: signedReceiveURL, Data: helloMsg,
+			Headers:            map[string]string{timestampHeader: "1700000000", signatureHeader: "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"},
+			ExpectedRespStatus: 400, ExpectedBodyContains: "invalid request signature",
+		},
+		{Label: "Missing Signature", URL: signedReceiveURL, Data: helloMsg,
+			ExpectedRespStatus: 400, ExpectedBodyContains: "missing request signature",
+		},
+	})
+}
+
 func buildMockAttachmentFileServer() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
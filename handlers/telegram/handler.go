@@ -20,6 +20,9 @@ import (
 
 var apiURL = "https://api.telegram.org"
 
+// header containing the secret token passed to setWebhook
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
 // see https://core.telegram.org/bots/api#sending-files
 var mediaSupport = map[handlers.MediaType]handlers.MediaTypeSupport{
 	handlers.MediaTypeImage:       {MaxBytes: 10 * 1024 * 1024},
@@ -36,8 +39,14 @@ type handler struct {
 	handlers.BaseHandler
 }
 
+// see https://core.telegram.org/bots/api#setwebhook, requests are only verified for channels which have a secret token
+var verifier = handlers.VerifyIfConfigured(courier.ConfigSecret, &handlers.TokenVerifier{
+	Token:     handlers.HeaderValue(secretTokenHeader),
+	ConfigKey: courier.ConfigSecret,
+})
+
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("TG"), "Telegram")}
+	return &handler{handlers.NewBaseHandler(courier.ChannelType("TG"), "Telegram", handlers.WithVerifier(verifier))}
 }
 
 // Initialize is called by the engine once everything is loaded
@@ -185,7 +194,7 @@ func (h *handler) Send(ctx context.Context, msg courier.MsgOut, clog *courier.Ch
 		return nil, fmt.Errorf("invalid auth token config")
 	}
 
-	attachments, err := handlers.ResolveAttachments(ctx, h.Backend(), msg.Attachments(), mediaSupport, true)
+	attachments, err := handlers.ResolveAttachments(ctx, h.Backend(), msg.Channel(), msg.Attachments(), mediaSupport, true)
 	if err != nil {
 		return nil, errors.Wrap(err, "error resolving attachments")
 	}
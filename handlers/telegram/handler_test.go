@@ -15,6 +15,7 @@ import (
 
 var testChannels = []courier.Channel{
 	test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c568c", "TG", "2020", "US", map[string]any{"auth_token": "a123"}),
+	test.NewMockChannel("c1b8e2a4-6d0b-4f5b-9a3e-7f2c4d9e1a55", "TG", "2021", "US", map[string]any{"auth_token": "b456", "secret": "sesame"}),
 }
 
 var helloMsg = `{
@@ -775,6 +776,41 @@ func TestIncoming(t *testing.T) {
 	RunIncomingTestCases(t, testChannels, newHandler(), testCases)
 }
 
+func TestSecretToken(t *testing.T) {
+	receiveURL := "/c/tg/c1b8e2a4-6d0b-4f5b-9a3e-7f2c4d9e1a55/receive/"
+
+	RunIncomingTestCases(t, testChannels, newHandler(), []IncomingTestCase{
+		{
+			Label:                "Receive Valid Secret Token",
+			URL:                  receiveURL,
+			Data:                 helloMsg,
+			Headers:              map[string]string{secretTokenHeader: "sesame"},
+			ExpectedRespStatus:   200,
+			ExpectedBodyContains: "Accepted",
+			ExpectedContactName:  Sp("Nic Pottier"),
+			ExpectedMsgText:      Sp("Hello World"),
+			ExpectedURN:          "telegram:3527065#nicpottier",
+			ExpectedExternalID:   "41",
+			ExpectedDate:         time.Date(2016, 1, 30, 1, 57, 9, 0, time.UTC),
+		},
+		{
+			Label:                "Receive Invalid Secret Token",
+			URL:                  receiveURL,
+			Data:                 helloMsg,
+			Headers:              map[string]string{secretTokenHeader: "open"},
+			ExpectedRespStatus:   400,
+			ExpectedBodyContains: "invalid request signature",
+		},
+		{
+			Label:                "Receive Missing Secret Token",
+			URL:                  receiveURL,
+			Data:                 helloMsg,
+			ExpectedRespStatus:   400,
+			ExpectedBodyContains: "missing request signature",
+		},
+	})
+}
+
 func BenchmarkHandler(b *testing.B) {
 	telegramService := buildMockTelegramService(testCases)
 	defer telegramService.Close()
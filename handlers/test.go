@@ -65,6 +65,7 @@ type IncomingTestCase struct {
 	ExpectedAttachments   []string
 	ExpectedDate          time.Time
 	ExpectedExternalID    string
+	ExpectedFingerprint   string
 	ExpectedMsgID         int64
 	ExpectedStatuses      []ExpectedStatus
 	ExpectedEvents        []ExpectedEvent
@@ -194,6 +195,9 @@ func RunIncomingTestCases(t *testing.T, channels []courier.Channel, handler cour
 				if tc.ExpectedExternalID != "" {
 					assert.Equal(t, tc.ExpectedExternalID, msg.ExternalID())
 				}
+				if tc.ExpectedFingerprint != "" {
+					assert.Equal(t, tc.ExpectedFingerprint, msg.Fingerprint())
+				}
 				assert.Equal(t, tc.ExpectedURN, msg.URN())
 			} else {
 				assert.Empty(t, mb.WrittenMsgs(), "unexpected msg written")
@@ -329,6 +333,7 @@ type OutgoingTestCase struct {
 	ExpectedStopEvent   bool
 	ExpectedContactURNs map[string]bool
 	ExpectedNewURN      string
+	ExpectedRetryAfter  time.Duration
 
 	// deprecated, use ExpectedRequests
 	ExpectedRequestPath string
@@ -420,6 +425,7 @@ func RunOutgoingTestCases(t *testing.T, channel courier.Channel, handler courier
 			}
 
 			assert.Equal(t, tc.ExpectedErrors, clog.Errors(), "unexpected errors logged")
+			assert.Equal(t, tc.ExpectedRetryAfter, clog.RetryAfter(), "retry after mismatch")
 
 			if tc.ExpectedRequestPath != "" || tc.ExpectedURLParams != nil || tc.ExpectedPostParams != nil || tc.ExpectedRequestBody != "" || tc.ExpectedHeaders != nil {
 				testRequest := actualRequests[len(actualRequests)-1]
@@ -7,10 +7,8 @@ package twiml
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
 	"crypto/sha1"
 	_ "embed"
-	"encoding/base64"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -63,8 +61,21 @@ type handler struct {
 	validateSignatures bool
 }
 
+// see https://www.twilio.com/docs/usage/security#validating-requests
+var verifier = &handlers.HMACVerifier{
+	Signature: handlers.HeaderValue(signatureHeader),
+	ConfigKey: courier.ConfigAuthToken,
+	Hash:      sha1.New,
+	Encoding:  handlers.SignatureBase64,
+	Payload:   signedPayload,
+}
+
 func newTWIMLHandler(channelType courier.ChannelType, name string, validateSignatures bool) courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(channelType, name), validateSignatures}
+	var options []func(*handlers.BaseHandler)
+	if validateSignatures {
+		options = append(options, handlers.WithVerifier(verifier))
+	}
+	return &handler{handlers.NewBaseHandler(channelType, name, options...), validateSignatures}
 }
 
 func init() {
@@ -113,14 +124,9 @@ var statusMapping = map[string]courier.MsgStatus{
 
 // receiveMessage is our HTTP handler function for incoming messages
 func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, clog *courier.ChannelLog) ([]courier.Event, error) {
-	err := h.validateSignature(channel, r)
-	if err != nil {
-		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
-	}
-
 	// get our params
 	form := &moForm{}
-	err = handlers.DecodeAndValidateForm(form, r)
+	err := handlers.DecodeAndValidateForm(form, r)
 	if err != nil {
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 	}
@@ -153,14 +159,9 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 
 // receiveStatus is our HTTP handler function for status updates
 func (h *handler) receiveStatus(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, clog *courier.ChannelLog) ([]courier.Event, error) {
-	err := h.validateSignature(channel, r)
-	if err != nil {
-		return nil, err
-	}
-
 	// get our params
 	form := &statusForm{}
-	err = handlers.DecodeAndValidateForm(form, r)
+	err := handlers.DecodeAndValidateForm(form, r)
 	if err != nil {
 		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "no msg status, ignoring")
 	}
@@ -231,7 +232,7 @@ func (h *handler) Send(ctx context.Context, msg courier.MsgOut, clog *courier.Ch
 
 	channel := msg.Channel()
 
-	attachments, err := handlers.ResolveAttachments(ctx, h.Backend(), msg.Attachments(), mediaSupport, true)
+	attachments, err := handlers.ResolveAttachments(ctx, h.Backend(), msg.Channel(), msg.Attachments(), mediaSupport, true)
 	if err != nil {
 		return nil, errors.Wrap(err, "error resolving attachments")
 	}
@@ -382,25 +383,10 @@ func (h *handler) baseURL(c courier.Channel) string {
 	return c.StringConfigForKey(configSendURL, c.StringConfigForKey(configBaseURL, ""))
 }
 
-// see https://www.twilio.com/docs/api/security
-func (h *handler) validateSignature(c courier.Channel, r *http.Request) error {
-	if !h.validateSignatures {
-		return nil
-	}
-
-	actual := r.Header.Get(signatureHeader)
-	if actual == "" {
-		return fmt.Errorf("missing request signature")
-	}
-
-	if err := r.ParseForm(); err != nil {
-		return err
-	}
-
-	confAuth := c.ConfigForKey(courier.ConfigAuthToken, "")
-	authToken, isStr := confAuth.(string)
-	if !isStr || authToken == "" {
-		return fmt.Errorf("invalid or missing auth token in config")
+// builds what Twilio signs, which is the full URL of the request followed by its sorted form parameters
+func signedPayload(r *http.Request) ([]byte, error) {
+	if _, err := handlers.RequestForm(r); err != nil {
+		return nil, err
 	}
 
 	path := r.URL.RequestURI()
@@ -409,48 +395,23 @@ func (h *handler) validateSignature(c courier.Channel, r *http.Request) error {
 		path = proxyPath
 	}
 
-	url := fmt.Sprintf("https://%s%s", r.Host, path)
-	expected, err := twCalculateSignature(url, r.PostForm, authToken)
-	if err != nil {
-		return err
-	}
-
-	// compare signatures in way that isn't sensitive to a timing attack
-	if !hmac.Equal(expected, []byte(actual)) {
-		return fmt.Errorf("invalid request signature")
-	}
-
-	return nil
-}
-
-// see https://www.twilio.com/docs/api/security
-func twCalculateSignature(url string, form url.Values, authToken string) ([]byte, error) {
 	var buffer bytes.Buffer
-	buffer.WriteString(url)
+	buffer.WriteString(fmt.Sprintf("https://%s%s", r.Host, path))
 
-	keys := make(sort.StringSlice, 0, len(form))
-	for k := range form {
+	keys := make(sort.StringSlice, 0, len(r.PostForm))
+	for k := range r.PostForm {
 		keys = append(keys, k)
 	}
 	keys.Sort()
 
 	for _, k := range keys {
 		buffer.WriteString(k)
-		for _, v := range form[k] {
+		for _, v := range r.PostForm[k] {
 			buffer.WriteString(v)
 		}
 	}
 
-	// hash with SHA1
-	mac := hmac.New(sha1.New, []byte(authToken))
-	mac.Write(buffer.Bytes())
-	hash := mac.Sum(nil)
-
-	// encode with Base64
-	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(hash)))
-	base64.StdEncoding.Encode(encoded, hash)
-
-	return encoded, nil
+	return buffer.Bytes(), nil
 }
 
 // WriteMsgSuccessResponse writes our response in TWIML format
@@ -1,10 +1,16 @@
 package twiml
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
+	"strings"
 	"testing"
 
 	"fmt"
@@ -508,6 +514,35 @@ func addForwardSignature(r *http.Request) {
 	r.Header.Set(signatureHeader, string(sig))
 }
 
+func twCalculateSignature(url string, form url.Values, authToken string) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(url)
+
+	keys := make(sort.StringSlice, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	keys.Sort()
+
+	for _, k := range keys {
+		buffer.WriteString(k)
+		for _, v := range form[k] {
+			buffer.WriteString(v)
+		}
+	}
+
+	// hash with SHA1
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write(buffer.Bytes())
+	hash := mac.Sum(nil)
+
+	// encode with Base64
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(hash)))
+	base64.StdEncoding.Encode(encoded, hash)
+
+	return encoded, nil
+}
+
 func addInvalidSignature(r *http.Request) {
 	r.Header.Set(signatureHeader, "invalidsig")
 }
@@ -952,6 +987,37 @@ var twaSendTestCases = []OutgoingTestCase{
 	},
 }
 
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+	form := "MessageSid=SMe287d7109a5a925f182f0e07fe5b223b&From=%2B14133881111&Body=Hello"
+
+	newRequest := func(target, forwardedPath, sig string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if forwardedPath != "" {
+			r.Header.Set(forwardedPathHeader, forwardedPath)
+		}
+		if sig != "" {
+			r.Header.Set(signatureHeader, sig)
+		}
+		return r
+	}
+
+	// signatures as computed by Twilio for these requests
+	r := newRequest("http://example.com/c/t/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive", "", "IDSKXX919v1XZgod8ztMGmiWqBU=")
+	sig, err := verifier.Sign("6789", r)
+	assert.NoError(t, err)
+	assert.Equal(t, "IDSKXX919v1XZgod8ztMGmiWqBU=", sig)
+	assert.NoError(t, verifier.Verify(ctx, mb, testChannels[0], r))
+
+	r = newRequest("http://example.com/c/tw/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive", "/handlers/twilio/receive/8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "1gx6dPTYi/y9kuWOOn0Czqd2dbI=")
+	assert.NoError(t, verifier.Verify(ctx, mb, testChannels[0], r))
+
+	r = newRequest("http://example.com/c/t/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive", "", "1gx6dPTYi/y9kuWOOn0Czqd2dbI=")
+	assert.Equal(t, ErrInvalidSignature, verifier.Verify(ctx, mb, testChannels[0], r))
+}
+
 func TestOutgoing(t *testing.T) {
 	maxMsgLength = 160
 	var defaultChannel = test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "T", "2020", "US",
@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing request signature")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrMissingTimestamp = errors.New("missing request timestamp")
+	ErrInvalidTimestamp = errors.New("request timestamp is outside of allowed tolerance")
+	ErrReplayedRequest  = errors.New("request has already been received")
+)
+
+// Verifier verifies that incoming requests were really sent by the channel they're for. Handlers opt in by passing one
+// to NewBaseHandler using WithVerifier, and the server then enforces it before any of the handler's funcs are called.
+type Verifier interface {
+	// Verify returns an error if the given request can't be verified
+	Verify(context.Context, courier.Backend, courier.Channel, *http.Request) error
+
+	// Handled is called after a verified request has been handled, with the error if handling it failed
+	Handled(context.Context, courier.Backend, courier.Channel, *http.Request, error)
+}
+
+// RequestValue extracts a value such as a signature or timestamp from a request
+type RequestValue func(*http.Request) string
+
+// HeaderValue returns a request value read from the given header
+func HeaderValue(name string) RequestValue {
+	return func(r *http.Request) string { return r.Header.Get(name) }
+}
+
+// FormValue returns a request value read from the given query or form parameter
+func FormValue(name string) RequestValue {
+	return func(r *http.Request) string {
+		form, _ := RequestForm(r)
+		return form.Get(name)
+	}
+}
+
+// RequestPayload returns the content of a request which was signed
+type RequestPayload func(*http.Request) ([]byte, error)
+
+// BodyPayload is a request payload which is the body of the request
+func BodyPayload(r *http.Request) ([]byte, error) {
+	return ReadBody(r, maxBodyReadBytes)
+}
+
+func readPayload(r *http.Request, payload RequestPayload) ([]byte, error) {
+	if payload == nil {
+		payload = BodyPayload
+	}
+	return payload(r)
+}
+
+// RequestForm parses the query and form parameters of the given request, leaving its body to be read again
+func RequestForm(r *http.Request) (url.Values, error) {
+	if r.Form == nil && r.Body != nil {
+		body, err := ReadBody(r, maxBodyReadBytes)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { r.Body = io.NopCloser(bytes.NewReader(body)) }()
+	}
+
+	err := r.ParseForm()
+	return r.Form, err
+}
+
+// SignatureEncoding is how a signature is encoded in a request
+type SignatureEncoding int
+
+const (
+	SignatureHex SignatureEncoding = iota
+	SignatureBase64
+)
+
+func (e SignatureEncoding) encode(sig []byte) string {
+	if e == SignatureBase64 {
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	return hex.EncodeToString(sig)
+}
+
+func (e SignatureEncoding) decode(sig string) ([]byte, error) {
+	if e == SignatureBase64 {
+		return base64.StdEncoding.DecodeString(sig)
+	}
+	return hex.DecodeString(sig)
+}
+
+// reads the signature from a request, removing the given prefix and decoding it
+func readSignature(r *http.Request, value RequestValue, prefix string, encoding SignatureEncoding) ([]byte, error) {
+	actual := value(r)
+	if actual == "" {
+		return nil, ErrMissingSignature
+	}
+
+	actual, hasPrefix := strings.CutPrefix(actual, prefix)
+	if !hasPrefix {
+		return nil, ErrInvalidSignature
+	}
+
+	decoded, err := encoding.decode(actual)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	return decoded, nil
+}
+
+func channelSecret(ch courier.Channel, key string) (string, error) {
+	secret := ch.StringConfigForKey(key, "")
+	if secret == "" {
+		return "", errors.Errorf("missing '%s' in channel config", key)
+	}
+	return secret, nil
+}
+
+// HMACVerifier verifies requests signed with an HMAC of their payload, using a secret from the channel config
+type HMACVerifier struct {
+	Signature RequestValue      // where the signature is read from
+	Prefix    string            // prefix of the signature, e.g. sha256=
+	ConfigKey string            // channel config key of the secret
+	Hash      func() hash.Hash  // hash function, e.g. sha256.New
+	Encoding  SignatureEncoding // how the signature is encoded
+	Payload   RequestPayload    // what was signed, defaults to the body
+}
+
+// Verify verifies the signature of the given request
+func (v *HMACVerifier) Verify(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request) error {
+	actual, err := readSignature(r, v.Signature, v.Prefix, v.Encoding)
+	if err != nil {
+		return err
+	}
+
+	secret, err := channelSecret(ch, v.ConfigKey)
+	if err != nil {
+		return err
+	}
+
+	payload, err := readPayload(r, v.Payload)
+	if err != nil {
+		return err
+	}
+
+	// compare signatures in way that isn't sensitive to a timing attack
+	if !hmac.Equal(v.mac(secret, payload), actual) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Handled is a no-op for this verifier
+func (v *HMACVerifier) Handled(context.Context, courier.Backend, courier.Channel, *http.Request, error) {
+}
+
+// Sign returns the signature of the given request, as it should be sent by a channel with the given secret
+func (v *HMACVerifier) Sign(secret string, r *http.Request) (string, error) {
+	payload, err := readPayload(r, v.Payload)
+	if err != nil {
+		return "", err
+	}
+	return v.Prefix + v.Encoding.encode(v.mac(secret, payload)), nil
+}
+
+func (v *HMACVerifier) mac(secret string, payload []byte) []byte {
+	mac := hmac.New(v.Hash, []byte(secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// RSAVerifier verifies requests signed with RSA PKCS #1 v1.5, using a PEM encoded public key from the channel config
+type RSAVerifier struct {
+	Signature RequestValue      // where the signature is read from
+	ConfigKey string            // channel config key of the public key
+	Hash      crypto.Hash       // hash function, e.g. crypto.SHA256
+	Encoding  SignatureEncoding // how the signature is encoded
+	Payload   RequestPayload    // what was signed, defaults to the body
+}
+
+// Verify verifies the signature of the given request
+func (v *RSAVerifier) Verify(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request) error {
+	actual, err := readSignature(r, v.Signature, "", v.Encoding)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := channelSecret(ch, v.ConfigKey)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return errors.Errorf("invalid public key in channel config")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "invalid public key in channel config")
+	}
+	rsaKey, isRSA := key.(*rsa.PublicKey)
+	if !isRSA {
+		return errors.Errorf("public key in channel config isn't an RSA key")
+	}
+
+	payload, err := readPayload(r, v.Payload)
+	if err != nil {
+		return err
+	}
+
+	hash := v.Hash.New()
+	hash.Write(payload)
+
+	if err := rsa.VerifyPKCS1v15(rsaKey, v.Hash, hash.Sum(nil), actual); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Handled is a no-op for this verifier
+func (v *RSAVerifier) Handled(context.Context, courier.Backend, courier.Channel, *http.Request, error) {
+}
+
+// TokenVerifier verifies requests which include a shared secret token from the channel config
+type TokenVerifier struct {
+	Token     RequestValue // where the token is read from
+	ConfigKey string       // channel config key of the token
+}
+
+// Verify verifies the token of the given request
+func (v *TokenVerifier) Verify(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request) error {
+	actual := v.Token(r)
+	if actual == "" {
+		return ErrMissingSignature
+	}
+
+	expected, err := channelSecret(ch, v.ConfigKey)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Handled is a no-op for this verifier
+func (v *TokenVerifier) Handled(context.Context, courier.Backend, courier.Channel, *http.Request, error) {
+}
+
+// TimestampVerifier verifies that requests include a timestamp, in seconds since the epoch, within a tolerance of now.
+// It should be used with a verifier of a signature which covers the timestamp.
+type TimestampVerifier struct {
+	Timestamp RequestValue  // where the timestamp is read from
+	Tolerance time.Duration // how far the timestamp can be from now in either direction
+}
+
+// Verify verifies the timestamp of the given request
+func (v *TimestampVerifier) Verify(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request) error {
+	value := v.Timestamp(r)
+	if value == "" {
+		return ErrMissingTimestamp
+	}
+
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	age := dates.Since(time.Unix(secs, 0))
+	if age > v.Tolerance || age < -v.Tolerance {
+		return ErrInvalidTimestamp
+	}
+	return nil
+}
+
+// Handled is a no-op for this verifier
+func (v *TimestampVerifier) Handled(context.Context, courier.Backend, courier.Channel, *http.Request, error) {
+}
+
+// ReplayVerifier rejects requests with a key, typically their signature, which has already been received within a window,
+// which should be at least the tolerance of a timestamp verifier. Requests are claimed atomically when they're verified so
+// that concurrent replays are rejected too, and released again if handling them fails so that channels can retry them.
+type ReplayVerifier struct {
+	Key    RequestValue  // the value which identifies a request
+	Window time.Duration // how long handled requests are remembered for
+}
+
+// Verify verifies that the given request hasn't already been received, claiming it if not
+func (v *ReplayVerifier) Verify(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request) error {
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	_, err := redis.String(rc.Do("SET", v.redisKey(ch, r), "1", "NX", "EX", int(v.Window/time.Second)))
+	if err == redis.ErrNil {
+		return ErrReplayedRequest
+	}
+	return errors.Wrap(err, "error checking for replayed request")
+}
+
+// Handled releases the claim on the given request if handling it failed, so that it can be retried
+func (v *ReplayVerifier) Handled(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	rc.Do("DEL", v.redisKey(ch, r))
+}
+
+func (v *ReplayVerifier) redisKey(ch courier.Channel, r *http.Request) string {
+	return fmt.Sprintf("handled_request:%s:%s", ch.UUID(), v.Key(r))
+}
+
+type allVerifier []Verifier
+
+// VerifyAll returns a verifier which requires requests to pass all of the given verifiers, in order
+func VerifyAll(verifiers ...Verifier) Verifier {
+	return allVerifier(verifiers)
+}
+
+func (a allVerifier) Verify(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request) error {
+	for i, v := range a {
+		if err := v.Verify(ctx, b, ch, r); err != nil {
+			// the request won't be handled so let the verifiers which did pass it release anything they claimed
+			a[:i].Handled(ctx, b, ch, r, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (a allVerifier) Handled(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request, err error) {
+	for _, v := range a {
+		v.Handled(ctx, b, ch, r, err)
+	}
+}
+
+type ifConfiguredVerifier struct {
+	configKey string
+	verifier  Verifier
+}
+
+// VerifyIfConfigured returns a verifier which only verifies requests to channels which have a value for the given
+// config key, e.g. a signing secret, allowing verification to be enabled channel by channel
+func VerifyIfConfigured(configKey string, v Verifier) Verifier {
+	return &ifConfiguredVerifier{configKey: configKey, verifier: v}
+}
+
+func (c *ifConfiguredVerifier) Verify(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request) error {
+	if ch.StringConfigForKey(c.configKey, "") == "" {
+		return nil
+	}
+	return c.verifier.Verify(ctx, b, ch, r)
+}
+
+func (c *ifConfiguredVerifier) Handled(ctx context.Context, b courier.Backend, ch courier.Channel, r *http.Request, err error) {
+	if ch.StringConfigForKey(c.configKey, "") != "" {
+		c.verifier.Handled(ctx, b, ch, r, err)
+	}
+}
@@ -0,0 +1,208 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(body string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "https://localhost/c/xx/receive?foo=bar", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestHMACVerifier(t *testing.T) {
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+	ch := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "XX", "2020", "US", map[string]any{"secret": "sesame"})
+	noSecret := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ac", "XX", "2020", "US", nil)
+
+	v := &handlers.HMACVerifier{
+		Signature: handlers.HeaderValue("X-Signature"),
+		Prefix:    "sha256=",
+		ConfigKey: "secret",
+		Hash:      sha256.New,
+		Encoding:  handlers.SignatureHex,
+	}
+
+	r := newRequest("text=hello", nil)
+	sig, err := v.Sign("sesame", r)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256=5d9a2a40d74b15367ea5c424bca787e1ba4e907ce968afceb58cdd30f681dec9", sig)
+
+	r = newRequest("text=hello", map[string]string{"X-Signature": sig})
+	assert.NoError(t, v.Verify(ctx, mb, ch, r))
+
+	// body can still be read by the handler
+	body, _ := io.ReadAll(r.Body)
+	assert.Equal(t, "text=hello", string(body))
+
+	// hex signatures aren't case sensitive
+	r = newRequest("text=hello", map[string]string{"X-Signature": "sha256=" + strings.ToUpper(sig[7:])})
+	assert.NoError(t, v.Verify(ctx, mb, ch, r))
+
+	// but do need their prefix
+	r = newRequest("text=hello", map[string]string{"X-Signature": sig[7:]})
+	assert.Equal(t, handlers.ErrInvalidSignature, v.Verify(ctx, mb, ch, r))
+
+	r = newRequest("text=goodbye", map[string]string{"X-Signature": sig})
+	assert.Equal(t, handlers.ErrInvalidSignature, v.Verify(ctx, mb, ch, r))
+
+	r = newRequest("text=hello", map[string]string{"X-Signature": "sha256=xyz"})
+	assert.Equal(t, handlers.ErrInvalidSignature, v.Verify(ctx, mb, ch, r))
+
+	r = newRequest("text=hello", nil)
+	assert.Equal(t, handlers.ErrMissingSignature, v.Verify(ctx, mb, ch, r))
+
+	r = newRequest("text=hello", map[string]string{"X-Signature": sig})
+	assert.EqualError(t, v.Verify(ctx, mb, noSecret, r), "missing 'secret' in channel config")
+
+	// unless verification is only for channels with a secret
+	assert.NoError(t, handlers.VerifyIfConfigured("secret", v).Verify(ctx, mb, noSecret, r))
+	assert.Equal(t, handlers.ErrMissingSignature, handlers.VerifyIfConfigured("secret", v).Verify(ctx, mb, ch, newRequest("text=hello", nil)))
+
+	// signature can be of other parts of the request and read from a form value
+	v = &handlers.HMACVerifier{
+		Signature: handlers.FormValue("sig"),
+		ConfigKey: "secret",
+		Hash:      sha256.New,
+		Encoding:  handlers.SignatureBase64,
+		Payload: func(r *http.Request) ([]byte, error) {
+			form, err := handlers.RequestForm(r)
+			return []byte(form.Get("foo") + form.Get("text")), err
+		},
+	}
+
+	sig, err = v.Sign("sesame", newRequest("text=hello", nil))
+	require.NoError(t, err)
+
+	r = newRequest("text=hello&sig="+strings.ReplaceAll(sig, "+", "%2B"), nil)
+	assert.NoError(t, v.Verify(ctx, mb, ch, r))
+
+	body, _ = io.ReadAll(r.Body)
+	assert.Equal(t, "text=hello&sig="+strings.ReplaceAll(sig, "+", "%2B"), string(body))
+}
+
+func TestRSAVerifier(t *testing.T) {
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pubPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+
+	ch := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "XX", "2020", "US", map[string]any{"public_key": pubPEM})
+	badKey := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ac", "XX", "2020", "US", map[string]any{"public_key": "xyz"})
+
+	v := &handlers.RSAVerifier{
+		Signature: handlers.HeaderValue("X-Signature"),
+		ConfigKey: "public_key",
+		Hash:      crypto.SHA256,
+		Encoding:  handlers.SignatureBase64,
+	}
+
+	hash := sha256.Sum256([]byte(`{"text":"hello"}`))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	require.NoError(t, err)
+	encoded := base64.StdEncoding.EncodeToString(sig)
+
+	assert.NoError(t, v.Verify(ctx, mb, ch, newRequest(`{"text":"hello"}`, map[string]string{"X-Signature": encoded})))
+	assert.Equal(t, handlers.ErrInvalidSignature, v.Verify(ctx, mb, ch, newRequest(`{"text":"goodbye"}`, map[string]string{"X-Signature": encoded})))
+	assert.Equal(t, handlers.ErrMissingSignature, v.Verify(ctx, mb, ch, newRequest(`{"text":"hello"}`, nil)))
+	assert.EqualError(t, v.Verify(ctx, mb, badKey, newRequest(`{"text":"hello"}`, map[string]string{"X-Signature": encoded})), "invalid public key in channel config")
+}
+
+func TestTokenVerifier(t *testing.T) {
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+	ch := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "XX", "2020", "US", map[string]any{"secret": "sesame"})
+
+	v := &handlers.TokenVerifier{Token: handlers.HeaderValue("X-Token"), ConfigKey: "secret"}
+
+	assert.NoError(t, v.Verify(ctx, mb, ch, newRequest("", map[string]string{"X-Token": "sesame"})))
+	assert.Equal(t, handlers.ErrInvalidSignature, v.Verify(ctx, mb, ch, newRequest("", map[string]string{"X-Token": "sesam"})))
+	assert.Equal(t, handlers.ErrMissingSignature, v.Verify(ctx, mb, ch, newRequest("", nil)))
+}
+
+func TestTimestampAndReplayVerifiers(t *testing.T) {
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+	ch := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "XX", "2020", "US", nil)
+	ch2 := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ac", "XX", "2020", "US", nil)
+
+	v := handlers.VerifyAll(
+		&handlers.TimestampVerifier{Timestamp: handlers.HeaderValue("X-Timestamp"), Tolerance: time.Minute},
+		&handlers.ReplayVerifier{Key: handlers.HeaderValue("X-Signature"), Window: time.Minute},
+	)
+
+	timestamp := func(d time.Duration) string { return strconv.FormatInt(time.Now().Add(d).Unix(), 10) }
+
+	assert.Equal(t, handlers.ErrMissingTimestamp, v.Verify(ctx, mb, ch, newRequest("", map[string]string{"X-Signature": "abc"})))
+	assert.Equal(t, handlers.ErrInvalidTimestamp, v.Verify(ctx, mb, ch, newRequest("", map[string]string{"X-Timestamp": "xx", "X-Signature": "abc"})))
+	assert.Equal(t, handlers.ErrInvalidTimestamp, v.Verify(ctx, mb, ch, newRequest("", map[string]string{"X-Timestamp": timestamp(-2 * time.Minute), "X-Signature": "abc"})))
+	assert.Equal(t, handlers.ErrInvalidTimestamp, v.Verify(ctx, mb, ch, newRequest("", map[string]string{"X-Timestamp": timestamp(2 * time.Minute), "X-Signature": "abc"})))
+
+	r := newRequest("", map[string]string{"X-Timestamp": timestamp(-30 * time.Second), "X-Signature": "abc"})
+	assert.NoError(t, v.Verify(ctx, mb, ch, r))
+
+	// the first request claims its signature so a replay is rejected even before the first has been handled
+	assert.Equal(t, handlers.ErrReplayedRequest, v.Verify(ctx, mb, ch, r))
+
+	// but if handling fails, the claim is released so that the channel can retry
+	v.Handled(ctx, mb, ch, r, errors.New("boom"))
+	assert.NoError(t, v.Verify(ctx, mb, ch, r))
+	v.Handled(ctx, mb, ch, r, nil)
+	assert.Equal(t, handlers.ErrReplayedRequest, v.Verify(ctx, mb, ch, r))
+
+	// requests are only replays for the same channel
+	assert.NoError(t, v.Verify(ctx, mb, ch2, r))
+
+	// concurrent requests with the same signature are only allowed through once
+	r2 := newRequest("", map[string]string{"X-Timestamp": timestamp(0), "X-Signature": "def"})
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v.Verify(ctx, mb, ch, r2) == nil {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), allowed.Load())
+
+	// a request which fails a later verifier doesn't stay claimed by an earlier one
+	replay := &handlers.ReplayVerifier{Key: handlers.HeaderValue("X-Signature"), Window: time.Minute}
+	v2 := handlers.VerifyAll(replay, &handlers.TimestampVerifier{Timestamp: handlers.HeaderValue("X-Timestamp"), Tolerance: time.Minute})
+	r3 := newRequest("", map[string]string{"X-Timestamp": timestamp(-2 * time.Minute), "X-Signature": "ghi"})
+	assert.Equal(t, handlers.ErrInvalidTimestamp, v2.Verify(ctx, mb, ch, r3))
+	assert.NoError(t, replay.Verify(ctx, mb, ch, r3))
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/queue"
 	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/i18n"
@@ -905,13 +906,11 @@ func (h *handler) sendWhatsAppMsg(rc redis.Conn, msg courier.MsgOut, sendPath *u
 	}
 
 	if resp != nil && (resp.StatusCode == 429 || resp.StatusCode == 503) {
-		rateLimitKey := fmt.Sprintf("rate_limit:%s", msg.Channel().UUID())
-		rc.Do("SET", rateLimitKey, "engaged")
-
-		// The rate limit is 50 requests per second
-		// We pause sending 2 seconds so the limit count is reset
-		// TODO: In the future we should the header value when available
-		rc.Do("EXPIRE", rateLimitKey, 2)
+		// The rate limit is 50 requests per second, so if we weren't told how long to wait
+		// we pause sending 2 seconds so the limit count is reset
+		if clog.RetryAfter() == 0 {
+			clog.SetRetryAfter(2 * time.Second)
+		}
 
 		return "", "", errors.New("received rate-limit response from send endpoint")
 	}
@@ -922,7 +921,7 @@ func (h *handler) sendWhatsAppMsg(rc redis.Conn, msg courier.MsgOut, sendPath *u
 	// handle send msg errors
 	if err == nil && len(errPayload.Errors) > 0 {
 		if hasTiersError(*errPayload) {
-			rateLimitBulkKey := fmt.Sprintf("rate_limit_bulk:%s", msg.Channel().UUID())
+			rateLimitBulkKey := queue.RateLimitBulkKeyPrefix + string(msg.Channel().UUID())
 			rc.Do("SET", rateLimitBulkKey, "engaged")
 
 			// The WA tiers spam rate limit hit
@@ -601,6 +601,7 @@ var defaultSendTestCases = []OutgoingTestCase{
 		MockResponseStatus:  429,
 		ExpectedRequestBody: `{"to":"250788123123","type":"text","text":{"body":"Error"}}`,
 		ExpectedMsgStatus:   "E",
+		ExpectedRetryAfter:  2 * time.Second,
 		SendPrep:            setSendURL,
 	},
 	{
@@ -0,0 +1,66 @@
+package courier
+
+// HealthCheck is the result of checking a single service that a backend depends on
+type HealthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Required bool   `json:"required"`
+}
+
+// NewHealthCheck creates a new health check result from the passed in error, which is nil if the check passed
+func NewHealthCheck(name string, required bool, err error) *HealthCheck {
+	c := &HealthCheck{Name: name, OK: err == nil, Required: required}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// HealthReport is the result of checking all the services that a backend depends on
+type HealthReport struct {
+	Checks []*HealthCheck `json:"checks"`
+}
+
+// Healthy returns whether all checks passed
+func (r *HealthReport) Healthy() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Ready returns whether all required checks passed, i.e. whether we are able to handle requests
+func (r *HealthReport) Ready() bool {
+	for _, c := range r.Checks {
+		if c.Required && !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// QueueStatus is the status of a single channel's outgoing queue
+type QueueStatus struct {
+	ChannelUUID ChannelUUID `json:"channel_uuid"`
+	ChannelType ChannelType `json:"channel_type"` // empty if channel couldn't be looked up
+	Size        int         `json:"size"`
+	BulkSize    int         `json:"bulk_size"`
+	Pending     int         `json:"pending"` // msgs counted in size and bulk size which are scheduled to be sent later
+	Workers     int         `json:"workers"`
+	TPS         int         `json:"tps"`
+
+	MaxConcurrency int  `json:"max_concurrency,omitempty"` // zero if the channel doesn't have a concurrency limit
+	Saturated      bool `json:"saturated"`                 // whether all the workers the channel is limited to are busy
+
+	Circuit         string `json:"circuit"`          // closed, open or probing
+	CircuitFailures int    `json:"circuit_failures"` // consecutive errored sends
+}
+
+// StatusReport is the current status of a backend, its queue sizes, workers etc..
+type StatusReport struct {
+	Queues []*QueueStatus  `json:"queues"`
+	Spool  []*SpoolBacklog `json:"spool,omitempty"` // nil if the backend doesn't spool
+}
@@ -0,0 +1,105 @@
+package courier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/urns"
+)
+
+// ErrInboundLimitExceeded is wrapped by the errors returned when an incoming msg or channel event would exceed an inbound rate limit
+var ErrInboundLimitExceeded = errors.New("inbound rate limit exceeded")
+
+// InboundLimitScope is what an inbound rate limit applies to
+type InboundLimitScope string
+
+// Possible values for InboundLimitScope
+const (
+	InboundLimitScopeChannel InboundLimitScope = "channel"
+	InboundLimitScopeURN     InboundLimitScope = "urn"
+)
+
+// the period over which inbound rate limits are counted
+const inboundLimitWindow = time.Minute
+
+// InboundLimitError is returned by backends when writing an incoming msg or channel event would exceed an inbound rate
+// limit, and can be retried after RetryAfter when the current window ends.
+type InboundLimitError struct {
+	Scope      InboundLimitScope
+	RetryAfter time.Duration
+}
+
+func (e *InboundLimitError) Error() string {
+	return fmt.Sprintf("%s for %s, retry after %s", ErrInboundLimitExceeded, e.Scope, e.RetryAfter)
+}
+
+func (e *InboundLimitError) Unwrap() error {
+	return ErrInboundLimitExceeded
+}
+
+// InboundLimits are the maximum numbers of incoming msgs and channel events per minute for channels and for URNs on
+// channels. A channel's own config takes precedence over these defaults, and a limit of zero means no limit.
+type InboundLimits struct {
+	ChannelLimit int
+	URNLimit     int
+}
+
+// NewInboundLimits creates new inbound limits from the given config
+func NewInboundLimits(cfg *Config) *InboundLimits {
+	return &InboundLimits{ChannelLimit: cfg.InboundChannelLimit, URNLimit: cfg.InboundURNLimit}
+}
+
+// increments a counter, setting its expiry if it's new, and returns its new value
+var luaIncrLimit = redis.NewScript(1, `-- KEYS: [Key] ARGV: [Expiry]
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("EXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// Check counts an incoming msg or channel event from the given URN on the given channel, returning an InboundLimitError
+// if that takes the URN or the channel over their limits. The URN is checked first so that a single URN going over its
+// limit doesn't use up the limit of the whole channel. If Redis can't be reached, we don't limit anything.
+func (l *InboundLimits) Check(ctx context.Context, rc redis.Conn, ch Channel, urn urns.URN, now time.Time) error {
+	channelLimit := ch.IntConfigForKey(ConfigInboundChannelLimit, l.ChannelLimit)
+	urnLimit := ch.IntConfigForKey(ConfigInboundURNLimit, l.URNLimit)
+
+	window := now.Truncate(inboundLimitWindow)
+	retryAfter := window.Add(inboundLimitWindow).Sub(now)
+	expiry := int(inboundLimitWindow/time.Second) * 2
+
+	if urnLimit > 0 && urn != urns.NilURN {
+		count, err := redis.Int(luaIncrLimit.Do(rc, fmt.Sprintf("inbound_limit:%s:%d:%s", ch.UUID(), window.Unix(), urn.Identity()), expiry))
+		if err != nil {
+			slog.Error("error checking inbound URN limit", "error", err, "channel_uuid", ch.UUID())
+		} else if count > urnLimit {
+			return &InboundLimitError{Scope: InboundLimitScopeURN, RetryAfter: retryAfter}
+		}
+	}
+
+	if channelLimit > 0 {
+		count, err := redis.Int(luaIncrLimit.Do(rc, fmt.Sprintf("inbound_limit:%s:%d", ch.UUID(), window.Unix()), expiry))
+		if err != nil {
+			slog.Error("error checking inbound channel limit", "error", err, "channel_uuid", ch.UUID())
+		} else if count > channelLimit {
+			return &InboundLimitError{Scope: InboundLimitScopeChannel, RetryAfter: retryAfter}
+		}
+	}
+
+	if accepted, ok := ctx.Value(contextInboundAccepted).(*int); ok {
+		*accepted++
+	}
+	return nil
+}
+
+// returns a context for handling a request which counts the incoming msgs and channel events that pass their limits, so
+// that if the request goes over a limit part way through, we know whether anything from it has already been written
+func withInboundAcceptedCount(ctx context.Context) (context.Context, *int) {
+	accepted := new(int)
+	return context.WithValue(ctx, contextInboundAccepted, accepted), accepted
+}
@@ -0,0 +1,59 @@
+package courier_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/test"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInboundLimits(t *testing.T) {
+	ctx := context.Background()
+	mb := test.NewMockBackend()
+	rc := mb.RedisPool().Get()
+	defer rc.Close()
+
+	cfg := courier.NewConfig()
+	cfg.InboundChannelLimit = 3
+	cfg.InboundURNLimit = 2
+
+	limits := courier.NewInboundLimits(cfg)
+	assert.Equal(t, &courier.InboundLimits{ChannelLimit: 3, URNLimit: 2}, limits)
+
+	channel := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "MCK", "2020", "US", nil)
+	unlimited := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ac", "MCK", "2020", "US", map[string]any{courier.ConfigInboundChannelLimit: 0, courier.ConfigInboundURNLimit: 0})
+	urn1 := urns.URN("tel:+12065551212")
+	urn2 := urns.URN("tel:+12065551313")
+	now := time.Date(2024, 3, 15, 10, 30, 15, 0, time.UTC)
+
+	assert.NoError(t, limits.Check(ctx, rc, channel, urn1, now))
+	assert.NoError(t, limits.Check(ctx, rc, channel, urn1, now))
+
+	// third from the same URN is over the URN limit
+	assert.Equal(t, &courier.InboundLimitError{Scope: courier.InboundLimitScopeURN, RetryAfter: 45 * time.Second}, limits.Check(ctx, rc, channel, urn1, now))
+
+	// which didn't count towards the channel limit so one more from another URN is fine
+	assert.NoError(t, limits.Check(ctx, rc, channel, urn2, now.Add(5*time.Second)))
+
+	err := limits.Check(ctx, rc, channel, urn2, now.Add(15*time.Second))
+	assert.Equal(t, &courier.InboundLimitError{Scope: courier.InboundLimitScopeChannel, RetryAfter: 30 * time.Second}, err)
+	assert.ErrorIs(t, err, courier.ErrInboundLimitExceeded)
+	assert.EqualError(t, err, "inbound rate limit exceeded for channel, retry after 30s")
+
+	// limits are per minute so everything is allowed again in the next minute
+	assert.NoError(t, limits.Check(ctx, rc, channel, urn1, now.Add(time.Minute)))
+
+	// and channels can override the defaults
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, limits.Check(ctx, rc, unlimited, urn1, now))
+	}
+
+	assert.NoError(t, cfg.Validate())
+
+	cfg.InboundLimitAction = "drop"
+	assert.EqualError(t, cfg.Validate(), "Key: 'Config.InboundLimitAction' Error:Field validation for 'InboundLimitAction' failed on the 'oneof' tag")
+}
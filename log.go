@@ -38,6 +38,20 @@ func LogMsgReceived(r *http.Request, msg MsgIn) {
 
 }
 
+// LogMsgDeduped logs that we received the passed in message but it was a duplicate of one already received
+func LogMsgDeduped(r *http.Request, msg MsgIn) {
+	if slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+		slog.Debug("msg deduped",
+			"channel_uuid", msg.Channel().UUID(),
+			"url", r.Context().Value(contextRequestURL),
+			"elapsed_ms", getElapsedMS(r),
+			"msg_uuid", msg.UUID(),
+			"msg_urn", msg.URN().Identity(),
+			"deduped_by", msg.DedupedBy(),
+		)
+	}
+}
+
 // LogChannelEventReceived logs that we received the passed in channel event
 func LogChannelEventReceived(r *http.Request, event ChannelEvent) {
 	if slog.Default().Enabled(r.Context(), slog.LevelDebug) {
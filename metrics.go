@@ -0,0 +1,135 @@
+package courier
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// IncomingOutcome is the outcome of an incoming channel request as recorded in metrics
+type IncomingOutcome string
+
+// Possible values for IncomingOutcome
+const (
+	IncomingOutcomeMsg     IncomingOutcome = "msg"
+	IncomingOutcomeStatus  IncomingOutcome = "status"
+	IncomingOutcomeEvent   IncomingOutcome = "event"
+	IncomingOutcomeIgnored IncomingOutcome = "ignored"
+	IncomingOutcomeError   IncomingOutcome = "error"
+
+	// IncomingOutcomeRejected is a request rejected because of where it came from
+	IncomingOutcomeRejected IncomingOutcome = "rejected"
+
+	// IncomingOutcomeLimited is a request refused because its channel or URN exceeded their inbound rate limits
+	IncomingOutcomeLimited IncomingOutcome = "limited"
+
+	// IncomingOutcomeDuplicate is a msg which was a duplicate of one already received and so wasn't written again
+	IncomingOutcomeDuplicate IncomingOutcome = "duplicate"
+)
+
+var (
+	metricSendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "courier",
+		Name:      "msg_send_duration_seconds",
+		Help:      "Time taken by channel handlers to send outgoing messages.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 35},
+	}, []string{"channel_type", "channel_uuid"})
+
+	metricSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "courier",
+		Name:      "msg_sends_total",
+		Help:      "Number of outgoing message sends by resulting message status.",
+	}, []string{"channel_type", "channel_uuid", "status"})
+
+	metricIncomingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "courier",
+		Name:      "incoming_request_duration_seconds",
+		Help:      "Time taken to handle incoming channel requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"channel_type", "channel_uuid", "outcome"})
+
+	metricIncoming = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "courier",
+		Name:      "incoming_requests_total",
+		Help:      "Number of incoming channel requests by outcome.",
+	}, []string{"channel_type", "channel_uuid", "outcome"})
+
+	metricInboundSpooled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "courier",
+		Name:      "inbound_spooled_total",
+		Help:      "Number of queued incoming msgs and channel events moved to the spool after repeatedly failing to be written.",
+	}, []string{"type"})
+
+	metricQueueSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "courier",
+		Name:      "queue_size",
+		Help:      "Number of items in each channel's outgoing queue.",
+	}, []string{"channel_type", "channel_uuid", "priority"})
+
+	metricPoolConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "courier",
+		Name:      "pool_connections",
+		Help:      "Number of connections in the DB and Redis pools by state.",
+	}, []string{"pool", "state"})
+
+	metricPoolWaitDuration = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "courier",
+		Name:      "pool_wait_seconds_total",
+		Help:      "Total time spent waiting for a DB or Redis connection.",
+	}, []string{"pool"})
+
+	metricPoolWaits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "courier",
+		Name:      "pool_waits_total",
+		Help:      "Number of times callers had to wait for a DB or Redis connection.",
+	}, []string{"pool"})
+)
+
+// records the outcome of a single message send
+func recordSendMetrics(ch Channel, status MsgStatus, elapsed time.Duration) {
+	ct, uuid := string(ch.ChannelType()), string(ch.UUID())
+
+	metricSendDuration.WithLabelValues(ct, uuid).Observe(elapsed.Seconds())
+	metricSends.WithLabelValues(ct, uuid, string(status)).Inc()
+}
+
+// records the outcome of a single incoming request, or an event within a request
+func recordIncomingMetrics(ch Channel, outcome IncomingOutcome, elapsed time.Duration) {
+	ct, uuid := string(ch.ChannelType()), string(ch.UUID())
+
+	metricIncomingDuration.WithLabelValues(ct, uuid, string(outcome)).Observe(elapsed.Seconds())
+	metricIncoming.WithLabelValues(ct, uuid, string(outcome)).Inc()
+}
+
+// RecordInboundSpooled records that a queued incoming item of the given type was moved to the spool
+func RecordInboundSpooled(itemType string) {
+	metricInboundSpooled.WithLabelValues(itemType).Inc()
+}
+
+// ResetQueueMetrics clears all queue size metrics, backends should call this before reporting the current sizes
+// so that queues which no longer exist aren't reported
+func ResetQueueMetrics() {
+	metricQueueSize.Reset()
+}
+
+// SetQueueMetrics records the size of the priority and bulk queues for the given channel
+func SetQueueMetrics(channelType ChannelType, channelUUID ChannelUUID, size, bulkSize int) {
+	metricQueueSize.WithLabelValues(string(channelType), string(channelUUID), "high").Set(float64(size))
+	metricQueueSize.WithLabelValues(string(channelType), string(channelUUID), "bulk").Set(float64(bulkSize))
+}
+
+// SetPoolMetrics records the current connections of the named pool and the waits that occurred since the last call
+func SetPoolMetrics(pool string, busy, idle int, waitDuration time.Duration, waitCount int64) {
+	metricPoolConnections.WithLabelValues(pool, "busy").Set(float64(busy))
+	metricPoolConnections.WithLabelValues(pool, "idle").Set(float64(idle))
+	metricPoolWaitDuration.WithLabelValues(pool).Add(waitDuration.Seconds())
+	metricPoolWaits.WithLabelValues(pool).Add(float64(waitCount))
+}
+
+// MetricsHandler returns the handler which serves our metrics in the Prometheus exposition format
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
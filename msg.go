@@ -87,6 +87,12 @@ type MsgOut interface {
 	OptIn() *OptInReference
 	SessionStatus() string
 	HighPriority() bool
+
+	// SendAfter is when this message was scheduled to be sent, nil if it should be sent immediately
+	SendAfter() *time.Time
+
+	// RetryCount is the number of times courier has already retried sending this message
+	RetryCount() int
 }
 
 // MsgIn is our interface to represent an incoming
@@ -99,4 +105,8 @@ type MsgIn interface {
 	WithContactName(name string) MsgIn
 	WithURNAuthTokens(tokens map[string]string) MsgIn
 	WithReceivedOn(date time.Time) MsgIn
+	WithFingerprint(fingerprint string) MsgIn
+
+	// DedupedBy returns how this msg was found to be a duplicate of one already received, or empty if it isn't one
+	DedupedBy() MsgDedupeMode
 }
@@ -0,0 +1,256 @@
+package queue
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Size is the size of a single queue and the number of workers currently popping from it
+type Size struct {
+	Queue          string
+	TPS            int
+	Size           int
+	BulkSize       int
+	Pending        int // how many of the values in Size and BulkSize can't be popped until some time in the future
+	Workers        int
+	MaxConcurrency int // zero if the queue doesn't have a concurrency limit
+}
+
+// MsgQueue is a fair queue of values partitioned into named queues, each of which has a TPS limit, a high
+// priority and a bulk (low priority) part, and can be throttled.
+type MsgQueue interface {
+	// Start starts any background goroutines the queue needs, these are stopped when quitter is closed
+	Start(rp *redis.Pool, quitter chan bool, wg *sync.WaitGroup)
+
+	// Push pushes the passed in value onto the named queue so that it won't be popped before the passed in time
+	Push(rc redis.Conn, queue string, tps int, value string, priority Priority, at time.Time) error
+
+	// Pop pops the next available value. If the token is Retry the caller should immediately call again, if it is
+	// EmptyQueue there are no values to pop, otherwise it must be passed to Complete once the value is processed.
+	Pop(rc redis.Conn) (WorkerToken, string, error)
+
+	// Complete marks the value popped with the passed in token as processed, freeing up a worker for its queue
+	Complete(rc redis.Conn, token WorkerToken) error
+
+	// Throttle stops anything being popped from the named queue for the passed in duration
+	Throttle(rc redis.Conn, queue string, d time.Duration) error
+
+	// SetMaxConcurrency sets the maximum number of workers that can be popping from the named queue at the same time,
+	// zero meaning no limit
+	SetMaxConcurrency(rc redis.Conn, queue string, max int) error
+
+	// Queue returns the name and TPS of the queue a value was popped from using its token
+	Queue(token WorkerToken) (string, int, error)
+
+	// Sizes returns the sizes of all queues which have values or workers
+	Sizes(rc redis.Conn) ([]*Size, error)
+}
+
+// the prefixes of the keys, suffixed by queue name, which the pop scripts of all our implementations honor
+const (
+	RateLimitKeyPrefix      = "rate_limit:"      // set to pause popping from a queue
+	RateLimitBulkKeyPrefix  = "rate_limit_bulk:" // set to pause popping bulk values from a queue
+	MaxConcurrencyKeyPrefix = "max_concurrency:" // the maximum number of workers that can pop from a queue at once
+	CircuitKeyPrefix        = "circuit:"         // hash of the circuit state of a queue, when open the next pop is a probe
+)
+
+// lua functions shared by the scripts of all our implementations so that they check the above keys the same way
+var luaQueueHelpers = `
+	-- whether popping (or popping bulk values) from the named queue is paused
+	local function isRateLimited(queueName)
+		return redis.call("get", "` + RateLimitKeyPrefix + `" .. queueName)
+	end
+	local function isBulkRateLimited(queueName)
+		return redis.call("get", "` + RateLimitBulkKeyPrefix + `" .. queueName)
+	end
+
+	-- whether the named queue has a concurrency limit which the given number of workers has reached, nil if it has no limit
+	local function isSaturated(queueName, workers)
+		local maxConcurrency = tonumber(redis.call("get", "` + MaxConcurrencyKeyPrefix + `" .. queueName))
+		return maxConcurrency and tonumber(workers) >= maxConcurrency
+	end
+
+	-- the cooldown of the named queue's circuit if it's open, in which case the next value popped is a probe
+	local function openCircuitCooldown(queueName)
+		local circuitKey = "` + CircuitKeyPrefix + `" .. queueName
+		if redis.call("hget", circuitKey, "state") == "open" then
+			return tonumber(redis.call("hget", circuitKey, "cooldown"))
+		end
+		return nil
+	end
+
+	-- marks the named queue's circuit as probing and pauses the queue until we know whether the probe succeeded
+	local function startProbe(queueName, cooldown)
+		redis.call("hset", "` + CircuitKeyPrefix + `" .. queueName, "state", "probing")
+		redis.call("set", "` + RateLimitKeyPrefix + `" .. queueName, "circuit", "EX", cooldown)
+	end
+`
+
+// how long concurrency limits last for if they're not set again, so that limits of queues no longer used expire
+const maxConcurrencyExpire = 3600
+
+func throttle(rc redis.Conn, queue string, d time.Duration) error {
+	_, err := rc.Do("SET", RateLimitKeyPrefix+queue, "engaged", "PX", max(d.Milliseconds(), 1))
+	return errors.Wrap(err, "error engaging rate limit")
+}
+
+func setMaxConcurrency(rc redis.Conn, queue string, max int) error {
+	var err error
+	if max > 0 {
+		_, err = rc.Do("SET", MaxConcurrencyKeyPrefix+queue, max, "EX", maxConcurrencyExpire)
+	} else {
+		_, err = rc.Do("DEL", MaxConcurrencyKeyPrefix+queue)
+	}
+	return errors.Wrap(err, "error setting max concurrency")
+}
+
+func getMaxConcurrency(rc redis.Conn, queue string) (int, error) {
+	max, err := redis.Int(rc.Do("GET", MaxConcurrencyKeyPrefix+queue))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return max, errors.Wrap(err, "error reading max concurrency")
+}
+
+// parses a queue name and tps from a string in the format name|tps
+func parseQueue(s string) (string, int, error) {
+	name, tpsStr, found := strings.Cut(s, "|")
+	if !found {
+		return "", 0, errors.Errorf("unable to parse queue name from '%s'", s)
+	}
+	tps, _ := strconv.Atoi(tpsStr)
+	return name, tps, nil
+}
+
+type sortedSetQueue struct {
+	qType      string
+	visibility time.Duration
+}
+
+// NewSortedSetQueue creates a new queue which stores each queue as a pair of sorted sets. This is the format
+// that RapidPro writes outgoing messages in. If visibility is non-zero, popped values are tracked as in flight
+// and requeued if they aren't completed within that time, e.g. because the process that popped them died.
+func NewSortedSetQueue(qType string, visibility time.Duration) MsgQueue {
+	return &sortedSetQueue{qType: qType, visibility: visibility}
+}
+
+func (q *sortedSetQueue) Start(rp *redis.Pool, quitter chan bool, wg *sync.WaitGroup) {
+	StartDethrottler(rp, quitter, wg, q.qType)
+
+	if q.visibility > 0 {
+		StartReaper(rp, quitter, wg, q.qType)
+	}
+}
+
+func (q *sortedSetQueue) Push(rc redis.Conn, queue string, tps int, value string, priority Priority, at time.Time) error {
+	return PushOntoQueueAt(rc, q.qType, queue, tps, value, priority, at)
+}
+
+func (q *sortedSetQueue) Pop(rc redis.Conn) (WorkerToken, string, error) {
+	return popFromQueue(rc, q.qType, q.visibility)
+}
+
+func (q *sortedSetQueue) Complete(rc redis.Conn, token WorkerToken) error {
+	return MarkComplete(rc, q.qType, token)
+}
+
+func (q *sortedSetQueue) Throttle(rc redis.Conn, queue string, d time.Duration) error {
+	return throttle(rc, queue, d)
+}
+
+func (q *sortedSetQueue) SetMaxConcurrency(rc redis.Conn, queue string, max int) error {
+	return setMaxConcurrency(rc, queue, max)
+}
+
+// our worker token is the key of the queue the value was popped from, in the format qType:name|tps, followed by
+// #id if the value is being tracked in flight
+func (q *sortedSetQueue) Queue(token WorkerToken) (string, int, error) {
+	key, _, _ := strings.Cut(string(token), "#")
+	return parseQueue(strings.TrimPrefix(key, q.qType+":"))
+}
+
+func (q *sortedSetQueue) Sizes(rc redis.Conn) ([]*Size, error) {
+	rc.Send("ZRANGE", q.qType+":active", 0, -1, "WITHSCORES")
+	rc.Send("ZRANGE", q.qType+":throttled", 0, -1, "WITHSCORES")
+	rc.Send("ZRANGE", q.qType+":future", 0, -1, "WITHSCORES")
+	rc.Flush()
+
+	active, err := redis.Int64Map(rc.Receive())
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading active queues")
+	}
+	throttled, err := redis.Int64Map(rc.Receive())
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading throttled queues")
+	}
+	future, err := redis.Int64Map(rc.Receive())
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading future queues")
+	}
+
+	// a queue can be in more than one set, e.g. if it was throttled whilst having workers, so merge their worker counts
+	for _, other := range []map[string]int64{throttled, future} {
+		for key, workers := range other {
+			active[key] += workers
+		}
+	}
+
+	now := epochMS(time.Now())
+
+	sizes := make([]*Size, 0, len(active))
+	for key, workers := range active {
+		name, tps, err := q.Queue(WorkerToken(key))
+		if err != nil {
+			return nil, err
+		}
+
+		rc.Send("ZCARD", key+"/1")
+		rc.Send("ZCARD", key+"/0")
+		rc.Send("ZCOUNT", key+"/1", "("+now, "+inf")
+		rc.Send("ZCOUNT", key+"/0", "("+now, "+inf")
+		rc.Flush()
+
+		size, err := redis.Int(rc.Receive())
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading queue size")
+		}
+		bulkSize, err := redis.Int(rc.Receive())
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading bulk queue size")
+		}
+		pending, err := redis.Int(rc.Receive())
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading pending queue size")
+		}
+		bulkPending, err := redis.Int(rc.Receive())
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading pending bulk queue size")
+		}
+
+		maxConcurrency, err := getMaxConcurrency(rc, name)
+		if err != nil {
+			return nil, err
+		}
+
+		sizes = append(sizes, &Size{Queue: name, TPS: tps, Size: size, BulkSize: bulkSize, Pending: pending + bulkPending, Workers: int(workers), MaxConcurrency: maxConcurrency})
+	}
+
+	return sortSizes(sizes), nil
+}
+
+// sorts sizes by most workers first, then by name
+func sortSizes(sizes []*Size) []*Size {
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Workers != sizes[j].Workers {
+			return sizes[i].Workers > sizes[j].Workers
+		}
+		return sizes[i].Queue < sizes[j].Queue
+	})
+	return sizes
+}
@@ -0,0 +1,276 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortedSetQueue(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	q := NewSortedSetQueue("msgs", 0)
+
+	assert.NoError(q.Push(conn, "chan1", 10, `[{"id":1},{"id":2}]`, LowPriority, time.Now()))
+	assert.NoError(q.Push(conn, "chan1", 10, `[{"id":3}]`, HighPriority, time.Now()))
+	assert.NoError(q.Push(conn, "chan2", 0, `[{"id":4}]`, HighPriority, time.Now()))
+
+	sizes, err := q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{
+		{Queue: "chan1", TPS: 10, Size: 1, BulkSize: 1, Workers: 0},
+		{Queue: "chan2", TPS: 0, Size: 1, BulkSize: 0, Workers: 0},
+	}, sizes)
+
+	token, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|10"), token)
+	assert.Equal(`{"id":3}`, value)
+
+	name, tps, err := q.Queue(token)
+	assert.NoError(err)
+	assert.Equal("chan1", name)
+	assert.Equal(10, tps)
+
+	sizes, err = q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{
+		{Queue: "chan1", TPS: 10, Size: 0, BulkSize: 1, Workers: 1},
+		{Queue: "chan2", TPS: 0, Size: 1, BulkSize: 0, Workers: 0},
+	}, sizes)
+
+	assert.NoError(q.Complete(conn, token))
+
+	// throttling chan2 means we only get values from chan1
+	assert.NoError(q.Throttle(conn, "chan2", time.Second*5))
+
+	token, value, err = q.Pop(conn)
+	for token == Retry {
+		token, value, err = q.Pop(conn)
+	}
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|10"), token)
+	assert.Equal(`{"id":1}`, value)
+
+	_, _, err = q.Queue("chan1")
+	assert.EqualError(err, "unable to parse queue name from 'chan1'")
+}
+
+func TestSortedSetQueueInFlight(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	q := NewSortedSetQueue("msgs", time.Second)
+
+	assert.NoError(q.Push(conn, "chan1", 0, `[{"id":1}]`, HighPriority, time.Now()))
+	assert.NoError(q.Push(conn, "chan1", 0, `[{"id":2}]`, HighPriority, time.Now()))
+
+	// pop both values but only complete one, as if we died whilst sending the other
+	token1, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|0#1"), token1)
+	assert.Equal(`{"id":1}`, value)
+
+	token2, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|0#2"), token2)
+	assert.Equal(`{"id":2}`, value)
+
+	name, tps, err := q.Queue(token2)
+	assert.NoError(err)
+	assert.Equal("chan1", name)
+	assert.Equal(0, tps)
+
+	assert.NoError(q.Complete(conn, token1))
+
+	inflight, err := redis.Strings(conn.Do("ZRANGE", "msgs:inflight", 0, -1))
+	assert.NoError(err)
+	assert.Equal([]string{"2"}, inflight)
+
+	// start our reaper which will requeue the uncompleted value once its visibility timeout has passed
+	quitter := make(chan bool)
+	wg := &sync.WaitGroup{}
+	q.Start(pool, quitter, wg)
+
+	time.Sleep(time.Millisecond * 2500)
+
+	inflight, err = redis.Strings(conn.Do("ZRANGE", "msgs:inflight", 0, -1))
+	assert.NoError(err)
+	assert.Len(inflight, 0)
+
+	sizes, err := q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 1, BulkSize: 0, Workers: 0}}, sizes)
+
+	token3, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|0#3"), token3)
+	assert.Equal(`{"id":2}`, value)
+
+	// completing with the old token doesn't remove the new worker
+	assert.NoError(q.Complete(conn, token2))
+
+	sizes, err = q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 0, BulkSize: 0, Workers: 1}}, sizes)
+
+	assert.NoError(q.Complete(conn, token3))
+
+	close(quitter)
+	wg.Wait()
+}
+
+func TestSortedSetQueueReapThrottled(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	q := NewSortedSetQueue("msgs", time.Second)
+
+	assert.NoError(q.Push(conn, "chan1", 0, `[{"id":1}]`, HighPriority, time.Now()))
+	assert.NoError(q.Push(conn, "chan1", 0, `[{"id":2}]`, HighPriority, time.Now()))
+
+	token1, _, err := q.Pop(conn)
+	assert.NoError(err)
+	_, _, err = q.Pop(conn)
+	assert.NoError(err)
+
+	// throttle our queue so that the next pop moves it and its workers to our throttled set
+	assert.NoError(q.Throttle(conn, "chan1", time.Minute))
+
+	token, _, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(Retry, token)
+
+	assertScore := func(key string, expected int) {
+		score, err := redis.Int(conn.Do("ZSCORE", key, "msgs:chan1|0"))
+		assert.NoError(err, "expected score in %s", key)
+		assert.Equal(expected, score, "score mismatch in %s", key)
+	}
+	assertScore("msgs:throttled", 2)
+
+	// complete one and reap the other, leaving the queue without workers and active again
+	assert.NoError(q.Complete(conn, token1))
+	assertScore("msgs:throttled", 1)
+
+	reaped, err := redis.Int(luaReap.Do(conn, epochMS(time.Now().Add(time.Minute)), "msgs"))
+	assert.NoError(err)
+	assert.Equal(1, reaped)
+
+	assertScore("msgs:throttled", 0)
+	assertScore("msgs:active", 0)
+
+	sizes, err := q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 1, BulkSize: 0, Workers: 0}}, sizes)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	quitter := make(chan bool)
+	wg := &sync.WaitGroup{}
+	defer func() { close(quitter); wg.Wait() }()
+
+	for _, q := range []MsgQueue{NewSortedSetQueue("msgs", 0), NewStreamsQueue("msgs", "courier1", time.Minute)} {
+		_, err := conn.Do("FLUSHDB")
+		assert.NoError(err)
+
+		q.Start(pool, quitter, wg)
+
+		for i := 0; i < 4; i++ {
+			assert.NoError(q.Push(conn, "chan1", 0, fmt.Sprintf(`[{"id":%d}]`, i), HighPriority, time.Now()))
+		}
+
+		assert.NoError(q.SetMaxConcurrency(conn, "chan1", 2))
+
+		pop := func() (WorkerToken, string) {
+			token, value, err := q.Pop(conn)
+			for token == Retry {
+				token, value, err = q.Pop(conn)
+			}
+			assert.NoError(err)
+			return token, value
+		}
+
+		// we can only have two workers popping from our queue at once
+		token1, value := pop()
+		assert.Equal(`{"id":0}`, value)
+		_, value = pop()
+		assert.Equal(`{"id":1}`, value)
+
+		token, _ := pop()
+		assert.Equal(EmptyQueue, token)
+
+		sizes, err := q.Sizes(conn)
+		assert.NoError(err)
+		assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 2, BulkSize: 0, Workers: 2, MaxConcurrency: 2}}, sizes)
+
+		// until one of them completes, which frees up a worker straight away
+		assert.NoError(q.Complete(conn, token1))
+
+		_, value = pop()
+		assert.Equal(`{"id":2}`, value)
+
+		token, _ = pop()
+		assert.Equal(EmptyQueue, token)
+
+		// removing the limit lets us pop the rest
+		assert.NoError(q.SetMaxConcurrency(conn, "chan1", 0))
+		time.Sleep(time.Millisecond * 1100)
+
+		_, value = pop()
+		assert.Equal(`{"id":3}`, value)
+	}
+}
+
+func TestPendingSizes(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	for _, q := range []MsgQueue{NewSortedSetQueue("msgs", 0), NewStreamsQueue("msgs", "courier1", time.Minute)} {
+		_, err := conn.Do("FLUSHDB")
+		assert.NoError(err)
+
+		// push a value which can be popped now and two which can't be popped for another second
+		assert.NoError(q.Push(conn, "chan1", 0, `[{"id":1}]`, HighPriority, time.Now()))
+		assert.NoError(q.Push(conn, "chan1", 0, `[{"id":2}]`, HighPriority, time.Now().Add(time.Second)))
+		assert.NoError(q.Push(conn, "chan1", 0, `[{"id":3}]`, LowPriority, time.Now().Add(time.Second)))
+
+		sizes, err := q.Sizes(conn)
+		assert.NoError(err)
+		assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 2, BulkSize: 1, Pending: 2, Workers: 0}}, sizes)
+
+		token, value, err := q.Pop(conn)
+		assert.NoError(err)
+		assert.Equal(`{"id":1}`, value)
+		assert.NoError(q.Complete(conn, token))
+
+		// our queue still has pending values even once nothing else can be popped from it
+		token, _, err = q.Pop(conn)
+		for token == Retry {
+			token, _, err = q.Pop(conn)
+		}
+		assert.NoError(err)
+		assert.Equal(EmptyQueue, token)
+
+		sizes, err = q.Sizes(conn)
+		assert.NoError(err)
+		assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 1, BulkSize: 1, Pending: 2, Workers: 0}}, sizes)
+	}
+}
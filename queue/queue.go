@@ -63,12 +63,19 @@ var luaPush = redis.NewScript(6, `-- KEYS: [EpochMS, QueueType, QueueName, TPS,
 // specified transactions per second are popped off at a time. A tps value of 0 means there is no
 // limit to the rate that messages can be consumed
 func PushOntoQueue(conn redis.Conn, qType string, queue string, tps int, value string, priority Priority) error {
-	epochMS := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
+	return PushOntoQueueAt(conn, qType, queue, tps, value, priority, time.Now())
+}
+
+// PushOntoQueueAt pushes the passed in value to the passed in queue so that it won't be popped before the
+// passed in time
+func PushOntoQueueAt(conn redis.Conn, qType string, queue string, tps int, value string, priority Priority, at time.Time) error {
+	epochMS := strconv.FormatFloat(float64(at.UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
 	_, err := redis.Int(luaPush.Do(conn, epochMS, qType, queue, tps, priority, value))
 	return err
 }
 
-var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
+var luaPop = redis.NewScript(3, `-- KEYS: [EpochMS QueueType VisibilityTimeout]
+`+luaQueueHelpers+`
 	-- get the first key off our active list
 	local result = redis.call("zrange", KEYS[2] .. ":active", 0, 0, "WITHSCORES")
 	local queue = result[1]
@@ -92,15 +99,23 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 	end
 
 	if queueName then
-		local rateLimitKey = "rate_limit:" .. queueName
-		local rateLimitEngaged = redis.call("get", rateLimitKey)
-		if rateLimitEngaged then
+		if isRateLimited(queueName) then
 			redis.call("zincrby", KEYS[2] .. ":throttled", workers, queue)
 			redis.call("zrem", KEYS[2] .. ":active", queue)
 			return {"retry", ""}
 		end
 	end
 
+	-- if this queue has a concurrency limit and all its workers are busy, move to our throttled queue
+	if isSaturated(queueName, workers) then
+		redis.call("zincrby", KEYS[2] .. ":throttled", workers, queue)
+		redis.call("zrem", KEYS[2] .. ":active", queue)
+		return {"retry", ""}
+	end
+
+	-- if this queue's circuit is open and its cooldown has passed, the next value we pop is a probe
+	local circuitCooldown = openCircuitCooldown(queueName)
+
 	-- if we have a tps, then check whether we exceed it
 	if tps > 0 then
 	    tpsKey = queue .. ":tps:" .. math.floor(KEYS[1])
@@ -124,9 +139,7 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 	-- if we didn't find one, try again from our bulk queue
 	if not result[1] or isFutureResult then
 		-- check if we are rate limited for bulk queue
-		local rateLimitBulkKey = "rate_limit_bulk:" .. queueName
-		local rateLimitBulk = redis.call("get", rateLimitBulkKey)
-		if rateLimitBulk then
+		if isBulkRateLimited(queueName) then
 			return {"retry", ""}
 		end
 
@@ -154,10 +167,16 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 	if result[1] and not isFutureResult then
 		-- then remove it from the queue
 		redis.call('zremrangebyrank', resultQueue, 0, 0)
+		local resultPriority = string.sub(resultQueue, -1)
 
 		-- and add a worker to this queue
 		redis.call("zincrby", KEYS[2] .. ":active", 1, queue)
 
+		-- if this is a probe, pause the queue again until we know whether it succeeded
+		if circuitCooldown then
+			startProbe(queueName, circuitCooldown)
+		end
+
 		-- parse it as JSON to get the first element out
 		local valueList = cjson.decode(result[1])
 		local popValue = cjson.encode(valueList[1])
@@ -178,6 +197,16 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
             redis.call("zincrby", KEYS[2] .. ":future", 0, queue)
 		end
 
+		-- if we're tracking values in flight, record this one so it can be requeued if it isn't completed in time
+		local visibility = tonumber(KEYS[3])
+		if visibility > 0 then
+			local id = redis.call("incr", KEYS[2] .. ":inflight:seq")
+			local inflight = cjson.encode({queue=queue, priority=resultPriority, score=tonumber(result[2]), value="[" .. popValue .. "]"})
+			redis.call("zadd", KEYS[2] .. ":inflight", tonumber(KEYS[1]) + visibility, id)
+			redis.call("hset", KEYS[2] .. ":inflight:values", id, inflight)
+			return {queue .. "#" .. id, popValue}
+		end
+
 		return {queue, popValue}
 
 	-- otherwise, the queue only contains future results, remove from active and add to future, have the caller retry
@@ -198,8 +227,14 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 // worker token of EmptyQueue will be returned if there are no more items to retrive.
 // Otherwise the WorkerToken should be saved in order to mark the task as complete later.
 func PopFromQueue(conn redis.Conn, qType string) (WorkerToken, string, error) {
+	return popFromQueue(conn, qType, 0)
+}
+
+// pops the next available value, and if visibility is non-zero, tracks it as in flight until it is marked complete
+// or the visibility timeout passes and it is requeued by the reaper
+func popFromQueue(conn redis.Conn, qType string, visibility time.Duration) (WorkerToken, string, error) {
 	epochMS := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
-	values, err := redis.Strings(luaPop.Do(conn, epochMS, qType))
+	values, err := redis.Strings(luaPop.Do(conn, epochMS, qType, int(visibility/time.Second)))
 	if err != nil {
 		slog.Error("error popping from queue", "error", err)
 		return "", "", err
@@ -207,19 +242,55 @@ func PopFromQueue(conn redis.Conn, qType string) (WorkerToken, string, error) {
 	return WorkerToken(values[0]), values[1], nil
 }
 
-var luaComplete = redis.NewScript(2, `-- KEYS: [QueueType, Queue]
-	-- decrement throttled if present
-	local throttled = tonumber(redis.call("zadd", KEYS[1] .. ":throttled", "XX", "CH", "INCR", -1, KEYS[2]))
-
-	-- if we didn't decrement anything, do so to our active set
-	if not throttled or throttled == 0 then
-		local active = tonumber(redis.call("zincrby", KEYS[1] .. ":active", -1, KEYS[2]))
-		
-		-- reset to zero if we somehow go below
-		if active < 0 then
-			redis.call("zadd", KEYS[1] .. ":active", 0, KEYS[2])
+// lua function shared by our complete and reap scripts to remove a worker from a queue
+var luaRemoveWorker = luaQueueHelpers + `
+	local function removeWorker(qType, queue)
+		-- decrement throttled if present
+		local throttled = tonumber(redis.call("zadd", qType .. ":throttled", "XX", "CH", "INCR", -1, queue))
+
+		-- if we didn't decrement anything, or the queue has no workers left, decrement our active set which also
+		-- makes sure the queue is active again
+		if not throttled or throttled == 0 then
+			local active = tonumber(redis.call("zincrby", qType .. ":active", -1, queue))
+
+			-- reset to zero if we somehow go below
+			if active < 0 then
+				redis.call("zadd", qType .. ":active", 0, queue)
+			end
+			return
+		end
+
+		-- if the queue was throttled because all its workers were busy, it can be active again now that one has finished
+		local delim = string.find(queue, "|", 1, true)
+		if delim then
+			local queueName = string.sub(queue, string.len(qType)+2, delim-1)
+
+			if not isRateLimited(queueName) and isSaturated(queueName, throttled) == false then
+				redis.call("zincrby", qType .. ":active", throttled, queue)
+				redis.call("zrem", qType .. ":throttled", queue)
+			end
 		end
 	end
+`
+
+var luaComplete = redis.NewScript(2, `-- KEYS: [QueueType, Token]
+`+luaRemoveWorker+`
+	local queue = KEYS[2]
+
+	-- tokens of values tracked in flight are the queue followed by their in flight id, e.g. msgs:uuid|tps#123
+	local delim = string.find(queue, "#", 1, true)
+	if delim then
+		local id = string.sub(queue, delim+1)
+		queue = string.sub(queue, 1, delim-1)
+
+		-- if the value is no longer in flight, the reaper has requeued it and already removed its worker
+		if redis.call("zrem", KEYS[1] .. ":inflight", id) == 0 then
+			return
+		end
+		redis.call("hdel", KEYS[1] .. ":inflight:values", id)
+	end
+
+	removeWorker(KEYS[1], queue)
 `)
 
 // MarkComplete marks a task as complete for the passed in queue and queue result. It is
@@ -284,3 +355,57 @@ func StartDethrottler(redis *redis.Pool, quitter chan bool, wg *sync.WaitGroup,
 		}
 	}()
 }
+
+var luaReap = redis.NewScript(2, `-- KEYS: [EpochMS, QueueType]
+`+luaRemoveWorker+`
+	local qType = KEYS[2]
+	local expired = redis.call("zrangebyscore", qType .. ":inflight", "-inf", KEYS[1], "LIMIT", 0, 100)
+
+	for _, id in ipairs(expired) do
+		local inflight = redis.call("hget", qType .. ":inflight:values", id)
+
+		if inflight then
+			local item = cjson.decode(inflight)
+			local queue = item["queue"]
+
+			-- put the value back on its queue with its original score so it keeps its place
+			redis.call("zadd", queue .. "/" .. item["priority"], item["score"], item["value"])
+
+			-- remove the worker that popped it
+			removeWorker(qType, queue)
+		end
+
+		redis.call("zrem", qType .. ":inflight", id)
+		redis.call("hdel", qType .. ":inflight:values", id)
+	end
+
+	return #expired
+`)
+
+// StartReaper starts a goroutine responsible for requeueing values which were popped with a visibility timeout
+// but weren't marked complete before it passed, e.g. because the process that popped them died. The passed in
+// quitter chan can be used to shut down the goroutine
+func StartReaper(rp *redis.Pool, quitter chan bool, wg *sync.WaitGroup, qType string) {
+	wg.Add(1)
+
+	go func() {
+		for {
+			select {
+			case <-quitter:
+				wg.Done()
+				return
+
+			case <-time.After(time.Second):
+				conn := rp.Get()
+				epochMS := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
+				reaped, err := redis.Int(luaReap.Do(conn, epochMS, qType))
+				if err != nil {
+					slog.Error("error reaping in flight values", "error", err)
+				} else if reaped > 0 {
+					slog.Warn("requeued in flight values which weren't completed in time", "count", reaped)
+				}
+				conn.Close()
+			}
+		}
+	}()
+}
@@ -299,6 +299,94 @@ func TestThrottle(t *testing.T) {
 	wg.Wait()
 }
 
+func TestPushAt(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	// start our dethrottler
+	quitter := make(chan bool)
+	wg := &sync.WaitGroup{}
+	StartDethrottler(pool, quitter, wg, "msgs")
+
+	// push one item to be popped in the future and one now
+	err := PushOntoQueueAt(conn, "msgs", "chan1", 0, `[{"id":1}]`, HighPriority, time.Now().Add(time.Second*2))
+	assert.NoError(err)
+	err = PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":2}]`, HighPriority)
+	assert.NoError(err)
+
+	// we get the current item first
+	queue, value, err := PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|0"), queue)
+	assert.Equal(`{"id":2}`, value)
+	assert.NoError(MarkComplete(conn, "msgs", queue))
+
+	// the future item isn't available yet
+	queue, value, err = PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(Retry, queue)
+	assert.Empty(value)
+
+	queue, value, err = PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(EmptyQueue, queue)
+	assert.Empty(value)
+
+	// but is once its time has passed and our dethrottler has moved its queue back to active
+	time.Sleep(time.Second * 3)
+
+	queue, value, err = PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|0"), queue)
+	assert.Equal(`{"id":1}`, value)
+
+	close(quitter)
+	wg.Wait()
+}
+
+func TestCircuitProbe(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		err := PushOntoQueue(conn, "msgs", "chan1", 0, fmt.Sprintf(`[{"id":%d}]`, i), HighPriority)
+		assert.NoError(err)
+	}
+
+	// open our circuit as if its cooldown has passed
+	_, err := conn.Do("HSET", "circuit:chan1", "state", "open", "cooldown", 30)
+	assert.NoError(err)
+
+	// we get a single value as a probe
+	queue, value, err := PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|0"), queue)
+	assert.Equal(`{"id":0}`, value)
+
+	state, err := redis.String(conn.Do("HGET", "circuit:chan1", "state"))
+	assert.NoError(err)
+	assert.Equal("probing", state)
+
+	ttl, err := redis.Int(conn.Do("TTL", "rate_limit:chan1"))
+	assert.NoError(err)
+	assert.Equal(30, ttl)
+
+	// and then nothing else until the probe is resolved
+	queue, value, err = PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(Retry, queue)
+	assert.Empty(value)
+
+	queue, value, err = PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(EmptyQueue, queue)
+	assert.Empty(value)
+}
+
 func BenchmarkQueue(b *testing.B) {
 	assert := assert.New(b)
 	pool := getPool()
@@ -0,0 +1,377 @@
+package queue
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// the consumer group all courier instances read streams as
+const streamsGroup = "courier"
+
+type streamsQueue struct {
+	qType      string
+	consumer   string
+	claimAfter time.Duration
+}
+
+// NewStreamsQueue creates a new queue which stores each queue as a pair of Redis streams which are read using a
+// consumer group. Values popped by a consumer which aren't completed within claimAfter, e.g. because that courier
+// instance crashed, are reclaimed and put back on their queue. Thus values are popped at least once, and claimAfter
+// should be longer than the time it takes to process a value.
+//
+// Keys used are:
+//
+//	{qType}:streams                     - sorted set of queues (name|tps) scored by number of workers
+//	{qType}:stream:{name}|{tps}/{prio}  - stream of values for each queue and priority
+//	{qType}:streams:delayed             - sorted set of values which can't be popped yet, scored by when they can be
+//
+// Note that unlike the sorted set queue, this is not the format that RapidPro writes outgoing messages in, so this
+// can only be used if something else writes them.
+func NewStreamsQueue(qType, consumer string, claimAfter time.Duration) MsgQueue {
+	return &streamsQueue{qType: qType, consumer: consumer, claimAfter: claimAfter}
+}
+
+var luaStreamsPush = redis.NewScript(8, `-- KEYS: [EpochMS, NowEpochMS, QueueType, Group, QueueName, TPS, Priority, Value]
+	local at, now, qType, group = tonumber(KEYS[1]), tonumber(KEYS[2]), KEYS[3], KEYS[4]
+	local queue, priority = KEYS[5] .. "|" .. KEYS[6], KEYS[7]
+	local streamKey = qType .. ":stream:" .. queue .. "/" .. priority
+
+	-- values are lists which we split up so that each entry in our stream is a single value that can be acked
+	local valueList = cjson.decode(KEYS[8])
+
+	for i=1,#valueList do
+		local value = cjson.encode({valueList[i]})
+
+		-- values that can't be popped yet wait in our delayed set until the pop script moves them onto their stream
+		if at > now then
+			redis.call("zadd", qType .. ":streams:delayed", at, cjson.encode({queue=queue, priority=priority, value=value}))
+		else
+			if redis.call("exists", streamKey) == 0 then
+				redis.call("xgroup", "create", streamKey, group, "0", "MKSTREAM")
+			end
+			redis.call("xadd", streamKey, "*", "value", value)
+		end
+	end
+
+	redis.call("zincrby", qType .. ":streams", 0, queue)
+`)
+
+func (q *streamsQueue) Push(rc redis.Conn, queue string, tps int, value string, priority Priority, at time.Time) error {
+	_, err := luaStreamsPush.Do(rc, epochMS(at), epochMS(time.Now()), q.qType, streamsGroup, queue, tps, priority, value)
+	return err
+}
+
+var luaStreamsPop = redis.NewScript(4, `-- KEYS: [EpochMS, QueueType, Group, Consumer]
+`+luaQueueHelpers+`
+	local now, qType, group, consumer = tonumber(KEYS[1]), KEYS[2], KEYS[3], KEYS[4]
+	local queuesKey = qType .. ":streams"
+	local delayedKey = qType .. ":streams:delayed"
+
+	-- move any delayed values which can now be popped onto their streams
+	local due = redis.call("zrangebyscore", delayedKey, "-inf", now, "LIMIT", 0, 100)
+	for i=1,#due do
+		local item = cjson.decode(due[i])
+		local streamKey = qType .. ":stream:" .. item["queue"] .. "/" .. item["priority"]
+		if redis.call("exists", streamKey) == 0 then
+			redis.call("xgroup", "create", streamKey, group, "0", "MKSTREAM")
+		end
+		redis.call("xadd", streamKey, "*", "value", item["value"])
+		redis.call("zincrby", queuesKey, 0, item["queue"])
+		redis.call("zrem", delayedKey, due[i])
+	end
+
+	-- look for a value in each of our queues, starting with those with the fewest workers
+	local queues = redis.call("zrange", queuesKey, 0, -1, "WITHSCORES")
+
+	for i=1,#queues,2 do
+		local queue, workers = queues[i], tonumber(queues[i+1])
+		local delim = string.find(queue, "|")
+		local queueName = string.sub(queue, 1, delim-1)
+		local tps = tonumber(string.sub(queue, delim+1))
+		local tpsKey = qType .. ":" .. queue .. ":tps:" .. math.floor(now)
+
+		-- skip this queue if it's rate limited, all its workers are busy or we've reached its tps for this second
+		local available = not isRateLimited(queueName) and not isSaturated(queueName, workers)
+		if available and tps > 0 then
+			available = tonumber(redis.call("get", tpsKey) or "0") < tps
+		end
+
+		if available then
+			local priorities = {"1"}
+			if not isBulkRateLimited(queueName) then
+				table.insert(priorities, "0")
+			end
+
+			for _, priority in ipairs(priorities) do
+				local streamKey = qType .. ":stream:" .. queue .. "/" .. priority
+				local result = false
+				if redis.call("exists", streamKey) == 1 then
+					result = redis.call("xreadgroup", "GROUP", group, consumer, "COUNT", 1, "STREAMS", streamKey, ">")
+				end
+
+				if result and result[1] then
+					local entry = result[1][2][1]
+					local id, value = entry[1], entry[2][2]
+
+					-- add a worker to this queue
+					redis.call("zincrby", queuesKey, 1, queue)
+
+					-- increment our tps for this second if we have a limit
+					if tps > 0 then
+						redis.call("incr", tpsKey)
+						redis.call("expire", tpsKey, 10)
+					end
+
+					-- if this queue's circuit is open, this is a probe so pause the queue again until we know whether it succeeded
+					local circuitCooldown = openCircuitCooldown(queueName)
+					if circuitCooldown then
+						startProbe(queueName, circuitCooldown)
+					end
+
+					return {queue .. "/" .. priority .. "/" .. id, cjson.encode(cjson.decode(value)[1])}
+				end
+			end
+		end
+
+		-- remove queues which have nothing left in them and no workers
+		if workers <= 0 and redis.call("xlen", qType .. ":stream:" .. queue .. "/1") == 0 and redis.call("xlen", qType .. ":stream:" .. queue .. "/0") == 0 then
+			redis.call("zrem", queuesKey, queue)
+		end
+	end
+
+	return {"empty", ""}
+`)
+
+func (q *streamsQueue) Pop(rc redis.Conn) (WorkerToken, string, error) {
+	values, err := redis.Strings(luaStreamsPop.Do(rc, epochMS(time.Now()), q.qType, streamsGroup, q.consumer))
+	if err != nil {
+		slog.Error("error popping from queue", "error", err)
+		return "", "", err
+	}
+	return WorkerToken(values[0]), values[1], nil
+}
+
+var luaStreamsComplete = redis.NewScript(5, `-- KEYS: [QueueType, Group, Queue, Priority, ID]
+	local qType, group, queue = KEYS[1], KEYS[2], KEYS[3]
+	local streamKey = qType .. ":stream:" .. queue .. "/" .. KEYS[4]
+
+	-- if this entry was reclaimed, its worker has already been removed
+	if redis.call("xack", streamKey, group, KEYS[5]) == 0 then
+		return 0
+	end
+	redis.call("xdel", streamKey, KEYS[5])
+
+	local workers = tonumber(redis.call("zincrby", qType .. ":streams", -1, queue))
+	if workers < 0 then
+		redis.call("zadd", qType .. ":streams", 0, queue)
+	end
+	return 1
+`)
+
+func (q *streamsQueue) Complete(rc redis.Conn, token WorkerToken) error {
+	queue, priority, id, err := parseStreamsToken(token)
+	if err != nil {
+		return err
+	}
+	_, err = luaStreamsComplete.Do(rc, q.qType, streamsGroup, queue, priority, id)
+	return err
+}
+
+func (q *streamsQueue) Throttle(rc redis.Conn, queue string, d time.Duration) error {
+	return throttle(rc, queue, d)
+}
+
+func (q *streamsQueue) SetMaxConcurrency(rc redis.Conn, queue string, max int) error {
+	return setMaxConcurrency(rc, queue, max)
+}
+
+func (q *streamsQueue) Queue(token WorkerToken) (string, int, error) {
+	queue, _, _, err := parseStreamsToken(token)
+	if err != nil {
+		return "", 0, err
+	}
+	return parseQueue(queue)
+}
+
+func (q *streamsQueue) Sizes(rc redis.Conn) ([]*Size, error) {
+	queues, err := redis.Int64Map(rc.Do("ZRANGE", q.qType+":streams", 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading queues")
+	}
+
+	pending, err := q.delayedCounts(rc)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading delayed values")
+	}
+
+	// a queue whose only values are delayed may have been removed from our set of queues
+	for queue := range pending {
+		if _, found := queues[queue]; !found {
+			queues[queue] = 0
+		}
+	}
+
+	sizes := make([]*Size, 0, len(queues))
+	for queue, workers := range queues {
+		name, tps, err := parseQueue(queue)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := q.streamSize(rc, q.qType+":stream:"+queue+"/1")
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading queue size")
+		}
+		bulkSize, err := q.streamSize(rc, q.qType+":stream:"+queue+"/0")
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading bulk queue size")
+		}
+
+		maxConcurrency, err := getMaxConcurrency(rc, name)
+		if err != nil {
+			return nil, err
+		}
+
+		// delayed values are still part of their queue, they just can't be popped yet
+		delayed := pending[queue]
+		size += delayed[HighPriority]
+		bulkSize += delayed[LowPriority]
+
+		sizes = append(sizes, &Size{Queue: name, TPS: tps, Size: size, BulkSize: bulkSize, Pending: delayed[HighPriority] + delayed[LowPriority], Workers: int(workers), MaxConcurrency: maxConcurrency})
+	}
+
+	return sortSizes(sizes), nil
+}
+
+// returns the number of delayed values for each queue, indexed by priority
+func (q *streamsQueue) delayedCounts(rc redis.Conn) (map[string][2]int, error) {
+	delayed, err := redis.ByteSlices(rc.Do("ZRANGE", q.qType+":streams:delayed", 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string][2]int)
+	for _, d := range delayed {
+		item := &struct {
+			Queue    string `json:"queue"`
+			Priority string `json:"priority"`
+		}{}
+		if err := json.Unmarshal(d, item); err != nil {
+			return nil, err
+		}
+
+		c := counts[item.Queue]
+		if item.Priority == "1" {
+			c[HighPriority]++
+		} else {
+			c[LowPriority]++
+		}
+		counts[item.Queue] = c
+	}
+	return counts, nil
+}
+
+// returns the number of entries in the given stream which haven't been popped yet
+func (q *streamsQueue) streamSize(rc redis.Conn, streamKey string) (int, error) {
+	length, err := redis.Int(rc.Do("XLEN", streamKey))
+	if err != nil || length == 0 {
+		return 0, err
+	}
+
+	pending, err := redis.Values(rc.Do("XPENDING", streamKey, streamsGroup))
+	if err != nil {
+		return 0, err
+	}
+	popped, err := redis.Int(pending[0], nil)
+	if err != nil {
+		return 0, err
+	}
+	return length - popped, nil
+}
+
+var luaStreamsReclaim = redis.NewScript(4, `-- KEYS: [QueueType, Group, Consumer, MinIdleMS]
+	local qType, group, consumer = KEYS[1], KEYS[2], KEYS[3]
+	local queuesKey = qType .. ":streams"
+	local queues = redis.call("zrange", queuesKey, 0, -1)
+	local reclaimed = 0
+
+	for _, queue in ipairs(queues) do
+		for _, priority in ipairs({"1", "0"}) do
+			local streamKey = qType .. ":stream:" .. queue .. "/" .. priority
+
+			if redis.call("exists", streamKey) == 1 then
+				local result = redis.call("xautoclaim", streamKey, group, consumer, KEYS[4], "0-0", "COUNT", 100)
+
+				-- put each claimed value back on the end of its stream and remove the worker that popped it
+				for _, entry in ipairs(result[2]) do
+					if type(entry) == "table" and entry[2] then
+						redis.call("xadd", streamKey, "*", "value", entry[2][2])
+						redis.call("xack", streamKey, group, entry[1])
+						redis.call("xdel", streamKey, entry[1])
+
+						local workers = tonumber(redis.call("zincrby", queuesKey, -1, queue))
+						if workers < 0 then
+							redis.call("zadd", queuesKey, 0, queue)
+						end
+						reclaimed = reclaimed + 1
+					end
+				end
+			end
+		end
+	end
+
+	return reclaimed
+`)
+
+// Start starts a goroutine which periodically reclaims values which were popped but not completed within our
+// claim timeout
+func (q *streamsQueue) Start(rp *redis.Pool, quitter chan bool, wg *sync.WaitGroup) {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		interval := max(q.claimAfter/2, time.Second)
+
+		for {
+			select {
+			case <-quitter:
+				return
+
+			case <-time.After(interval):
+				rc := rp.Get()
+				reclaimed, err := redis.Int(luaStreamsReclaim.Do(rc, q.qType, streamsGroup, q.consumer, q.claimAfter.Milliseconds()))
+				if err != nil {
+					slog.Error("error reclaiming queue values", "error", err)
+				} else if reclaimed > 0 {
+					slog.Warn("reclaimed queue values which were popped but not completed", "count", reclaimed)
+				}
+				rc.Close()
+			}
+		}
+	}()
+}
+
+// formats the given time as seconds since the epoch with microsecond precision as our scripts expect
+func epochMS(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
+}
+
+// our worker tokens are in the format name|tps/priority/id
+func parseStreamsToken(token WorkerToken) (string, string, string, error) {
+	parts := strings.Split(string(token), "/")
+	if len(parts) != 3 {
+		return "", "", "", errors.Errorf("unable to parse worker token '%s'", token)
+	}
+	if _, err := strconv.Atoi(parts[1]); err != nil {
+		return "", "", "", errors.Errorf("unable to parse worker token '%s'", token)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
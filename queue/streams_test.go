@@ -0,0 +1,190 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamsQueue(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	q := NewStreamsQueue("msgs", "courier1", time.Minute)
+
+	// nothing to pop yet
+	token, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(EmptyQueue, token)
+	assert.Empty(value)
+
+	// push a bulk batch of two values and a high priority value
+	assert.NoError(q.Push(conn, "chan1", 0, `[{"id":1},{"id":2}]`, LowPriority, time.Now()))
+	assert.NoError(q.Push(conn, "chan1", 0, `[{"id":3}]`, HighPriority, time.Now()))
+
+	sizes, err := q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 1, BulkSize: 2, Workers: 0}}, sizes)
+
+	// high priority value comes first
+	token1, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":3}`, value)
+
+	name, tps, err := q.Queue(token1)
+	assert.NoError(err)
+	assert.Equal("chan1", name)
+	assert.Equal(0, tps)
+
+	// then our batch, one value at a time
+	token2, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":1}`, value)
+
+	sizes, err = q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 0, BulkSize: 1, Workers: 2}}, sizes)
+
+	// throttle our queue, nothing can be popped
+	assert.NoError(q.Throttle(conn, "chan1", time.Second))
+
+	token, _, err = q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(EmptyQueue, token)
+
+	time.Sleep(time.Millisecond * 1100)
+
+	token3, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":2}`, value)
+
+	for _, token := range []WorkerToken{token1, token2, token3} {
+		assert.NoError(q.Complete(conn, token))
+	}
+
+	sizes, err = q.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 0, BulkSize: 0, Workers: 0}}, sizes)
+
+	// once a pop finds our queue empty, it's removed
+	token, _, err = q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(EmptyQueue, token)
+
+	sizes, err = q.Sizes(conn)
+	assert.NoError(err)
+	assert.Len(sizes, 0)
+
+	// push one value to be popped in the future and two now to a queue with a tps of 1
+	assert.NoError(q.Push(conn, "chan2", 1, `[{"id":4}]`, HighPriority, time.Now().Add(time.Second*2)))
+	assert.NoError(q.Push(conn, "chan2", 1, `[{"id":5},{"id":6}]`, HighPriority, time.Now()))
+
+	_, value, err = q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":5}`, value)
+
+	// we've reached our tps for this second
+	token, _, err = q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(EmptyQueue, token)
+
+	time.Sleep(time.Millisecond * 1100)
+
+	_, value, err = q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":6}`, value)
+
+	time.Sleep(time.Millisecond * 1100)
+
+	_, value, err = q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":4}`, value)
+
+	_, _, err = q.Queue("msgs:chan1|0")
+	assert.EqualError(err, "unable to parse worker token 'msgs:chan1|0'")
+}
+
+func TestStreamsQueueProbe(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	q := NewStreamsQueue("msgs", "courier1", time.Minute)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(q.Push(conn, "chan1", 0, fmt.Sprintf(`[{"id":%d}]`, i), HighPriority, time.Now()))
+	}
+
+	// open our circuit as if its cooldown has passed
+	_, err := conn.Do("HSET", "circuit:chan1", "state", "open", "cooldown", 30)
+	assert.NoError(err)
+
+	// we get a single value as a probe
+	_, value, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":0}`, value)
+
+	state, err := redis.String(conn.Do("HGET", "circuit:chan1", "state"))
+	assert.NoError(err)
+	assert.Equal("probing", state)
+
+	// and then nothing else until the probe is resolved
+	token, _, err := q.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(EmptyQueue, token)
+}
+
+func TestStreamsQueueReclaim(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	q1 := NewStreamsQueue("msgs", "courier1", time.Second)
+	q2 := NewStreamsQueue("msgs", "courier2", time.Second)
+
+	assert.NoError(q1.Push(conn, "chan1", 0, `[{"id":1},{"id":2}]`, HighPriority, time.Now()))
+
+	// courier1 pops both values but only completes one before it crashes
+	token1, value, err := q1.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":1}`, value)
+	token2, value, err := q1.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":2}`, value)
+	assert.NoError(q1.Complete(conn, token1))
+
+	// courier2 starts up and its reclaimer puts the uncompleted value back on the queue
+	quitter := make(chan bool)
+	wg := &sync.WaitGroup{}
+	q2.Start(pool, quitter, wg)
+
+	time.Sleep(time.Millisecond * 2500)
+
+	sizes, err := q2.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 1, BulkSize: 0, Workers: 0}}, sizes)
+
+	token3, value, err := q2.Pop(conn)
+	assert.NoError(err)
+	assert.Equal(`{"id":2}`, value)
+
+	// completing the reclaimed value with its old token is a noop
+	assert.NoError(q1.Complete(conn, token2))
+
+	sizes, err = q2.Sizes(conn)
+	assert.NoError(err)
+	assert.Equal([]*Size{{Queue: "chan1", TPS: 0, Size: 0, BulkSize: 0, Workers: 1}}, sizes)
+
+	assert.NoError(q2.Complete(conn, token3))
+
+	close(quitter)
+	wg.Wait()
+}
@@ -0,0 +1,85 @@
+package courier
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// QuietHours is a daily period during which scheduled messages shouldn't be sent on a channel. It's configured on the
+// channel with the quiet_hours key, e.g. {"start": "21:00", "end": "08:00", "timezone": "Africa/Kigali"}, and can wrap
+// around midnight. If no timezone is given, UTC is used.
+type QuietHours struct {
+	start    int // minutes since midnight
+	end      int // minutes since midnight
+	location *time.Location
+}
+
+// ChannelQuietHours returns the quiet hours configured on the passed in channel, or nil if there aren't any
+func ChannelQuietHours(ch Channel) (*QuietHours, error) {
+	config, isMap := ch.ConfigForKey(ConfigQuietHours, nil).(map[string]any)
+	if !isMap {
+		return nil, nil
+	}
+
+	start, _ := config["start"].(string)
+	end, _ := config["end"].(string)
+	timezone, _ := config["timezone"].(string)
+
+	return NewQuietHours(start, end, timezone)
+}
+
+// NewQuietHours creates new quiet hours from start and end times in the format HH:MM and an optional timezone
+func NewQuietHours(start, end, timezone string) (*QuietHours, error) {
+	startMins, err := parseTimeOfDay(start)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid quiet hours start '%s'", start)
+	}
+	endMins, err := parseTimeOfDay(end)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid quiet hours end '%s'", end)
+	}
+
+	location := time.UTC
+	if timezone != "" {
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid quiet hours timezone '%s'", timezone)
+		}
+	}
+
+	return &QuietHours{start: startMins, end: endMins, location: location}, nil
+}
+
+// Until returns when the quiet hours that the passed in time falls within end, or the time itself if it doesn't fall
+// within quiet hours
+func (q *QuietHours) Until(t time.Time) time.Time {
+	local := t.In(q.location)
+	mins := local.Hour()*60 + local.Minute()
+	endOn := func(days int) time.Time {
+		return time.Date(local.Year(), local.Month(), local.Day()+days, 0, q.end, 0, 0, q.location)
+	}
+
+	if q.start < q.end {
+		if mins >= q.start && mins < q.end {
+			return endOn(0)
+		}
+	} else if q.start > q.end {
+		// our quiet hours wrap around midnight
+		if mins >= q.start {
+			return endOn(1)
+		} else if mins < q.end {
+			return endOn(0)
+		}
+	}
+
+	return t
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,65 @@
+package courier_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuietHours(t *testing.T) {
+	kigali, _ := time.LoadLocation("Africa/Kigali")
+
+	tcs := []struct {
+		start, end, timezone string
+		t                    time.Time
+		until                time.Time
+	}{
+		// quiet hours within a single day
+		{"12:00", "14:00", "", time.Date(2024, 3, 1, 11, 59, 0, 0, time.UTC), time.Date(2024, 3, 1, 11, 59, 0, 0, time.UTC)},
+		{"12:00", "14:00", "", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)},
+		{"12:00", "14:00", "", time.Date(2024, 3, 1, 13, 30, 0, 0, time.UTC), time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)},
+		{"12:00", "14:00", "", time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)},
+
+		// quiet hours which wrap around midnight
+		{"21:00", "08:00", "", time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)},
+		{"21:00", "08:00", "", time.Date(2024, 3, 1, 22, 15, 0, 0, time.UTC), time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)},
+		{"21:00", "08:00", "", time.Date(2024, 3, 31, 23, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 8, 0, 0, 0, time.UTC)},
+		{"21:00", "08:00", "", time.Date(2024, 3, 2, 3, 0, 0, 0, time.UTC), time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)},
+
+		// quiet hours in a different timezone (Kigali is UTC+2)
+		{"21:00", "08:00", "Africa/Kigali", time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC), time.Date(2024, 3, 2, 8, 0, 0, 0, kigali)},
+		{"21:00", "08:00", "Africa/Kigali", time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)},
+
+		// quiet hours which start and end at the same time are never in effect
+		{"10:00", "10:00", "", time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range tcs {
+		q, err := courier.NewQuietHours(tc.start, tc.end, tc.timezone)
+		require.NoError(t, err)
+
+		until := q.Until(tc.t)
+		assert.True(t, tc.until.Equal(until), "until mismatch for %s-%s at %s, got %s", tc.start, tc.end, tc.t, until)
+	}
+
+	_, err := courier.NewQuietHours("9pm", "08:00", "")
+	assert.EqualError(t, err, `invalid quiet hours start '9pm': parsing time "9pm" as "15:04": cannot parse "pm" as ":"`)
+	_, err = courier.NewQuietHours("21:00", "08:00", "Mars/Olympus")
+	assert.EqualError(t, err, "invalid quiet hours timezone 'Mars/Olympus': unknown time zone Mars/Olympus")
+
+	// channels without quiet hours
+	q, err := courier.ChannelQuietHours(test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US", map[string]any{}))
+	assert.NoError(t, err)
+	assert.Nil(t, q)
+
+	ch := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US", map[string]any{
+		courier.ConfigQuietHours: map[string]any{"start": "21:00", "end": "08:00", "timezone": "Africa/Kigali"},
+	})
+	q, err = courier.ChannelQuietHours(ch)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 2, 6, 0, 0, 0, time.UTC), q.Until(time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)).UTC())
+}
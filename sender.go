@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/nyaruka/gocommon/analytics"
+	"github.com/pkg/errors"
 )
 
 // Foreman takes care of managing our set of sending workers and assigns msgs for each to send
@@ -15,6 +17,9 @@ type Foreman struct {
 	senders          []*Sender
 	availableSenders chan *Sender
 	quit             chan bool
+
+	draining atomic.Bool  // whether we've stopped popping new messages
+	sending  atomic.Int64 // number of messages currently being sent
 }
 
 // NewForeman creates a new Foreman for the passed in server with the number of max senders
@@ -50,6 +55,38 @@ func (f *Foreman) Stop() {
 	slog.Info("foreman stopping", "comp", "foreman", "state", "stopping")
 }
 
+// Drain stops the foreman popping any new messages, callers can use Wait to wait for active sends to complete
+func (f *Foreman) Drain() {
+	f.draining.Store(true)
+	slog.Info("foreman draining", "comp", "foreman", "state", "draining", "sending", f.sending.Load())
+}
+
+// Wait waits until all the messages currently being sent have been sent or the passed in context is done. Returns
+// whether all active sends completed.
+func (f *Foreman) Wait(ctx context.Context) bool {
+	for f.sending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			slog.Warn("foreman timed out waiting for sends", "comp", "foreman", "sending", f.sending.Load())
+			return false
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+	return true
+}
+
+// Resume has the foreman resume popping new messages after having been drained
+func (f *Foreman) Resume() {
+	f.draining.Store(false)
+	slog.Info("foreman resumed", "comp", "foreman", "state", "started")
+}
+
+// Draining returns whether the foreman has been drained
+func (f *Foreman) Draining() bool { return f.draining.Load() }
+
+// Sending returns the number of messages currently being sent
+func (f *Foreman) Sending() int { return int(f.sending.Load()) }
+
 // Assign is our main loop for the Foreman, it takes care of popping the next outgoing messages from our
 // backend and assigning them to workers
 func (f *Foreman) Assign() {
@@ -73,6 +110,17 @@ func (f *Foreman) Assign() {
 
 		// otherwise, grab the next msg and assign it to a sender
 		case sender := <-f.availableSenders:
+			// count ourselves as sending before checking whether we're draining, so a drain waits for this send
+			f.sending.Add(1)
+
+			// if we're draining, don't pop anything new
+			if f.draining.Load() {
+				f.sending.Add(-1)
+				f.availableSenders <- sender
+				time.Sleep(250 * time.Millisecond)
+				continue
+			}
+
 			// see if we have a message to work on
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 			msg, err := backend.PopNextOutgoingMsg(ctx)
@@ -83,6 +131,8 @@ func (f *Foreman) Assign() {
 				sender.job <- msg
 				lastSleep = false
 			} else {
+				f.sending.Add(-1)
+
 				// we received an error getting the next message, log it
 				if err != nil {
 					log.Error("error popping outgoing msg", "error", err)
@@ -138,6 +188,7 @@ func (w *Sender) Start() {
 			}
 
 			w.sendMessage(msg)
+			w.foreman.sending.Add(-1)
 		}
 	}()
 }
@@ -185,6 +236,7 @@ func (w *Sender) sendMessage(msg MsgOut) {
 	}
 
 	var status StatusUpdate
+	var retryAfter time.Duration
 	var redactValues []string
 	handler := server.GetHandler(msg.Channel())
 	if handler != nil {
@@ -192,6 +244,7 @@ func (w *Sender) sendMessage(msg MsgOut) {
 	}
 
 	clog := NewChannelLogForSend(msg, redactValues)
+	clog.SetAttempt(msg.RetryCount() + 1)
 
 	if handler == nil {
 		// if there's no handler, create a FAILED status for it
@@ -231,13 +284,59 @@ func (w *Sender) sendMessage(msg MsgOut) {
 			log.Debug("msg sent", "elapsed", duration)
 			analytics.Gauge(fmt.Sprintf("courier.msg_send_%s", msg.Channel().ChannelType()), secondDuration)
 		}
+
+		recordSendMetrics(msg.Channel(), status.Status(), duration)
+
+		// check whether the channel rate limited us, either explicitly via the returned error or in an HTTP response
+		retryAfter = clog.RetryAfter()
+		var rlErr *RateLimitedError
+		if errors.As(err, &rlErr) {
+			retryAfter = rlErr.RetryAfter
+		}
 	}
 
 	// we allot 10 seconds to write our status to the db
 	writeCTX, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	err = backend.WriteStatusUpdate(writeCTX, status)
+	// if we were rate limited, pause the channel's queue and requeue this msg without it counting as an error
+	if status.Status() == MsgStatusErrored && retryAfter > 0 {
+		if err := backend.ThrottleOutgoingMsg(writeCTX, msg, retryAfter); err != nil {
+			log.Error("error requeueing rate limited msg", "error", err)
+		} else {
+			status = backend.NewStatusUpdate(msg.Channel(), msg.ID(), MsgStatusQueued, clog)
+			log.Info("channel rate limited, msg requeued", "retry_after", retryAfter)
+		}
+	}
+
+	// if we're managing retries ourselves, requeue errored sends with a backoff, failing them on the last attempt.. but
+	// the status of the send itself is still what we pass when marking the msg complete
+	writeStatus := status
+	config := server.Config()
+	if status.Status() == MsgStatusErrored && config.SendMaxAttempts > 0 {
+		attempt := msg.RetryCount() + 1
+
+		if attempt < config.SendMaxAttempts {
+			delay := sendRetryDelay(config, msg.RetryCount())
+
+			if err := backend.RequeueOutgoingMsg(writeCTX, msg, delay); err != nil {
+				log.Error("error requeueing errored msg", "error", err)
+			} else {
+				clog.Error(ErrorSendRetrying(attempt, config.SendMaxAttempts, delay))
+				writeStatus = backend.NewStatusUpdate(msg.Channel(), msg.ID(), MsgStatusQueued, clog)
+				log.Info("errored msg requeued", "attempt", attempt, "delay", delay)
+			}
+		} else {
+			clog.Error(ErrorSendAttemptsExhausted(attempt))
+			writeStatus = backend.NewStatusUpdate(msg.Channel(), msg.ID(), MsgStatusFailed, clog)
+		}
+
+		if status.ExternalID() != "" {
+			writeStatus.SetExternalID(status.ExternalID())
+		}
+	}
+
+	err = backend.WriteStatusUpdate(writeCTX, writeStatus)
 	if err != nil {
 		log.Info("error writing msg status", "error", err)
 	}
@@ -253,3 +352,17 @@ func (w *Sender) sendMessage(msg MsgOut) {
 	// mark our send task as complete
 	backend.MarkOutgoingMsgComplete(writeCTX, msg, status)
 }
+
+// returns how long to wait before retrying a send which has already been retried the given number of times
+func sendRetryDelay(config *Config, retryCount int) time.Duration {
+	delay := time.Duration(config.SendRetryBackoff) * time.Second
+	maxDelay := time.Duration(config.SendRetryMaxBackoff) * time.Second
+
+	for i := 0; i < retryCount && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"compress/flate"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,6 +33,8 @@ type contextKey int
 const (
 	contextRequestURL contextKey = iota
 	contextRequestStart
+	contextPeerAddr
+	contextInboundAccepted
 )
 
 // Server is the main interface ChannelHandlers use to interact with backends. It provides an
@@ -64,12 +69,13 @@ func NewServer(config *Config, backend Backend) Server {
 // afterwards, which is when configuration options are checked.
 func NewServerWithLogger(config *Config, backend Backend, logger *slog.Logger) Server {
 	router := chi.NewRouter()
-	router.Use(middleware.Compress(flate.DefaultCompression))
+	router.Use(unlessStreaming(middleware.Compress(flate.DefaultCompression)))
 	router.Use(middleware.StripSlashes)
 	router.Use(middleware.RequestID)
+	router.Use(savePeerAddr) // before RealIP overwrites it with whatever the forwarding headers claim
 	router.Use(middleware.RealIP)
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.Timeout(30 * time.Second))
+	router.Use(unlessStreaming(middleware.Timeout(30 * time.Second)))
 
 	publicRouter := chi.NewRouter()
 	router.Mount("/c/", publicRouter)
@@ -78,6 +84,9 @@ func NewServerWithLogger(config *Config, backend Backend, logger *slog.Logger) S
 		config:  config,
 		backend: backend,
 
+		attachmentPolicy: NewAttachmentPolicy(config),
+		sourcePolicy:     NewSourcePolicy(config),
+
 		router:       router,
 		publicRouter: publicRouter,
 
@@ -113,7 +122,22 @@ func (s *server) Start() error {
 	s.router.MethodNotAllowed(s.handle405)
 	s.router.Get("/", s.handleIndex)
 	s.router.Get("/status", s.basicAuthRequired(s.handleStatus))
+	s.router.Get("/status.json", s.basicAuthRequired(s.handleStatusJSON))
+	s.router.Get("/health/live", s.handleHealthLive)
+	s.router.Get("/health/ready", s.handleHealthReady)
+	s.router.Get("/metrics", s.basicAuthRequired(MetricsHandler().ServeHTTP))
 	s.publicRouter.Post("/_fetch-attachment", s.tokenAuthRequired(s.handleFetchAttachment)) // becomes /c/_fetch-attachment
+	s.publicRouter.Get("/_attachments/*", s.tokenAuthRequired(s.handleAttachment))          // becomes /c/_attachments/<path>
+	s.publicRouter.Get("/_drain", s.tokenAuthRequired(s.handleDrain))                       // becomes /c/_drain
+	s.publicRouter.Post("/_drain", s.tokenAuthRequired(s.handleDrain))
+	s.publicRouter.Delete("/_drain", s.tokenAuthRequired(s.handleDrain))
+	s.publicRouter.Get("/_spool", s.tokenAuthRequired(s.handleSpool)) // becomes /c/_spool
+	s.publicRouter.Post("/_spool/flush", s.tokenAuthRequired(s.handleSpoolFlush))
+	s.publicRouter.Post("/_spool/quarantine", s.tokenAuthRequired(s.handleSpoolQuarantine))
+	s.publicRouter.Post("/_spool/reinject", s.tokenAuthRequired(s.handleSpoolReinject))
+	s.publicRouter.Get("/_logs/{uuid:[a-fA-F0-9-]{36}}", s.tokenAuthRequired(s.handleChannelLogs)) // becomes /c/_logs/<channel_uuid>
+	s.publicRouter.Get("/_logs/{uuid:[a-fA-F0-9-]{36}}/{logUUID:[a-fA-F0-9-]{36}}", s.tokenAuthRequired(s.handleChannelLog))
+	s.publicRouter.Get("/_logs/{uuid:[a-fA-F0-9-]{36}}/tail", s.tokenAuthRequired(s.handleChannelLogTail))
 
 	// initialize our handlers
 	s.initializeChannelHandlers()
@@ -127,6 +151,9 @@ func (s *server) Start() error {
 		IdleTimeout:  90 * time.Second,
 	}
 
+	// end any log tails when we shut down, otherwise they'll keep the server from shutting down
+	s.httpServer.RegisterOnShutdown(closeChannelLogSubscriptions)
+
 	s.waitGroup.Add(1)
 
 	// and start serving HTTP
@@ -176,6 +203,20 @@ func (s *server) Stop() error {
 	log := slog.With("comp", "server")
 	log.Info("stopping server", "state", "stopping")
 
+	// stop popping new messages and wait for active sends to complete
+	s.startDrain()
+	s.waitForDrain()
+
+	// keep accepting incoming requests until our grace period since draining started has passed
+	s.drainMutex.Lock()
+	grace := time.Duration(s.config.DrainGracePeriod)*time.Second - time.Since(s.drainStarted)
+	s.drainMutex.Unlock()
+
+	if grace > 0 {
+		log.Info("waiting for drain grace period", "state", "stopping", "grace_period", grace)
+		time.Sleep(grace)
+	}
+
 	// stop our foreman
 	s.foreman.Stop()
 
@@ -205,6 +246,38 @@ func (s *server) Stop() error {
 	return nil
 }
 
+// stops our foreman popping new messages
+func (s *server) startDrain() {
+	s.drainMutex.Lock()
+	if s.drainStarted.IsZero() {
+		s.drainStarted = time.Now()
+	}
+	s.drainMutex.Unlock()
+
+	s.foreman.Drain()
+}
+
+// waits for active sends to complete and for the backend to flush its writers, for at most our drain timeout
+func (s *server) waitForDrain() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.DrainTimeout)*time.Second)
+	defer cancel()
+
+	s.foreman.Wait(ctx)
+
+	if err := s.backend.Flush(ctx); err != nil {
+		slog.Error("error flushing backend writers", "error", err, "comp", "server")
+	}
+}
+
+// has our foreman resume popping new messages after a drain
+func (s *server) resume() {
+	s.drainMutex.Lock()
+	s.drainStarted = time.Time{}
+	s.drainMutex.Unlock()
+
+	s.foreman.Resume()
+}
+
 func (s *server) GetHandler(ch Channel) ChannelHandler { return activeHandlers[ch.ChannelType()] }
 
 func (s *server) WaitGroup() *sync.WaitGroup { return s.waitGroup }
@@ -222,9 +295,13 @@ type server struct {
 	router       *chi.Mux
 	publicRouter *chi.Mux
 
-	foreman *Foreman
+	foreman      *Foreman
+	drainStarted time.Time
+	drainMutex   sync.Mutex
 
-	config *Config
+	config           *Config
+	attachmentPolicy *AttachmentPolicy
+	sourcePolicy     *SourcePolicy
 
 	waitGroup *sync.WaitGroup
 	stopChan  chan bool
@@ -262,6 +339,7 @@ func (s *server) channelHandleWrapper(handler ChannelHandler, handlerFunc Channe
 		// stuff a few things in our context that help with logging
 		baseCtx := context.WithValue(r.Context(), contextRequestURL, r.URL.String())
 		baseCtx = context.WithValue(baseCtx, contextRequestStart, time.Now())
+		baseCtx, inboundAccepted := withInboundAcceptedCount(baseCtx)
 
 		// add a 30 second timeout to the request
 		ctx, cancel := context.WithTimeout(baseCtx, time.Second*30)
@@ -298,14 +376,62 @@ func (s *server) channelHandleWrapper(handler ChannelHandler, handlerFunc Channe
 
 		clog := NewChannelLogForIncoming(logType, channel, recorder, handler.RedactValues(channel))
 
-		events, hErr := handlerFunc(ctx, channel, recorder.ResponseWriter, r, clog)
+		var events []Event
+		var hErr error
+
+		// if the channel restricts which networks requests can come from, reject any from elsewhere
+		if channel != nil {
+			if ip := s.sourcePolicy.RequestIP(r); !s.sourcePolicy.Allows(channel, ip) {
+				clog.Error(ErrorSourceNotAllowed(ip))
+				hErr = fmt.Errorf("%w: %s", ErrSourceNotAllowed, ip)
+			}
+		}
+
+		// if the handler verifies requests, make sure this one really came from the channel before handling it
+		verifier, verifies := handler.(RequestVerifier)
+		if verifies && channel != nil && hErr == nil {
+			hErr = verifier.VerifyRequest(ctx, channel, r)
+		}
+		if hErr == nil {
+			events, hErr = handlerFunc(ctx, channel, recorder.ResponseWriter, r, clog)
+
+			if verifies && channel != nil {
+				verifier.RequestHandled(ctx, channel, r, hErr)
+			}
+		}
 		duration := time.Since(start)
 		secondDuration := float64(duration) / float64(time.Second)
 
 		// if we received an error, write it out and report it
 		if hErr != nil {
+			var limitErr *InboundLimitError
 			slog.Error("error handling request", "error", err, "channel_uuid", channelUUID, "request", recorder.Trace.RequestTrace)
-			writeAndLogRequestError(ctx, handler, recorder.ResponseWriter, r, channel, hErr)
+
+			// if we couldn't write to the db and our spool is full, tell the sender to back off and retry later
+			if errors.Is(hErr, ErrSpoolFull) {
+				LogRequestError(r, channel, hErr)
+				recorder.ResponseWriter.Header().Set("Retry-After", fmt.Sprint(int(spoolFlushInterval/time.Second)))
+				WriteError(recorder.ResponseWriter, http.StatusServiceUnavailable, hErr)
+			} else if errors.Is(hErr, ErrSourceNotAllowed) {
+				LogRequestError(r, channel, hErr)
+				WriteError(recorder.ResponseWriter, http.StatusForbidden, hErr)
+			} else if errors.As(hErr, &limitErr) {
+				clog.Error(ErrorInboundLimitExceeded(limitErr.Scope))
+
+				// either tell the sender to back off until the current window ends, or pretend we just didn't care about it.
+				// If some of the request was written before it went over the limit, a rejection would have the sender resend
+				// all of it, so only the rest is ignored.
+				if s.config.InboundLimitAction == "ignore" || *inboundAccepted > 0 {
+					LogRequestIgnored(r, channel, hErr.Error())
+					handler.WriteRequestIgnored(ctx, recorder.ResponseWriter, hErr.Error())
+				} else {
+					LogRequestError(r, channel, hErr)
+					recorder.ResponseWriter.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(limitErr.RetryAfter.Seconds()))))
+					WriteError(recorder.ResponseWriter, http.StatusTooManyRequests, hErr)
+				}
+			} else {
+				writeAndLogRequestError(ctx, handler, recorder.ResponseWriter, r, channel, hErr)
+			}
 		}
 
 		// end recording of the request so that we have a response trace
@@ -317,25 +443,43 @@ func (s *server) channelHandleWrapper(handler ChannelHandler, handlerFunc Channe
 		if channel != nil {
 			// if we have a channel but no events were created, we still log this to analytics
 			if len(events) == 0 {
-				if hErr != nil {
+				if errors.Is(hErr, ErrSourceNotAllowed) {
+					analytics.Gauge(fmt.Sprintf("courier.channel_rejected_%s", channel.ChannelType()), secondDuration)
+					recordIncomingMetrics(channel, IncomingOutcomeRejected, duration)
+				} else if errors.Is(hErr, ErrInboundLimitExceeded) {
+					analytics.Gauge(fmt.Sprintf("courier.channel_limited_%s", channel.ChannelType()), secondDuration)
+					recordIncomingMetrics(channel, IncomingOutcomeLimited, duration)
+				} else if hErr != nil {
 					analytics.Gauge(fmt.Sprintf("courier.channel_error_%s", channel.ChannelType()), secondDuration)
+					recordIncomingMetrics(channel, IncomingOutcomeError, duration)
 				} else {
 					analytics.Gauge(fmt.Sprintf("courier.channel_ignored_%s", channel.ChannelType()), secondDuration)
+					recordIncomingMetrics(channel, IncomingOutcomeIgnored, duration)
 				}
 			}
 
 			for _, event := range events {
 				switch e := event.(type) {
 				case MsgIn:
-					clog.SetAttached(true)
-					analytics.Gauge(fmt.Sprintf("courier.msg_receive_%s", channel.ChannelType()), secondDuration)
-					LogMsgReceived(r, e)
+					// duplicates aren't written so their logs can't be attached to them
+					if e.DedupedBy() != "" {
+						analytics.Gauge(fmt.Sprintf("courier.msg_duplicate_%s", channel.ChannelType()), secondDuration)
+						recordIncomingMetrics(channel, IncomingOutcomeDuplicate, duration)
+						LogMsgDeduped(r, e)
+					} else {
+						clog.SetAttached(true)
+						analytics.Gauge(fmt.Sprintf("courier.msg_receive_%s", channel.ChannelType()), secondDuration)
+						recordIncomingMetrics(channel, IncomingOutcomeMsg, duration)
+						LogMsgReceived(r, e)
+					}
 				case StatusUpdate:
 					clog.SetAttached(true)
 					analytics.Gauge(fmt.Sprintf("courier.msg_status_%s", channel.ChannelType()), secondDuration)
+					recordIncomingMetrics(channel, IncomingOutcomeStatus, duration)
 					LogMsgStatusReceived(r, e)
 				case ChannelEvent:
 					analytics.Gauge(fmt.Sprintf("courier.evt_receive_%s", channel.ChannelType()), secondDuration)
+					recordIncomingMetrics(channel, IncomingOutcomeEvent, duration)
 					LogChannelEventReceived(r, e)
 				}
 			}
@@ -392,20 +536,403 @@ func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf.Bytes())
 }
 
+type statusResponse struct {
+	Version string        `json:"version"`
+	Status  *StatusReport `json:"status"`
+	Health  *HealthReport `json:"health"`
+}
+
+func (s *server) handleStatusJSON(w http.ResponseWriter, r *http.Request) {
+	status, err := s.backend.StatusReport(r.Context())
+	if err != nil {
+		slog.Error("error getting status report", "error", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &statusResponse{Version: s.config.Version, Status: status, Health: s.backend.HealthReport(r.Context())})
+}
+
+type healthResponse struct {
+	Version  string         `json:"version"`
+	Ready    bool           `json:"ready"`
+	Draining bool           `json:"draining,omitempty"`
+	Checks   []*HealthCheck `json:"checks,omitempty"`
+}
+
+// liveness only tells us that we're able to serve requests at all, so doesn't check any dependencies
+func (s *server) handleHealthLive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &healthResponse{Version: s.config.Version, Ready: true})
+}
+
+// readiness fails if any of the backend's required checks fail, e.g. DB or redis are unreachable, or if we're draining
+// so that load balancers stop sending us requests
+func (s *server) handleHealthReady(w http.ResponseWriter, r *http.Request) {
+	health := s.backend.HealthReport(r.Context())
+	draining := s.foreman.Draining()
+	ready := health.Ready() && !draining
+
+	statusCode := http.StatusOK
+	if !ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, statusCode, &healthResponse{Version: s.config.Version, Ready: ready, Draining: draining, Checks: health.Checks})
+}
+
+type drainResponse struct {
+	Draining bool `json:"draining"`
+	Sending  int  `json:"sending"`
+}
+
+// POST starts draining, i.e. we stop sending new messages but keep handling incoming requests, DELETE resumes
+// sending, and GET returns whether we're draining and how many messages are still being sent
+func (s *server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if !s.foreman.Draining() {
+			slog.Info("draining requested", "comp", "server")
+			s.startDrain()
+			go s.waitForDrain()
+		}
+	case http.MethodDelete:
+		if s.foreman.Draining() {
+			slog.Info("resume requested", "comp", "server")
+			s.resume()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &drainResponse{Draining: s.foreman.Draining(), Sending: s.foreman.Sending()})
+}
+
+type spoolResponse struct {
+	Backlog []*SpoolBacklog `json:"backlog"`
+	Entries []*SpoolEntry   `json:"entries,omitempty"` // only included when listing a subdirectory
+	Total   int             `json:"total,omitempty"`   // number of entries in that subdirectory
+}
+
+// the default and maximum number of spool entries we list at once
+const (
+	spoolEntriesDefaultLimit = 100
+	spoolEntriesMaxLimit     = 1000
+)
+
+type spoolEntryRequest struct {
+	Subdir string `json:"subdir" validate:"required"`
+	Name   string `json:"name"   validate:"required"`
+}
+
+// GET returns the backlog of each spool subdirectory, and if a subdir is given, a page of the entries in it given by
+// offset and limit
+func (s *server) handleSpool(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	subdir := params.Get("subdir")
+	if subdir == "" {
+		s.writeSpool(w, http.StatusOK)
+		return
+	}
+
+	limit, offset := spoolEntriesDefaultLimit, 0
+	if v := params.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			WriteError(w, http.StatusBadRequest, errors.Errorf("invalid limit '%s'", v))
+			return
+		}
+		limit = min(l, spoolEntriesMaxLimit)
+	}
+	if v := params.Get("offset"); v != "" {
+		o, err := strconv.Atoi(v)
+		if err != nil || o < 0 {
+			WriteError(w, http.StatusBadRequest, errors.Errorf("invalid offset '%s'", v))
+			return
+		}
+		offset = o
+	}
+
+	entries, err := ReadSpoolSubdir(s.config.SpoolDir, subdir)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	backlog, err := s.readSpoolBacklog()
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	page := entries[min(offset, len(entries)):min(offset+limit, len(entries))]
+
+	writeJSON(w, http.StatusOK, &spoolResponse{Backlog: backlog, Entries: page, Total: len(entries)})
+}
+
+// POST starts flushing our spool in the background rather than waiting for the next periodic flush
+func (s *server) handleSpoolFlush(w http.ResponseWriter, r *http.Request) {
+	if !StartSpoolFlush(s.waitGroup) {
+		WriteError(w, http.StatusConflict, errors.New("spool flush already in progress"))
+		return
+	}
+	slog.Info("spool flush started", "comp", "server")
+
+	s.writeSpool(w, http.StatusAccepted)
+}
+
+// POST moves a spool entry to our quarantine directory so that it is no longer retried
+func (s *server) handleSpoolQuarantine(w http.ResponseWriter, r *http.Request) {
+	s.handleSpoolEntry(w, r, QuarantineSpoolEntry)
+}
+
+// POST moves an invalid or quarantined spool entry back into its subdirectory so that it's retried
+func (s *server) handleSpoolReinject(w http.ResponseWriter, r *http.Request) {
+	s.handleSpoolEntry(w, r, ReinjectSpoolEntry)
+}
+
+func (s *server) handleSpoolEntry(w http.ResponseWriter, r *http.Request, fn func(spoolDir, subdir, name string) error) {
+	req := &spoolEntryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		WriteError(w, http.StatusBadRequest, errors.Wrap(err, "error unmarshalling request"))
+		return
+	}
+	if err := utils.Validate(req); err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := fn(s.config.SpoolDir, req.Subdir, req.Name); err != nil {
+		statusCode := http.StatusBadRequest
+		if err == ErrSpoolEntryNotFound {
+			statusCode = http.StatusNotFound
+		} else if err == ErrSpoolFull {
+			statusCode = http.StatusServiceUnavailable
+		}
+		WriteError(w, statusCode, err)
+		return
+	}
+
+	slog.Info("spool entry moved", "comp", "server", "action", r.URL.Path, "subdir", req.Subdir, "name", req.Name)
+
+	s.writeSpool(w, http.StatusOK)
+}
+
+// writes the backlog of each spool subdirectory, which is small regardless of how many entries there are
+func (s *server) writeSpool(w http.ResponseWriter, status int) {
+	backlog, err := s.readSpoolBacklog()
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, status, &spoolResponse{Backlog: backlog})
+}
+
+func (s *server) readSpoolBacklog() ([]*SpoolBacklog, error) {
+	entries, err := ReadSpool(s.config.SpoolDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading spool")
+	}
+	return SummarizeSpool(entries), nil
+}
+
+type channelLogsResponse struct {
+	Results []*ChannelLogRecord `json:"results"`
+}
+
+// GET returns the most recent logs for a channel, optionally filtered by type, is_error and a created on range
+// given by after and before
+func (s *server) handleChannelLogs(w http.ResponseWriter, r *http.Request) {
+	ch, err := s.channelForLogs(w, r)
+	if err != nil {
+		return
+	}
+
+	query, err := parseChannelLogQuery(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	logs, err := s.backend.ChannelLogs(r.Context(), ch, query)
+	if err != nil {
+		slog.Error("error querying channel logs", "error", err, "channel_uuid", ch.UUID())
+		WriteError(w, http.StatusInternalServerError, errors.New("error querying channel logs"))
+		return
+	}
+
+	redactVals := redactValuesForChannel(ch)
+	for _, l := range logs {
+		l.Redact(redactVals)
+	}
+
+	writeJSON(w, http.StatusOK, &channelLogsResponse{Results: logs})
+}
+
+// GET returns a single log for a channel by its UUID, wherever it was stored
+func (s *server) handleChannelLog(w http.ResponseWriter, r *http.Request) {
+	ch, err := s.channelForLogs(w, r)
+	if err != nil {
+		return
+	}
+
+	log, err := s.backend.GetChannelLog(r.Context(), ch, ChannelLogUUID(chi.URLParam(r, "logUUID")))
+	if err == ErrChannelLogNotFound {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		slog.Error("error fetching channel log", "error", err, "channel_uuid", ch.UUID())
+		WriteError(w, http.StatusInternalServerError, errors.New("error fetching channel log"))
+		return
+	}
+
+	log.Redact(redactValuesForChannel(ch))
+
+	writeJSON(w, http.StatusOK, log)
+}
+
+// looks up the channel whose logs are being requested, writing an error response if that fails
+func (s *server) channelForLogs(w http.ResponseWriter, r *http.Request) (Channel, error) {
+	channelUUID := ChannelUUID(chi.URLParam(r, "uuid"))
+
+	ch, err := s.backend.GetChannel(r.Context(), AnyChannelType, channelUUID)
+	if err == ErrChannelNotFound {
+		WriteError(w, http.StatusNotFound, err)
+	} else if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+	}
+	return ch, err
+}
+
+// how often we write a comment to an idle tail so that proxies and clients keep the connection open
+const channelLogTailKeepAlive = 15 * time.Second
+
+// GET streams the logs of a channel as server-sent events as they are written, until the client disconnects
+func (s *server) handleChannelLogTail(w http.ResponseWriter, r *http.Request) {
+	ch, err := s.channelForLogs(w, r)
+	if err != nil {
+		return
+	}
+
+	// this request is exempt from our timeout middleware but we also need to lift the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		WriteError(w, http.StatusInternalServerError, errors.Wrap(err, "streaming not supported"))
+		return
+	}
+
+	sub := SubscribeChannelLogs(ch.UUID(), 100)
+	defer sub.Close()
+
+	log := slog.With("comp", "server", "channel_uuid", ch.UUID())
+	log.Info("channel log tail started")
+	defer log.Info("channel log tail ended")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(channelLogTailKeepAlive)
+	defer keepAlive.Stop()
+
+	var dropped int64
+	write := func(format string, args ...any) bool {
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	if !write(": tailing logs for channel %s\n\n", ch.UUID()) {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if d := sub.Dropped(); d > dropped {
+				if !write("event: dropped\ndata: %s\n\n", jsonx.MustMarshal(map[string]int64{"dropped": d - dropped})) {
+					return
+				}
+				dropped = d
+			}
+			if !write(": keep-alive\n\n") {
+				return
+			}
+		case l, ok := <-sub.Logs():
+			if !ok {
+				return // subscription closed because we're shutting down
+			}
+			if !write("event: log\nid: %s\ndata: %s\n\n", l.UUID, jsonx.MustMarshal(l)) {
+				return
+			}
+		}
+	}
+}
+
+func parseChannelLogQuery(r *http.Request) (*ChannelLogQuery, error) {
+	params := r.URL.Query()
+	query := &ChannelLogQuery{Type: ChannelLogType(params.Get("type")), Limit: defaultChannelLogQueryLimit}
+
+	if v := params.Get("is_error"); v != "" {
+		isError, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Errorf("invalid is_error '%s'", v)
+		}
+		query.IsError = &isError
+	}
+
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"after", &query.After}, {"before", &query.Before}} {
+		if v := params.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, errors.Errorf("invalid %s '%s', must be RFC3339 formatted", p.name, v)
+			}
+			*p.dest = t
+		}
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, errors.Errorf("invalid limit '%s'", v)
+		}
+		query.Limit = min(limit, maxChannelLogQueryLimit)
+	}
+
+	return query, nil
+}
+
 func (s *server) handleFetchAttachment(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
 	defer cancel()
 
-	resp, err := fetchAttachment(ctx, s.backend, r)
+	resp, err := fetchAttachment(ctx, s.backend, s.attachmentPolicy, r)
 	if err != nil {
 		slog.Error("error fetching attachment", "error", err)
 		WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonx.MustMarshal(resp))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// redirects to a URL which can be used to read the attachment referred to, e.g. a presigned URL for private storage
+func (s *server) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	path := chi.URLParam(r, "*")
+	ref := AttachmentRef(s.config.Domain, path)
+
+	attURL, err := s.backend.AttachmentURL(r.Context(), ref)
+	if err != nil {
+		slog.Error("error getting attachment URL", "error", err, "path", path)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, attURL, http.StatusFound)
 }
 
 func (s *server) handle404(w http.ResponseWriter, r *http.Request) {
@@ -427,6 +954,27 @@ func (s *server) handle405(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(jsonx.MustMarshal(v))
+}
+
+// wraps a middleware so that it's skipped for long lived streaming requests, i.e. channel log tails, which can't be
+// buffered for compression or cut off by a timeout
+func unlessStreaming(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/c/_logs/") && strings.HasSuffix(r.URL.Path, "/tail") {
+				next.ServeHTTP(w, r)
+			} else {
+				wrapped.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
 // wraps a handler to make it use basic auth
 func (s *server) basicAuthRequired(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1,14 +1,23 @@
 package courier_test
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/test"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/stretchr/testify/assert"
@@ -56,6 +65,46 @@ func TestServer(t *testing.T) {
 	assert.Equal(t, 200, statusCode)
 	assert.Contains(t, respBody, "ALL GOOD")
 
+	// JSON status also requires auth
+	statusCode, _ = request("GET", "http://localhost:8080/status.json", "", "")
+	assert.Equal(t, 401, statusCode)
+
+	statusCode, respBody = request("GET", "http://localhost:8080/status.json", "admin", "password123")
+	assert.Equal(t, 200, statusCode)
+	assert.JSONEq(t, `{"version": "Dev", "status": {"queues": []}, "health": {"checks": [{"name": "db", "ok": true, "required": true}, {"name": "redis", "ok": true, "required": true}]}}`, respBody)
+
+	// health endpoints don't require auth
+	statusCode, respBody = request("GET", "http://localhost:8080/health/live", "", "")
+	assert.Equal(t, 200, statusCode)
+	assert.JSONEq(t, `{"version": "Dev", "ready": true}`, respBody)
+
+	statusCode, respBody = request("GET", "http://localhost:8080/health/ready", "", "")
+	assert.Equal(t, 200, statusCode)
+	assert.JSONEq(t, `{"version": "Dev", "ready": true, "checks": [{"name": "db", "ok": true, "required": true}, {"name": "redis", "ok": true, "required": true}]}`, respBody)
+
+	// readiness fails if redis is unreachable, but liveness doesn't
+	mb.SetHealthError("redis", errors.New("connection refused"))
+
+	statusCode, respBody = request("GET", "http://localhost:8080/health/ready", "", "")
+	assert.Equal(t, 503, statusCode)
+	assert.JSONEq(t, `{"version": "Dev", "ready": false, "checks": [{"name": "db", "ok": true, "required": true}, {"name": "redis", "ok": false, "error": "connection refused", "required": true}]}`, respBody)
+
+	statusCode, _ = request("GET", "http://localhost:8080/health/live", "", "")
+	assert.Equal(t, 200, statusCode)
+
+	mb.SetHealthError("redis", nil)
+
+	// metrics endpoint also requires auth
+	statusCode, _ = request("GET", "http://localhost:8080/metrics", "", "")
+	assert.Equal(t, 401, statusCode)
+
+	courier.SetQueueMetrics("MCK", "95710b36-855d-4832-a723-5f71f73688a0", 5, 3)
+
+	statusCode, respBody = request("GET", "http://localhost:8080/metrics", "admin", "password123")
+	assert.Equal(t, 200, statusCode)
+	assert.Contains(t, respBody, `courier_queue_size{channel_type="MCK",channel_uuid="95710b36-855d-4832-a723-5f71f73688a0",priority="bulk"} 3`)
+	assert.Contains(t, respBody, `courier_queue_size{channel_type="MCK",channel_uuid="95710b36-855d-4832-a723-5f71f73688a0",priority="high"} 5`)
+
 	// can't access status page with wrong method
 	statusCode, respBody = request("POST", "http://localhost:8080/status", "admin", "password123")
 	assert.Equal(t, 405, statusCode)
@@ -136,7 +185,7 @@ func TestFetchAttachment(t *testing.T) {
 
 	statusCode, respBody = submit(`{"channel_uuid": "e4bb1578-29da-4fa5-a214-9da19dd24230", "channel_type": "MCK", "url": "http://mock.com/media/hello.jpg"}`, "sesame")
 	assert.Equal(t, 200, statusCode)
-	assert.JSONEq(t, `{"attachment": {"content_type": "image/jpeg", "url": "https://backend.com/attachments/cdf7ed27-5ad5-4028-b664-880fc7581c77.jpg", "size": 17301}, "log_uuid": "c00e5d67-c275-4389-aded-7d8b151cbd5b"}`, string(respBody))
+	assert.JSONEq(t, `{"attachment": {"content_type": "image/jpeg", "url": "https://backend.com/attachments/cdf7ed27-5ad5-4028-b664-880fc7581c77.jpg", "size": 17301, "sha256": "c0dd06c42c906a2a06488f601079289bed14ea0766c4209ec500beda03e7921a"}, "log_uuid": "c00e5d67-c275-4389-aded-7d8b151cbd5b"}`, string(respBody))
 
 	assert.Len(t, mb.WrittenChannelLogs(), 1)
 	clog := mb.WrittenChannelLogs()[0]
@@ -154,3 +203,607 @@ func TestFetchAttachment(t *testing.T) {
 	assert.Equal(t, 200, statusCode)
 	assert.JSONEq(t, `{"attachment": {"content_type": "unavailable", "url": "http://mock.com/media/hello.pdf", "size": 0}, "log_uuid": "338ff339-5663-49ed-8ef6-384876655d1b"}`, string(respBody))
 }
+
+func TestSourceRestrictions(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+	config.AllowedNetworks = "MCK:10.0.0.0/8"
+	config.TrustedProxies = "127.0.0.1, ::1" // so that our requests can claim to be from elsewhere
+
+	mb := test.NewMockBackend()
+
+	server := courier.NewServerWithLogger(config, mb, logger)
+	server.Start()
+	defer server.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	request := func(realIP string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/c/mck/e4bb1578-29da-4fa5-a214-9da19dd24230/receive?from=2065551212&text=hello", nil)
+		req.Header.Set("X-Real-IP", realIP)
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+		require.NoError(t, err)
+		return trace.Response.StatusCode, string(trace.ResponseBody)
+	}
+
+	statusCode, _ := request("10.1.2.3")
+	assert.Equal(t, 200, statusCode)
+	assert.Len(t, mb.WrittenMsgs(), 1)
+
+	mb.Reset()
+
+	statusCode, respBody := request("8.8.8.8")
+	assert.Equal(t, 403, statusCode)
+	assert.Contains(t, respBody, "request source not allowed: 8.8.8.8")
+	assert.Len(t, mb.WrittenMsgs(), 0)
+
+	// rejected request is still logged against the channel
+	if assert.Len(t, mb.WrittenChannelLogs(), 1) {
+		assert.Equal(t, []*courier.ChannelError{courier.ErrorSourceNotAllowed("8.8.8.8")}, mb.WrittenChannelLogs()[0].Errors())
+	}
+
+	mb.Reset()
+
+	// a client can't get around the restriction by prefixing the X-Forwarded-For header added by our proxy
+	req, _ := http.NewRequest("GET", "http://localhost:8080/c/mck/e4bb1578-29da-4fa5-a214-9da19dd24230/receive?from=2065551212&text=hello", nil)
+	req.Header.Set("X-Forwarded-For", "10.1.2.3, 8.8.8.8")
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 403, trace.Response.StatusCode)
+	assert.Contains(t, string(trace.ResponseBody), "request source not allowed: 8.8.8.8")
+
+}
+
+func TestSourceRestrictionsWithoutTrustedProxies(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+	config.AllowedNetworks = "MCK:10.0.0.0/8"
+
+	mb := test.NewMockBackend()
+
+	server := courier.NewServerWithLogger(config, mb, logger)
+	server.Start()
+	defer server.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	// without any trusted proxies, forwarding headers are ignored and we check where the request really came from
+	req, _ := http.NewRequest("GET", "http://localhost:8080/c/mck/e4bb1578-29da-4fa5-a214-9da19dd24230/receive?from=2065551212&text=hello", nil)
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	req.Header.Set("X-Forwarded-For", "10.1.2.3")
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 403, trace.Response.StatusCode)
+	assert.Regexp(t, `request source not allowed: (127\.0\.0\.1|::1)`, string(trace.ResponseBody))
+	assert.Len(t, mb.WrittenMsgs(), 0)
+}
+
+func TestInboundLimitResponses(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+
+	mb := test.NewMockBackend()
+	mb.SetWriteMsgError(&courier.InboundLimitError{Scope: courier.InboundLimitScopeURN, RetryAfter: 12500 * time.Millisecond})
+
+	server := courier.NewServerWithLogger(config, mb, logger)
+	server.Start()
+	defer server.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	request := func(texts ...string) *httpx.Trace {
+		query := url.Values{"from": []string{"2065551212"}, "text": []string{"hello"}}
+		if len(texts) > 0 {
+			query["text"] = texts
+		}
+		req, _ := http.NewRequest("GET", "http://localhost:8080/c/mck/e4bb1578-29da-4fa5-a214-9da19dd24230/receive?"+query.Encode(), nil)
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+		require.NoError(t, err)
+		return trace
+	}
+
+	// by default requests over a limit are rejected so that the sender retries later
+	trace := request()
+	assert.Equal(t, 429, trace.Response.StatusCode)
+	assert.Equal(t, "13", trace.Response.Header.Get("Retry-After"))
+	assert.Contains(t, string(trace.ResponseBody), "inbound rate limit exceeded for urn")
+
+	if assert.Len(t, mb.WrittenChannelLogs(), 1) {
+		assert.Equal(t, []*courier.ChannelError{courier.ErrorInboundLimitExceeded(courier.InboundLimitScopeURN)}, mb.WrittenChannelLogs()[0].Errors())
+	}
+
+	// but can instead be ignored
+	config.InboundLimitAction = "ignore"
+
+	trace = request()
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Contains(t, string(trace.ResponseBody), "Ignored")
+	assert.Len(t, mb.WrittenChannelLogs(), 2)
+
+	config.InboundLimitAction = "reject"
+	mb.SetWriteMsgError(nil)
+	mb.SetInboundLimits(&courier.InboundLimits{ChannelLimit: 2})
+	mb.Reset()
+
+	// a request which goes over the limit part way through isn't rejected as that would have the sender resend the msgs
+	// which were written, so the rest of it is ignored instead
+	trace = request("one", "two", "three")
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Contains(t, string(trace.ResponseBody), "Ignored")
+	assert.Len(t, mb.WrittenMsgs(), 2)
+
+	if assert.Len(t, mb.WrittenChannelLogs(), 1) {
+		assert.Equal(t, []*courier.ChannelError{courier.ErrorInboundLimitExceeded(courier.InboundLimitScopeChannel)}, mb.WrittenChannelLogs()[0].Errors())
+	}
+
+	// but a request which is entirely over the limit is still rejected
+	trace = request("four")
+	assert.Equal(t, 429, trace.Response.StatusCode)
+	assert.Len(t, mb.WrittenMsgs(), 2)
+}
+
+func TestDrain(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+	config.AuthToken = "sesame"
+
+	mb := test.NewMockBackend()
+	channel := test.NewMockChannel("95710b36-855d-4832-a723-5f71f73688a0", "MCK", "12345", "RW", nil)
+	mb.AddChannel(channel)
+
+	server := courier.NewServerWithLogger(config, mb, logger)
+	server.Start()
+	defer server.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	request := func(method, url, authToken string) (int, string) {
+		req, _ := http.NewRequest(method, url, nil)
+		if authToken != "" {
+			req.Header.Set("Authorization", "Bearer "+authToken)
+		}
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+		require.NoError(t, err)
+		return trace.Response.StatusCode, string(trace.ResponseBody)
+	}
+
+	// drain endpoint requires auth
+	statusCode, _ := request("POST", "http://localhost:8080/c/_drain", "")
+	assert.Equal(t, 401, statusCode)
+
+	statusCode, respBody := request("GET", "http://localhost:8080/c/_drain", "sesame")
+	assert.Equal(t, 200, statusCode)
+	assert.JSONEq(t, `{"draining": false, "sending": 0}`, respBody)
+
+	statusCode, respBody = request("POST", "http://localhost:8080/c/_drain", "sesame")
+	assert.Equal(t, 200, statusCode)
+	assert.JSONEq(t, `{"draining": true, "sending": 0}`, respBody)
+
+	// we're no longer ready so that load balancers take us out
+	statusCode, respBody = request("GET", "http://localhost:8080/health/ready", "")
+	assert.Equal(t, 503, statusCode)
+	assert.JSONEq(t, `{"version": "Dev", "ready": false, "draining": true, "checks": [{"name": "db", "ok": true, "required": true}, {"name": "redis", "ok": true, "required": true}]}`, respBody)
+
+	// and outgoing messages aren't popped
+	msg := mb.NewOutgoingMsg(channel, 10, "tel:+250788383383", "Hello", false, nil, "", "", courier.MsgOriginFlow, nil)
+	mb.PushOutgoingMsg(msg)
+
+	time.Sleep(500 * time.Millisecond)
+
+	popped, err := mb.PopNextOutgoingMsg(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, msg, popped)
+
+	// but we still accept incoming requests
+	statusCode, _ = request("POST", "http://localhost:8080/c/mck/95710b36-855d-4832-a723-5f71f73688a0/receive", "")
+	assert.NotEqual(t, 404, statusCode)
+
+	statusCode, respBody = request("DELETE", "http://localhost:8080/c/_drain", "sesame")
+	assert.Equal(t, 200, statusCode)
+	assert.JSONEq(t, `{"draining": false, "sending": 0}`, respBody)
+
+	statusCode, _ = request("GET", "http://localhost:8080/health/ready", "")
+	assert.Equal(t, 200, statusCode)
+}
+
+func TestSpoolAPI(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+	config.AuthToken = "sesame"
+	config.SpoolDir = t.TempDir()
+
+	require.NoError(t, courier.EnsureSpoolDirPresent(config.SpoolDir, "msgs"))
+
+	// register a flusher which can't parse some files, fails to flush others as if the db was down, and blocks on
+	// others until released
+	release := make(chan struct{})
+	courier.RegisterFlusher(path.Join(config.SpoolDir, "msgs"), func(filename string, contents []byte) error {
+		if strings.Contains(string(contents), "slow") {
+			<-release
+		} else if strings.Contains(string(contents), "invalid") {
+			return fmt.Errorf("%w: %s", courier.ErrInvalidSpoolFile, "unexpected token")
+		} else if strings.Contains(string(contents), "down") {
+			return errors.New("db is down")
+		}
+		return nil
+	})
+
+	server := courier.NewServerWithLogger(config, test.NewMockBackend(), logger)
+	server.Start()
+	defer server.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	request := func(method, url, body string) (int, map[string]any) {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sesame")
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+		require.NoError(t, err)
+
+		resp := make(map[string]any)
+		json.Unmarshal(trace.ResponseBody, &resp)
+		return trace.Response.StatusCode, resp
+	}
+	entries := func(resp map[string]any) []string {
+		es := make([]string, 0)
+		list, _ := resp["entries"].([]any)
+		for _, e := range list {
+			entry := e.(map[string]any)
+			es = append(es, fmt.Sprintf("%s/%s %s %v", entry["subdir"], entry["name"], entry["status"], entry["last_error"]))
+		}
+		return es
+	}
+	listMsgs := func() []string {
+		statusCode, resp := request("GET", "http://localhost:8080/c/_spool?subdir=msgs", "")
+		require.Equal(t, 200, statusCode)
+		return entries(resp)
+	}
+
+	// spool API requires auth
+	req, _ := http.NewRequest("GET", "http://localhost:8080/c/_spool", nil)
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 401, trace.Response.StatusCode)
+
+	statusCode, resp := request("GET", "http://localhost:8080/c/_spool", "")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []any{}, resp["backlog"])
+	assert.Nil(t, resp["entries"])
+	assert.Equal(t, []string{}, listMsgs())
+
+	require.NoError(t, os.WriteFile(path.Join(config.SpoolDir, "msgs", "1.json"), []byte(`{"text": "ok"}`), 0640))
+	require.NoError(t, os.WriteFile(path.Join(config.SpoolDir, "msgs", "2.json"), []byte(`{"text": "down"}`), 0640))
+	require.NoError(t, os.WriteFile(path.Join(config.SpoolDir, "msgs", "3.json"), []byte(`{"text": "invalid"}`), 0640))
+	require.NoError(t, os.WriteFile(path.Join(config.SpoolDir, "msgs", "4.json"), []byte(`{"text": "slow"}`), 0640))
+
+	// without a subdir we only get the backlog
+	statusCode, resp = request("GET", "http://localhost:8080/c/_spool", "")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, 4.0, resp["backlog"].([]any)[0].(map[string]any)["pending"])
+	assert.Nil(t, resp["entries"])
+
+	assert.Equal(t, []string{"msgs/1.json pending <nil>", "msgs/2.json pending <nil>", "msgs/3.json pending <nil>", "msgs/4.json pending <nil>"}, listMsgs())
+
+	// entries can be paged through
+	statusCode, resp = request("GET", "http://localhost:8080/c/_spool?subdir=msgs&limit=2", "")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []string{"msgs/1.json pending <nil>", "msgs/2.json pending <nil>"}, entries(resp))
+	assert.Equal(t, 4.0, resp["total"])
+
+	statusCode, resp = request("GET", "http://localhost:8080/c/_spool?subdir=msgs&limit=2&offset=2", "")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []string{"msgs/3.json pending <nil>", "msgs/4.json pending <nil>"}, entries(resp))
+	assert.Equal(t, 4.0, resp["total"])
+
+	statusCode, resp = request("GET", "http://localhost:8080/c/_spool?subdir=msgs&offset=5", "")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []string{}, entries(resp))
+
+	statusCode, _ = request("GET", "http://localhost:8080/c/_spool?subdir=msgs&limit=0", "")
+	assert.Equal(t, 400, statusCode)
+
+	statusCode, _ = request("GET", "http://localhost:8080/c/_spool?subdir=msgs&offset=-1", "")
+	assert.Equal(t, 400, statusCode)
+
+	statusCode, _ = request("GET", "http://localhost:8080/c/_spool?subdir=..", "")
+	assert.Equal(t, 400, statusCode)
+
+	// flushing happens in the background, and we get the backlog as it was when the flush started
+	statusCode, resp = request("POST", "http://localhost:8080/c/_spool/flush", "")
+	assert.Equal(t, 202, statusCode)
+	assert.Equal(t, 4.0, resp["backlog"].([]any)[0].(map[string]any)["pending"])
+	assert.Nil(t, resp["entries"])
+
+	// can't start another flush until that one is done
+	statusCode, _ = request("POST", "http://localhost:8080/c/_spool/flush", "")
+	assert.Equal(t, 409, statusCode)
+
+	close(release)
+
+	// a file failing to flush doesn't stop others from being flushed
+	expected := []string{"msgs/2.json pending db is down", "msgs/3.json.error invalid invalid spool file: unexpected token"}
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(expected, listMsgs()) }, time.Second, 10*time.Millisecond)
+
+	statusCode, resp = request("GET", "http://localhost:8080/c/_spool?subdir=msgs", "")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, expected, entries(resp))
+	assert.Equal(t, 1.0, resp["entries"].([]any)[0].(map[string]any)["attempts"])
+	assert.NotNil(t, resp["entries"].([]any)[0].(map[string]any)["retry_on"])
+
+	// quarantine the file which won't flush
+	statusCode, resp = request("POST", "http://localhost:8080/c/_spool/quarantine", `{"subdir": "msgs", "name": "2.json"}`)
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []any{map[string]any{"subdir": "msgs", "pending": 0.0, "invalid": 1.0, "quarantined": 1.0, "oldest_on": nil}}, resp["backlog"])
+	assert.Equal(t, []string{"msgs/3.json.error invalid invalid spool file: unexpected token", "msgs/2.json quarantined db is down"}, listMsgs())
+
+	// fix and reinject the invalid file
+	require.NoError(t, os.WriteFile(path.Join(config.SpoolDir, "msgs", "3.json.error"), []byte(`{"text": "fixed"}`), 0640))
+
+	statusCode, _ = request("POST", "http://localhost:8080/c/_spool/reinject", `{"subdir": "msgs", "name": "3.json.error"}`)
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []string{"msgs/3.json pending <nil>", "msgs/2.json quarantined db is down"}, listMsgs())
+
+	statusCode, _ = request("POST", "http://localhost:8080/c/_spool/flush", "")
+	assert.Equal(t, 202, statusCode)
+	assert.Eventually(t, func() bool { return len(listMsgs()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"msgs/2.json quarantined db is down"}, listMsgs())
+
+	// try to move entries that don't exist or with invalid requests
+	statusCode, _ = request("POST", "http://localhost:8080/c/_spool/reinject", `{"subdir": "msgs", "name": "3.json.error"}`)
+	assert.Equal(t, 404, statusCode)
+
+	statusCode, _ = request("POST", "http://localhost:8080/c/_spool/reinject", `{"subdir": "msgs"}`)
+	assert.Equal(t, 400, statusCode)
+
+	statusCode, _ = request("POST", "http://localhost:8080/c/_spool/quarantine", `{"subdir": "..", "name": "msgs"}`)
+	assert.Equal(t, 400, statusCode)
+}
+
+func TestAttachmentRedirect(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+	config.AuthToken = "sesame"
+
+	mb := test.NewMockBackend()
+	mb.SetPrivateAttachments("localhost")
+
+	server := courier.NewServerWithLogger(config, mb, logger)
+	server.Start()
+	defer server.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	// don't follow redirects so we can check them
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(url, authToken string) *http.Response {
+		req, _ := http.NewRequest("GET", url, nil)
+		if authToken != "" {
+			req.Header.Set("Authorization", "Bearer "+authToken)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("http://localhost:8080/c/_attachments/attachments/1234.jpg", "")
+	assert.Equal(t, 401, resp.StatusCode)
+
+	resp = get("http://localhost:8080/c/_attachments/attachments/1234.jpg", "sesame")
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "https://backend.com/attachments/1234.jpg?signature=sesame", resp.Header.Get("Location"))
+
+	mb.SetStorageError(errors.New("boom"))
+
+	resp = get("http://localhost:8080/c/_attachments/attachments/1234.jpg", "sesame")
+	assert.Equal(t, 500, resp.StatusCode)
+}
+
+func TestChannelLogsAPI(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+	config.AuthToken = "sesame"
+
+	dates.SetNowSource(dates.NewSequentialNowSource(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]*httpx.MockResponse{
+		"https://api.messages.com/send.json?secret=sesame": {
+			httpx.NewMockResponse(200, nil, []byte(`{"status":"success"}`)),
+			httpx.NewMockResponse(500, nil, []byte(`{"status":"error"}`)),
+			httpx.NewMockResponse(200, nil, []byte(`{"status":"success"}`)),
+		},
+	}))
+
+	mb := test.NewMockBackend()
+	channel := test.NewMockChannel("95710b36-855d-4832-a723-5f71f73688a0", "MCK", "12345", "RW", nil)
+	mb.AddChannel(channel)
+
+	// write logs without redaction so we can check the API redacts them
+	newLog := func(t_ courier.ChannelLogType) *courier.ChannelLog {
+		clog := courier.NewChannelLog(t_, channel, nil)
+		req, _ := http.NewRequest("POST", "https://api.messages.com/send.json?secret=sesame", nil)
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+		require.NoError(t, err)
+		clog.HTTP(trace)
+		mb.WriteChannelLog(context.Background(), clog)
+		return clog
+	}
+	clog1 := newLog(courier.ChannelLogTypeMsgSend)
+	clog2 := newLog(courier.ChannelLogTypeMsgSend)
+	clog3 := newLog(courier.ChannelLogTypeTokenRefresh)
+
+	httpx.SetRequestor(httpx.DefaultRequestor)
+
+	server := courier.NewServerWithLogger(config, mb, logger)
+	server.Start()
+	defer server.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	request := func(url string) (int, string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer sesame")
+		trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+		require.NoError(t, err)
+		return trace.Response.StatusCode, string(trace.ResponseBody)
+	}
+	logUUIDs := func(body string) []courier.ChannelLogUUID {
+		resp := &struct {
+			Results []*courier.ChannelLogRecord `json:"results"`
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(body), resp))
+		us := make([]courier.ChannelLogUUID, len(resp.Results))
+		for i, l := range resp.Results {
+			us[i] = l.UUID
+		}
+		return us
+	}
+
+	// logs API requires auth
+	req, _ := http.NewRequest("GET", "http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0", nil)
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 401, trace.Response.StatusCode)
+
+	statusCode, body := request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []courier.ChannelLogUUID{clog3.UUID(), clog2.UUID(), clog1.UUID()}, logUUIDs(body))
+	assert.NotContains(t, body, "sesame")
+	assert.Contains(t, body, "secret=**********")
+
+	statusCode, body = request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0?type=msg_send&limit=1")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []courier.ChannelLogUUID{clog2.UUID()}, logUUIDs(body))
+
+	statusCode, body = request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0?is_error=true")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []courier.ChannelLogUUID{clog2.UUID()}, logUUIDs(body))
+
+	statusCode, body = request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0?after=" + clog2.CreatedOn().Format(time.RFC3339Nano) + "&before=" + clog3.CreatedOn().Format(time.RFC3339Nano))
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, []courier.ChannelLogUUID{clog2.UUID()}, logUUIDs(body))
+
+	statusCode, body = request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0?is_error=maybe")
+	assert.Equal(t, 400, statusCode)
+	assert.Contains(t, body, "invalid is_error 'maybe'")
+
+	statusCode, body = request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0?before=yesterday")
+	assert.Equal(t, 400, statusCode)
+	assert.Contains(t, body, "invalid before 'yesterday', must be RFC3339 formatted")
+
+	// fetch a single log
+	statusCode, body = request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0/" + string(clog2.UUID()))
+	assert.Equal(t, 200, statusCode)
+	l := &courier.ChannelLogRecord{}
+	require.NoError(t, json.Unmarshal([]byte(body), l))
+	assert.Equal(t, clog2.UUID(), l.UUID)
+	assert.Equal(t, courier.ChannelLogTypeMsgSend, l.Type)
+	assert.True(t, l.IsError)
+	assert.Equal(t, "https://api.messages.com/send.json?secret=**********", l.HTTPLogs[0].URL)
+
+	// our written log isn't modified by redaction
+	assert.Equal(t, "https://api.messages.com/send.json?secret=sesame", clog2.HTTPLogs()[0].URL)
+
+	statusCode, _ = request("http://localhost:8080/c/_logs/95710b36-855d-4832-a723-5f71f73688a0/" + string(uuids.New()))
+	assert.Equal(t, 404, statusCode)
+
+	statusCode, _ = request("http://localhost:8080/c/_logs/" + string(uuids.New()))
+	assert.Equal(t, 404, statusCode)
+}
+
+func TestChannelLogTail(t *testing.T) {
+	logger := slog.Default()
+	config := courier.NewConfig()
+	config.AuthToken = "sesame"
+
+	mb := test.NewMockBackend()
+	channel := test.NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "MCK", "2020", "US", nil)
+	mb.AddChannel(channel)
+
+	server := courier.NewServerWithLogger(config, mb, logger)
+	server.Start()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	// tail requires auth
+	req, _ := http.NewRequest("GET", "http://localhost:8080/c/_logs/e4bb1578-29da-4fa5-a214-9da19dd24230/tail", nil)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 401, resp.StatusCode)
+
+	req.Header.Set("Authorization", "Bearer sesame")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan string, 10)
+	go func() {
+		reader := bufio.NewReader(resp.Body)
+		event := ""
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			if line == "\n" {
+				events <- event
+				event = ""
+			} else {
+				event += line
+			}
+		}
+	}()
+	nextEvent := func() string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second * 2):
+			return ""
+		}
+	}
+
+	assert.Equal(t, ": tailing logs for channel e4bb1578-29da-4fa5-a214-9da19dd24230\n", nextEvent())
+
+	// make an incoming request to this channel which will be logged by the handler wrapper
+	req, _ = http.NewRequest("GET", "http://localhost:8080/c/mck/e4bb1578-29da-4fa5-a214-9da19dd24230/receive?from=2065551212&text=open+sesame", nil)
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+
+	event := nextEvent()
+	assert.Contains(t, event, "event: log\n")
+	assert.Contains(t, event, `"type":"msg_receive"`)
+	assert.Contains(t, event, "text=open+**********")
+	assert.NotContains(t, event, "sesame")
+
+	// logs of other channels aren't streamed but logs written by anything else for this channel are
+	other := test.NewMockChannel("95710b36-855d-4832-a723-5f71f73688a0", "MCK", "12345", "RW", nil)
+	mb.WriteChannelLog(context.Background(), courier.NewChannelLog(courier.ChannelLogTypeTokenRefresh, other, nil))
+	clog := courier.NewChannelLog(courier.ChannelLogTypeMsgSend, channel, nil)
+	mb.WriteChannelLog(context.Background(), clog)
+
+	event = nextEvent()
+	assert.Contains(t, event, fmt.Sprintf("id: %s\n", clog.UUID()))
+	assert.Contains(t, event, `"type":"msg_send"`)
+
+	// tails are ended when the server stops
+	server.Stop()
+
+	_, ok := <-events
+	assert.False(t, ok)
+}
@@ -0,0 +1,138 @@
+package courier
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/gocommon/httpx"
+)
+
+// ErrSourceNotAllowed is returned when an incoming request doesn't come from a network allowed for its channel
+var ErrSourceNotAllowed = errors.New("request source not allowed")
+
+// SourcePolicy restricts which IP addresses incoming requests for channels can come from. A channel's own config takes
+// precedence over the defaults for its channel type, and channels with neither accept requests from anywhere.
+type SourcePolicy struct {
+	ChannelTypeNetworks map[ChannelType][]string
+	TrustedProxyIPs     []net.IP
+	TrustedProxyNets    []*net.IPNet
+}
+
+// NewSourcePolicy creates a new source policy from the given config
+func NewSourcePolicy(cfg *Config) *SourcePolicy {
+	networks, _ := cfg.ParseAllowedNetworks()           // already validated
+	proxyIPs, proxyNets, _ := cfg.ParseTrustedProxies() // already validated
+
+	return &SourcePolicy{ChannelTypeNetworks: networks, TrustedProxyIPs: proxyIPs, TrustedProxyNets: proxyNets}
+}
+
+// Allows returns whether incoming requests for the given channel can come from the given IP address
+func (p *SourcePolicy) Allows(ch Channel, ip string) bool {
+	addrs := p.networks(ch)
+	if len(addrs) == 0 {
+		return true
+	}
+
+	ips, ipNets, err := httpx.ParseNetworks(addrs...)
+	if err != nil {
+		// better to reject everything than let requests through from networks that weren't meant to be allowed
+		slog.Error("invalid allowed networks in channel config", "error", err, "channel_uuid", ch.UUID())
+		return false
+	}
+
+	return containsIP(ips, ipNets, ip)
+}
+
+// gets the networks for the given channel, which can be configured as a comma separated string or a list
+func (p *SourcePolicy) networks(ch Channel) []string {
+	switch v := ch.ConfigForKey(ConfigAllowedNetworks, nil).(type) {
+	case string:
+		return splitConfigList(v)
+	case []any:
+		addrs := make([]string, 0, len(v))
+		for _, a := range v {
+			if s, isStr := a.(string); isStr && strings.TrimSpace(s) != "" {
+				addrs = append(addrs, strings.TrimSpace(s))
+			}
+		}
+		return addrs
+	}
+
+	if p == nil {
+		return nil
+	}
+	return p.ChannelTypeNetworks[ch.ChannelType()]
+}
+
+// RequestIP gets the IP address of the client which made the given request. The X-Forwarded-For and X-Real-IP headers
+// can be set by anyone so are only used if the request came from a trusted proxy, in which case the client is the last
+// address in X-Forwarded-For that isn't another trusted proxy.
+func (p *SourcePolicy) RequestIP(r *http.Request) string {
+	peer := hostOnly(peerAddr(r))
+	if !p.trustsProxy(peer) {
+		return peer
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip != "" && !p.trustsProxy(ip) {
+			return ip
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return peer
+}
+
+func (p *SourcePolicy) trustsProxy(ip string) bool {
+	return p != nil && containsIP(p.TrustedProxyIPs, p.TrustedProxyNets, ip)
+}
+
+func containsIP(ips []net.IP, ipNets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, i := range ips {
+		if i.Equal(parsed) {
+			return true
+		}
+	}
+	for _, n := range ipNets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware which saves the address of whatever actually connected to us, before RealIP replaces it
+func savePeerAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextPeerAddr, r.RemoteAddr)))
+	})
+}
+
+// gets the address of whatever actually connected to us to make the given request
+func peerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(contextPeerAddr).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
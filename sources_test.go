@@ -0,0 +1,100 @@
+package courier_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourcePolicy(t *testing.T) {
+	cfg := courier.NewConfig()
+	cfg.AllowedNetworks = "KN:10.0.0.0/8, 192.168.1.5; AT:2001:db8::/32"
+
+	policy := courier.NewSourcePolicy(cfg)
+	assert.Equal(t, map[courier.ChannelType][]string{"KN": {"10.0.0.0/8", "192.168.1.5"}, "AT": {"2001:db8::/32"}}, policy.ChannelTypeNetworks)
+
+	kannel := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US", nil)
+	kannelOverride := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ac", "KN", "2020", "US", map[string]any{courier.ConfigAllowedNetworks: "172.16.0.1"})
+	at := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ad", "AT", "2020", "US", nil)
+	external := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ae", "EX", "2020", "US", nil)
+	externalList := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56af", "EX", "2020", "US", map[string]any{courier.ConfigAllowedNetworks: []any{"1.2.3.0/24", "5.6.7.8"}})
+	invalid := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56b0", "EX", "2020", "US", map[string]any{courier.ConfigAllowedNetworks: "1.2.3"})
+
+	tcs := []struct {
+		channel courier.Channel
+		ip      string
+		allowed bool
+	}{
+		{kannel, "10.1.2.3", true},
+		{kannel, "192.168.1.5", true},
+		{kannel, "192.168.1.6", false},
+		{kannel, "8.8.8.8", false},
+		{kannel, "", false},
+		{kannelOverride, "172.16.0.1", true},
+		{kannelOverride, "10.1.2.3", false},
+		{at, "2001:db8::1", true},
+		{at, "10.1.2.3", false},
+		{external, "8.8.8.8", true},
+		{externalList, "1.2.3.4", true},
+		{externalList, "5.6.7.8", true},
+		{externalList, "8.8.8.8", false},
+		{invalid, "1.2.3.4", false},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.allowed, policy.Allows(tc.channel, tc.ip), "allows mismatch for channel %s and ip '%s'", tc.channel.UUID(), tc.ip)
+	}
+
+	assert.NoError(t, cfg.Validate())
+
+	cfg.AllowedNetworks = "KN:10.0.0.0/8;AT"
+	assert.EqualError(t, cfg.Validate(), "unable to parse 'AllowedNetworks': invalid channel type networks 'AT'")
+
+	cfg.AllowedNetworks = "KN:10.0.0.0/33"
+	assert.EqualError(t, cfg.Validate(), "unable to parse 'AllowedNetworks': couldn't parse '10.0.0.0/33' as an IP network")
+}
+
+func TestSourcePolicyRequestIP(t *testing.T) {
+	cfg := courier.NewConfig()
+	cfg.TrustedProxies = "10.0.0.1, 172.16.0.0/12"
+
+	policy := courier.NewSourcePolicy(cfg)
+
+	tcs := []struct {
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		expectedIP   string
+	}{
+		{"8.8.8.8:1234", nil, "", "8.8.8.8"},
+		{"8.8.8.8:1234", []string{"10.1.2.3"}, "10.1.2.4", "8.8.8.8"}, // forwarding headers from untrusted clients are ignored
+		{"10.0.0.1:1234", nil, "", "10.0.0.1"},
+		{"10.0.0.1:1234", nil, "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:1234", []string{"1.2.3.4"}, "", "1.2.3.4"},
+		{"10.0.0.1:1234", []string{"10.1.2.3, 1.2.3.4"}, "", "1.2.3.4"},             // only the address added by our proxy counts
+		{"10.0.0.1:1234", []string{"10.1.2.3, 1.2.3.4, 172.16.5.5"}, "", "1.2.3.4"}, // skipping any other trusted proxies
+		{"10.0.0.1:1234", []string{"10.1.2.3", "1.2.3.4"}, "", "1.2.3.4"},
+		{"[2001:db8::1]:1234", []string{"1.2.3.4"}, "", "2001:db8::1"},
+	}
+
+	for _, tc := range tcs {
+		r := httptest.NewRequest("GET", "http://example.com/c/kn/receive", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for _, f := range tc.forwardedFor {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+
+		assert.Equal(t, tc.expectedIP, policy.RequestIP(r), "request IP mismatch for remote %s and forwarded for %v", tc.remoteAddr, tc.forwardedFor)
+	}
+
+	assert.NoError(t, cfg.Validate())
+
+	cfg.TrustedProxies = "10.0.0.1, 10.0.0.0/33"
+	assert.EqualError(t, cfg.Validate(), "unable to parse 'TrustedProxies': couldn't parse '10.0.0.0/33' as an IP network")
+}
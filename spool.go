@@ -5,39 +5,107 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // FlusherFunc defines our interface for flushers, they are handed a filename and byte blob and are expected
-// to try to flush that to the db, returning an error if the db is still down
+// to try to flush that to the db, returning an error if the db is still down. If the file can't be parsed, they
+// should return an error wrapping ErrInvalidSpoolFile and the file will be renamed to .error so it isn't retried.
 type FlusherFunc func(filename string, contents []byte) error
 
-// RegisterFlusher creates a new walker which we will use to flush files from the passed in directory
+// SpoolOrderFunc returns the key that spooled files should be flushed in order by, e.g. a contact URN, and the time to
+// order them by within that key, e.g. when a message was received
+type SpoolOrderFunc func(contents []byte) (string, time.Time, error)
+
+// ErrInvalidSpoolFile is wrapped by flushers for spool files which can never be flushed
+var ErrInvalidSpoolFile = errors.New("invalid spool file")
+
+// ErrSpoolEntryNotFound is returned when trying to quarantine or reinject a spool entry which doesn't exist
+var ErrSpoolEntryNotFound = errors.New("spool entry not found")
+
+// ErrSpoolFull is returned when trying to write to a spool which has reached its maximum size
+var ErrSpoolFull = errors.New("spool is full")
+
+// the subdirectory of our spool directory which quarantined files are moved to
+const spoolQuarantineDir = "quarantine"
+
+// how often we flush our spool and how long we back off for after failing to flush a file, which doubles with each
+// failed attempt up to a maximum
+const (
+	spoolFlushInterval   = 30 * time.Second
+	spoolRetryBackoff    = 30 * time.Second
+	spoolRetryMaxBackoff = 30 * time.Minute
+)
+
+// RegisterFlusher registers a flusher which we will use to flush files from the passed in directory
 func RegisterFlusher(directory string, flusherFunc FlusherFunc) {
-	registeredFlushers = append(registeredFlushers, &flusherRegistration{directory, flusherFunc})
+	registeredFlushers = append(registeredFlushers, &flusherRegistration{directory, flusherFunc, nil})
+}
+
+// RegisterOrderedFlusher registers a flusher which we will use to flush files from the passed in directory, such that
+// files with the same key are flushed one at a time in order, and a file is never flushed before an earlier one with
+// the same key
+func RegisterOrderedFlusher(directory string, flusherFunc FlusherFunc, orderFunc SpoolOrderFunc) {
+	registeredFlushers = append(registeredFlushers, &flusherRegistration{directory, flusherFunc, orderFunc})
 }
 
-// WriteToSpool writes the passed in object to the passed in subdir
+// WriteToSpool writes the passed in object to the passed in subdir, returning ErrSpoolFull if that would take our
+// spool over its maximum size
 func WriteToSpool(spoolDir string, subdir string, contents any) error {
 	contentBytes, err := json.MarshalIndent(contents, "", "  ")
 	if err != nil {
 		return err
 	}
 
+	if err := checkSpoolRoom(int64(len(contentBytes))); err != nil {
+		return err
+	}
+
 	filename := path.Join(spoolDir, subdir, fmt.Sprintf("%d.json", time.Now().UnixNano()))
-	return os.WriteFile(filename, contentBytes, 0640)
+	if err := os.WriteFile(filename, contentBytes, 0640); err != nil {
+		return err
+	}
+
+	spoolSize.Add(int64(len(contentBytes)))
+	return nil
+}
+
+// returns ErrSpoolFull if adding a file of the passed in size would take our spool over its maximum size
+func checkSpoolRoom(size int64) error {
+	if maxSize := spoolMaxSize.Load(); maxSize > 0 && spoolSize.Load()+size > maxSize {
+		return ErrSpoolFull
+	}
+	return nil
 }
 
 // starts our spool flusher, which every 30 seconds tries to write our pending msgs and statuses
 func startSpoolFlushers(s Server) {
+	config := s.Config()
+
 	// create our actual flushers
 	flushers = make([]*flusher, len(registeredFlushers))
 	for i, reg := range registeredFlushers {
-		flushers[i] = newSpoolFlusher(s, reg.directory, reg.flusher)
+		flushers[i] = &flusher{server: s, directory: reg.directory, flush: reg.flusher, order: reg.order}
+	}
+	flushWorkers = max(config.SpoolFlushWorkers, 1)
+	flushRate = config.SpoolFlushRate
+	spoolMaxSize.Store(int64(config.SpoolMaxSize) * 1024 * 1024)
+
+	// work out how big our spool is before anything else is written to it
+	spoolSize.Store(0)
+	for _, f := range flushers {
+		files, _ := f.pendingFiles()
+		for _, file := range files {
+			spoolSize.Add(file.size)
+		}
 	}
 
 	s.WaitGroup().Add(1)
@@ -58,15 +126,101 @@ func startSpoolFlushers(s Server) {
 				return
 
 			// every 30 seconds we check to see if there are any files to spool
-			case <-time.After(30 * time.Second):
-				for _, flusher := range flushers {
-					filepath.Walk(flusher.directory, flusher.walker)
-				}
+			case <-time.After(spoolFlushInterval):
+				FlushSpool()
 			}
 		}
 	}()
 }
 
+// FlushSpool tries to flush all the files in our spool directories which aren't backing off after failed attempts,
+// using our flush workers, returning once it has done so
+func FlushSpool() {
+	flushMutex.Lock()
+	defer flushMutex.Unlock()
+
+	flushSpool()
+}
+
+// StartSpoolFlush starts flushing our spool in the background, adding to the passed in wait group until done, returning
+// false without doing anything if a flush is already in progress
+func StartSpoolFlush(wg *sync.WaitGroup) bool {
+	if !flushMutex.TryLock() {
+		return false
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer flushMutex.Unlock()
+
+		flushSpool()
+	}()
+	return true
+}
+
+// flushes our spool, callers must hold our flush mutex
+func flushSpool() {
+	// read what's waiting to be flushed in all our directories, resyncing our size in case files have been added or
+	// removed outside of courier
+	var size int64
+	seqs := make([]*spoolSequence, 0)
+	for _, f := range flushers {
+		files, err := f.pendingFiles()
+		if err != nil {
+			slog.Error("error reading spool directory", "comp", "spool", "error", err, "directory", f.directory)
+			continue
+		}
+		for _, file := range files {
+			size += file.size
+		}
+		seqs = append(seqs, f.sequences(files, time.Now())...)
+	}
+	spoolSize.Store(size)
+
+	pruneSpoolFileStates()
+
+	// rate limit flushes across all our workers
+	var limiter <-chan time.Time
+	if flushRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(flushRate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	work := make(chan *spoolSequence, flushWorkers)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < flushWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for seq := range work {
+				for _, file := range seq.files {
+					if seq.flusher.server.Stopped() {
+						break
+					}
+					if limiter != nil {
+						<-limiter
+					}
+
+					// if a file fails to flush, later files in the same sequence have to wait until it does
+					if !seq.flusher.flushFile(file) {
+						break
+					}
+				}
+			}
+		}()
+	}
+
+	for _, seq := range seqs {
+		work <- seq
+	}
+	close(work)
+	wg.Wait()
+}
+
 // EnsureSpoolDirPresent checks that the passed in spool directory is present and writable
 func EnsureSpoolDirPresent(spoolDir string, subdir string) (err error) {
 	msgsDir := path.Join(spoolDir, subdir)
@@ -76,64 +230,575 @@ func EnsureSpoolDirPresent(spoolDir string, subdir string) (err error) {
 	return err
 }
 
-// creates a new spool flusher
-func newSpoolFlusher(s Server, dir string, flusherFunc FlusherFunc) *flusher {
-	return &flusher{func(filename string, info os.FileInfo, err error) error {
-		if filename == dir {
-			return nil
-		}
+// CheckSpoolDirWritable checks that the passed in spool directory is writable by writing and removing a temp file
+func CheckSpoolDirWritable(spoolDir string, subdir string) error {
+	f, err := os.CreateTemp(path.Join(spoolDir, subdir), ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
 
-		// we've been stopped, exit
-		if s.Stopped() {
-			return errors.New("spool flush process stopped")
-		}
+// a file in one of our spool directories which is waiting to be flushed
+type spoolFile struct {
+	path    string
+	size    int64
+	key     string
+	orderOn time.Time
+}
+
+// a sequence of files which must be flushed in order by a single worker
+type spoolSequence struct {
+	flusher *flusher
+	files   []*spoolFile
+}
+
+// simple struct that represents a flush function and the directory that it flushes
+type flusher struct {
+	server    Server
+	directory string
+	flush     FlusherFunc
+	order     SpoolOrderFunc
+
+	// the keys and times of our files by path, so we don't have to read every file to order them each time we flush
+	orders      map[string]*spoolOrder
+	ordersMutex sync.Mutex
+}
+
+// the key and time a spool file is ordered by, along with the modified time and size of the file it was read from
+type spoolOrder struct {
+	modTime time.Time
+	size    int64
+	key     string
+	orderOn time.Time
+}
+
+// returns the files in our directory waiting to be flushed, with their keys and times if we're ordered
+func (f *flusher) pendingFiles() ([]*spoolFile, error) {
+	entries, err := os.ReadDir(f.directory)
+	if err != nil {
+		return nil, err
+	}
 
-		// we don't care about subdirectories
-		if info.IsDir() {
-			return filepath.SkipDir
+	files := make([]*spoolFile, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
 		}
 
-		// ignore non-json files
-		if !strings.HasSuffix(filename, ".json") {
-			return nil
+		info, err := e.Info()
+		if err != nil {
+			continue // flushed since we read the directory
 		}
 
-		log := slog.With("comp", "spool", "filename", filename)
+		file := &spoolFile{path: filepath.Join(f.directory, e.Name()), size: info.Size(), orderOn: info.ModTime()}
 
-		// otherwise, read our msg json
-		contents, err := os.ReadFile(filename)
-		if err != nil {
-			log.Error("reading spool file", "error", err)
-			return nil
+		if f.order != nil {
+			order, err := f.fileOrder(file.path, info)
+			if err != nil {
+				continue
+			}
+			file.key, file.orderOn = order.key, order.orderOn
 		}
 
-		err = flusherFunc(filename, contents)
-		if err != nil {
-			log.Error("flushing spool file", "error", err)
-			return err
+		files = append(files, file)
+	}
+
+	// forget the order of files which are no longer in our directory
+	if f.order != nil {
+		present := make(map[string]bool, len(files))
+		for _, file := range files {
+			present[file.path] = true
 		}
-		log.Info("flushed")
 
-		// we flushed, remove our file if it is still present
-		if _, e := os.Stat(filename); e == nil {
-			err = os.Remove(filename)
+		f.ordersMutex.Lock()
+		for filename := range f.orders {
+			if !present[filename] {
+				delete(f.orders, filename)
+			}
 		}
-		return err
-	}, dir}
+		f.ordersMutex.Unlock()
+	}
+
+	return files, nil
 }
 
-// simple struct that represents our walking function and the directory that gets walked
-type flusher struct {
-	walker    filepath.WalkFunc
-	directory string
+// returns the key and time the passed in file is ordered by, only reading it if it's new or has changed
+func (f *flusher) fileOrder(filename string, info os.FileInfo) (*spoolOrder, error) {
+	f.ordersMutex.Lock()
+	defer f.ordersMutex.Unlock()
+
+	if order := f.orders[filename]; order != nil && order.modTime.Equal(info.ModTime()) && order.size == info.Size() {
+		return order, nil
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &spoolOrder{modTime: info.ModTime(), size: info.Size(), orderOn: info.ModTime()}
+
+	// files we can't read the order of are flushed on their own, and will likely be found to be invalid
+	if key, orderOn, err := f.order(contents); err == nil {
+		order.key, order.orderOn = key, orderOn
+	}
+
+	if f.orders == nil {
+		f.orders = make(map[string]*spoolOrder)
+	}
+	f.orders[filename] = order
+	return order, nil
+}
+
+// groups the passed in files into sequences which can be flushed in parallel, leaving out files which are backing off
+// after failing to flush, as well as any files after them in the same sequence
+func (f *flusher) sequences(files []*spoolFile, now time.Time) []*spoolSequence {
+	// our filenames are the time they were written, so sort by that first to make ordering by time stable
+	sort.SliceStable(files, func(i, j int) bool { return files[i].path < files[j].path })
+	sort.SliceStable(files, func(i, j int) bool { return files[i].orderOn.Before(files[j].orderOn) })
+
+	seqs := make([]*spoolSequence, 0, len(files))
+	byKey := make(map[string]*spoolSequence)
+	blocked := make(map[string]bool)
+
+	for _, file := range files {
+		if f.order != nil && file.key != "" {
+			if blocked[file.key] {
+				continue
+			}
+			if isSpoolFileBackingOff(file.path, now) {
+				blocked[file.key] = true
+				continue
+			}
+
+			seq := byKey[file.key]
+			if seq == nil {
+				seq = &spoolSequence{flusher: f}
+				byKey[file.key] = seq
+				seqs = append(seqs, seq)
+			}
+			seq.files = append(seq.files, file)
+		} else if !isSpoolFileBackingOff(file.path, now) {
+			seqs = append(seqs, &spoolSequence{flusher: f, files: []*spoolFile{file}})
+		}
+	}
+
+	return seqs
 }
 
-var flushers []*flusher
+// tries to flush the passed in file, returning whether the next file in its sequence can be flushed
+func (f *flusher) flushFile(file *spoolFile) bool {
+	log := slog.With("comp", "spool", "filename", file.path)
+
+	contents, err := os.ReadFile(file.path)
+	if err != nil {
+		log.Error("reading spool file", "error", err)
+		return false
+	}
+
+	err = f.flush(file.path, contents)
+	if errors.Is(err, ErrInvalidSpoolFile) {
+		// this file will never flush, rename it so we stop retrying it
+		log.Error("invalid spool file, renaming", "error", err)
+		if err := os.Rename(file.path, file.path+".error"); err != nil {
+			log.Error("renaming invalid spool file", "error", err)
+			return false
+		}
+		clearSpoolFileState(file.path)
+		recordSpoolFileError(file.path+".error", err, false)
+		spoolSize.Add(-file.size)
+		return true
+	} else if err != nil {
+		log.Error("flushing spool file", "error", err)
+		recordSpoolFileError(file.path, err, true)
+		return false
+	}
+
+	// we flushed, remove our file if it is still present
+	if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+		log.Error("removing flushed spool file", "error", err)
+	}
+	log.Info("flushed")
+	clearSpoolFileState(file.path)
+	spoolSize.Add(-file.size)
+	return true
+}
 
 // simple struct to keep track of who has registered to flush and for what directories
 type flusherRegistration struct {
 	directory string
 	flusher   FlusherFunc
+	order     SpoolOrderFunc
 }
 
 var registeredFlushers []*flusherRegistration
+
+// spool state which is shared between writers, our periodic flushing and the admin API
+var (
+	flushers     []*flusher
+	flushWorkers = 1
+	flushRate    = 0        // files per second, zero meaning no limit
+	flushMutex   sync.Mutex // held whilst flushing so that forced flushes don't overlap with our periodic ones
+
+	spoolSize    atomic.Int64 // bytes of files waiting to be flushed
+	spoolMaxSize atomic.Int64 // zero meaning no limit
+
+	spoolStates      = make(map[string]*spoolFileState) // by path
+	spoolStatesMutex sync.Mutex
+)
+
+// what we know about a spool file from trying to flush it
+type spoolFileState struct {
+	attempts  int
+	retryOn   time.Time
+	lastError string
+}
+
+// records that we failed to flush the passed in file, and if it will be retried, backs it off
+func recordSpoolFileError(filename string, err error, retry bool) {
+	spoolStatesMutex.Lock()
+	defer spoolStatesMutex.Unlock()
+
+	state := spoolStates[filename]
+	if state == nil {
+		state = &spoolFileState{}
+		spoolStates[filename] = state
+	}
+	state.lastError = err.Error()
+
+	if retry {
+		state.attempts++
+		backoff := float64(spoolRetryBackoff) * math.Pow(2, float64(state.attempts-1))
+		state.retryOn = time.Now().Add(time.Duration(min(backoff, float64(spoolRetryMaxBackoff))))
+	}
+}
+
+// moves any state we have for a file when it's moved
+func moveSpoolFileState(from, to string, keepAttempts bool) {
+	spoolStatesMutex.Lock()
+	defer spoolStatesMutex.Unlock()
+
+	if state := spoolStates[from]; state != nil {
+		delete(spoolStates, from)
+		if keepAttempts {
+			spoolStates[to] = state
+		}
+	}
+}
+
+func clearSpoolFileState(filename string) {
+	spoolStatesMutex.Lock()
+	defer spoolStatesMutex.Unlock()
+
+	delete(spoolStates, filename)
+}
+
+// removes any state we have for files which no longer exist, e.g. because they were deleted outside of courier
+func pruneSpoolFileStates() {
+	spoolStatesMutex.Lock()
+	defer spoolStatesMutex.Unlock()
+
+	for filename := range spoolStates {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			delete(spoolStates, filename)
+		}
+	}
+}
+
+func getSpoolFileState(filename string) spoolFileState {
+	spoolStatesMutex.Lock()
+	defer spoolStatesMutex.Unlock()
+
+	if state := spoolStates[filename]; state != nil {
+		return *state
+	}
+	return spoolFileState{}
+}
+
+func isSpoolFileBackingOff(filename string, now time.Time) bool {
+	return getSpoolFileState(filename).retryOn.After(now)
+}
+
+// SpoolEntryStatus is the status of a file in our spool
+type SpoolEntryStatus string
+
+// possible spool entry statuses
+const (
+	SpoolEntryPending     SpoolEntryStatus = "pending"     // waiting to be flushed
+	SpoolEntryInvalid     SpoolEntryStatus = "invalid"     // couldn't be parsed and won't be retried
+	SpoolEntryQuarantined SpoolEntryStatus = "quarantined" // moved out of the way by an operator
+)
+
+// SpoolEntry is a single file in our spool
+type SpoolEntry struct {
+	Subdir     string           `json:"subdir"`
+	Name       string           `json:"name"`
+	Status     SpoolEntryStatus `json:"status"`
+	Size       int64            `json:"size"`
+	ModifiedOn time.Time        `json:"modified_on"`
+
+	// only known for files we've tried to flush since starting
+	Attempts  int        `json:"attempts,omitempty"`
+	RetryOn   *time.Time `json:"retry_on,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// SpoolBacklog is a summary of the entries in a single spool subdirectory
+type SpoolBacklog struct {
+	Subdir      string     `json:"subdir"`
+	Pending     int        `json:"pending"`
+	Invalid     int        `json:"invalid"`
+	Quarantined int        `json:"quarantined"`
+	OldestOn    *time.Time `json:"oldest_on"` // when the oldest pending entry was written
+}
+
+// ReadSpool reads all the entries in the passed in spool directory, including those which are quarantined
+func ReadSpool(spoolDir string) ([]*SpoolEntry, error) {
+	subdirs, err := spoolSubdirs(spoolDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*SpoolEntry, 0)
+	for _, subdir := range subdirs {
+		subdirEntries, err := readSpoolSubdir(spoolDir, subdir)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, subdirEntries...)
+	}
+
+	return entries, nil
+}
+
+// ReadSpoolSubdir reads the entries in the passed in spool subdirectory, pending and invalid entries first and then
+// quarantined ones, each oldest first
+func ReadSpoolSubdir(spoolDir, subdir string) ([]*SpoolEntry, error) {
+	if err := checkSpoolSubdir(subdir); err != nil {
+		return nil, err
+	}
+	return readSpoolSubdir(spoolDir, subdir)
+}
+
+func readSpoolSubdir(spoolDir, subdir string) ([]*SpoolEntry, error) {
+	pending, err := readSpoolDir(path.Join(spoolDir, subdir), subdir, false)
+	if err != nil {
+		return nil, err
+	}
+	quarantined, err := readSpoolDir(path.Join(spoolDir, spoolQuarantineDir, subdir), subdir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*SpoolEntry, 0, len(pending)+len(quarantined))
+	entries = append(entries, pending...)
+	return append(entries, quarantined...), nil
+}
+
+// SummarizeSpool summarizes the passed in spool entries by subdirectory
+func SummarizeSpool(entries []*SpoolEntry) []*SpoolBacklog {
+	backlogs := make([]*SpoolBacklog, 0)
+	bySubdir := make(map[string]*SpoolBacklog)
+
+	for _, e := range entries {
+		b := bySubdir[e.Subdir]
+		if b == nil {
+			b = &SpoolBacklog{Subdir: e.Subdir}
+			bySubdir[e.Subdir] = b
+			backlogs = append(backlogs, b)
+		}
+
+		switch e.Status {
+		case SpoolEntryPending:
+			b.Pending++
+			if b.OldestOn == nil || e.ModifiedOn.Before(*b.OldestOn) {
+				oldestOn := e.ModifiedOn
+				b.OldestOn = &oldestOn
+			}
+		case SpoolEntryInvalid:
+			b.Invalid++
+		case SpoolEntryQuarantined:
+			b.Quarantined++
+		}
+	}
+
+	return backlogs
+}
+
+// QuarantineSpoolEntry moves the named file in the passed in spool subdirectory to our quarantine directory so that
+// it is no longer retried
+func QuarantineSpoolEntry(spoolDir, subdir, name string) error {
+	src, err := spoolEntryPath(spoolDir, subdir, name)
+	if err != nil {
+		return err
+	}
+
+	if err := EnsureSpoolDirPresent(path.Join(spoolDir, spoolQuarantineDir), subdir); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	dst := path.Join(spoolDir, spoolQuarantineDir, subdir, name)
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	// keep the reason it was failing with it
+	moveSpoolFileState(src, dst, true)
+
+	if strings.HasSuffix(name, ".json") {
+		spoolSize.Add(-info.Size())
+	}
+	return nil
+}
+
+// ReinjectSpoolEntry moves the named invalid (.error) or quarantined file in the passed in spool subdirectory back
+// into that subdirectory as a .json file so that it will be retried, e.g. after an operator has fixed it
+func ReinjectSpoolEntry(spoolDir, subdir, name string) error {
+	src, err := spoolEntryPath(spoolDir, subdir, name)
+	if err != nil {
+		src, err = spoolEntryPath(path.Join(spoolDir, spoolQuarantineDir), subdir, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	dst := path.Join(spoolDir, subdir, strings.TrimSuffix(name, ".error"))
+	if !strings.HasSuffix(dst, ".json") {
+		return fmt.Errorf("can't reinject '%s' as it isn't a spooled json file", name)
+	}
+	if src == dst {
+		return fmt.Errorf("can't reinject '%s' as it is already pending", name)
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("can't reinject '%s' as a pending entry named '%s' already exists", name, path.Base(dst))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	// it goes back to counting towards our spool size so can't take that over our maximum
+	if err := checkSpoolRoom(info.Size()); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	// it gets a fresh set of attempts
+	moveSpoolFileState(src, dst, false)
+
+	spoolSize.Add(info.Size())
+	return nil
+}
+
+// returns the names of the subdirectories of our spool which contain spooled files, e.g. msgs, statuses..
+func spoolSubdirs(spoolDir string) ([]string, error) {
+	files, err := os.ReadDir(spoolDir)
+	if err != nil {
+		return nil, err
+	}
+
+	subdirs := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() && f.Name() != spoolQuarantineDir && !strings.HasPrefix(f.Name(), ".") {
+			subdirs = append(subdirs, f.Name())
+		}
+	}
+	return subdirs, nil
+}
+
+func readSpoolDir(dir, subdir string, quarantined bool) ([]*SpoolEntry, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*SpoolEntry, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		var status SpoolEntryStatus
+		if quarantined {
+			status = SpoolEntryQuarantined
+		} else if strings.HasSuffix(name, ".json") {
+			status = SpoolEntryPending
+		} else if strings.HasSuffix(name, ".error") {
+			status = SpoolEntryInvalid
+		} else {
+			continue
+		}
+
+		info, err := f.Info()
+		if os.IsNotExist(err) {
+			continue // flushed whilst we were reading
+		} else if err != nil {
+			return nil, err
+		}
+
+		entry := &SpoolEntry{
+			Subdir:     subdir,
+			Name:       name,
+			Status:     status,
+			Size:       info.Size(),
+			ModifiedOn: info.ModTime().UTC(),
+		}
+
+		state := getSpoolFileState(path.Join(dir, name))
+		entry.Attempts = state.attempts
+		entry.LastError = state.lastError
+		if status == SpoolEntryPending && !state.retryOn.IsZero() {
+			retryOn := state.retryOn.UTC()
+			entry.RetryOn = &retryOn
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// oldest first
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ModifiedOn.Before(entries[j].ModifiedOn) })
+
+	return entries, nil
+}
+
+// returns the path of the named file in the passed in spool subdirectory, making sure neither of those escape the
+// spool directory and that the file exists
+func spoolEntryPath(spoolDir, subdir, name string) (string, error) {
+	if err := checkSpoolSubdir(subdir); err != nil {
+		return "", err
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid spool entry name '%s'", name)
+	}
+
+	p := path.Join(spoolDir, subdir, name)
+	if info, err := os.Stat(p); err != nil || info.IsDir() {
+		return "", ErrSpoolEntryNotFound
+	}
+	return p, nil
+}
+
+// checks that the passed in spool subdirectory name doesn't escape our spool directory or refer to our quarantine
+func checkSpoolSubdir(subdir string) error {
+	if subdir == "" || subdir != filepath.Base(subdir) || subdir == spoolQuarantineDir || strings.HasPrefix(subdir, ".") {
+		return fmt.Errorf("invalid spool subdirectory '%s'", subdir)
+	}
+	return nil
+}
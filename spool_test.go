@@ -0,0 +1,270 @@
+package courier_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/test"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolEntries(t *testing.T) {
+	spoolDir := t.TempDir()
+
+	for _, subdir := range []string{"msgs", "statuses"} {
+		require.NoError(t, courier.EnsureSpoolDirPresent(spoolDir, subdir))
+	}
+
+	writeFile := func(subdir, name string, age time.Duration) {
+		p := path.Join(spoolDir, subdir, name)
+		require.NoError(t, os.WriteFile(p, []byte(`{"id": 1}`), 0640))
+		require.NoError(t, os.Chtimes(p, time.Now().Add(-age), time.Now().Add(-age)))
+	}
+
+	writeFile("msgs", "1.json", time.Minute)
+	writeFile("msgs", "2.json", time.Hour)
+	writeFile("msgs", "3.json.error", time.Hour)
+	writeFile("msgs", ".check-123", 0)
+	writeFile("statuses", "4.json", time.Second)
+
+	entries, err := courier.ReadSpool(spoolDir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, "msgs", entries[0].Subdir)
+		assert.Equal(t, "2.json", entries[0].Name)
+		assert.Equal(t, courier.SpoolEntryPending, entries[0].Status)
+		assert.Equal(t, int64(9), entries[0].Size)
+		assert.Equal(t, "3.json.error", entries[1].Name)
+		assert.Equal(t, courier.SpoolEntryInvalid, entries[1].Status)
+		assert.Equal(t, "1.json", entries[2].Name)
+		assert.Equal(t, "4.json", entries[3].Name)
+	}
+
+	subdirEntries, err := courier.ReadSpoolSubdir(spoolDir, "statuses")
+	assert.NoError(t, err)
+	if assert.Len(t, subdirEntries, 1) {
+		assert.Equal(t, "4.json", subdirEntries[0].Name)
+	}
+
+	subdirEntries, err = courier.ReadSpoolSubdir(spoolDir, "events")
+	assert.NoError(t, err)
+	assert.Len(t, subdirEntries, 0)
+
+	_, err = courier.ReadSpoolSubdir(spoolDir, "../msgs")
+	assert.EqualError(t, err, "invalid spool subdirectory '../msgs'")
+
+	backlogs := courier.SummarizeSpool(entries)
+	assert.Len(t, backlogs, 2)
+	assert.Equal(t, "msgs", backlogs[0].Subdir)
+	assert.Equal(t, 2, backlogs[0].Pending)
+	assert.Equal(t, 1, backlogs[0].Invalid)
+	assert.Equal(t, 0, backlogs[0].Quarantined)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), *backlogs[0].OldestOn, time.Second)
+	assert.Equal(t, "statuses", backlogs[1].Subdir)
+	assert.Equal(t, 1, backlogs[1].Pending)
+
+	// quarantine a pending file and an invalid file
+	assert.NoError(t, courier.QuarantineSpoolEntry(spoolDir, "msgs", "2.json"))
+	assert.NoError(t, courier.QuarantineSpoolEntry(spoolDir, "msgs", "3.json.error"))
+	assert.FileExists(t, path.Join(spoolDir, "quarantine", "msgs", "2.json"))
+	assert.FileExists(t, path.Join(spoolDir, "quarantine", "msgs", "3.json.error"))
+
+	entries, err = courier.ReadSpool(spoolDir)
+	assert.NoError(t, err)
+	backlogs = courier.SummarizeSpool(entries)
+	assert.Equal(t, 1, backlogs[0].Pending)
+	assert.Equal(t, 0, backlogs[0].Invalid)
+	assert.Equal(t, 2, backlogs[0].Quarantined)
+
+	// reinject them both
+	assert.NoError(t, courier.ReinjectSpoolEntry(spoolDir, "msgs", "2.json"))
+	assert.NoError(t, courier.ReinjectSpoolEntry(spoolDir, "msgs", "3.json.error"))
+	assert.FileExists(t, path.Join(spoolDir, "msgs", "2.json"))
+	assert.FileExists(t, path.Join(spoolDir, "msgs", "3.json"))
+
+	entries, err = courier.ReadSpool(spoolDir)
+	assert.NoError(t, err)
+	backlogs = courier.SummarizeSpool(entries)
+	assert.Equal(t, 3, backlogs[0].Pending)
+	assert.Equal(t, 0, backlogs[0].Invalid)
+	assert.Equal(t, 0, backlogs[0].Quarantined)
+
+	// can't reinject something that's already pending, or things which don't exist or are outside of our spool
+	assert.EqualError(t, courier.ReinjectSpoolEntry(spoolDir, "msgs", "2.json"), "can't reinject '2.json' as it is already pending")
+
+	// or something which would overwrite a pending file
+	writeFile("msgs", "2.json.error", time.Hour)
+	assert.EqualError(t, courier.ReinjectSpoolEntry(spoolDir, "msgs", "2.json.error"), "can't reinject '2.json.error' as a pending entry named '2.json' already exists")
+	assert.FileExists(t, path.Join(spoolDir, "msgs", "2.json.error"))
+
+	assert.Equal(t, courier.ErrSpoolEntryNotFound, courier.ReinjectSpoolEntry(spoolDir, "msgs", "5.json.error"))
+	assert.Equal(t, courier.ErrSpoolEntryNotFound, courier.QuarantineSpoolEntry(spoolDir, "events", "1.json"))
+	assert.EqualError(t, courier.QuarantineSpoolEntry(spoolDir, "msgs", "../statuses/4.json"), "invalid spool entry name '../statuses/4.json'")
+	assert.EqualError(t, courier.QuarantineSpoolEntry(spoolDir, "..", "msgs"), "invalid spool subdirectory '..'")
+	assert.EqualError(t, courier.QuarantineSpoolEntry(spoolDir, "quarantine", "msgs"), "invalid spool subdirectory 'quarantine'")
+}
+
+func TestFlushSpool(t *testing.T) {
+	config := courier.NewConfig()
+	config.SpoolDir = t.TempDir()
+	config.SpoolFlushWorkers = 3
+	config.SpoolFlushRate = 0
+
+	require.NoError(t, courier.EnsureSpoolDirPresent(config.SpoolDir, "msgs"))
+
+	// a flusher for msgs which records what it flushed by URN, and fails to flush anything containing "down"
+	flushed := make(map[string][]string)
+	flushedMutex := sync.Mutex{}
+	ordered := 0
+
+	courier.RegisterOrderedFlusher(path.Join(config.SpoolDir, "msgs"), func(filename string, contents []byte) error {
+		msg := &spooledMsg{}
+		jsonx.MustUnmarshal(contents, msg)
+		if msg.Text == "down" {
+			return errors.New("db is down")
+		}
+
+		flushedMutex.Lock()
+		defer flushedMutex.Unlock()
+		flushed[msg.URN] = append(flushed[msg.URN], msg.Text)
+		return nil
+	}, func(contents []byte) (string, time.Time, error) {
+		ordered++
+		msg := &spooledMsg{}
+		if err := json.Unmarshal(contents, msg); err != nil {
+			return "", time.Time{}, err
+		}
+		return msg.URN, msg.ReceivedOn, nil
+	})
+
+	server := courier.NewServerWithLogger(config, test.NewMockBackend(), slog.Default())
+	server.Start()
+	defer server.Stop()
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// spool msgs for three URNs, not in the order they were received
+	spool := func(urn, text string, receivedOn time.Time) {
+		require.NoError(t, courier.WriteToSpool(config.SpoolDir, "msgs", &spooledMsg{URN: urn, Text: text, ReceivedOn: receivedOn}))
+	}
+	spool("tel:+250788000001", "1c", t0.Add(time.Second*3))
+	spool("tel:+250788000001", "1a", t0.Add(time.Second*1))
+	spool("tel:+250788000002", "2a", t0.Add(time.Second*1))
+	spool("tel:+250788000001", "1b", t0.Add(time.Second*2))
+	spool("tel:+250788000003", "3a", t0.Add(time.Second*1))
+	spool("tel:+250788000002", "down", t0.Add(time.Second*2))
+	spool("tel:+250788000002", "2c", t0.Add(time.Second*3))
+	spool("tel:+250788000003", "3b", t0.Add(time.Second*2))
+
+	courier.FlushSpool()
+
+	// msgs are flushed in the order they were received for each URN, and one failing holds up later ones for its URN
+	assert.Equal(t, map[string][]string{
+		"tel:+250788000001": {"1a", "1b", "1c"},
+		"tel:+250788000002": {"2a"},
+		"tel:+250788000003": {"3a", "3b"},
+	}, flushed)
+
+	entries, err := courier.ReadSpool(config.SpoolDir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, 1, entries[0].Attempts)
+		assert.Equal(t, "db is down", entries[0].LastError)
+		assert.NotNil(t, entries[0].RetryOn)
+		assert.Equal(t, 0, entries[1].Attempts)
+	}
+
+	// flushing again does nothing as the failed msg is backing off
+	courier.FlushSpool()
+
+	entries, err = courier.ReadSpool(config.SpoolDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, 1, entries[0].Attempts)
+	assert.Len(t, flushed["tel:+250788000002"], 1)
+
+	// and files which haven't changed aren't read again to order them
+	assert.Equal(t, 8, ordered)
+
+	// if the failed file is deleted outside of courier, we forget about its attempts
+	failed := path.Join(config.SpoolDir, "msgs", entries[0].Name)
+	contents, err := os.ReadFile(failed)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(failed))
+
+	courier.FlushSpool()
+
+	assert.Equal(t, []string{"2a", "2c"}, flushed["tel:+250788000002"])
+
+	require.NoError(t, os.WriteFile(failed, contents, 0640))
+
+	entries, err = courier.ReadSpool(config.SpoolDir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, path.Base(failed), entries[0].Name)
+		assert.Equal(t, 0, entries[0].Attempts)
+		assert.Nil(t, entries[0].RetryOn)
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	config := courier.NewConfig()
+	config.SpoolDir = t.TempDir()
+	config.SpoolMaxSize = 1
+
+	require.NoError(t, courier.EnsureSpoolDirPresent(config.SpoolDir, "msgs"))
+	courier.RegisterFlusher(path.Join(config.SpoolDir, "msgs"), func(filename string, contents []byte) error { return errors.New("db is down") })
+
+	// spool is already half full when we start
+	require.NoError(t, os.WriteFile(path.Join(config.SpoolDir, "msgs", "1.json"), bytes.Repeat([]byte("x"), 600*1024), 0640))
+
+	mb := test.NewMockBackend()
+	channel := test.NewMockChannel("95710b36-855d-4832-a723-5f71f73688a0", "MCK", "12345", "RW", nil)
+	mb.AddChannel(channel)
+
+	server := courier.NewServerWithLogger(config, mb, slog.Default())
+	server.Start()
+	defer server.Stop()
+
+	assert.Equal(t, courier.ErrSpoolFull, courier.WriteToSpool(config.SpoolDir, "msgs", strings.Repeat("x", 500*1024)))
+	assert.NoError(t, courier.WriteToSpool(config.SpoolDir, "msgs", strings.Repeat("x", 100*1024)))
+
+	// quarantining a file frees up space
+	require.NoError(t, courier.QuarantineSpoolEntry(config.SpoolDir, "msgs", "1.json"))
+	assert.NoError(t, courier.WriteToSpool(config.SpoolDir, "msgs", strings.Repeat("x", 500*1024)))
+
+	// and reinjecting it would take us over again
+	assert.Equal(t, courier.ErrSpoolFull, courier.ReinjectSpoolEntry(config.SpoolDir, "msgs", "1.json"))
+	assert.FileExists(t, path.Join(config.SpoolDir, "quarantine", "msgs", "1.json"))
+
+	// requests which can't be written or spooled are rejected with a 503 so that the sender retries later
+	mb.SetWriteMsgError(courier.ErrSpoolFull)
+
+	time.Sleep(100 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/c/mck/95710b36-855d-4832-a723-5f71f73688a0/receive?from=2065551212&text=hello", nil)
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 503, trace.Response.StatusCode)
+	assert.Equal(t, "30", trace.Response.Header.Get("Retry-After"))
+	assert.Contains(t, string(trace.ResponseBody), "spool is full")
+}
+
+type spooledMsg struct {
+	URN        string    `json:"urn"`
+	Text       string    `json:"text"`
+	ReceivedOn time.Time `json:"received_on"`
+}
@@ -3,6 +3,7 @@ package test
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"sync"
@@ -41,6 +42,8 @@ type MockBackend struct {
 	outgoingMsgs      []courier.MsgOut
 	media             map[string]courier.Media // url -> Media
 	errorOnQueue      bool
+	writeMsgError     error
+	inboundLimits     *courier.InboundLimits
 
 	mutex     sync.RWMutex
 	redisPool *redis.Pool
@@ -51,6 +54,8 @@ type MockBackend struct {
 	writtenChannelLogs   []*courier.ChannelLog
 	savedAttachments     []*SavedAttachment
 	storageError         error
+	privateDomain        string
+	healthErrors         map[string]error
 
 	lastMsgID       courier.MsgID
 	lastContactName string
@@ -90,6 +95,7 @@ func NewMockBackend() *MockBackend {
 		media:             make(map[string]courier.Media),
 		sentMsgs:          make(map[courier.MsgID]bool),
 		seenExternalIDs:   make(map[string]courier.MsgUUID),
+		healthErrors:      make(map[string]error),
 		redisPool:         redisPool,
 	}
 }
@@ -109,6 +115,7 @@ func (mb *MockBackend) NewIncomingMsg(channel courier.Channel, urn urns.URN, tex
 	if uuid != "" {
 		m.uuid = uuid
 		m.alreadyWritten = true
+		m.dedupedBy = courier.MsgDedupeExternalID
 	}
 
 	return m
@@ -170,6 +177,36 @@ func (mb *MockBackend) ClearMsgSent(ctx context.Context, id courier.MsgID) error
 	return nil
 }
 
+// RequeueOutgoingMsg puts the passed in message back on our outgoing queue, ignoring the delay
+func (mb *MockBackend) RequeueOutgoingMsg(ctx context.Context, msg courier.MsgOut, delay time.Duration) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if mb.errorOnQueue {
+		return errors.New("unable to queue message")
+	}
+
+	if m, ok := msg.(*MockMsg); ok {
+		m.retryCount++
+	}
+
+	mb.outgoingMsgs = append(mb.outgoingMsgs, msg)
+	return nil
+}
+
+// ThrottleOutgoingMsg puts the passed in message back on our outgoing queue, ignoring the duration
+func (mb *MockBackend) ThrottleOutgoingMsg(ctx context.Context, msg courier.MsgOut, retryAfter time.Duration) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if mb.errorOnQueue {
+		return errors.New("unable to queue message")
+	}
+
+	mb.outgoingMsgs = append(mb.outgoingMsgs, msg)
+	return nil
+}
+
 // MarkOutgoingMsgComplete marks the passed msg as having been dealt with
 func (mb *MockBackend) MarkOutgoingMsgComplete(ctx context.Context, msg courier.MsgOut, s courier.StatusUpdate) {
 	mb.mutex.Lock()
@@ -183,10 +220,64 @@ func (mb *MockBackend) WriteChannelLog(ctx context.Context, clog *courier.Channe
 	mb.mutex.Lock()
 	defer mb.mutex.Unlock()
 
-	mb.writtenChannelLogs = append(mb.writtenChannelLogs, clog)
+	courier.PublishChannelLog(clog)
+
+	if clog.Retain() {
+		mb.writtenChannelLogs = append(mb.writtenChannelLogs, clog)
+	}
 	return nil
 }
 
+// ChannelLogs returns the written channel logs for the given channel which match the given query
+func (mb *MockBackend) ChannelLogs(ctx context.Context, ch courier.Channel, q *courier.ChannelLogQuery) ([]*courier.ChannelLogRecord, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	records := make([]*courier.ChannelLogRecord, 0)
+	for i := len(mb.writtenChannelLogs) - 1; i >= 0 && (q.Limit <= 0 || len(records) < q.Limit); i-- {
+		clog := mb.writtenChannelLogs[i]
+		if clog.Channel().UUID() == ch.UUID() && q.Matches(clog.Type(), clog.IsError(), clog.CreatedOn()) {
+			records = append(records, clog.Record())
+		}
+	}
+	return records, nil
+}
+
+// GetChannelLog returns the written channel log with the given UUID
+func (mb *MockBackend) GetChannelLog(ctx context.Context, ch courier.Channel, uuid courier.ChannelLogUUID) (*courier.ChannelLogRecord, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	for _, clog := range mb.writtenChannelLogs {
+		if clog.Channel().UUID() == ch.UUID() && clog.UUID() == uuid {
+			return clog.Record(), nil
+		}
+	}
+	return nil, courier.ErrChannelLogNotFound
+}
+
+// SetWriteMsgError sets an error to be returned by WriteMsg, e.g. courier.ErrSpoolFull
+func (mb *MockBackend) SetWriteMsgError(err error) {
+	mb.writeMsgError = err
+}
+
+// SetInboundLimits sets limits to be checked by WriteMsg and WriteChannelEvent
+func (mb *MockBackend) SetInboundLimits(limits *courier.InboundLimits) {
+	mb.inboundLimits = limits
+}
+
+// checks the inbound limits for the given URN if we have any
+func (mb *MockBackend) checkInboundLimits(ctx context.Context, ch courier.Channel, urn urns.URN) error {
+	if mb.inboundLimits == nil {
+		return nil
+	}
+
+	rc := mb.redisPool.Get()
+	defer rc.Close()
+
+	return mb.inboundLimits.Check(ctx, rc, ch, urn, time.Now())
+}
+
 // SetErrorOnQueue is a mock method which makes the QueueMsg call throw the passed in error on next call
 func (mb *MockBackend) SetErrorOnQueue(shouldError bool) {
 	mb.errorOnQueue = shouldError
@@ -201,6 +292,13 @@ func (mb *MockBackend) WriteMsg(ctx context.Context, m courier.MsgIn, clog *cour
 		return nil
 	}
 
+	if mb.writeMsgError != nil {
+		return mb.writeMsgError
+	}
+	if err := mb.checkInboundLimits(ctx, mm.Channel(), mm.URN()); err != nil {
+		return err
+	}
+
 	mb.lastMsgID++
 	mm.id = mb.lastMsgID
 
@@ -264,6 +362,10 @@ func (mb *MockBackend) NewChannelEvent(channel courier.Channel, eventType courie
 func (mb *MockBackend) WriteChannelEvent(ctx context.Context, event courier.ChannelEvent, clog *courier.ChannelLog) error {
 	evt := event.(*mockChannelEvent)
 
+	if err := mb.checkInboundLimits(ctx, evt.channel, evt.urn); err != nil {
+		return err
+	}
+
 	mb.mutex.Lock()
 	defer mb.mutex.Unlock()
 
@@ -329,21 +431,45 @@ func (mb *MockBackend) Stop() error { return nil }
 // Cleanup cleans up any connections that are open
 func (mb *MockBackend) Cleanup() error { return nil }
 
+// Flush waits for batched writes, which the mock backend doesn't have
+func (mb *MockBackend) Flush(ctx context.Context) error { return nil }
+
 // SaveAttachment saves an attachment to backend storage
-func (mb *MockBackend) SaveAttachment(ctx context.Context, ch courier.Channel, contentType string, data []byte, extension string) (string, error) {
+func (mb *MockBackend) SaveAttachment(ctx context.Context, ch courier.Channel, contentType string, content io.Reader, extension string) (string, error) {
 	if mb.storageError != nil {
 		return "", mb.storageError
 	}
 
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+
 	mb.savedAttachments = append(mb.savedAttachments, &SavedAttachment{
 		Channel: ch, ContentType: contentType, Data: data, Extension: extension,
 	})
 
 	time.Sleep(time.Millisecond * 2)
 
+	if mb.privateDomain != "" {
+		return courier.AttachmentRef(mb.privateDomain, fmt.Sprintf("attachments/%s.%s", uuids.New(), extension)), nil
+	}
+
 	return fmt.Sprintf("https://backend.com/attachments/%s.%s", uuids.New(), extension), nil
 }
 
+// AttachmentURL returns a readable URL for the passed in attachment URL
+func (mb *MockBackend) AttachmentURL(ctx context.Context, attURL string) (string, error) {
+	if mb.storageError != nil {
+		return "", mb.storageError
+	}
+
+	if path, isRef := courier.ParseAttachmentRef(mb.privateDomain, attURL); isRef {
+		return fmt.Sprintf("https://backend.com/%s?signature=sesame", path), nil
+	}
+	return attURL, nil
+}
+
 // ResolveMedia resolves the passed in media URL to a media object
 func (mb *MockBackend) ResolveMedia(ctx context.Context, mediaUrl string) (courier.Media, error) {
 	media := mb.media[mediaUrl]
@@ -358,6 +484,19 @@ func (mb *MockBackend) Health() string {
 	return ""
 }
 
+// HealthReport returns a report with a check for our DB and redis, which can be made to fail with SetHealthError
+func (mb *MockBackend) HealthReport(ctx context.Context) *courier.HealthReport {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	return &courier.HealthReport{
+		Checks: []*courier.HealthCheck{
+			courier.NewHealthCheck("db", true, mb.healthErrors["db"]),
+			courier.NewHealthCheck("redis", true, mb.healthErrors["redis"]),
+		},
+	}
+}
+
 // Health gives a string representing our health, empty for our mock
 func (mb *MockBackend) HttpClient(bool) *http.Client {
 	return http.DefaultClient
@@ -372,6 +511,11 @@ func (mb *MockBackend) Status() string {
 	return "ALL GOOD"
 }
 
+// StatusReport returns an empty status report
+func (mb *MockBackend) StatusReport(ctx context.Context) (*courier.StatusReport, error) {
+	return &courier.StatusReport{Queues: []*courier.QueueStatus{}}, nil
+}
+
 // Heartbeat is a noop for our mock backend
 func (mb *MockBackend) Heartbeat() error {
 	return nil
@@ -393,6 +537,14 @@ func (mb *MockBackend) WrittenChannelLogs() []*courier.ChannelLog     { return m
 func (mb *MockBackend) SavedAttachments() []*SavedAttachment          { return mb.savedAttachments }
 func (mb *MockBackend) URNAuthTokens() map[urns.URN]map[string]string { return mb.urnAuthTokens }
 
+// SetHealthError sets an error to be reported by the named health check
+func (mb *MockBackend) SetHealthError(check string, err error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	mb.healthErrors[check] = err
+}
+
 // LastContactName returns the contact name set on the last msg or channel event written
 func (mb *MockBackend) LastContactName() string {
 	return mb.lastContactName
@@ -432,6 +584,11 @@ func (mb *MockBackend) SetStorageError(err error) {
 	mb.storageError = err
 }
 
+// SetPrivateAttachments makes saved attachments be referred to by references on the given domain
+func (mb *MockBackend) SetPrivateAttachments(domain string) {
+	mb.privateDomain = domain
+}
+
 func (mb *MockBackend) recordURNAuthTokens(urn urns.URN, authTokens map[string]string) {
 	if mb.urnAuthTokens == nil {
 		mb.urnAuthTokens = make(map[urns.URN]map[string]string)
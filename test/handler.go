@@ -72,18 +72,25 @@ func (h *mockHandler) WriteRequestIgnored(ctx context.Context, w http.ResponseWr
 	return courier.WriteIgnored(w, details)
 }
 
-// ReceiveMsg sends the passed in message, returning any error
+// ReceiveMsg writes a message for each text parameter, returning any error
 func (h *mockHandler) receiveMsg(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, clog *courier.ChannelLog) ([]courier.Event, error) {
 	r.ParseForm()
 	from := r.Form.Get("from")
-	text := r.Form.Get("text")
-	if from == "" || text == "" {
+	texts := r.Form["text"]
+	if from == "" || len(texts) == 0 || texts[0] == "" {
 		return nil, errors.New("missing from or text")
 	}
 
-	msg := h.backend.NewIncomingMsg(channel, urns.URN("tel:"+from), text, "", clog)
+	events := make([]courier.Event, 0, len(texts))
+	for _, text := range texts {
+		msg := h.backend.NewIncomingMsg(channel, urns.URN("tel:"+from), text, "", clog)
+		if err := h.backend.WriteMsg(ctx, msg, clog); err != nil {
+			return nil, err
+		}
+		events = append(events, msg)
+	}
+
 	w.WriteHeader(200)
 	w.Write([]byte("ok"))
-	h.backend.WriteMsg(ctx, msg, clog)
-	return []courier.Event{msg}, nil
+	return events, nil
 }
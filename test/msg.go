@@ -29,13 +29,17 @@ type MockMsg struct {
 	responseToExternalID string
 	metadata             json.RawMessage
 	alreadyWritten       bool
+	fingerprint          string
+	dedupedBy            courier.MsgDedupeMode
 	isResend             bool
+	retryCount           int
 
 	flow  *courier.FlowReference
 	optIn *courier.OptInReference
 
 	receivedOn *time.Time
 	sentOn     *time.Time
+	sendAfter  *time.Time
 }
 
 func NewMockMsg(id courier.MsgID, uuid courier.MsgUUID, channel courier.Channel, urn urns.URN, text string, attachments []string) *MockMsg {
@@ -73,6 +77,8 @@ func (m *MockMsg) Flow() *courier.FlowReference   { return m.flow }
 func (m *MockMsg) OptIn() *courier.OptInReference { return m.optIn }
 func (m *MockMsg) SessionStatus() string          { return "" }
 func (m *MockMsg) HighPriority() bool             { return m.highPriority }
+func (m *MockMsg) SendAfter() *time.Time          { return m.sendAfter }
+func (m *MockMsg) RetryCount() int                { return m.retryCount }
 
 // incoming specific
 func (m *MockMsg) ReceivedOn() *time.Time { return m.receivedOn }
@@ -86,6 +92,14 @@ func (m *MockMsg) WithURNAuthTokens(tokens map[string]string) courier.MsgIn {
 	return m
 }
 func (m *MockMsg) WithReceivedOn(date time.Time) courier.MsgIn { m.receivedOn = &date; return m }
+func (m *MockMsg) WithFingerprint(fingerprint string) courier.MsgIn {
+	m.fingerprint = fingerprint
+	return m
+}
+func (m *MockMsg) DedupedBy() courier.MsgDedupeMode { return m.dedupedBy }
+
+// Fingerprint returns the fingerprint set by the handler, for testing
+func (m *MockMsg) Fingerprint() string { return m.fingerprint }
 
 // used to create outgoing messages for testing
 func (m *MockMsg) WithID(id courier.MsgID) courier.MsgOut       { m.id = id; return m }